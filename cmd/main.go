@@ -15,6 +15,10 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "scrub" {
+		os.Exit(runScrub(os.Args[2:]))
+	}
+
 	logger.Info("Starting Noverna-API...")
 
 	if err := config.Init(); err != nil {
@@ -24,7 +28,9 @@ func main() {
 	server := api.NewServer(config.GetConfig(), nil)
 
 	server.Mount("/ws", websocketHandler())
-	routes.SetupRoutes(server)
+	if err := routes.SetupRoutes(server); err != nil {
+		logger.Fatal("Error while setting up routes", map[string]any{"error": err})
+	}
 
 	gracefulShutdown(server)
 }
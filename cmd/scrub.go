@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"noverna.de/m/v2/internal/config"
+	"noverna.de/m/v2/internal/files"
+)
+
+// runScrub is the "scrub" subcommand. The metadata store belongs to the
+// running server, so it asks the server to scrub and waits for the report.
+// It exits with 1 if the report lists damaged or missing blobs.
+func runScrub(args []string) int {
+	flags := flag.NewFlagSet("scrub", flag.ContinueOnError)
+	addr := flags.String("addr", "", "server address, defaults to server.host and server.port")
+	reportOnly := flags.Bool("report", false, "print the last report without starting a scrub")
+	poll := flags.Duration("poll", 2*time.Second, "how often to check on a running scrub")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if err := config.Init(); err != nil {
+		fmt.Fprintln(os.Stderr, "scrub:", err)
+		return 2
+	}
+	cfg := config.GetConfig()
+	if *addr == "" {
+		host := cfg.Server.Host
+		if host == "" || host == "0.0.0.0" || host == "::" {
+			host = "127.0.0.1"
+		}
+		*addr = net.JoinHostPort(host, strconv.Itoa(cfg.Server.Port))
+	}
+	client := &scrubClient{base: "http://" + *addr + "/v1/admin/scrub", apiKey: cfg.Security.ApiKey}
+
+	if !*reportOnly {
+		if _, err := client.do(http.MethodPost); err != nil {
+			fmt.Fprintln(os.Stderr, "scrub:", err)
+			return 2
+		}
+	}
+
+	for {
+		report, err := client.do(http.MethodGet)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "scrub:", err)
+			return 2
+		}
+		if report.State == files.TaskRunning && !*reportOnly {
+			time.Sleep(*poll)
+			continue
+		}
+
+		out := json.NewEncoder(os.Stdout)
+		out.SetIndent("", "  ")
+		out.Encode(report)
+
+		switch {
+		case report.State == files.TaskFailed:
+			return 2
+		case len(report.Issues) > 0:
+			return 1
+		default:
+			return 0
+		}
+	}
+}
+
+type scrubClient struct {
+	base   string
+	apiKey string
+}
+
+func (c *scrubClient) do(method string) (*files.ScrubReport, error) {
+	req, err := http.NewRequest(method, c.base, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Data  *files.ScrubReport `json:"data"`
+		Error string             `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("%s %s: %s", method, c.base, resp.Status)
+	}
+	if body.Error != "" {
+		return nil, fmt.Errorf("%s %s: %s", method, c.base, body.Error)
+	}
+	if body.Data == nil {
+		return nil, fmt.Errorf("%s %s: empty response", method, c.base)
+	}
+	return body.Data, nil
+}
@@ -9,15 +9,20 @@ require (
 )
 
 require (
-	github.com/BurntSushi/toml v1.5.0 // indirect
-	github.com/go-chi/cors v1.2.2 // indirect
-	github.com/go-chi/jwtauth v1.2.0 // indirect
+	github.com/BurntSushi/toml v1.5.0
+	github.com/go-chi/cors v1.2.2
+	github.com/go-chi/jwtauth v1.2.0
+	github.com/lestrrat-go/jwx v1.1.0
+	github.com/yuin/gopher-lua v1.1.1
+	golang.org/x/image v0.25.0
+)
+
+require (
 	github.com/goccy/go-json v0.3.5 // indirect
 	github.com/lestrrat-go/backoff/v2 v2.0.7 // indirect
 	github.com/lestrrat-go/httpcc v1.0.0 // indirect
 	github.com/lestrrat-go/iter v1.0.0 // indirect
-	github.com/lestrrat-go/jwx v1.1.0 // indirect
 	github.com/lestrrat-go/option v1.0.0 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad // indirect
+	golang.org/x/crypto v0.36.0 // indirect
 )
@@ -3,16 +3,26 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
 
+	"noverna.de/m/v2/internal/auth"
 	"noverna.de/m/v2/internal/config"
+	"noverna.de/m/v2/internal/ippolicy"
 	"noverna.de/m/v2/internal/logger"
+	"noverna.de/m/v2/internal/ratelimit"
+	"noverna.de/m/v2/internal/resp"
 	custommw "noverna.de/m/v2/internal/middleware"
 )
 
@@ -22,12 +32,21 @@ type Server struct {
 	router *chi.Mux
 	httpServer *http.Server
 	logger *logger.Logger
+
+	shutdownHooks []func(ctx context.Context) error
+	// Paths that are reachable without an API key
+	exemptPaths   []string
+	exemptFuncs   []func(r *http.Request) bool
+	authenticator *auth.Authenticator
+	// setupErr keeps the server from starting with a broken configuration
+	setupErr error
 }
 
 type APIResponse struct {
 	Status int         `json:"status"`
 	Data   any `json:"data,omitempty"`
 	Error  string      `json:"error,omitempty"`
+	Details any        `json:"details,omitempty"`
 }
 
 func NewServer(cfg *config.Config, log *logger.Logger) *Server {
@@ -43,9 +62,10 @@ func NewServer(cfg *config.Config, log *logger.Logger) *Server {
 	}
 
 	s := &Server{
-		config: cfg,
-		router: chi.NewRouter(),
-		logger: log,
+		config:        cfg,
+		router:        chi.NewRouter(),
+		logger:        log,
+		authenticator: auth.NewAuthenticator(cfg.Security.ApiKey, nil, nil, nil),
 	}
 
 	s.setupMiddleware()
@@ -53,24 +73,242 @@ func NewServer(cfg *config.Config, log *logger.Logger) *Server {
 }
 
 func (s *Server) setupMiddleware() {
+	policy, trusted, err := s.ipPolicy()
+	if err != nil {
+		s.setupErr = fmt.Errorf("security.ip_policy: %w", err)
+	}
+
 	s.router.Use(middleware.RequestID)
-	s.router.Use(middleware.RealIP)
+	s.router.Use(custommw.RealIP(trusted))
 	s.router.Use(middleware.Recoverer)
 	s.router.Use(middleware.Timeout(60 * time.Second))
 
 	s.router.Use(custommw.DetailedLoggerMiddleware(s.logger))
 
+	policy.Logger = s.logger
+	policy.Denied = func(w http.ResponseWriter, r *http.Request) {
+		s.WriteJSONError(w, http.StatusForbidden, "access from this address is not allowed")
+	}
+	s.router.Use(custommw.IPPolicyMiddleware(policy))
+
 	// Simple Logging
 	// s.router.Use(custommw.SimpleLoggerMiddleware(s.logger))
 
 	s.router.Use(cors.Handler(cors.Options{
 			AllowedOrigins:   []string{"*"},
-			AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-			AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-			ExposedHeaders:   []string{"Link"},
+			AllowedMethods:   []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+			AllowedHeaders:   []string{"Accept", "Authorization", "X-Api-Key", "Content-Type", "X-CSRF-Token",
+				"Tus-Resumable", "Upload-Length", "Upload-Metadata", "Upload-Offset",
+				"X-Nv-Date", "X-Nv-Nonce", "X-Nv-Content-Sha256"},
+			ExposedHeaders:   []string{"Link", "Location", "Tus-Resumable", "Tus-Version", "Tus-Extension",
+				"Tus-Max-Size", "Upload-Offset", "Upload-Length", "Upload-Expires", "X-File-Id"},
 			AllowCredentials: true,
 			MaxAge:           300,
 	}))
+
+	limiter := s.rateLimitStore()
+
+	// Before the key check, so failed attempts count too and keys can't be
+	// guessed faster than this from one address
+	s.router.Use(custommw.RateLimitMiddleware(&custommw.RateLimitConfig{
+		Limiter: limiter,
+		Default: ratelimit.Limit{
+			PerMinute: s.config.Security.AuthRateLimit,
+			Burst:     s.config.Security.AuthRateLimitBurst,
+		},
+		Bucket: "auth",
+		Skip: func(r *http.Request) bool {
+			return r.Method == http.MethodOptions || s.isExempt(r)
+		},
+		Limited: s.rateLimited,
+	}))
+
+	// After CORS, so preflights are answered without a key
+	s.router.Use(custommw.APIKeyMiddleware(&custommw.APIKeyConfig{
+		Authenticate:        func(key string) (*auth.Identity, error) { return s.authenticator.Authenticate(key) },
+		AuthenticateRequest: s.authenticateRequest,
+		Required:            s.config.Security.TokenRequired,
+		Exempt:              s.isExempt,
+		Unauthorized:        s.unauthorized,
+	}))
+
+	// After the key check, so clients with a key are counted by key
+	s.router.Use(custommw.RateLimitMiddleware(&custommw.RateLimitConfig{
+		Limiter: limiter,
+		Default: ratelimit.Limit{
+			PerMinute: s.config.Security.RateLimitPerMinute,
+			Burst:     s.config.Security.RateLimitBurst,
+		},
+		Routes:  s.routeLimits(),
+		Limited: s.rateLimited,
+	}))
+}
+
+func (s *Server) rateLimited(w http.ResponseWriter, r *http.Request, d ratelimit.Decision) {
+	s.WriteJSONErrorDetails(w, http.StatusTooManyRequests, "rate limit exceeded", map[string]any{
+		"limit":               d.Limit,
+		"retry_after_seconds": math.Ceil(d.RetryAfter.Seconds()),
+	})
+}
+
+// authenticateRequest checks signed requests, reporting when the nonce store
+// is out of reach as every signed request is refused until it is back
+func (s *Server) authenticateRequest(r *http.Request) (*auth.Identity, error) {
+	identity, err := s.authenticator.AuthenticateRequest(r)
+	if errors.Is(err, auth.ErrNonceUnavailable) {
+		s.logger.Error("Nonce store unreachable, refusing signed requests", map[string]any{
+			"error": err.Error(),
+		})
+	}
+	return identity, err
+}
+
+// rateLimitStore picks where buckets are kept. Shared buckets make the
+// limits hold across all instances behind a load balancer.
+func (s *Server) rateLimitStore() ratelimit.Store {
+	local := ratelimit.New(s.config.Security.RateLimitMaxClients)
+	if s.config.Security.RateLimitStore != "cache" {
+		return local
+	}
+
+	opts, err := resp.ParseURL(s.config.Advanced.CacheEndpoint)
+	if s.config.Advanced.CacheEndpoint == "" {
+		err = errors.New("advanced.cache_endpoint is not set")
+	}
+	if err != nil {
+		s.logger.Error("Rate limit store unusable, limiting per instance", map[string]any{
+			"error": err.Error(),
+		})
+		return local
+	}
+
+	client := resp.NewClient(opts)
+	s.OnShutdown(client.Close)
+	shared := ratelimit.NewRedisStore(client, "noverna:ratelimit:")
+	return ratelimit.NewFallback(shared, local, 250*time.Millisecond, 10*time.Second, s.logger)
+}
+
+// ipPolicy parses the address policies and trusted proxies from the config
+func (s *Server) ipPolicy() (*custommw.IPPolicyConfig, []netip.Prefix, error) {
+	cfg := s.config.Security.IPPolicy
+	config := &custommw.IPPolicyConfig{}
+
+	trusted, err := ippolicy.ParsePrefixes(cfg.TrustedProxies)
+	if err != nil {
+		return config, nil, err
+	}
+	if config.Default, err = ippolicy.NewPolicy(cfg.Allow, cfg.Deny); err != nil {
+		return config, trusted, err
+	}
+
+	// Sorted, so groups with equally specific paths always resolve the same way
+	names := make([]string, 0, len(cfg.Groups))
+	for name := range cfg.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		group := cfg.Groups[name]
+		policy, err := ippolicy.NewPolicy(group.Allow, group.Deny)
+		if err != nil {
+			return config, trusted, fmt.Errorf("group %s: %w", name, err)
+		}
+		config.Groups = append(config.Groups, custommw.IPPolicyGroup{Name: name, Patterns: group.Paths, Policy: policy})
+	}
+	return config, trusted, nil
+}
+
+// routeLimits turns the per route overrides from the config into limits,
+// filling in what they leave out from the defaults
+func (s *Server) routeLimits() []custommw.RouteLimit {
+	var routes []custommw.RouteLimit
+	for pattern, override := range s.config.Security.RateLimitRoutes {
+		limit := ratelimit.Limit{PerMinute: override.PerMinute, Burst: override.Burst}
+		if limit.PerMinute == 0 {
+			limit.PerMinute = s.config.Security.RateLimitPerMinute
+		}
+		if limit.Burst == 0 {
+			limit.Burst = limit.PerMinute
+		}
+		routes = append(routes, custommw.RouteLimit{Pattern: pattern, Limit: limit})
+	}
+	return routes
+}
+
+// Exempt makes paths reachable without an API key. A trailing "*" matches
+// everything below a prefix.
+func (s *Server) Exempt(paths ...string) {
+	s.exemptPaths = append(s.exemptPaths, paths...)
+}
+
+// ExemptFunc lets requests for which fn reports true through without an API
+// key. Handlers of those requests have to check their credentials themselves.
+func (s *Server) ExemptFunc(fn func(r *http.Request) bool) {
+	s.exemptFuncs = append(s.exemptFuncs, fn)
+}
+
+// SetAuthenticator replaces how credentials are checked. Until it is called
+// only the API key from the config file is accepted.
+func (s *Server) SetAuthenticator(authenticator *auth.Authenticator) {
+	s.authenticator = authenticator
+}
+
+// RequireScopes turns away callers whose key lacks one of scopes. Anonymous
+// callers only get this far if the config doesn't require a key, and never
+// past routes that need the admin scope.
+func (s *Server) RequireScopes(scopes ...string) func(http.Handler) http.Handler {
+	admin := slices.Contains(scopes, auth.ScopeAdmin)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity := auth.FromContext(r.Context())
+			if identity == nil && admin {
+				s.unauthorized(w, r, "missing API key")
+				return
+			}
+			if identity != nil {
+				for _, scope := range scopes {
+					if !identity.HasScope(scope) {
+						s.WriteJSONErrorDetails(w, http.StatusForbidden, "insufficient scope", map[string]any{
+							"required": scopes,
+						})
+						return
+					}
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (s *Server) unauthorized(w http.ResponseWriter, r *http.Request, reason string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="noverna"`)
+	s.WriteJSONError(w, http.StatusUnauthorized, reason)
+}
+
+// withScopes wraps a handler in RequireScopes if any scopes are given
+func (s *Server) withScopes(handlerFn http.HandlerFunc, scopes []string) http.HandlerFunc {
+	if len(scopes) == 0 {
+		return handlerFn
+	}
+	return s.RequireScopes(scopes...)(handlerFn).ServeHTTP
+}
+
+func (s *Server) isExempt(r *http.Request) bool {
+	for _, path := range s.exemptPaths {
+		if prefix, ok := strings.CutSuffix(path, "*"); ok {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				return true
+			}
+		} else if r.URL.Path == path {
+			return true
+		}
+	}
+	for _, fn := range s.exemptFuncs {
+		if fn(r) {
+			return true
+		}
+	}
+	return false
 }
 
 // func (s *Server) setupRoutes() {
@@ -127,12 +365,18 @@ func (s *Server) WriteJSON(w http.ResponseWriter, status int, data any) {
 
 // The same shit in Red
 func (s *Server) WriteJSONError(w http.ResponseWriter, status int, message string) {
+	s.WriteJSONErrorDetails(w, status, message, nil)
+}
+
+// WriteJSONErrorDetails is WriteJSONError with machine readable context attached
+func (s *Server) WriteJSONErrorDetails(w http.ResponseWriter, status int, message string, details any) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	
 	response := APIResponse{
-		Status: status,
-		Error:  message,
+		Status:  status,
+		Error:   message,
+		Details: details,
 	}
 	
 	if err := json.NewEncoder(w).Encode(response); err != nil {
@@ -170,6 +414,10 @@ func (s *Server) SetLogger(l *logger.Logger) {
 	s.logger = l
 }
 
+func (s *Server) GetConfig() *config.Config {
+	return s.config
+}
+
 func (s *Server) GetRouter() *chi.Mux {
 	return s.router
 }
@@ -178,20 +426,29 @@ func (s *Server) Route(pattern string, fn func(r chi.Router)) {
 	s.router.Route(pattern, fn)
 }
 
-func (s *Server) Get(pattern string, handlerFn http.HandlerFunc) {
-	s.router.Get(pattern, handlerFn)
+// Get and the other method helpers take the scopes a caller's key needs, see RequireScopes
+func (s *Server) Get(pattern string, handlerFn http.HandlerFunc, scopes ...string) {
+	s.router.Get(pattern, s.withScopes(handlerFn, scopes))
 }
 
-func (s *Server) Post(pattern string, handlerFn http.HandlerFunc) {
-	s.router.Post(pattern, handlerFn)
+func (s *Server) Head(pattern string, handlerFn http.HandlerFunc, scopes ...string) {
+	s.router.Head(pattern, s.withScopes(handlerFn, scopes))
 }
 
-func (s *Server) Put(pattern string, handlerFn http.HandlerFunc) {
-	s.router.Put(pattern, handlerFn)
+func (s *Server) Post(pattern string, handlerFn http.HandlerFunc, scopes ...string) {
+	s.router.Post(pattern, s.withScopes(handlerFn, scopes))
 }
 
-func (s *Server) Delete(pattern string, handlerFn http.HandlerFunc) {
-	s.router.Delete(pattern, handlerFn)
+func (s *Server) Put(pattern string, handlerFn http.HandlerFunc, scopes ...string) {
+	s.router.Put(pattern, s.withScopes(handlerFn, scopes))
+}
+
+func (s *Server) Patch(pattern string, handlerFn http.HandlerFunc, scopes ...string) {
+	s.router.Patch(pattern, s.withScopes(handlerFn, scopes))
+}
+
+func (s *Server) Delete(pattern string, handlerFn http.HandlerFunc, scopes ...string) {
+	s.router.Delete(pattern, s.withScopes(handlerFn, scopes))
 }
 
 func (s *Server) Mount(pattern string, handler http.Handler) {
@@ -211,38 +468,40 @@ func (s *Server) Group(fn func(r chi.Router)) {
 // Server-Lifecycle
 
 func (s *Server) Start() error {
+	if s.setupErr != nil {
+		return s.setupErr
+	}
 	addr := fmt.Sprintf("%s:%d", s.config.Server.Host, s.config.Server.Port)
 	
 	s.httpServer = &http.Server{
 		Addr:         addr,
 		Handler:      s.router,
-		ReadTimeout:  30000,
-		WriteTimeout: 30000,
+		ReadHeaderTimeout: 30 * time.Second,
 	}
 
 	s.logger.Info("Server starting", map[string]any{
 		"address":      addr,
-		"read_timeout": 30000,
-		"write_timeout": 30000,
+		"read_header_timeout": "30s",
 		"debug":        s.config.Debug,
 	})
 	return s.httpServer.ListenAndServe()
 }
 
 func (s *Server) StartTLS(certFile, keyFile string) error {
+	if s.setupErr != nil {
+		return s.setupErr
+	}
 	addr := fmt.Sprintf("%s:%d", s.config.Server.Host, s.config.Server.Port)
 	
 	s.httpServer = &http.Server{
 		Addr:         addr,
 		Handler:      s.router,
-		ReadTimeout:  30000,
-		WriteTimeout: 30000,
+		ReadHeaderTimeout: 30 * time.Second,
 	}
 
 	s.logger.Info("Server starting", map[string]any{
 		"address":      addr,
-		"read_timeout": 30000,
-		"write_timeout": 30000,
+		"read_header_timeout": "30s",
 		"debug":        s.config.Debug,
 	})
 	return s.httpServer.ListenAndServeTLS(certFile, keyFile)
@@ -263,9 +522,23 @@ func (s *Server) Stop(ctx context.Context) error {
 	} else {
 		s.logger.Info("Server stopped gracefully")
 	}
+
+	// Background workers only stop once no request can reach them anymore
+	for _, hook := range s.shutdownHooks {
+		if err := hook(ctx); err != nil {
+			s.logger.Error("Shutdown hook failed", map[string]any{
+				"error": err.Error(),
+			})
+		}
+	}
 	return s.httpServer.Shutdown(ctx)
 }
 
+// OnShutdown registers fn to run after the HTTP server stopped accepting requests
+func (s *Server) OnShutdown(fn func(ctx context.Context) error) {
+	s.shutdownHooks = append(s.shutdownHooks, fn)
+}
+
 func (s *Server) GetAddress() string {
 	return fmt.Sprintf("%s:%d", s.config.Server.Host, s.config.Server.Port)
 }
@@ -0,0 +1,91 @@
+package files
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"noverna.de/m/v2/internal/api"
+	filesvc "noverna.de/m/v2/internal/files"
+	"noverna.de/m/v2/internal/imaging"
+)
+
+// downloadHandler streams a file or one of its image variants. Ranges
+// (including multipart/byteranges), If-None-Match, If-Modified-Since and
+// If-Range are handled by http.ServeContent, which only reads the parts it
+// actually sends.
+func downloadHandler(s *api.Server, svc *filesvc.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		file, content, err := svc.Open(r.Context(), chi.URLParam(r, "id"))
+		if err != nil {
+			writeDownloadError(s, w, err)
+			return
+		}
+		defer content.Close()
+
+		name := file.Name
+		if name == "" {
+			name = file.ID
+		}
+
+		if !imaging.Wants(r.URL.Query()) {
+			// The checksum never changes for a given content, so it makes a strong ETag
+			serveContent(w, r, name, file.Mime, file.Hash(), file.LastModified(), content)
+			return
+		}
+
+		opts, err := svc.VariantOptions(file, r.URL.Query())
+		if err != nil {
+			writeDownloadError(s, w, err)
+			return
+		}
+
+		variant, variantContent, err := svc.OpenVariant(r.Context(), file, opts)
+		if err != nil {
+			writeDownloadError(s, w, err)
+			return
+		}
+		defer variantContent.Close()
+
+		name = strings.TrimSuffix(name, path.Ext(name)) + "-" + variant.Name
+		serveContent(w, r, name, variant.Mime, file.Hash()+"-"+variant.Name, variant.ModTime, variantContent)
+	}
+}
+
+func serveContent(w http.ResponseWriter, r *http.Request, name, mimeType, etag string, modTime time.Time, content io.ReadSeeker) {
+	disposition := "inline"
+	if r.URL.Query().Has("download") {
+		disposition = "attachment"
+	}
+
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	http.ServeContent(w, r, "", modTime, content)
+}
+
+func writeDownloadError(s *api.Server, w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, filesvc.ErrNotFound):
+		s.WriteJSONError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, filesvc.ErrExpired):
+		s.WriteJSONError(w, http.StatusGone, err.Error())
+	case errors.Is(err, imaging.ErrInvalidOptions), errors.Is(err, filesvc.ErrSizeNotAllowed):
+		s.WriteJSONError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, filesvc.ErrNotAnImage):
+		s.WriteJSONError(w, http.StatusUnsupportedMediaType, err.Error())
+	case errors.Is(err, imaging.ErrTooManyPixels):
+		s.WriteJSONError(w, http.StatusUnprocessableEntity, err.Error())
+	default:
+		s.GetLogger().Error("Failed to open file", map[string]any{"error": err.Error()})
+		s.WriteJSONError(w, http.StatusInternalServerError, "failed to open file")
+	}
+}
@@ -0,0 +1,284 @@
+package files
+
+import (
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"noverna.de/m/v2/internal/api"
+	"noverna.de/m/v2/internal/auth"
+	filesvc "noverna.de/m/v2/internal/files"
+	"noverna.de/m/v2/internal/sniff"
+	"noverna.de/m/v2/internal/urlsign"
+)
+
+// Some headroom for the multipart boundaries and part headers
+const multipartOverhead = 1 << 20
+
+// Register mounts the file routes. Signed download links are only minted
+// and accepted if links is not nil.
+func Register(s *api.Server, svc *filesvc.Service, links *urlsign.Signer) {
+	read, write := auth.ScopeFilesRead, auth.ScopeFilesWrite
+
+	download := namespaced(s, svc, downloadHandler(s, svc))
+	if links != nil {
+		download = presigned(s, links, download)
+		s.ExemptFunc(signedDownload)
+		s.Post("/v1/files/{id}/links", namespaced(s, svc, linkHandler(s, svc, links)), read)
+	}
+
+	s.Get("/v1/files", listHandler(s, svc), read)
+	s.Post("/v1/files", uploadHandler(s, svc), write)
+	s.Get("/v1/files/{id}", download, read)
+	s.Head("/v1/files/{id}", download, read)
+	s.Put("/v1/files/{id}", namespaced(s, svc, replaceHandler(s, svc)), write)
+	s.Delete("/v1/files/{id}", namespaced(s, svc, deleteHandler(s, svc)), write)
+	s.Get("/v1/files/{id}/metadata", namespaced(s, svc, metadataHandler(s, svc)), read)
+
+	s.Get("/v1/files/{id}/versions", namespaced(s, svc, versionsHandler(s, svc)), read)
+	s.Get("/v1/files/{id}/versions/{version}", namespaced(s, svc, versionDownloadHandler(s, svc)), read)
+	s.Head("/v1/files/{id}/versions/{version}", namespaced(s, svc, versionDownloadHandler(s, svc)), read)
+	s.Post("/v1/files/{id}/versions/{version}/promote", namespaced(s, svc, promoteHandler(s, svc)), write)
+
+	s.Get("/v1/trash", trashListHandler(s, svc), read)
+	s.Post("/v1/trash/{id}/restore", namespaced(s, svc, restoreHandler(s, svc)), write)
+	s.Delete("/v1/trash/{id}", namespaced(s, svc, purgeHandler(s, svc)), write)
+
+	s.Get("/v1/usage", usageHandler(s, svc), read)
+
+	s.Get("/v1/admin/scrub", scrubReportHandler(s, svc), auth.ScopeAdmin)
+	s.Post("/v1/admin/scrub", startScrubHandler(s, svc), auth.ScopeAdmin)
+}
+
+func uploadHandler(s *api.Server, svc *filesvc.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		upload, part, ok := readUpload(s, svc, w, r)
+		if !ok {
+			return
+		}
+		defer part.Close()
+
+		file, err := svc.Ingest(r.Context(), upload, part)
+		if err != nil {
+			WriteUploadError(s, w, err)
+			return
+		}
+
+		s.WriteJSON(w, http.StatusCreated, file)
+	}
+}
+
+// replaceHandler uploads new content for an existing file, the old content becomes a version
+func replaceHandler(s *api.Server, svc *filesvc.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		upload, part, ok := readUpload(s, svc, w, r)
+		if !ok {
+			return
+		}
+		defer part.Close()
+
+		file, err := svc.Replace(r.Context(), chi.URLParam(r, "id"), upload, part)
+		if errors.Is(err, filesvc.ErrNotFound) {
+			s.WriteJSONError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if errors.Is(err, filesvc.ErrExpired) {
+			s.WriteJSONError(w, http.StatusGone, err.Error())
+			return
+		}
+		if err != nil {
+			WriteUploadError(s, w, err)
+			return
+		}
+
+		s.WriteJSON(w, http.StatusOK, file)
+	}
+}
+
+// readUpload opens the first file of a multipart body and collects the
+// options sent with it. If it fails the error response is already written.
+func readUpload(s *api.Server, svc *filesvc.Service, w http.ResponseWriter, r *http.Request) (filesvc.Upload, *multipart.Part, bool) {
+	limit := svc.MaxFileSize() + multipartOverhead
+	if r.ContentLength > limit {
+		s.WriteJSONError(w, http.StatusRequestEntityTooLarge, filesvc.ErrTooLarge.Error())
+		return filesvc.Upload{}, nil, false
+	}
+
+	// The body is a bit larger than the file, only turn it down if even
+	// without the multipart overhead it can't fit
+	owner := auth.Owner(r.Context())
+	size := int64(-1)
+	if r.ContentLength >= 0 {
+		size = max(r.ContentLength-multipartOverhead, 0)
+	}
+	if err := svc.CheckQuota(owner, size); err != nil {
+		WriteUploadError(s, w, err)
+		return filesvc.Upload{}, nil, false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		s.WriteJSONError(w, http.StatusBadRequest, "expected a multipart/form-data body")
+		return filesvc.Upload{}, nil, false
+	}
+
+	part, fields, err := nextFilePart(reader)
+	if err != nil {
+		s.WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return filesvc.Upload{}, nil, false
+	}
+
+	keep, err := keepMetadata(r.URL.Query(), fields)
+	if err != nil {
+		part.Close()
+		s.WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return filesvc.Upload{}, nil, false
+	}
+
+	namespace, err := BoundNamespace(r, option(r.URL.Query(), fields, "namespace"))
+	if err != nil {
+		part.Close()
+		WriteUploadError(s, w, err)
+		return filesvc.Upload{}, nil, false
+	}
+
+	expiresAt, err := filesvc.ParseExpiry(option(r.URL.Query(), fields, "expires_at"), option(r.URL.Query(), fields, "ttl"), time.Now())
+	if err != nil {
+		part.Close()
+		s.WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return filesvc.Upload{}, nil, false
+	}
+
+	upload := filesvc.Upload{
+		Name:         part.FileName(),
+		DeclaredType: part.Header.Get("Content-Type"),
+		Namespace:    namespace,
+		Owner:        owner,
+		Tags:         splitTags(r.URL.Query(), fields),
+		ExpiresAt:    expiresAt,
+		KeepMetadata: keep,
+	}
+	return upload, part, true
+}
+
+// metadataHandler returns the stored record of a file, including what we
+// extracted from images and videos
+func metadataHandler(s *api.Server, svc *filesvc.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		file, err := svc.Get(chi.URLParam(r, "id"))
+		if err != nil {
+			writeDownloadError(s, w, err)
+			return
+		}
+		s.WriteJSON(w, http.StatusOK, file)
+	}
+}
+
+// Plain form fields only carry options, anything longer is cut off
+const maxFieldSize = 1 << 10
+
+// nextFilePart collects plain form fields until it finds the first file.
+// Options therefore have to be sent before the file itself.
+func nextFilePart(reader *multipart.Reader) (*multipart.Part, url.Values, error) {
+	fields := url.Values{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, nil, errors.New("no file found in request")
+		}
+		if err != nil {
+			return nil, nil, errors.New("malformed multipart body")
+		}
+		if part.FileName() != "" {
+			return part, fields, nil
+		}
+
+		if name := part.FormName(); name != "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxFieldSize))
+			if err != nil {
+				part.Close()
+				return nil, nil, errors.New("malformed multipart body")
+			}
+			fields.Add(name, string(value))
+		}
+		part.Close()
+	}
+}
+
+// option reads a single option from the query, falling back to the form fields
+func option(query, fields url.Values, name string) string {
+	if value := query.Get(name); value != "" {
+		return value
+	}
+	return fields.Get(name)
+}
+
+// splitTags collects comma separated tags from the query and form fields
+func splitTags(query, fields url.Values) []string {
+	var tags []string
+	for _, values := range [][]string{query["tags"], fields["tags"]} {
+		for _, value := range values {
+			tags = append(tags, strings.Split(value, ",")...)
+		}
+	}
+	return tags
+}
+
+// keepMetadata reads the keep_metadata option from the query or a form field
+func keepMetadata(query, fields url.Values) (bool, error) {
+	value := query.Get("keep_metadata")
+	if value == "" {
+		value = fields.Get("keep_metadata")
+	}
+	if value == "" {
+		return false, nil
+	}
+
+	keep, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New("keep_metadata must be a boolean")
+	}
+	return keep, nil
+}
+
+// WriteUploadError maps errors from the files service to HTTP responses
+func WriteUploadError(s *api.Server, w http.ResponseWriter, err error) {
+	var maxBytes *http.MaxBytesError
+	var mismatch *sniff.MismatchError
+	var quota *filesvc.QuotaError
+
+	switch {
+	case errors.Is(err, filesvc.ErrTooLarge), errors.As(err, &maxBytes):
+		s.WriteJSONError(w, http.StatusRequestEntityTooLarge, filesvc.ErrTooLarge.Error())
+	case errors.As(err, &mismatch):
+		s.WriteJSONErrorDetails(w, http.StatusUnsupportedMediaType, "declared content type does not match file content", mismatch)
+	case errors.Is(err, filesvc.ErrTypeNotAllowed):
+		s.WriteJSONError(w, http.StatusUnsupportedMediaType, err.Error())
+	case errors.Is(err, ErrNamespaceForbidden):
+		s.WriteJSONError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, filesvc.ErrEmpty):
+		s.WriteJSONError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, filesvc.ErrInvalidTags), errors.Is(err, filesvc.ErrInvalidNamespace), errors.Is(err, filesvc.ErrInvalidExpiry):
+		s.WriteJSONError(w, http.StatusBadRequest, err.Error())
+	case errors.As(err, &quota):
+		// 413 if a smaller upload would still fit, 507 once nothing does
+		status := http.StatusRequestEntityTooLarge
+		if quota.Full() {
+			status = http.StatusInsufficientStorage
+		}
+		s.WriteJSONErrorDetails(w, status, err.Error(), quota)
+	case errors.Is(err, filesvc.ErrInvalidContent):
+		s.WriteJSONError(w, http.StatusUnprocessableEntity, err.Error())
+	default:
+		s.GetLogger().Error("Upload failed", map[string]any{"error": err.Error()})
+		s.WriteJSONError(w, http.StatusInternalServerError, "upload failed")
+	}
+}
@@ -0,0 +1,66 @@
+package files
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"noverna.de/m/v2/internal/api"
+	"noverna.de/m/v2/internal/config"
+	filesvc "noverna.de/m/v2/internal/files"
+	"noverna.de/m/v2/internal/logger"
+)
+
+func TestWriteUploadErrorQuota(t *testing.T) {
+	s := api.NewServer(&config.Config{}, logger.NewLogger().SetOutput(io.Discard))
+	quota := filesvc.Quota{MaxBytes: 100, MaxFiles: 5}
+
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{
+			name: "smaller upload would fit",
+			err:  &filesvc.QuotaError{Limit: filesvc.QuotaBytes, Usage: &filesvc.Usage{Bytes: 40}, Quota: quota},
+			want: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name: "no bytes left",
+			err:  &filesvc.QuotaError{Limit: filesvc.QuotaBytes, Usage: &filesvc.Usage{Bytes: 100}, Quota: quota},
+			want: http.StatusInsufficientStorage,
+		},
+		{
+			name: "no files left",
+			err:  &filesvc.QuotaError{Limit: filesvc.QuotaFiles, Usage: &filesvc.Usage{Files: 5}, Quota: quota},
+			want: http.StatusInsufficientStorage,
+		},
+		{
+			name: "wrapped",
+			err:  fmt.Errorf("ingest: %w", &filesvc.QuotaError{Limit: filesvc.QuotaBytes, Usage: &filesvc.Usage{}, Quota: quota}),
+			want: http.StatusRequestEntityTooLarge,
+		},
+		{name: "upload limit", err: filesvc.ErrTooLarge, want: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			WriteUploadError(s, w, tt.err)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d", w.Code, tt.want)
+			}
+
+			var body api.APIResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := tt.err.(*filesvc.QuotaError); ok && body.Details == nil {
+				t.Error("quota details missing")
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package files
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"noverna.de/m/v2/internal/api"
+	"noverna.de/m/v2/internal/auth"
+	filesvc "noverna.de/m/v2/internal/files"
+	"noverna.de/m/v2/internal/middleware"
+	"noverna.de/m/v2/internal/urlsign"
+)
+
+type linkRequest struct {
+	// TTL like "15m", the configured default if empty
+	TTL string `json:"ttl"`
+	// Variant is the image variant the link serves, as on downloads
+	Variant *struct {
+		W      int    `json:"w"`
+		H      int    `json:"h"`
+		Fit    string `json:"fit"`
+		Format string `json:"format"`
+	} `json:"variant"`
+	// Download serves the file as an attachment
+	Download bool `json:"download"`
+	// ClientIP binds the link to one address
+	ClientIP string `json:"client_ip"`
+}
+
+type linkResponse struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+	KeyID     string    `json:"key_id"`
+}
+
+// linkHandler mints a link to a file that works without an API key until it
+// expires
+func linkHandler(s *api.Server, svc *filesvc.Service, links *urlsign.Signer) http.HandlerFunc {
+	baseURL := strings.TrimSuffix(s.GetConfig().Security.SignedURLs.BaseURL, "/")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req linkRequest
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req)
+		if err != nil && !errors.Is(err, io.EOF) {
+			s.WriteJSONError(w, http.StatusBadRequest, "expected a JSON body")
+			return
+		}
+
+		file, err := svc.Get(chi.URLParam(r, "id"))
+		if err != nil {
+			writeDownloadError(s, w, err)
+			return
+		}
+
+		query := url.Values{}
+		if v := req.Variant; v != nil {
+			if v.W != 0 {
+				query.Set("w", strconv.Itoa(v.W))
+			}
+			if v.H != 0 {
+				query.Set("h", strconv.Itoa(v.H))
+			}
+			if v.Fit != "" {
+				query.Set("fit", v.Fit)
+			}
+			if v.Format != "" {
+				query.Set("format", v.Format)
+			}
+			// Links to variants that could never be served aren't handed out
+			if _, err := svc.VariantOptions(file, query); err != nil {
+				writeDownloadError(s, w, err)
+				return
+			}
+		}
+		if req.Download {
+			query.Set("download", "1")
+		}
+
+		var ttl time.Duration
+		if req.TTL != "" {
+			if ttl, err = time.ParseDuration(req.TTL); err != nil {
+				s.WriteJSONError(w, http.StatusBadRequest, urlsign.ErrInvalidTTL.Error())
+				return
+			}
+		}
+		expires, err := links.Expiry(ttl, time.Now())
+		if err != nil {
+			s.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		var client netip.Addr
+		if req.ClientIP != "" {
+			if client, err = netip.ParseAddr(req.ClientIP); err != nil {
+				s.WriteJSONError(w, http.StatusBadRequest, "invalid client_ip")
+				return
+			}
+		}
+
+		path := "/v1/files/" + file.ID
+		signed := links.Sign(path, query, expires, client)
+
+		s.GetLogger().Info("Download link minted", map[string]any{
+			"file_id":    file.ID,
+			"key_id":     links.KeyID(),
+			"expires_at": expires,
+			"owner":      auth.Owner(r.Context()),
+		})
+		s.WriteJSON(w, http.StatusCreated, linkResponse{
+			URL:       baseURL + path + "?" + signed.Encode(),
+			ExpiresAt: expires,
+			KeyID:     links.KeyID(),
+		})
+	}
+}
+
+// signedDownload reports whether r is a download through a signed link.
+// Those pass the API key check, presigned checks them instead.
+func signedDownload(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	id, ok := strings.CutPrefix(r.URL.Path, "/v1/files/")
+	return ok && id != "" && !strings.Contains(id, "/") && r.URL.Query().Has(urlsign.ParamSignature)
+}
+
+// presigned serves downloads through signed links once their signature
+// holds, other requests went through the API key check and pass on
+func presigned(s *api.Server, links *urlsign.Signer, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !signedDownload(r) {
+			next(w, r)
+			return
+		}
+
+		if err := links.Verify(r.URL.Path, r.URL.Query(), middleware.ClientAddr(r), time.Now()); err != nil {
+			s.WriteJSONError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		next(w, r)
+	}
+}
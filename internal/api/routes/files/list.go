@@ -0,0 +1,79 @@
+package files
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"noverna.de/m/v2/internal/api"
+	filesvc "noverna.de/m/v2/internal/files"
+)
+
+// listHandler serves GET /v1/files?namespace=&type=&tag=&owner=&from=&to=&limit=&cursor=
+func listHandler(s *api.Server, svc *filesvc.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseQuery(r.URL.Query())
+		if err != nil {
+			s.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if q.Namespace, err = BoundNamespace(r, r.URL.Query().Get("namespace")); err != nil {
+			WriteUploadError(s, w, err)
+			return
+		}
+
+		page, err := svc.List(q)
+		if errors.Is(err, filesvc.ErrInvalidCursor) {
+			s.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			s.GetLogger().Error("Failed to list files", map[string]any{"error": err.Error()})
+			s.WriteJSONError(w, http.StatusInternalServerError, "failed to list files")
+			return
+		}
+
+		s.WriteJSON(w, http.StatusOK, page)
+	}
+}
+
+func parseQuery(values url.Values) (filesvc.Query, error) {
+	q := filesvc.Query{
+		Owner:  values.Get("owner"),
+		Type:   values.Get("type"),
+		Tag:    values.Get("tag"),
+		Cursor: values.Get("cursor"),
+	}
+
+	var err error
+	if q.From, err = parseTime(values.Get("from")); err != nil {
+		return q, errors.New("from must be an RFC 3339 timestamp or a date")
+	}
+	if q.To, err = parseTime(values.Get("to")); err != nil {
+		return q, errors.New("to must be an RFC 3339 timestamp or a date")
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && !q.From.Before(q.To) {
+		return q, errors.New("from must be before to")
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		q.Limit, err = strconv.Atoi(limit)
+		if err != nil || q.Limit < 1 || q.Limit > filesvc.MaxPageSize {
+			return q, errors.New("limit must be between 1 and " + strconv.Itoa(filesvc.MaxPageSize))
+		}
+	}
+	return q, nil
+}
+
+// parseTime accepts RFC 3339 timestamps and plain dates (midnight UTC)
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
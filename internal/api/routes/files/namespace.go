@@ -0,0 +1,59 @@
+package files
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"noverna.de/m/v2/internal/api"
+	"noverna.de/m/v2/internal/auth"
+	filesvc "noverna.de/m/v2/internal/files"
+)
+
+var ErrNamespaceForbidden = errors.New("API key is bound to another namespace")
+
+// BoundNamespace resolves the namespace a request works in. Keys bound to a
+// namespace get theirs if none is named and may not name another one.
+func BoundNamespace(r *http.Request, requested string) (string, error) {
+	if requested != "" {
+		namespace, err := filesvc.NormalizeNamespace(requested)
+		if err != nil {
+			return "", err
+		}
+		requested = namespace
+	}
+
+	identity := auth.FromContext(r.Context())
+	if identity == nil || identity.Namespace == "" {
+		return requested, nil
+	}
+	if requested != "" && requested != identity.Namespace {
+		return "", ErrNamespaceForbidden
+	}
+	return identity.Namespace, nil
+}
+
+// namespaced hides files outside the caller's namespace from routes with an
+// {id}. They are not found rather than forbidden, so ids can't be probed.
+func namespaced(s *api.Server, svc *filesvc.Service, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity := auth.FromContext(r.Context())
+		if identity == nil || identity.Namespace == "" {
+			next(w, r)
+			return
+		}
+
+		namespace, err := svc.Namespace(chi.URLParam(r, "id"))
+		if errors.Is(err, filesvc.ErrNotFound) || (err == nil && namespace != identity.Namespace) {
+			s.WriteJSONError(w, http.StatusNotFound, filesvc.ErrNotFound.Error())
+			return
+		}
+		if err != nil {
+			s.GetLogger().Error("Failed to load file", map[string]any{"error": err.Error()})
+			s.WriteJSONError(w, http.StatusInternalServerError, "failed to load file")
+			return
+		}
+		next(w, r)
+	}
+}
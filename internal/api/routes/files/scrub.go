@@ -0,0 +1,45 @@
+package files
+
+import (
+	"errors"
+	"net/http"
+
+	"noverna.de/m/v2/internal/api"
+	filesvc "noverna.de/m/v2/internal/files"
+)
+
+// scrubReportHandler returns the report of the running or last scrub
+func scrubReportHandler(s *api.Server, svc *filesvc.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, err := svc.LastScrub()
+		if err != nil {
+			writeScrubError(s, w, err)
+			return
+		}
+		s.WriteJSON(w, http.StatusOK, report)
+	}
+}
+
+// startScrubHandler starts a scrub in the background, its progress shows up in the report
+func startScrubHandler(s *api.Server, svc *filesvc.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, err := svc.StartScrub()
+		if err != nil {
+			writeScrubError(s, w, err)
+			return
+		}
+		s.WriteJSON(w, http.StatusAccepted, report)
+	}
+}
+
+func writeScrubError(s *api.Server, w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, filesvc.ErrNoScrub):
+		s.WriteJSONError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, filesvc.ErrScrubRunning):
+		s.WriteJSONError(w, http.StatusConflict, err.Error())
+	default:
+		s.GetLogger().Error("Scrub operation failed", map[string]any{"error": err.Error()})
+		s.WriteJSONError(w, http.StatusInternalServerError, "scrub operation failed")
+	}
+}
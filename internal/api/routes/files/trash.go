@@ -0,0 +1,83 @@
+package files
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"noverna.de/m/v2/internal/api"
+	filesvc "noverna.de/m/v2/internal/files"
+)
+
+// deleteHandler moves a file to the trash
+func deleteHandler(s *api.Server, svc *filesvc.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		file, err := svc.Trash(chi.URLParam(r, "id"))
+		if err != nil {
+			writeTrashError(s, w, err)
+			return
+		}
+		s.WriteJSON(w, http.StatusOK, file)
+	}
+}
+
+// trashListHandler serves GET /v1/trash, supporting the same filters as GET /v1/files
+func trashListHandler(s *api.Server, svc *filesvc.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseQuery(r.URL.Query())
+		if err != nil {
+			s.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if q.Namespace, err = BoundNamespace(r, r.URL.Query().Get("namespace")); err != nil {
+			WriteUploadError(s, w, err)
+			return
+		}
+		q.Trashed = true
+
+		page, err := svc.List(q)
+		if err != nil {
+			writeTrashError(s, w, err)
+			return
+		}
+		s.WriteJSON(w, http.StatusOK, page)
+	}
+}
+
+func restoreHandler(s *api.Server, svc *filesvc.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		file, err := svc.Restore(chi.URLParam(r, "id"))
+		if err != nil {
+			writeTrashError(s, w, err)
+			return
+		}
+		s.WriteJSON(w, http.StatusOK, file)
+	}
+}
+
+func purgeHandler(s *api.Server, svc *filesvc.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := svc.Purge(r.Context(), chi.URLParam(r, "id")); err != nil {
+			writeTrashError(s, w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeTrashError(s *api.Server, w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, filesvc.ErrNotFound):
+		s.WriteJSONError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, filesvc.ErrExpired):
+		s.WriteJSONError(w, http.StatusGone, err.Error())
+	case errors.Is(err, filesvc.ErrNotTrashed):
+		s.WriteJSONError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, filesvc.ErrInvalidCursor):
+		s.WriteJSONError(w, http.StatusBadRequest, err.Error())
+	default:
+		s.GetLogger().Error("Trash operation failed", map[string]any{"error": err.Error()})
+		s.WriteJSONError(w, http.StatusInternalServerError, "trash operation failed")
+	}
+}
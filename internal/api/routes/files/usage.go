@@ -0,0 +1,38 @@
+package files
+
+import (
+	"net/http"
+
+	"noverna.de/m/v2/internal/api"
+	"noverna.de/m/v2/internal/auth"
+	filesvc "noverna.de/m/v2/internal/files"
+)
+
+type usageResponse struct {
+	Owner string         `json:"owner"`
+	Usage *filesvc.Usage `json:"usage"`
+	Quota filesvc.Quota  `json:"quota"`
+	// Remaining is how many bytes still fit, -1 without a byte limit
+	Remaining int64 `json:"remaining_bytes"`
+}
+
+// usageHandler returns what the caller stores and how much of their quota is left
+func usageHandler(s *api.Server, svc *filesvc.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		owner := auth.Owner(r.Context())
+		usage, err := svc.Usage(owner)
+		if err != nil {
+			s.GetLogger().Error("Failed to load usage", map[string]any{"error": err.Error()})
+			s.WriteJSONError(w, http.StatusInternalServerError, "failed to load usage")
+			return
+		}
+
+		quota := svc.Quota(owner)
+		s.WriteJSON(w, http.StatusOK, usageResponse{
+			Owner:     owner,
+			Usage:     usage,
+			Quota:     quota,
+			Remaining: quota.Remaining(usage),
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package files
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"noverna.de/m/v2/internal/api"
+	filesvc "noverna.de/m/v2/internal/files"
+)
+
+func versionsHandler(s *api.Server, svc *filesvc.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		versions, err := svc.Versions(chi.URLParam(r, "id"))
+		if err != nil {
+			writeVersionError(s, w, err)
+			return
+		}
+		s.WriteJSON(w, http.StatusOK, versions)
+	}
+}
+
+// versionDownloadHandler streams the content of one version, with the same
+// range and conditional request handling as the current content
+func versionDownloadHandler(s *api.Server, svc *filesvc.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		number, ok := versionParam(s, w, r)
+		if !ok {
+			return
+		}
+
+		file, version, content, err := svc.OpenVersion(r.Context(), chi.URLParam(r, "id"), number)
+		if err != nil {
+			writeVersionError(s, w, err)
+			return
+		}
+		defer content.Close()
+
+		name := file.Name
+		if name == "" {
+			name = file.ID
+		}
+		name = strings.TrimSuffix(name, path.Ext(name)) + "-v" + strconv.Itoa(version.Number) + path.Ext(name)
+
+		serveContent(w, r, name, version.Mime, version.Hash(), version.CreatedAt, content)
+	}
+}
+
+func promoteHandler(s *api.Server, svc *filesvc.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		number, ok := versionParam(s, w, r)
+		if !ok {
+			return
+		}
+
+		file, err := svc.Promote(r.Context(), chi.URLParam(r, "id"), number)
+		if err != nil {
+			writeVersionError(s, w, err)
+			return
+		}
+		s.WriteJSON(w, http.StatusOK, file)
+	}
+}
+
+func versionParam(s *api.Server, w http.ResponseWriter, r *http.Request) (int, bool) {
+	number, err := strconv.Atoi(chi.URLParam(r, "version"))
+	if err != nil || number < 1 {
+		s.WriteJSONError(w, http.StatusBadRequest, "version must be a positive number")
+		return 0, false
+	}
+	return number, true
+}
+
+func writeVersionError(s *api.Server, w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, filesvc.ErrNotFound), errors.Is(err, filesvc.ErrVersionNotFound):
+		s.WriteJSONError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, filesvc.ErrExpired):
+		s.WriteJSONError(w, http.StatusGone, err.Error())
+	default:
+		s.GetLogger().Error("Version operation failed", map[string]any{"error": err.Error()})
+		s.WriteJSONError(w, http.StatusInternalServerError, "version operation failed")
+	}
+}
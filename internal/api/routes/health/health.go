@@ -9,6 +9,7 @@ import (
 
 func Register(s *api.Server) {
 	s.GetRouter().Get("/health", healthHandler(s))
+	s.Exempt("/health")
 }
 
 func healthHandler(s *api.Server) http.HandlerFunc {
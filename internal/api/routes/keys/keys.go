@@ -0,0 +1,128 @@
+package keys
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"noverna.de/m/v2/internal/api"
+	"noverna.de/m/v2/internal/auth"
+	filesvc "noverna.de/m/v2/internal/files"
+)
+
+// Register mounts the API key administration under /v1/admin/keys
+func Register(s *api.Server, registry *auth.Registry) {
+	s.Get("/v1/admin/keys", listHandler(s, registry), auth.ScopeAdmin)
+	s.Post("/v1/admin/keys", createHandler(s, registry), auth.ScopeAdmin)
+	s.Delete("/v1/admin/keys/{id}", revokeHandler(s, registry), auth.ScopeAdmin)
+	s.Post("/v1/admin/keys/{id}/rotate", rotateHandler(s, registry), auth.ScopeAdmin)
+}
+
+type createRequest struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	Namespace string   `json:"namespace"`
+	// Either an RFC 3339 timestamp or a ttl like "720h", not both
+	ExpiresAt string `json:"expires_at"`
+	TTL       string `json:"ttl"`
+}
+
+// keyResponse carries the token, it is only ever shown once
+type keyResponse struct {
+	Key   *auth.Key `json:"key"`
+	Token string    `json:"token"`
+}
+
+func listHandler(s *api.Server, registry *auth.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys, err := registry.List()
+		if err != nil {
+			writeKeyError(s, w, err)
+			return
+		}
+		s.WriteJSON(w, http.StatusOK, map[string]any{"keys": keys})
+	}
+}
+
+func createHandler(s *api.Server, registry *auth.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req createRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+			s.WriteJSONError(w, http.StatusBadRequest, "expected a JSON body")
+			return
+		}
+
+		spec := auth.NewKey{Name: req.Name, Scopes: req.Scopes}
+		if req.Namespace != "" {
+			namespace, err := filesvc.NormalizeNamespace(req.Namespace)
+			if err != nil {
+				s.WriteJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			spec.Namespace = namespace
+		}
+		expiresAt, err := filesvc.ParseExpiry(req.ExpiresAt, req.TTL, time.Now())
+		if err != nil {
+			s.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		spec.ExpiresAt = expiresAt
+
+		key, token, err := registry.Create(spec)
+		if err != nil {
+			writeKeyError(s, w, err)
+			return
+		}
+
+		s.GetLogger().Info("API key created", map[string]any{
+			"key_id":    key.ID,
+			"scopes":    key.Scopes,
+			"namespace": key.Namespace,
+		})
+		s.WriteJSON(w, http.StatusCreated, keyResponse{Key: key, Token: token})
+	}
+}
+
+func revokeHandler(s *api.Server, registry *auth.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := registry.Revoke(chi.URLParam(r, "id"))
+		if err != nil {
+			writeKeyError(s, w, err)
+			return
+		}
+
+		s.GetLogger().Info("API key revoked", map[string]any{"key_id": key.ID})
+		s.WriteJSON(w, http.StatusOK, key)
+	}
+}
+
+// rotateHandler hands out a new secret for a key, the old one stops working
+func rotateHandler(s *api.Server, registry *auth.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, token, err := registry.Rotate(chi.URLParam(r, "id"))
+		if err != nil {
+			writeKeyError(s, w, err)
+			return
+		}
+
+		s.GetLogger().Info("API key rotated", map[string]any{"key_id": key.ID})
+		s.WriteJSON(w, http.StatusOK, keyResponse{Key: key, Token: token})
+	}
+}
+
+func writeKeyError(s *api.Server, w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, auth.ErrKeyNotFound):
+		s.WriteJSONError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, auth.ErrKeyRevoked):
+		s.WriteJSONError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, auth.ErrInvalidScopes), errors.Is(err, auth.ErrInvalidExpiry):
+		s.WriteJSONError(w, http.StatusBadRequest, err.Error())
+	default:
+		s.GetLogger().Error("API key operation failed", map[string]any{"error": err.Error()})
+		s.WriteJSONError(w, http.StatusInternalServerError, "API key operation failed")
+	}
+}
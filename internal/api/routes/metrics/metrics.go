@@ -0,0 +1,10 @@
+package metrics
+
+import (
+	"noverna.de/m/v2/internal/api"
+	"noverna.de/m/v2/internal/metrics"
+)
+
+func Register(s *api.Server) {
+	s.GetRouter().Get("/metrics", metrics.Handler().ServeHTTP)
+}
@@ -1,11 +1,138 @@
 package routes
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
 	"noverna.de/m/v2/internal/api"
+	"noverna.de/m/v2/internal/api/routes/files"
 	"noverna.de/m/v2/internal/api/routes/health"
+	"noverna.de/m/v2/internal/api/routes/keys"
+	"noverna.de/m/v2/internal/api/routes/metrics"
+	"noverna.de/m/v2/internal/api/routes/uploads"
+	"noverna.de/m/v2/internal/auth"
+	filesvc "noverna.de/m/v2/internal/files"
+	"noverna.de/m/v2/internal/janitor"
+	"noverna.de/m/v2/internal/kv"
+	"noverna.de/m/v2/internal/resp"
+	"noverna.de/m/v2/internal/storage"
+	"noverna.de/m/v2/internal/tus"
+	"noverna.de/m/v2/internal/urlsign"
 )
 
-func SetupRoutes(s *api.Server) {
+func SetupRoutes(s *api.Server) (err error) {
 	/// Setup all Routes
 	health.Register(s)
-}
\ No newline at end of file
+	metrics.Register(s)
+
+	cfg := s.GetConfig()
+
+	backend, err := storage.New(cfg)
+	if err != nil {
+		return err
+	}
+
+	db, err := kv.Open(filepath.Join(cfg.Server.DataDir, "meta", "files.db"))
+	if err != nil {
+		return err
+	}
+	// Until the shutdown hooks own them, a failed setup closes what it opened
+	var svc *filesvc.Service
+	defer func() {
+		if err == nil {
+			return
+		}
+		if svc != nil {
+			svc.Close(context.Background())
+		}
+		db.Close()
+	}()
+
+	keyDB, err := kv.Open(filepath.Join(cfg.Server.DataDir, "meta", "keys.db"))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			keyDB.Close()
+		}
+	}()
+	s.OnShutdown(func(ctx context.Context) error { return keyDB.Close() })
+	registry := auth.NewRegistry(keyDB)
+	var verifier *auth.JWTVerifier
+	if cfg.Security.JWT.Enabled {
+		if verifier, err = auth.NewJWTVerifier(cfg.Security.JWT); err != nil {
+			return err
+		}
+	}
+	var signatures *auth.HMACVerifier
+	if cfg.Security.HMAC.Enabled {
+		nonces, err := nonceStore(s)
+		if err != nil {
+			return err
+		}
+		// Room for the multipart framing around the largest upload
+		maxBody := int64(cfg.Uploads.MAX_FILE_SIZE)<<20 + 1<<20
+		if signatures, err = auth.NewHMACVerifier(cfg.Security.HMAC, nonces, cfg.Server.TempDir, maxBody); err != nil {
+			return err
+		}
+	}
+	s.SetAuthenticator(auth.NewAuthenticator(cfg.Security.ApiKey, registry, verifier, signatures))
+	keys.Register(s, registry)
+
+	if svc, err = filesvc.NewService(cfg, s.GetLogger(), backend, db); err != nil {
+		return err
+	}
+	s.OnShutdown(svc.Close)
+	// After the service, so its background tasks are done writing
+	s.OnShutdown(func(ctx context.Context) error { return db.Close() })
+	var links *urlsign.Signer
+	if cfg.Security.SignedURLs.Enabled {
+		if links, err = urlsign.New(cfg.Security.SignedURLs); err != nil {
+			return err
+		}
+	}
+	files.Register(s, svc, links)
+
+	store, err := tus.NewStore(
+		filepath.Join(cfg.Server.TempDir, "tus"),
+		time.Duration(cfg.Uploads.ResumableExpiryHours)*time.Hour,
+	)
+	if err != nil {
+		return err
+	}
+	uploads.Register(s, svc, store)
+
+	// Expired resumable sessions are left to the store, which knows which
+	// ones are still being written
+	j := janitor.New(cfg.Server.TempDir, time.Duration(cfg.Janitor.MaxAgeHours)*time.Hour, s.GetLogger())
+	j.Delegate("tus", store)
+	j.Start(time.Duration(cfg.Janitor.IntervalMinutes) * time.Minute)
+	s.OnShutdown(j.Stop)
+
+	return nil
+}
+
+// nonceStore picks where nonces of signed requests are kept. Unlike rate
+// limits they don't fall back to memory: a request replayed against another
+// instance would pass there.
+func nonceStore(s *api.Server) (auth.NonceStore, error) {
+	cfg := s.GetConfig()
+	if cfg.Security.HMAC.NonceStore != "cache" {
+		return auth.NewNonceCache(cfg.Security.HMAC.NonceCacheSize), nil
+	}
+
+	if cfg.Advanced.CacheEndpoint == "" {
+		return nil, errors.New("hmac: nonce_store is cache but advanced.cache_endpoint is not set")
+	}
+	opts, err := resp.ParseURL(cfg.Advanced.CacheEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("hmac: %w", err)
+	}
+	client := resp.NewClient(opts)
+	s.OnShutdown(client.Close)
+	return auth.NewRedisNonces(client, "noverna:nonce:"), nil
+}
@@ -0,0 +1,291 @@
+package uploads
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"noverna.de/m/v2/internal/api"
+	"noverna.de/m/v2/internal/api/routes/files"
+	"noverna.de/m/v2/internal/auth"
+	filesvc "noverna.de/m/v2/internal/files"
+	"noverna.de/m/v2/internal/tus"
+)
+
+const extensions = "creation,termination,expiration"
+
+// Register mounts the tus 1.0 endpoints under /v1/uploads
+func Register(s *api.Server, svc *filesvc.Service, store *tus.Store) {
+	h := &handler{s: s, svc: svc, store: store}
+
+	s.Route("/v1/uploads", func(r chi.Router) {
+		r.Use(h.tusHeaders)
+		r.Use(s.RequireScopes(auth.ScopeFilesWrite))
+		r.Options("/", h.options)
+		r.Post("/", h.create)
+		r.Options("/{id}", h.options)
+		r.Head("/{id}", h.head)
+		r.Patch("/{id}", h.patch)
+		r.Delete("/{id}", h.terminate)
+	})
+}
+
+type handler struct {
+	s     *api.Server
+	svc   *filesvc.Service
+	store *tus.Store
+}
+
+// tusHeaders sets the protocol headers and rejects clients speaking another version
+func (h *handler) tusHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tus.Version)
+
+		if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != tus.Version {
+			w.Header().Set("Tus-Version", tus.Version)
+			h.s.WriteJSONError(w, http.StatusPreconditionFailed, "unsupported tus version")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *handler) options(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", tus.Version)
+	w.Header().Set("Tus-Extension", extensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.svc.MaxFileSize(), 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) create(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		h.s.WriteJSONError(w, http.StatusBadRequest, "missing or invalid Upload-Length header")
+		return
+	}
+	if length == 0 {
+		h.s.WriteJSONError(w, http.StatusBadRequest, filesvc.ErrEmpty.Error())
+		return
+	}
+	if length > h.svc.MaxFileSize() {
+		h.s.WriteJSONError(w, http.StatusRequestEntityTooLarge, filesvc.ErrTooLarge.Error())
+		return
+	}
+
+	metadata, err := tus.ParseMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		h.s.WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Fail early if the client already tells us the type won't be accepted
+	if filetype := metadata["filetype"]; filetype != "" && !h.svc.IsAllowed(filetype) {
+		h.s.WriteJSONError(w, http.StatusUnsupportedMediaType, filesvc.ErrTypeNotAllowed.Error()+": "+filetype)
+		return
+	}
+
+	// Catch a bad expiry now rather than after all bytes were sent
+	expiresAt, err := filesvc.ParseExpiry(metadata["expires_at"], metadata["ttl"], time.Now())
+	if err == nil && expiresAt != nil && !expiresAt.After(time.Now()) {
+		err = fmt.Errorf("%w: expiry is in the past", filesvc.ErrInvalidExpiry)
+	}
+	if err != nil {
+		h.s.WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// The session remembers the namespace, finish takes it from there
+	namespace, err := files.BoundNamespace(r, metadata["namespace"])
+	if err != nil {
+		files.WriteUploadError(h.s, w, err)
+		return
+	}
+	if namespace != "" {
+		metadata["namespace"] = namespace
+	}
+
+	owner := auth.Owner(r.Context())
+	if err := h.svc.CheckQuota(owner, length); err != nil {
+		files.WriteUploadError(h.s, w, err)
+		return
+	}
+
+	info, err := h.store.Create(length, owner, metadata)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "/v1/uploads/"+info.ID)
+	w.Header().Set("Upload-Expires", info.ExpiresAt.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *handler) head(w http.ResponseWriter, r *http.Request) {
+	info, err := h.session(r)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	h.writeOffset(w, info)
+	w.Header().Set("Upload-Length", strconv.FormatInt(info.Length, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *handler) patch(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		h.s.WriteJSONError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		h.s.WriteJSONError(w, http.StatusBadRequest, "missing or invalid Upload-Offset header")
+		return
+	}
+
+	info, err := h.session(r)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	// An empty final chunk, sent again because its response got lost or
+	// while another request is still finishing the upload, has nothing to
+	// append. It goes straight to finish and gets the same file.
+	if !(info.Done() && offset == info.Offset && r.ContentLength == 0) {
+		info, err = h.store.Append(r.Context(), id, offset, r.Body)
+		if err != nil {
+			h.writeError(w, err)
+			return
+		}
+	}
+
+	if info.Done() {
+		fileID, err := h.finish(r, info)
+		if err != nil {
+			h.writeError(w, err)
+			return
+		}
+		w.Header().Set("X-File-Id", fileID)
+	}
+
+	h.writeOffset(w, info)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finish hands a complete upload to the files service, the same path a
+// multipart upload takes
+func (h *handler) finish(r *http.Request, info *tus.Info) (string, error) {
+	unlock, err := h.store.LockWait(r.Context(), info.ID)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	// Another request may have finished it while we waited for the lock
+	current, err := h.store.Get(info.ID)
+	if err != nil {
+		return "", err
+	}
+	if current.FileID != "" {
+		return current.FileID, nil
+	}
+
+	part, err := h.store.Open(info.ID)
+	if err != nil {
+		return "", err
+	}
+	defer part.Close()
+
+	// tus has no query or form fields, options travel in Upload-Metadata
+	keep, _ := strconv.ParseBool(info.Metadata["keep_metadata"])
+	// A ttl counts from when the upload completes
+	expiresAt, err := filesvc.ParseExpiry(info.Metadata["expires_at"], info.Metadata["ttl"], time.Now())
+	if err != nil {
+		return "", err
+	}
+	upload := filesvc.Upload{
+		Name:         info.Metadata["filename"],
+		DeclaredType: info.Metadata["filetype"],
+		Namespace:    info.Metadata["namespace"],
+		Owner:        info.Owner,
+		Tags:         strings.Split(info.Metadata["tags"], ","),
+		ExpiresAt:    expiresAt,
+		KeepMetadata: keep,
+	}
+
+	file, err := h.svc.Ingest(r.Context(), upload, part)
+	if err != nil {
+		if filesvc.IsRejected(err) {
+			// The content itself was rejected, resuming won't change that
+			h.store.Abort(info.ID)
+		}
+		return "", err
+	}
+
+	if err := h.store.Complete(info.ID, file.ID); err != nil {
+		h.s.GetLogger().Error("Failed to complete upload session", map[string]any{
+			"upload_id": info.ID,
+			"error":     err.Error(),
+		})
+	}
+	return file.ID, nil
+}
+
+func (h *handler) terminate(w http.ResponseWriter, r *http.Request) {
+	if _, err := h.session(r); err != nil {
+		h.writeError(w, err)
+		return
+	}
+	if err := h.store.Delete(chi.URLParam(r, "id")); err != nil {
+		h.writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// session loads the upload named in the URL. Sessions of other owners are
+// not found, so their ids can't be probed.
+func (h *handler) session(r *http.Request) (*tus.Info, error) {
+	info, err := h.store.Get(chi.URLParam(r, "id"))
+	if err != nil {
+		return nil, err
+	}
+	if info.Owner != auth.Owner(r.Context()) {
+		return nil, tus.ErrNotFound
+	}
+	return info, nil
+}
+
+func (h *handler) writeOffset(w http.ResponseWriter, info *tus.Info) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+	w.Header().Set("Upload-Expires", info.ExpiresAt.Format(http.TimeFormat))
+	if info.FileID != "" {
+		w.Header().Set("X-File-Id", info.FileID)
+	}
+}
+
+func (h *handler) writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, tus.ErrNotFound):
+		h.s.WriteJSONError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, tus.ErrExpired):
+		h.s.WriteJSONError(w, http.StatusGone, err.Error())
+	case errors.Is(err, tus.ErrOffsetMismatch), errors.Is(err, tus.ErrCompleted):
+		h.s.WriteJSONError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, tus.ErrLocked):
+		h.s.WriteJSONError(w, http.StatusLocked, err.Error())
+	case errors.Is(err, tus.ErrExceedsLength):
+		h.s.WriteJSONError(w, http.StatusRequestEntityTooLarge, err.Error())
+	default:
+		files.WriteUploadError(h.s, w, err)
+	}
+}
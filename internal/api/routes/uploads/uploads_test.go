@@ -0,0 +1,155 @@
+package uploads
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"noverna.de/m/v2/internal/api"
+	"noverna.de/m/v2/internal/config"
+	filesvc "noverna.de/m/v2/internal/files"
+	"noverna.de/m/v2/internal/kv"
+	"noverna.de/m/v2/internal/logger"
+	"noverna.de/m/v2/internal/storage"
+	"noverna.de/m/v2/internal/tus"
+)
+
+func newServer(t *testing.T) (http.Handler, *tus.Store) {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &config.Config{
+		Server:     config.Server{DataDir: dir, TempDir: filepath.Join(dir, "tmp")},
+		Uploads:    config.Uploads{MAX_FILE_SIZE: 1, AllowedTypes: []string{"text/plain"}},
+		Trash:      config.Trash{RetentionHours: 1, ReapIntervalMinutes: 60},
+		Versioning: config.Versioning{MaxVersions: 1},
+		Expiry:     config.Expiry{GCIntervalMinutes: 60},
+		Security: config.Security{
+			RateLimitPerMinute:  -1,
+			RateLimitMaxClients: 100,
+			AuthRateLimit:       -1,
+		},
+	}
+	log := logger.NewLogger().SetOutput(io.Discard)
+
+	db, err := kv.Open(filepath.Join(dir, "files.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc, err := filesvc.NewService(cfg, log, storage.NewMemory(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		svc.Close(context.Background())
+		db.Close()
+	})
+	store, err := tus.NewStore(filepath.Join(cfg.Server.TempDir, "tus"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := api.NewServer(cfg, log)
+	Register(s, svc, store)
+	return s.GetRouter(), store
+}
+
+func do(h http.Handler, method, target string, headers map[string]string, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	r.Header.Set("Tus-Resumable", tus.Version)
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func create(t *testing.T, h http.Handler, length int) string {
+	t.Helper()
+	w := do(h, http.MethodPost, "/v1/uploads/", map[string]string{"Upload-Length": strconv.Itoa(length)}, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	return w.Header().Get("Location")
+}
+
+func patch(h http.Handler, location string, offset int, chunk string) *httptest.ResponseRecorder {
+	return do(h, http.MethodPatch, location, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": strconv.Itoa(offset),
+	}, []byte(chunk))
+}
+
+func TestUpload(t *testing.T) {
+	h, _ := newServer(t)
+	location := create(t, h, 11)
+
+	if w := patch(h, location, 0, "hello "); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "6" {
+		t.Fatalf("first chunk: %d, offset %s", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	if w := patch(h, location, 0, "hello "); w.Code != http.StatusConflict {
+		t.Fatalf("stale offset: %d, want 409", w.Code)
+	}
+	w := patch(h, location, 6, "world")
+	fileID := w.Header().Get("X-File-Id")
+	if w.Code != http.StatusNoContent || fileID == "" {
+		t.Fatalf("last chunk: %d %s, file %q", w.Code, w.Body, fileID)
+	}
+
+	// The final chunk sent again because its response got lost
+	if w := patch(h, location, 11, ""); w.Code != http.StatusNoContent || w.Header().Get("X-File-Id") != fileID {
+		t.Fatalf("retried final chunk: %d, file %q, want %s", w.Code, w.Header().Get("X-File-Id"), fileID)
+	}
+	if w := patch(h, location, 11, "!"); w.Code != http.StatusConflict {
+		t.Fatalf("bytes after completion: %d, want 409", w.Code)
+	}
+	if w := do(h, http.MethodHead, location, nil, nil); w.Header().Get("X-File-Id") != fileID {
+		t.Fatalf("head: file %q, want %s", w.Header().Get("X-File-Id"), fileID)
+	}
+}
+
+func TestConcurrentFinish(t *testing.T) {
+	h, store := newServer(t)
+	location := create(t, h, 5)
+	id := strings.TrimPrefix(location, "/v1/uploads/")
+
+	// All bytes are in but the request that sent them is still finishing
+	if _, err := store.Append(context.Background(), id, 0, strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := store.Lock(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responses := make([]*httptest.ResponseRecorder, 3)
+	var wg sync.WaitGroup
+	for i := range responses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i] = patch(h, location, 5, "")
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	unlock()
+	wg.Wait()
+
+	fileID := responses[0].Header().Get("X-File-Id")
+	for i, w := range responses {
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("request %d: %d %s, want to wait for the lock", i, w.Code, w.Body)
+		}
+		if got := w.Header().Get("X-File-Id"); got == "" || got != fileID {
+			t.Errorf("request %d got file %q, want %q", i, got, fileID)
+		}
+	}
+}
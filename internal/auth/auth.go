@@ -0,0 +1,132 @@
+// Package auth identifies who is calling the API and what they may do
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"slices"
+)
+
+var (
+	ErrInvalidKey = errors.New("invalid API key")
+	ErrKeyExpired = errors.New("API key has expired")
+	ErrKeyRevoked = errors.New("API key has been revoked")
+)
+
+// Scopes a key can be granted
+const (
+	ScopeFilesRead  = "files:read"
+	ScopeFilesWrite = "files:write"
+	// ScopeAdmin includes every other scope
+	ScopeAdmin = "admin"
+)
+
+// Scopes lists every known scope
+var Scopes = []string{ScopeFilesRead, ScopeFilesWrite, ScopeAdmin}
+
+// Identity is the caller behind a request
+type Identity struct {
+	// Owner is what files and usage are recorded under
+	Owner string
+	KeyID string
+	// Subject is the verified sub of a JWT
+	Subject string
+	Scopes  []string
+	// Namespace limits the caller to one namespace, "" allows all
+	Namespace string
+}
+
+// HasScope reports whether the identity was granted scope
+func (i *Identity) HasScope(scope string) bool {
+	return slices.Contains(i.Scopes, ScopeAdmin) || slices.Contains(i.Scopes, scope)
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a context for requests made by id
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext returns the caller of a request, nil if it is anonymous
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
+
+// Owner returns who the request is made for, "" if it is anonymous
+func Owner(ctx context.Context) string {
+	if id := FromContext(ctx); id != nil {
+		return id.Owner
+	}
+	return ""
+}
+
+// Name is how the caller appears in logs: the JWT subject or the owner of the API key
+func (i *Identity) Name() string {
+	if i.Subject != "" {
+		return i.Subject
+	}
+	return i.Owner
+}
+
+// KeyID derives the owner name of an API key. Records and logs only ever
+// see this, never the key itself.
+func KeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "key-" + hex.EncodeToString(sum[:8])
+}
+
+// Authenticator checks the credentials callers present: the static key from
+// the config file, which has every scope, the keys in the registry, JWTs and
+// signed requests
+type Authenticator struct {
+	static   [sha256.Size]byte
+	hasKey   bool
+	registry *Registry
+	jwt      *JWTVerifier
+	hmac     *HMACVerifier
+}
+
+// NewAuthenticator accepts staticKey if it is not empty, every valid key in
+// registry, every valid JWT and every validly signed request if those are not nil
+func NewAuthenticator(staticKey string, registry *Registry, jwt *JWTVerifier, hmac *HMACVerifier) *Authenticator {
+	return &Authenticator{
+		static:   sha256.Sum256([]byte(staticKey)),
+		hasKey:   staticKey != "",
+		registry: registry,
+		jwt:      jwt,
+		hmac:     hmac,
+	}
+}
+
+// AuthenticateRequest resolves the signature of a signed request to the
+// identity of its key
+func (a *Authenticator) AuthenticateRequest(r *http.Request) (*Identity, error) {
+	if a.hmac == nil {
+		return nil, ErrInvalidSignature
+	}
+	return a.hmac.Verify(r)
+}
+
+// Authenticate resolves a presented key to the identity behind it
+func (a *Authenticator) Authenticate(key string) (*Identity, error) {
+	if a.hasKey {
+		// Comparing digests keeps the comparison constant time regardless of key length
+		digest := sha256.Sum256([]byte(key))
+		if subtle.ConstantTimeCompare(digest[:], a.static[:]) == 1 {
+			return &Identity{Owner: KeyID(key), Scopes: []string{ScopeAdmin}}, nil
+		}
+	}
+	if a.jwt != nil && LooksLikeJWT(key) {
+		return a.jwt.Verify(key)
+	}
+	if a.registry == nil {
+		return nil, ErrInvalidKey
+	}
+	return a.registry.Verify(key)
+}
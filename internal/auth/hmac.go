@@ -0,0 +1,300 @@
+package auth
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"noverna.de/m/v2/internal/config"
+	"noverna.de/m/v2/internal/resp"
+	"noverna.de/m/v2/pkg/hmacsign"
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid request signature")
+	ErrStaleRequest     = errors.New("request date is outside the allowed clock skew")
+	ErrReplayedRequest  = errors.New("request nonce has already been used")
+	ErrBodyMismatch     = errors.New("request body does not match its signed hash")
+	ErrNonceUnavailable = errors.New("request nonce could not be checked")
+	ErrBodyTooLarge     = errors.New("request body is too large to verify")
+)
+
+// Bodies up to this size are verified in memory, larger ones in a temp file
+const maxMemoryBody = 1 << 20
+
+var (
+	keyIDFormat = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+	nonceFormat = regexp.MustCompile(`^[A-Za-z0-9_-]{16,128}$`)
+	hashFormat  = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// NonceStore remembers nonces. Add reports false if nonce was seen within ttl.
+type NonceStore interface {
+	Add(ctx context.Context, nonce string, ttl time.Duration) (bool, error)
+}
+
+type hmacKey struct {
+	secret   []byte
+	identity Identity
+}
+
+// HMACVerifier checks requests signed with hmacsign by the services listed
+// in the config
+type HMACVerifier struct {
+	keys     map[string]hmacKey
+	skew     time.Duration
+	nonces   NonceStore
+	spoolDir string
+	maxBody  int64
+}
+
+// NewHMACVerifier loads the secret of every key in cfg. Bodies are read in
+// full and checked before a request is let through, bodies larger than
+// maxBody are refused and large ones are held in a temp file in spoolDir.
+func NewHMACVerifier(cfg config.HMAC, nonces NonceStore, spoolDir string, maxBody int64) (*HMACVerifier, error) {
+	v := &HMACVerifier{
+		keys:     make(map[string]hmacKey, len(cfg.Keys)),
+		skew:     time.Duration(cfg.MaxSkewSeconds) * time.Second,
+		nonces:   nonces,
+		spoolDir: spoolDir,
+		maxBody:  maxBody,
+	}
+	if v.skew <= 0 {
+		return nil, errors.New("hmac: max_skew_seconds must be positive")
+	}
+
+	for id, key := range cfg.Keys {
+		if !keyIDFormat.MatchString(id) {
+			return nil, fmt.Errorf("hmac: invalid key id %q", id)
+		}
+		if key.SecretFile == "" {
+			return nil, fmt.Errorf("hmac: key %q needs a secret_file", id)
+		}
+		secret, err := os.ReadFile(key.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("hmac: read secret of %q: %w", id, err)
+		}
+		secret = bytes.TrimSpace(secret)
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("hmac: secret of %q must be at least 32 bytes", id)
+		}
+		for _, scope := range key.Scopes {
+			if !slices.Contains(Scopes, scope) {
+				return nil, fmt.Errorf("hmac: key %q has unknown scope %q", id, scope)
+			}
+		}
+
+		v.keys[id] = hmacKey{
+			secret: secret,
+			identity: Identity{
+				Owner:     "hmac-" + id,
+				KeyID:     id,
+				Scopes:    key.Scopes,
+				Namespace: key.Namespace,
+			},
+		}
+	}
+	return v, nil
+}
+
+// Verify checks the signature of r and returns the identity of its key. The
+// body is read up front and checked against the signed hash, so handlers
+// never see a byte of a tampered body. It is replaced by a copy the caller
+// has to close once the request is done.
+func (v *HMACVerifier) Verify(r *http.Request) (*Identity, error) {
+	authz, err := hmacsign.ParseAuthorization(r.Header.Get("Authorization"))
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	key, ok := v.keys[authz.KeyID]
+	if !ok || !slices.Contains(authz.SignedHeaders, "host") {
+		return nil, ErrInvalidSignature
+	}
+
+	nonce := r.Header.Get(hmacsign.HeaderNonce)
+	bodyHash := r.Header.Get(hmacsign.HeaderContentSHA256)
+	if !nonceFormat.MatchString(nonce) || !hashFormat.MatchString(bodyHash) {
+		return nil, ErrInvalidSignature
+	}
+
+	expected := hmacsign.Sign(key.secret, hmacsign.StringToSign(r, authz.SignedHeaders))
+	if !hmac.Equal(expected, authz.Signature) {
+		return nil, ErrInvalidSignature
+	}
+
+	// The date is signed, so it is only checked once the signature holds
+	unix, err := strconv.ParseInt(r.Header.Get(hmacsign.HeaderDate), 10, 64)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	if offset := time.Since(time.Unix(unix, 0)); offset > v.skew || offset < -v.skew {
+		return nil, ErrStaleRequest
+	}
+
+	// A nonce has to be kept for as long as a request carrying it could
+	// still pass the date check, from either side of the skew
+	fresh, err := v.nonces.Add(r.Context(), authz.KeyID+":"+nonce, 2*v.skew)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNonceUnavailable, err)
+	}
+	if !fresh {
+		return nil, ErrReplayedRequest
+	}
+
+	if r.Body == nil || r.Body == http.NoBody {
+		if bodyHash != hmacsign.EmptySHA256 {
+			return nil, ErrBodyMismatch
+		}
+		identity := key.identity
+		return &identity, nil
+	}
+
+	body, size, err := v.spool(r.Body, r.ContentLength, bodyHash)
+	if err != nil {
+		return nil, err
+	}
+	r.Body.Close()
+	r.Body, r.ContentLength = body, size
+
+	identity := key.identity
+	return &identity, nil
+}
+
+// spool reads body to the end, hashing it on the way, and returns a copy to
+// read from once the hash matched
+func (v *HMACVerifier) spool(body io.Reader, length int64, expected string) (io.ReadCloser, int64, error) {
+	if length > v.maxBody {
+		return nil, 0, ErrBodyTooLarge
+	}
+
+	hash := sha256.New()
+	limited := io.LimitReader(io.TeeReader(body, hash), v.maxBody+1)
+
+	head, err := io.ReadAll(io.LimitReader(limited, maxMemoryBody+1))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(head) <= maxMemoryBody {
+		if int64(len(head)) > v.maxBody {
+			return nil, 0, ErrBodyTooLarge
+		}
+		if hex.EncodeToString(hash.Sum(nil)) != expected {
+			return nil, 0, ErrBodyMismatch
+		}
+		return io.NopCloser(bytes.NewReader(head)), int64(len(head)), nil
+	}
+
+	f, err := os.CreateTemp(v.spoolDir, "signed-body-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	spooled := &spooledBody{f}
+	n, err := io.Copy(f, io.MultiReader(bytes.NewReader(head), limited))
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	switch {
+	case err != nil:
+	case n > v.maxBody:
+		err = ErrBodyTooLarge
+	case hex.EncodeToString(hash.Sum(nil)) != expected:
+		err = ErrBodyMismatch
+	}
+	if err != nil {
+		spooled.Close()
+		return nil, 0, err
+	}
+	return spooled, n, nil
+}
+
+// spooledBody removes its temp file when it is closed
+type spooledBody struct {
+	*os.File
+}
+
+func (b *spooledBody) Close() error {
+	err := b.File.Close()
+	os.Remove(b.File.Name())
+	return err
+}
+
+// NonceCache keeps nonces in memory. Only the most recent ones are kept, so
+// it should hold more than the requests expected within twice the skew.
+type NonceCache struct {
+	max int
+
+	mu   sync.Mutex
+	seen map[string]*list.Element
+	// Oldest at the front, every nonce lives equally long so this is also
+	// the order they expire in
+	order *list.List
+}
+
+type nonceEntry struct {
+	nonce   string
+	expires time.Time
+}
+
+// NewNonceCache creates a cache holding at most size nonces
+func NewNonceCache(size int) *NonceCache {
+	return &NonceCache{
+		max:   max(size, 1),
+		seen:  make(map[string]*list.Element),
+		order: list.New(),
+	}
+}
+
+// Add records nonce for ttl, it never fails
+func (c *NonceCache) Add(_ context.Context, nonce string, ttl time.Duration) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for front := c.order.Front(); front != nil; front = c.order.Front() {
+		entry := front.Value.(*nonceEntry)
+		if now.Before(entry.expires) && c.order.Len() < c.max {
+			break
+		}
+		c.order.Remove(front)
+		delete(c.seen, entry.nonce)
+	}
+
+	if _, ok := c.seen[nonce]; ok {
+		return false, nil
+	}
+	c.seen[nonce] = c.order.PushBack(&nonceEntry{nonce: nonce, expires: now.Add(ttl)})
+	return true, nil
+}
+
+// RedisNonces keeps nonces in a Redis compatible server, so a request can't
+// be replayed against another instance
+type RedisNonces struct {
+	client *resp.Client
+	prefix string
+}
+
+func NewRedisNonces(client *resp.Client, prefix string) *RedisNonces {
+	return &RedisNonces{client: client, prefix: prefix}
+}
+
+func (n *RedisNonces) Add(ctx context.Context, nonce string, ttl time.Duration) (bool, error) {
+	reply, err := n.client.Do(ctx, "SET", n.prefix+nonce, "1", "NX", "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return false, err
+	}
+	// SET NX replies OK when it stored the nonce and nil when it was there
+	return reply != nil, nil
+}
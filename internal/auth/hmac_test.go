@@ -0,0 +1,345 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"noverna.de/m/v2/internal/config"
+	"noverna.de/m/v2/internal/resp"
+	"noverna.de/m/v2/internal/resp/resptest"
+	"noverna.de/m/v2/pkg/hmacsign"
+)
+
+var testSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func newVerifier(t *testing.T, maxBody int64) *HMACVerifier {
+	t.Helper()
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "backend.key")
+	if err := os.WriteFile(secretFile, append(testSecret, '\n'), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := NewHMACVerifier(config.HMAC{
+		MaxSkewSeconds: 300,
+		Keys: map[string]config.HMACKey{
+			"backend": {SecretFile: secretFile, Scopes: []string{ScopeFilesWrite}, Namespace: "avatars"},
+		},
+	}, NewNonceCache(100), dir, maxBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func signed(t *testing.T, method, target string, body []byte) *http.Request {
+	t.Helper()
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	signer := &hmacsign.Signer{KeyID: "backend", Secret: testSecret}
+	if err := signer.Sign(r); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// resign signs r again after its headers were changed
+func resign(r *http.Request, secret []byte) {
+	signature := hmacsign.Sign(secret, hmacsign.StringToSign(r, []string{"host"}))
+	r.Header.Set("Authorization", fmt.Sprintf("%s KeyId=backend, SignedHeaders=host, Signature=%x", hmacsign.Scheme, signature))
+}
+
+func TestHMACVerify(t *testing.T) {
+	body := []byte("hello world")
+
+	tests := []struct {
+		name    string
+		request func(t *testing.T) *http.Request
+		wantErr error
+	}{
+		{
+			name:    "valid",
+			request: func(t *testing.T) *http.Request { return signed(t, http.MethodPost, "/v1/files?a=1", body) },
+		},
+		{
+			name:    "no body",
+			request: func(t *testing.T) *http.Request { return signed(t, http.MethodGet, "/v1/files", nil) },
+		},
+		{
+			name: "tampered path",
+			request: func(t *testing.T) *http.Request {
+				r := signed(t, http.MethodPost, "/v1/files", body)
+				r.URL.Path = "/v1/admin/keys"
+				return r
+			},
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name: "tampered query",
+			request: func(t *testing.T) *http.Request {
+				r := signed(t, http.MethodPost, "/v1/files?a=1", body)
+				r.URL.RawQuery = "a=2"
+				return r
+			},
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name: "tampered host",
+			request: func(t *testing.T) *http.Request {
+				r := signed(t, http.MethodPost, "/v1/files", body)
+				r.Host = "other.test"
+				return r
+			},
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name: "wrong secret",
+			request: func(t *testing.T) *http.Request {
+				r := signed(t, http.MethodPost, "/v1/files", body)
+				resign(r, []byte("another secret, also 32 bytes long"))
+				return r
+			},
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name: "unknown key",
+			request: func(t *testing.T) *http.Request {
+				r := signed(t, http.MethodPost, "/v1/files", body)
+				r.Header.Set("Authorization", strings.Replace(r.Header.Get("Authorization"), "KeyId=backend", "KeyId=other", 1))
+				return r
+			},
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name: "host not signed",
+			request: func(t *testing.T) *http.Request {
+				r := signed(t, http.MethodPost, "/v1/files", body)
+				sts := hmacsign.StringToSign(r, []string{"content-length"})
+				r.Header.Set("Authorization", fmt.Sprintf("%s KeyId=backend, SignedHeaders=content-length, Signature=%x",
+					hmacsign.Scheme, hmacsign.Sign(testSecret, sts)))
+				return r
+			},
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name: "short nonce",
+			request: func(t *testing.T) *http.Request {
+				r := signed(t, http.MethodPost, "/v1/files", body)
+				r.Header.Set(hmacsign.HeaderNonce, "abc")
+				resign(r, testSecret)
+				return r
+			},
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name: "stale",
+			request: func(t *testing.T) *http.Request {
+				r := signed(t, http.MethodPost, "/v1/files", body)
+				r.Header.Set(hmacsign.HeaderDate, strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10))
+				resign(r, testSecret)
+				return r
+			},
+			wantErr: ErrStaleRequest,
+		},
+		{
+			name: "from the future",
+			request: func(t *testing.T) *http.Request {
+				r := signed(t, http.MethodPost, "/v1/files", body)
+				r.Header.Set(hmacsign.HeaderDate, strconv.FormatInt(time.Now().Add(10*time.Minute).Unix(), 10))
+				resign(r, testSecret)
+				return r
+			},
+			wantErr: ErrStaleRequest,
+		},
+		{
+			name: "swapped body",
+			request: func(t *testing.T) *http.Request {
+				r := signed(t, http.MethodPost, "/v1/files", body)
+				r.Body = io.NopCloser(strings.NewReader("hello WORLD"))
+				return r
+			},
+			wantErr: ErrBodyMismatch,
+		},
+		{
+			name: "body where none was signed",
+			request: func(t *testing.T) *http.Request {
+				r := signed(t, http.MethodPost, "/v1/files", nil)
+				r.Body = io.NopCloser(strings.NewReader("surprise"))
+				return r
+			},
+			wantErr: ErrBodyMismatch,
+		},
+		{
+			name: "body dropped",
+			request: func(t *testing.T) *http.Request {
+				r := signed(t, http.MethodPost, "/v1/files", body)
+				r.Body = http.NoBody
+				return r
+			},
+			wantErr: ErrBodyMismatch,
+		},
+		{
+			name: "swapped chunked body",
+			request: func(t *testing.T) *http.Request {
+				r := signed(t, http.MethodPost, "/v1/files", body)
+				r.ContentLength = -1
+				r.Body = io.NopCloser(strings.NewReader("hello WORLD"))
+				return r
+			},
+			wantErr: ErrBodyMismatch,
+		},
+		{
+			name: "declared too large",
+			request: func(t *testing.T) *http.Request {
+				r := signed(t, http.MethodPost, "/v1/files", body)
+				r.ContentLength = 1 << 40
+				return r
+			},
+			wantErr: ErrBodyTooLarge,
+		},
+		{
+			name: "chunked and too large",
+			request: func(t *testing.T) *http.Request {
+				large := bytes.Repeat([]byte("x"), 4<<20)
+				r := signed(t, http.MethodPost, "/v1/files", large)
+				r.ContentLength = -1
+				return r
+			},
+			wantErr: ErrBodyTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newVerifier(t, 2<<20)
+			r := tt.request(t)
+			identity, err := v.Verify(r)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer r.Body.Close()
+			if identity.Owner != "hmac-backend" || identity.Namespace != "avatars" || !identity.HasScope(ScopeFilesWrite) {
+				t.Errorf("identity %+v", identity)
+			}
+		})
+	}
+}
+
+func TestHMACVerifyReplay(t *testing.T) {
+	v := newVerifier(t, 1<<20)
+	r := signed(t, http.MethodPost, "/v1/files", []byte("hello"))
+	replay := r.Clone(context.Background())
+	replay.Body = io.NopCloser(strings.NewReader("hello"))
+
+	if _, err := v.Verify(r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Verify(replay); !errors.Is(err, ErrReplayedRequest) {
+		t.Fatalf("replay: err = %v, want ErrReplayedRequest", err)
+	}
+}
+
+func TestHMACVerifySpooledBody(t *testing.T) {
+	for _, size := range []int{maxMemoryBody, maxMemoryBody + 1, 3 << 20} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			v := newVerifier(t, 4<<20)
+			body := bytes.Repeat([]byte("0123456789"), size/10+1)[:size]
+
+			r := signed(t, http.MethodPut, "/v1/files/1", body)
+			r.ContentLength = -1
+			if _, err := v.Verify(r); err != nil {
+				t.Fatal(err)
+			}
+			if r.ContentLength != int64(size) {
+				t.Errorf("content length %d, want the spooled size %d", r.ContentLength, size)
+			}
+			got, err := io.ReadAll(r.Body)
+			if err != nil || !bytes.Equal(got, body) {
+				t.Fatalf("read %d bytes back, %v", len(got), err)
+			}
+			r.Body.Close()
+
+			// A tampered last byte is caught before anything is handed on
+			tampered := signed(t, http.MethodPut, "/v1/files/1", body)
+			tampered.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body[:size-1]), strings.NewReader("!")))
+			if _, err := v.Verify(tampered); !errors.Is(err, ErrBodyMismatch) {
+				t.Fatalf("tampered: err = %v, want ErrBodyMismatch", err)
+			}
+
+			entries, _ := os.ReadDir(v.spoolDir)
+			for _, entry := range entries {
+				if strings.HasPrefix(entry.Name(), "signed-body-") {
+					t.Errorf("%s left behind", entry.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	ctx := context.Background()
+	cache := NewNonceCache(3)
+
+	for _, nonce := range []string{"a", "b", "c"} {
+		if fresh, _ := cache.Add(ctx, nonce, time.Hour); !fresh {
+			t.Fatalf("%s reported as seen", nonce)
+		}
+	}
+	if fresh, _ := cache.Add(ctx, "b", time.Hour); fresh {
+		t.Fatal("b accepted twice")
+	}
+
+	// A full cache drops the oldest nonce
+	cache.Add(ctx, "d", time.Hour)
+	if fresh, _ := cache.Add(ctx, "a", time.Hour); !fresh {
+		t.Error("a should have been evicted")
+	}
+	if fresh, _ := cache.Add(ctx, "d", time.Hour); fresh {
+		t.Error("d was evicted before older nonces")
+	}
+
+	// Expired nonces are dropped
+	short := NewNonceCache(10)
+	short.Add(ctx, "x", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if fresh, _ := short.Add(ctx, "x", time.Hour); !fresh {
+		t.Error("expired nonce still counted as seen")
+	}
+}
+
+func TestRedisNonces(t *testing.T) {
+	ctx := context.Background()
+	server := resptest.NewServer()
+	defer server.Close()
+	client := resp.NewClient(resp.Options{Addr: server.Addr, DialTimeout: time.Second, MaxIdle: 1})
+	defer client.Close(ctx)
+	nonces := NewRedisNonces(client, "test:nonce:")
+
+	if fresh, err := nonces.Add(ctx, "backend:abc", 10*time.Minute); err != nil || !fresh {
+		t.Fatalf("first add: %v, %v", fresh, err)
+	}
+	if fresh, err := nonces.Add(ctx, "backend:abc", 10*time.Minute); err != nil || fresh {
+		t.Fatalf("second add: %v, %v, want seen", fresh, err)
+	}
+	if ttl := server.TTL("test:nonce:backend:abc"); ttl <= 9*time.Minute || ttl > 10*time.Minute {
+		t.Errorf("nonce kept for %v", ttl)
+	}
+
+	server.SetUnavailable(true)
+	if _, err := nonces.Add(ctx, "backend:def", time.Minute); err == nil {
+		t.Fatal("add succeeded without a server")
+	}
+}
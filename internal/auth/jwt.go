@@ -0,0 +1,302 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-chi/jwtauth"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jws"
+	"github.com/lestrrat-go/jwx/jwt"
+
+	"noverna.de/m/v2/internal/config"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token has expired")
+)
+
+// JWTVerifier checks bearer JWTs and maps their claims onto an Identity
+type JWTVerifier struct {
+	cfg config.JWT
+	// Verifiers by key id, "" holds the key used for tokens without a kid
+	auths  map[string]jwtKey
+	leeway time.Duration
+}
+
+// jwtKey is a verifier together with the one algorithm it accepts
+type jwtKey struct {
+	alg  string
+	auth *jwtauth.JWTAuth
+}
+
+// NewJWTVerifier loads the keys named in cfg. Either a single key from
+// secret_file or public_key_file, or every key of a local JWKS.
+func NewJWTVerifier(cfg config.JWT) (*JWTVerifier, error) {
+	v := &JWTVerifier{
+		cfg:    cfg,
+		auths:  map[string]jwtKey{},
+		leeway: time.Duration(max(cfg.LeewaySeconds, 0)) * time.Second,
+	}
+
+	if cfg.JWKSFile != "" {
+		if err := v.loadJWKS(cfg.JWKSFile); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+
+	key, err := loadKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkKey(cfg.Algorithm, key); err != nil {
+		return nil, err
+	}
+	v.auths[""] = jwtKey{alg: cfg.Algorithm, auth: jwtauth.New(cfg.Algorithm, nil, key)}
+	return v, nil
+}
+
+func loadKey(cfg config.JWT) (any, error) {
+	switch cfg.Algorithm {
+	case "HS256":
+		if cfg.SecretFile == "" {
+			return nil, errors.New("jwt: HS256 needs a secret_file")
+		}
+		secret, err := os.ReadFile(cfg.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("jwt: read secret: %w", err)
+		}
+		return bytes.TrimSpace(secret), nil
+	case "RS256", "ES256":
+		if cfg.PublicKeyFile == "" {
+			return nil, fmt.Errorf("jwt: %s needs a public_key_file or jwks_file", cfg.Algorithm)
+		}
+		return loadPublicKey(cfg.PublicKeyFile)
+	default:
+		return nil, fmt.Errorf("jwt: unsupported algorithm %q", cfg.Algorithm)
+	}
+}
+
+// loadPublicKey reads a PEM encoded public key or certificate
+func loadPublicKey(path string) (any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("jwt: read public key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("jwt: %s holds no PEM data", path)
+	}
+
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("jwt: parse certificate: %w", err)
+		}
+		return cert.PublicKey, nil
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("jwt: parse public key: %w", err)
+		}
+		return key, nil
+	}
+}
+
+func (v *JWTVerifier) loadJWKS(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("jwt: read jwks: %w", err)
+	}
+	set, err := jwk.Parse(data)
+	if err != nil {
+		return fmt.Errorf("jwt: parse jwks: %w", err)
+	}
+
+	for i := 0; i < set.Len(); i++ {
+		key, _ := set.Get(i)
+		alg := key.Algorithm()
+		if alg == "" {
+			alg = v.cfg.Algorithm
+		}
+
+		var raw any
+		if err := key.Raw(&raw); err != nil {
+			return fmt.Errorf("jwt: key %q: %w", key.KeyID(), err)
+		}
+		if err := checkKey(alg, raw); err != nil {
+			return fmt.Errorf("jwt: key %q: %w", key.KeyID(), err)
+		}
+		v.auths[key.KeyID()] = jwtKey{alg: alg, auth: jwtauth.New(alg, nil, raw)}
+	}
+	if len(v.auths) == 0 {
+		return fmt.Errorf("jwt: %s holds no keys", path)
+	}
+	return nil
+}
+
+// checkKey makes sure a key fits the algorithm it is used with
+func checkKey(alg string, key any) error {
+	switch alg {
+	case "HS256":
+		if secret, ok := key.([]byte); !ok || len(secret) < 32 {
+			return errors.New("HS256 needs a secret of at least 32 bytes")
+		}
+	case "RS256":
+		if _, ok := key.(*rsa.PublicKey); !ok {
+			return errors.New("RS256 needs an RSA public key")
+		}
+	case "ES256":
+		if ec, ok := key.(*ecdsa.PublicKey); !ok || ec.Curve != elliptic.P256() {
+			return errors.New("ES256 needs a P-256 public key")
+		}
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	return nil
+}
+
+// LooksLikeJWT tells JWTs apart from API keys without parsing them
+func LooksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Verify checks signature, lifetime, issuer and audience of a token and
+// returns the identity of its subject
+func (v *JWTVerifier) Verify(token string) (*Identity, error) {
+	ja, err := v.verifierFor(token)
+	if err != nil {
+		return nil, err
+	}
+	// Decode only checks the signature, the claims are validated below with leeway
+	parsed, err := ja.Decode(token)
+	if err != nil || parsed == nil {
+		return nil, ErrInvalidToken
+	}
+
+	if parsed.Expiration().IsZero() {
+		return nil, fmt.Errorf("%w: exp is required", ErrInvalidToken)
+	}
+	// jwt.Validate lets tokens without iss through, we don't
+	if v.cfg.Issuer != "" && parsed.Issuer() != v.cfg.Issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer", ErrInvalidToken)
+	}
+	options := []jwt.ValidateOption{jwt.WithAcceptableSkew(v.leeway)}
+	if v.cfg.Audience != "" {
+		options = append(options, jwt.WithAudience(v.cfg.Audience))
+	}
+	if err := jwt.Validate(parsed, options...); err != nil {
+		if errors.Is(jwtauth.ErrorReason(err), jwtauth.ErrExpired) {
+			return nil, ErrTokenExpired
+		}
+		return nil, fmt.Errorf("%w: %s", ErrInvalidToken, err)
+	}
+
+	subject := parsed.Subject()
+	if subject == "" {
+		return nil, fmt.Errorf("%w: sub is required", ErrInvalidToken)
+	}
+	return &Identity{
+		Owner:     "jwt-" + subject,
+		Subject:   subject,
+		Scopes:    v.scopes(parsed),
+		Namespace: v.namespace(parsed),
+	}, nil
+}
+
+// verifierFor picks the key a token was signed with by its kid. The
+// signature is checked with the key's algorithm either way, a header naming
+// another one is still rejected so alg none or HS256 never pass as such.
+func (v *JWTVerifier) verifierFor(token string) (*jwtauth.JWTAuth, error) {
+	msg, err := jws.ParseString(token)
+	if err != nil || len(msg.Signatures()) != 1 {
+		return nil, ErrInvalidToken
+	}
+	headers := msg.Signatures()[0].ProtectedHeaders()
+
+	key, err := v.keyFor(headers.KeyID())
+	if err != nil {
+		return nil, err
+	}
+	if string(headers.Algorithm()) != key.alg {
+		return nil, fmt.Errorf("%w: unexpected algorithm", ErrInvalidToken)
+	}
+	return key.auth, nil
+}
+
+func (v *JWTVerifier) keyFor(kid string) (jwtKey, error) {
+	if key, ok := v.auths[kid]; ok {
+		return key, nil
+	}
+	// Keys without an id, like the one from secret_file or public_key_file, take any token
+	if key, ok := v.auths[""]; ok {
+		return key, nil
+	}
+	// A single key also verifies tokens that don't name it
+	if kid == "" && len(v.auths) == 1 {
+		for _, key := range v.auths {
+			return key, nil
+		}
+	}
+	return jwtKey{}, fmt.Errorf("%w: unknown key", ErrInvalidToken)
+}
+
+// scopes maps the values of the scopes claim, a space separated string or
+// an array. Values in scope_map are translated, known scopes are taken as
+// they are and everything else is ignored.
+func (v *JWTVerifier) scopes(token jwt.Token) []string {
+	claim, ok := token.Get(v.cfg.ScopesClaim)
+	if !ok {
+		return nil
+	}
+
+	var values []string
+	switch claim := claim.(type) {
+	case string:
+		values = strings.Fields(claim)
+	case []any:
+		for _, value := range claim {
+			if s, ok := value.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	var scopes []string
+	for _, value := range values {
+		mapped, ok := v.cfg.ScopeMap[value]
+		if !ok {
+			mapped = []string{value}
+		}
+		for _, scope := range mapped {
+			if slices.Contains(Scopes, scope) && !slices.Contains(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	return scopes
+}
+
+func (v *JWTVerifier) namespace(token jwt.Token) string {
+	if v.cfg.NamespaceClaim == "" {
+		return ""
+	}
+	claim, _ := token.Get(v.cfg.NamespaceClaim)
+	namespace, _ := claim.(string)
+	return strings.ToLower(strings.TrimSpace(namespace))
+}
@@ -0,0 +1,403 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"noverna.de/m/v2/internal/config"
+)
+
+var jwtSecret = []byte("jwt secret of at least 32 bytes!")
+
+// signer produces the signature of a JWT's signing input
+type signer func(t *testing.T, input []byte) []byte
+
+func hs256(secret []byte) signer {
+	return func(t *testing.T, input []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(input)
+		return mac.Sum(nil)
+	}
+}
+
+func hs384(secret []byte) signer {
+	return func(t *testing.T, input []byte) []byte {
+		mac := hmac.New(sha512.New384, secret)
+		mac.Write(input)
+		return mac.Sum(nil)
+	}
+}
+
+func rs256(key *rsa.PrivateKey) signer {
+	return func(t *testing.T, input []byte) []byte {
+		digest := sha256.Sum256(input)
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signature
+	}
+}
+
+func es256(key *ecdsa.PrivateKey) signer {
+	return func(t *testing.T, input []byte) []byte {
+		digest := sha256.Sum256(input)
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		// JWS wants r and s as fixed size big endian halves, not DER
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+}
+
+func unsigned(t *testing.T, input []byte) []byte {
+	return nil
+}
+
+// token builds a compact JWT by hand, so tests can produce the broken and
+// hostile ones a library would refuse to
+func token(t *testing.T, header, claims map[string]any, sign signer) string {
+	t.Helper()
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	input := encode(header) + "." + encode(claims)
+	return input + "." + base64.RawURLEncoding.EncodeToString(sign(t, []byte(input)))
+}
+
+func hsHeader() map[string]any {
+	return map[string]any{"alg": "HS256", "typ": "JWT"}
+}
+
+// claims returns valid claims for the config of newJWTVerifier, changed by
+// the pairs in overrides. A nil value removes the claim.
+func claims(overrides ...any) map[string]any {
+	c := map[string]any{
+		"sub":   "user-1",
+		"iss":   "https://issuer.test",
+		"aud":   "noverna",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"scope": "files:read",
+	}
+	for i := 0; i < len(overrides); i += 2 {
+		name := overrides[i].(string)
+		if overrides[i+1] == nil {
+			delete(c, name)
+			continue
+		}
+		c[name] = overrides[i+1]
+	}
+	return c
+}
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newJWTVerifier(t *testing.T, modify func(cfg *config.JWT)) *JWTVerifier {
+	t.Helper()
+	cfg := config.JWT{
+		Enabled:       true,
+		Algorithm:     "HS256",
+		SecretFile:    writeFile(t, "jwt.key", append(jwtSecret, '\n')),
+		Issuer:        "https://issuer.test",
+		Audience:      "noverna",
+		ScopesClaim:   "scope",
+		LeewaySeconds: 30,
+	}
+	if modify != nil {
+		modify(&cfg)
+	}
+	v, err := NewJWTVerifier(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestJWTVerify(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		header  map[string]any
+		claims  map[string]any
+		sign    signer
+		wantErr error
+	}{
+		{name: "valid", claims: claims()},
+		{name: "no typ", header: map[string]any{"alg": "HS256"}, claims: claims()},
+		{name: "audience in a list", claims: claims("aud", []string{"other", "noverna"})},
+		{name: "wrong secret", claims: claims(), sign: hs256([]byte("another secret of at least 32 bytes")), wantErr: ErrInvalidToken},
+		{name: "alg none", header: map[string]any{"alg": "none"}, claims: claims(), sign: unsigned, wantErr: ErrInvalidToken},
+		{name: "alg none with a signature", header: map[string]any{"alg": "none"}, claims: claims(), wantErr: ErrInvalidToken},
+		{name: "other hmac alg", header: map[string]any{"alg": "HS384"}, claims: claims(), sign: hs384(jwtSecret), wantErr: ErrInvalidToken},
+		{name: "header claims another alg", header: map[string]any{"alg": "RS256"}, claims: claims(), wantErr: ErrInvalidToken},
+		{name: "expired", claims: claims("exp", now.Add(-time.Minute).Unix()), wantErr: ErrTokenExpired},
+		{name: "expired within leeway", claims: claims("exp", now.Add(-10*time.Second).Unix())},
+		{name: "no exp", claims: claims("exp", nil), wantErr: ErrInvalidToken},
+		{name: "not yet valid", claims: claims("nbf", now.Add(time.Minute).Unix()), wantErr: ErrInvalidToken},
+		{name: "not yet valid within leeway", claims: claims("nbf", now.Add(10*time.Second).Unix())},
+		{name: "issued in the future", claims: claims("iat", now.Add(time.Minute).Unix()), wantErr: ErrInvalidToken},
+		{name: "wrong issuer", claims: claims("iss", "https://evil.test"), wantErr: ErrInvalidToken},
+		{name: "no issuer", claims: claims("iss", nil), wantErr: ErrInvalidToken},
+		{name: "wrong audience", claims: claims("aud", "other"), wantErr: ErrInvalidToken},
+		{name: "no audience", claims: claims("aud", nil), wantErr: ErrInvalidToken},
+		{name: "no subject", claims: claims("sub", nil), wantErr: ErrInvalidToken},
+	}
+
+	v := newJWTVerifier(t, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, sign := tt.header, tt.sign
+			if header == nil {
+				header = hsHeader()
+			}
+			if sign == nil {
+				sign = hs256(jwtSecret)
+			}
+
+			identity, err := v.Verify(token(t, header, tt.claims, sign))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if identity.Owner != "jwt-user-1" || identity.Subject != "user-1" {
+				t.Errorf("identity %+v", identity)
+			}
+		})
+	}
+
+	for _, malformed := range []string{"", "a.b.c", "not a token", "e30.e30"} {
+		if _, err := v.Verify(malformed); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Verify(%q): err = %v, want ErrInvalidToken", malformed, err)
+		}
+	}
+}
+
+func TestJWTLeewayDisabled(t *testing.T) {
+	v := newJWTVerifier(t, func(cfg *config.JWT) { cfg.LeewaySeconds = -1 })
+	expired := token(t, hsHeader(), claims("exp", time.Now().Add(-10*time.Second).Unix()), hs256(jwtSecret))
+	if _, err := v.Verify(expired); !errors.Is(err, ErrTokenExpired) {
+		t.Fatalf("err = %v, want ErrTokenExpired", err)
+	}
+}
+
+func TestJWTOptionalChecks(t *testing.T) {
+	v := newJWTVerifier(t, func(cfg *config.JWT) { cfg.Issuer, cfg.Audience = "", "" })
+	if _, err := v.Verify(token(t, hsHeader(), claims("iss", nil, "aud", nil), hs256(jwtSecret))); err != nil {
+		t.Fatalf("token without iss and aud: %v", err)
+	}
+}
+
+func TestJWTScopes(t *testing.T) {
+	tests := []struct {
+		name  string
+		claim any
+		want  []string
+	}{
+		{name: "string", claim: "files:read files:write", want: []string{"files:read", "files:write"}},
+		{name: "array", claim: []string{"files:write", "admin"}, want: []string{"files:write", "admin"}},
+		{name: "mapped", claim: "storage.read storage.write", want: []string{"files:read", "files:write"}},
+		{name: "mapped to several", claim: []string{"storage.all"}, want: []string{"files:read", "files:write"}},
+		{name: "unknown values ignored", claim: "openid files:read profile", want: []string{"files:read"}},
+		{name: "duplicates", claim: []any{"files:read", "storage.read", "files:read"}, want: []string{"files:read"}},
+		{name: "not strings", claim: []any{1, true, "files:write"}, want: []string{"files:write"}},
+		{name: "wrong type", claim: 42},
+		{name: "missing"},
+	}
+
+	v := newJWTVerifier(t, func(cfg *config.JWT) {
+		cfg.ScopesClaim = "scp"
+		cfg.ScopeMap = map[string][]string{
+			"storage.read":  {"files:read"},
+			"storage.write": {"files:write"},
+			"storage.all":   {"files:read", "files:write"},
+		}
+	})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := claims("scope", nil)
+			if tt.claim != nil {
+				c["scp"] = tt.claim
+			}
+			identity, err := v.Verify(token(t, hsHeader(), c, hs256(jwtSecret)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(identity.Scopes, tt.want) {
+				t.Errorf("scopes %v, want %v", identity.Scopes, tt.want)
+			}
+		})
+	}
+}
+
+func TestJWTNamespace(t *testing.T) {
+	v := newJWTVerifier(t, func(cfg *config.JWT) { cfg.NamespaceClaim = "ns" })
+	identity, err := v.Verify(token(t, hsHeader(), claims("ns", " Avatars "), hs256(jwtSecret)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Namespace != "avatars" {
+		t.Errorf("namespace %q", identity.Namespace)
+	}
+}
+
+func TestJWTPublicKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPEM := func(key any) []byte {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	}
+	rsaPEM, ecPEM := publicPEM(&rsaKey.PublicKey), publicPEM(&ecKey.PublicKey)
+
+	tests := []struct {
+		name      string
+		alg       string
+		publicKey []byte
+		header    string
+		sign      signer
+		wantErr   bool
+	}{
+		{name: "rs256", alg: "RS256", publicKey: rsaPEM, header: "RS256", sign: rs256(rsaKey)},
+		{name: "es256", alg: "ES256", publicKey: ecPEM, header: "ES256", sign: es256(ecKey)},
+		// The classic confusion: the public key, which anyone has, used as an HMAC secret
+		{name: "hs256 with the public key", alg: "RS256", publicKey: rsaPEM, header: "HS256", sign: hs256(rsaPEM), wantErr: true},
+		{name: "es256 key for rs256", alg: "RS256", publicKey: rsaPEM, header: "ES256", sign: es256(ecKey), wantErr: true},
+		{name: "none", alg: "ES256", publicKey: ecPEM, header: "none", sign: unsigned, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newJWTVerifier(t, func(cfg *config.JWT) {
+				cfg.Algorithm = tt.alg
+				cfg.SecretFile = ""
+				cfg.PublicKeyFile = writeFile(t, "public.pem", tt.publicKey)
+			})
+			_, err := v.Verify(token(t, map[string]any{"alg": tt.header}, claims(), tt.sign))
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidToken) {
+					t.Fatalf("err = %v, want ErrInvalidToken", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestJWTKeySet(t *testing.T) {
+	otherSecret := []byte("second jwt secret, also 32 bytes")
+	jwks := `{"keys": [
+		{"kty": "oct", "kid": "one", "alg": "HS256", "k": "` + base64.RawURLEncoding.EncodeToString(jwtSecret) + `"},
+		{"kty": "oct", "kid": "two", "k": "` + base64.RawURLEncoding.EncodeToString(otherSecret) + `"}
+	]}`
+	v := newJWTVerifier(t, func(cfg *config.JWT) {
+		cfg.SecretFile = ""
+		cfg.JWKSFile = writeFile(t, "jwks.json", []byte(jwks))
+	})
+
+	tests := []struct {
+		name    string
+		kid     string
+		secret  []byte
+		wantErr bool
+	}{
+		{name: "first key", kid: "one", secret: jwtSecret},
+		{name: "second key", kid: "two", secret: otherSecret},
+		{name: "key of another id", kid: "two", secret: jwtSecret, wantErr: true},
+		{name: "unknown key", kid: "three", secret: jwtSecret, wantErr: true},
+		{name: "no key id", secret: jwtSecret, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := hsHeader()
+			if tt.kid != "" {
+				header["kid"] = tt.kid
+			}
+			_, err := v.Verify(token(t, header, claims(), hs256(tt.secret)))
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("err = %v, want an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewJWTVerifier(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *config.JWT)
+	}{
+		{name: "short secret", modify: func(cfg *config.JWT) { cfg.SecretFile = writeFile(t, "short.key", []byte("too short")) }},
+		{name: "no secret", modify: func(cfg *config.JWT) { cfg.SecretFile = "" }},
+		{name: "unsupported alg", modify: func(cfg *config.JWT) { cfg.Algorithm = "none" }},
+		{name: "rs256 without a key", modify: func(cfg *config.JWT) { cfg.Algorithm = "RS256" }},
+		{
+			name: "rs256 with garbage",
+			modify: func(cfg *config.JWT) {
+				cfg.Algorithm = "RS256"
+				cfg.PublicKeyFile = writeFile(t, "public.pem", []byte("not pem"))
+			},
+		},
+		{name: "empty jwks", modify: func(cfg *config.JWT) { cfg.JWKSFile = writeFile(t, "jwks.json", []byte(`{"keys": []}`)) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.JWT{Algorithm: "HS256", SecretFile: writeFile(t, "jwt.key", jwtSecret), ScopesClaim: "scope"}
+			tt.modify(&cfg)
+			if _, err := NewJWTVerifier(cfg); err == nil {
+				t.Fatal("config accepted")
+			}
+		})
+	}
+}
+
+func TestLooksLikeJWT(t *testing.T) {
+	jwt := token(t, hsHeader(), claims(), hs256(jwtSecret))
+	if !LooksLikeJWT(jwt) || LooksLikeJWT("nv_0123456789abcdef") || LooksLikeJWT(strings.Repeat("a", 40)) {
+		t.Error("tokens and keys told apart wrongly")
+	}
+}
@@ -0,0 +1,248 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"noverna.de/m/v2/internal/kv"
+)
+
+var (
+	ErrKeyNotFound   = errors.New("API key not found")
+	ErrInvalidScopes = errors.New("invalid scopes")
+	ErrInvalidExpiry = errors.New("expires_at must be in the future")
+)
+
+// Keys look like nv_<id>_<secret>, the id is how they are found again
+const tokenPrefix = "nv_"
+
+// Key is an API key as the admin endpoints show it. The secret is only
+// handed out when the key is created or rotated.
+type Key struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name,omitempty"`
+	Scopes    []string   `json:"scopes"`
+	Namespace string     `json:"namespace,omitempty"`
+	Owner     string     `json:"owner"`
+	CreatedAt time.Time  `json:"created_at"`
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// storedKey is a Key with the SHA-256 of its secret. Secrets are random
+// and long, so a plain hash is enough to make a leaked store useless.
+type storedKey struct {
+	Key
+	SecretHash string `json:"secret_hash"`
+}
+
+// NewKey is what a key is created with
+type NewKey struct {
+	Name      string
+	Scopes    []string
+	Namespace string
+	ExpiresAt *time.Time
+}
+
+// Registry keeps API keys in a kv store
+type Registry struct {
+	db *kv.DB
+}
+
+func NewRegistry(db *kv.DB) *Registry {
+	return &Registry{db: db}
+}
+
+func recordKey(id string) string {
+	return "apikey/" + id
+}
+
+// Create adds a key and returns it together with the token to hand out
+func (r *Registry) Create(spec NewKey) (*Key, string, error) {
+	scopes, err := normalizeScopes(spec.Scopes)
+	if err != nil {
+		return nil, "", err
+	}
+	if spec.ExpiresAt != nil && !spec.ExpiresAt.After(time.Now()) {
+		return nil, "", ErrInvalidExpiry
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomHex(24)
+	if err != nil {
+		return nil, "", err
+	}
+
+	stored := &storedKey{
+		Key: Key{
+			ID:        id,
+			Name:      strings.TrimSpace(spec.Name),
+			Scopes:    scopes,
+			Namespace: spec.Namespace,
+			// Stays the same when the secret is rotated, so files and usage stay with the key
+			Owner:     "key-" + id,
+			CreatedAt: time.Now().UTC(),
+			ExpiresAt: spec.ExpiresAt,
+		},
+		SecretHash: hashSecret(secret),
+	}
+	err = r.db.Update(func(tx *kv.Tx) error {
+		return tx.PutJSON(recordKey(id), stored)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return &stored.Key, tokenPrefix + id + "_" + secret, nil
+}
+
+// List returns every key, revoked ones included, oldest first
+func (r *Registry) List() ([]Key, error) {
+	keys := []Key{}
+	var decodeErr error
+	r.db.Scan("apikey/", "", func(_ string, value []byte) bool {
+		stored := &storedKey{}
+		if err := json.Unmarshal(value, stored); err != nil {
+			decodeErr = err
+			return false
+		}
+		keys = append(keys, stored.Key)
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, decodeErr
+}
+
+// Revoke disables a key for good. It stays listed.
+func (r *Registry) Revoke(id string) (*Key, error) {
+	return r.update(id, func(stored *storedKey) error {
+		if stored.RevokedAt == nil {
+			now := time.Now().UTC()
+			stored.RevokedAt = &now
+		}
+		return nil
+	})
+}
+
+// Rotate replaces the secret of a key. The old token stops working at once.
+func (r *Registry) Rotate(id string) (*Key, string, error) {
+	var token string
+	key, err := r.update(id, func(stored *storedKey) error {
+		if stored.RevokedAt != nil {
+			return ErrKeyRevoked
+		}
+		secret, err := randomHex(24)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		stored.SecretHash = hashSecret(secret)
+		stored.RotatedAt = &now
+		token = tokenPrefix + id + "_" + secret
+		return nil
+	})
+	return key, token, err
+}
+
+func (r *Registry) update(id string, fn func(stored *storedKey) error) (*Key, error) {
+	stored := &storedKey{}
+	err := r.db.Update(func(tx *kv.Tx) error {
+		found, err := tx.GetJSON(recordKey(id), stored)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return ErrKeyNotFound
+		}
+		if err := fn(stored); err != nil {
+			return err
+		}
+		return tx.PutJSON(recordKey(id), stored)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &stored.Key, nil
+}
+
+// Verify resolves a token to the identity of its key
+func (r *Registry) Verify(token string) (*Identity, error) {
+	rest, ok := strings.CutPrefix(token, tokenPrefix)
+	if !ok {
+		return nil, ErrInvalidKey
+	}
+	id, secret, ok := strings.Cut(rest, "_")
+	if !ok || id == "" || strings.Contains(id, "/") {
+		return nil, ErrInvalidKey
+	}
+
+	data, found := r.db.Get(recordKey(id))
+	if !found {
+		return nil, ErrInvalidKey
+	}
+	stored := &storedKey{}
+	if err := json.Unmarshal(data, stored); err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(stored.SecretHash)) != 1 {
+		return nil, ErrInvalidKey
+	}
+	// Only tell why a key is refused to someone who has its secret
+	if stored.RevokedAt != nil {
+		return nil, ErrKeyRevoked
+	}
+	if stored.ExpiresAt != nil && !time.Now().Before(*stored.ExpiresAt) {
+		return nil, ErrKeyExpired
+	}
+
+	return &Identity{
+		Owner:     stored.Owner,
+		KeyID:     stored.ID,
+		Scopes:    stored.Scopes,
+		Namespace: stored.Namespace,
+	}, nil
+}
+
+func normalizeScopes(scopes []string) ([]string, error) {
+	var normalized []string
+	for _, scope := range scopes {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		if scope == "" || slices.Contains(normalized, scope) {
+			continue
+		}
+		if !slices.Contains(Scopes, scope) {
+			return nil, fmt.Errorf("%w: unknown scope %q", ErrInvalidScopes, scope)
+		}
+		normalized = append(normalized, scope)
+	}
+	if len(normalized) == 0 {
+		return nil, fmt.Errorf("%w: at least one scope is required", ErrInvalidScopes)
+	}
+	return normalized, nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate key: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
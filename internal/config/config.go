@@ -12,10 +12,20 @@ import (
 //! IMPORTANT - BETTER ERROR HANDLING NEEDED
 
 type Config struct {
-	Server   Server   `toml:"server"`
-	Uploads  Uploads  `toml:"uploads"`
-	Security Security `toml:"security"`
-	Debug    Debug    `toml:"debug"`
+	Server     Server     `toml:"server"`
+	Uploads    Uploads    `toml:"uploads"`
+	Security   Security   `toml:"security"`
+	Storage    Storage    `toml:"storage"`
+	Images     Images     `toml:"images"`
+	Videos     Videos     `toml:"videos"`
+	Trash      Trash      `toml:"trash"`
+	Versioning Versioning `toml:"versioning"`
+	Expiry     Expiry     `toml:"expiry"`
+	Janitor    Janitor    `toml:"janitor"`
+	Scrub      Scrub      `toml:"scrub"`
+	Quotas     Quotas     `toml:"quotas"`
+	Advanced   Advanced   `toml:"advanced"`
+	Debug      Debug      `toml:"debug"`
 }
 
 type Server struct {
@@ -27,18 +37,157 @@ type Server struct {
 }
 
 type Uploads struct {
-	MAX_FILE_SIZE int      `toml:"max_file_size_mb"`
-	AllowedTypes  []string `toml:"allowed_types"`
+	MAX_FILE_SIZE        int      `toml:"max_file_size_mb"`
+	AllowedTypes         []string `toml:"allowed_types"`
+	ResumableExpiryHours int      `toml:"resumable_expiry_hours"`
+}
+
+type Images struct {
+	VariantSizes []string `toml:"variant_sizes"` // "WxH", 0 keeps the aspect ratio
+	JPEGQuality  int      `toml:"jpeg_quality"`
+}
+
+type Videos struct {
+	Faststart bool `toml:"faststart"` // Move moov in front of the media data after upload
+}
+
+type Trash struct {
+	RetentionHours      int `toml:"retention_hours"`       // Trashed files are purged after this
+	ReapIntervalMinutes int `toml:"reap_interval_minutes"` // How often the reaper looks for expired items
+}
+
+type Versioning struct {
+	MaxVersions int                            `toml:"max_versions"` // Previous versions kept per file
+	Namespaces  map[string]NamespaceVersioning `toml:"namespaces"`
+}
+
+type NamespaceVersioning struct {
+	MaxVersions int `toml:"max_versions"` // 0 falls back to versioning.max_versions
+}
+
+type Expiry struct {
+	GCIntervalMinutes int `toml:"gc_interval_minutes"` // How often expired files are deleted
+}
+
+type Janitor struct {
+	MaxAgeHours     int `toml:"max_age_hours"`    // Temp files untouched for this long are removed
+	IntervalMinutes int `toml:"interval_minutes"` // How often the temp dir is cleaned up after startup
+}
+
+type Scrub struct {
+	IntervalHours   int     `toml:"interval_hours"`     // How often all blobs are verified, negative disables the schedule
+	RateMBPerSecond int     `toml:"rate_mb_per_second"` // Read limit so scrubbing doesn't starve requests
+	Replica         Storage `toml:"replica"`            // Where damaged blobs are repaired from, an empty backend disables repair
+}
+
+type Quotas struct {
+	MaxMB    int                   `toml:"max_mb"`    // Bytes each owner may store, 0 is unlimited
+	MaxFiles int                   `toml:"max_files"` // Files each owner may store, 0 is unlimited
+	Owners   map[string]OwnerQuota `toml:"owners"`
+}
+
+type OwnerQuota struct {
+	MaxMB    int `toml:"max_mb"`    // 0 falls back to quotas.max_mb, -1 is unlimited
+	MaxFiles int `toml:"max_files"` // 0 falls back to quotas.max_files, -1 is unlimited
 }
 
 type Security struct {
-	TokenRequired      bool   `toml:"token_required"`
-	ApiKey             string `toml:"api_key"`
-	RateLimitPerMinute int    `toml:"rate_limit_per_minute"`
+	TokenRequired       bool                  `toml:"token_required"`
+	ApiKey              string                `toml:"api_key"`
+	RateLimitPerMinute  int                   `toml:"rate_limit_per_minute"`
+	RateLimitBurst      int                   `toml:"rate_limit_burst"`           // Requests allowed at once, 0 means rate_limit_per_minute
+	RateLimitMaxClients int                   `toml:"rate_limit_max_clients"`     // Clients tracked at once, the least recently seen are forgotten first
+	RateLimitRoutes     map[string]RouteLimit `toml:"rate_limit_routes"`          // Keyed by "/path", "/prefix*" or "METHOD /path"
+	RateLimitStore      string                `toml:"rate_limit_store"`           // memory, or cache to share buckets through advanced.cache_endpoint
+	AuthRateLimit       int                   `toml:"auth_rate_limit_per_minute"` // Requests per client IP before credentials are checked, -1 is unlimited
+	AuthRateLimitBurst  int                   `toml:"auth_rate_limit_burst"`      // 0 means auth_rate_limit_per_minute
+	JWT                 JWT                   `toml:"jwt"`
+	HMAC                HMAC                  `toml:"hmac"`
+	SignedURLs          SignedURLs            `toml:"signed_urls"`
+	IPPolicy            IPPolicy              `toml:"ip_policy"`
+}
+
+type SignedURLs struct {
+	Enabled           bool                  `toml:"enabled"`             // Let callers mint download links that work without an API key
+	SigningKey        string                `toml:"signing_key"`         // Id of the key new links are signed with
+	Keys              map[string]SigningKey `toml:"keys"`                // Every key links are accepted from, keyed by id
+	DefaultTTLSeconds int                   `toml:"default_ttl_seconds"` // Lifetime of links minted without one
+	MaxTTLSeconds     int                   `toml:"max_ttl_seconds"`     // Longest lifetime a link may be minted with
+	BaseURL           string                `toml:"base_url"`            // Put in front of minted links, empty leaves them relative
+}
+
+type SigningKey struct {
+	SecretFile string `toml:"secret_file"` // At least 32 bytes
+}
+
+type HMAC struct {
+	Enabled        bool               `toml:"enabled"`          // Accept requests signed with pkg/hmacsign next to API keys
+	MaxSkewSeconds int                `toml:"max_skew_seconds"` // How far the signed date may be off the server clock
+	NonceCacheSize int                `toml:"nonce_cache_size"` // Nonces kept in memory, should cover twice max_skew_seconds of signed requests
+	NonceStore     string             `toml:"nonce_store"`      // memory, or cache to share nonces through advanced.cache_endpoint
+	Keys           map[string]HMACKey `toml:"keys"`             // Keyed by the KeyId the caller signs with
+}
+
+type HMACKey struct {
+	SecretFile string   `toml:"secret_file"` // Shared secret, at least 32 bytes
+	Scopes     []string `toml:"scopes"`
+	Namespace  string   `toml:"namespace"` // Binds the key to a namespace, empty allows all
+}
+
+type IPPolicy struct {
+	TrustedProxies []string                 `toml:"trusted_proxies"` // Peers whose X-Forwarded-For and X-Real-IP are believed
+	Allow          []string                 `toml:"allow"`           // CIDR ranges for every route, empty allows all
+	Deny           []string                 `toml:"deny"`            // CIDR ranges turned away, wins over allow
+	Groups         map[string]IPPolicyGroup `toml:"groups"`          // Further policies for some routes, on top of the ones above
+}
+
+type IPPolicyGroup struct {
+	Paths []string `toml:"paths"` // "/path", "/prefix*" or "METHOD /path"
+	Allow []string `toml:"allow"`
+	Deny  []string `toml:"deny"`
+}
+
+type RouteLimit struct {
+	PerMinute int `toml:"per_minute"` // 0 falls back to security.rate_limit_per_minute, -1 is unlimited
+	Burst     int `toml:"burst"`      // 0 means per_minute
+}
+
+type JWT struct {
+	Enabled        bool                `toml:"enabled"`         // Accept JWTs as bearer tokens next to API keys
+	Algorithm      string              `toml:"algorithm"`       // HS256, RS256 or ES256, the default for JWKS keys without alg
+	SecretFile     string              `toml:"secret_file"`     // HS256 shared secret, at least 32 bytes
+	PublicKeyFile  string              `toml:"public_key_file"` // PEM public key or certificate for RS256 and ES256
+	JWKSFile       string              `toml:"jwks_file"`       // Local JWKS, used instead of the single key files
+	Issuer         string              `toml:"issuer"`          // Required iss, empty skips the check
+	Audience       string              `toml:"audience"`        // Required aud, empty skips the check
+	ScopesClaim    string              `toml:"scopes_claim"`    // Space separated string or array of scopes
+	ScopeMap       map[string][]string `toml:"scope_map"`       // Claim values translated to scopes
+	NamespaceClaim string              `toml:"namespace_claim"` // Binds tokens to the namespace in this claim, empty disables
+	LeewaySeconds  int                 `toml:"leeway_seconds"`  // Clock skew allowed on exp, nbf and iat, negative disables
+}
+
+type Storage struct {
+	Backend string       `toml:"backend"` // local, memory or s3
+	Local   LocalStorage `toml:"local"`
+	S3      S3Storage    `toml:"s3"`
+}
+
+type LocalStorage struct {
+	Root string `toml:"root"` // Defaults to server.data_dir
+}
+
+type S3Storage struct {
+	Endpoint  string `toml:"endpoint"`
+	Region    string `toml:"region"`
+	Bucket    string `toml:"bucket"`
+	Prefix    string `toml:"prefix"`
+	AccessKey string `toml:"access_key"`
+	SecretKey string `toml:"secret_key"`
+	PathStyle bool   `toml:"path_style"`
 }
 
 type Advanced struct {
-	CacheEndpoint string `toml:"cache_endpoint"`
+	CacheEndpoint string `toml:"cache_endpoint"` // Redis compatible server, redis://[user:password@]host:port[/db]
 	CacheNodes    []string `toml:"cache_nodes"`
 	CDNEndpoint string `toml:"cdn_endpoint"`
 	CDNNodes    []string `toml:"cdn_nodes"`
@@ -86,7 +235,7 @@ func Init() error {
 	// Validierung der Konfiguration
 	if err := validateConfig(cfg); err != nil {
 		log.Error("invalid config", map[string]any{"error": err})
-		return nil
+		return err
 	}
 	
 	// Defaults setzen
@@ -135,7 +284,49 @@ func validateConfig(cfg *Config) error {
 		log.Error("invalid rate limit per minute", map[string]any{"error": "rate limit per minute must be greater than 0"})
 		return nil
 	}
-	
+
+	if cfg.Security.RateLimitBurst < 0 || cfg.Security.AuthRateLimitBurst < 0 {
+		return fmt.Errorf("security.rate_limit_burst and security.auth_rate_limit_burst must not be negative")
+	}
+
+	for pattern, route := range cfg.Security.RateLimitRoutes {
+		if route.PerMinute < -1 {
+			return fmt.Errorf("security.rate_limit_routes.%q.per_minute must be -1 for unlimited or not negative, got %d", pattern, route.PerMinute)
+		}
+		if route.Burst < 0 {
+			return fmt.Errorf("security.rate_limit_routes.%q.burst must not be negative", pattern)
+		}
+	}
+
+	// 0 falls back to the default
+	if cfg.Images.JPEGQuality < 0 || cfg.Images.JPEGQuality > 100 {
+		return fmt.Errorf("images.jpeg_quality must be between 1 and 100, got %d", cfg.Images.JPEGQuality)
+	}
+
+	// A negative retention would purge on the next pass, a negative interval panics the ticker
+	if cfg.Trash.RetentionHours < 0 || cfg.Trash.ReapIntervalMinutes < 0 {
+		return fmt.Errorf("trash.retention_hours and trash.reap_interval_minutes must not be negative")
+	}
+
+	// Pruning cuts the history down to this many versions, it can't be less than none
+	if cfg.Versioning.MaxVersions < 0 {
+		return fmt.Errorf("versioning.max_versions must not be negative")
+	}
+	for namespace, policy := range cfg.Versioning.Namespaces {
+		if policy.MaxVersions < 0 {
+			return fmt.Errorf("versioning.namespaces.%s.max_versions must not be negative", namespace)
+		}
+	}
+
+	if cfg.Expiry.GCIntervalMinutes < 0 {
+		return fmt.Errorf("expiry.gc_interval_minutes must not be negative")
+	}
+
+	// A negative age would make every temp file look stale, including ones in use
+	if cfg.Janitor.MaxAgeHours < 0 || cfg.Janitor.IntervalMinutes < 0 {
+		return fmt.Errorf("janitor.max_age_hours and janitor.interval_minutes must not be negative")
+	}
+
 	return nil
 }
 
@@ -156,10 +347,115 @@ func applyDefaults(cfg *Config) {
 	if cfg.Uploads.MAX_FILE_SIZE == 0 {
 		cfg.Uploads.MAX_FILE_SIZE = 10
 	}
+
+	if cfg.Uploads.ResumableExpiryHours == 0 {
+		cfg.Uploads.ResumableExpiryHours = 24
+	}
 	
 	if cfg.Security.RateLimitPerMinute == 0 {
 		cfg.Security.RateLimitPerMinute = 60
 	}
+
+	if cfg.Security.RateLimitBurst == 0 {
+		cfg.Security.RateLimitBurst = cfg.Security.RateLimitPerMinute
+	}
+
+	if cfg.Security.RateLimitMaxClients == 0 {
+		cfg.Security.RateLimitMaxClients = 10000
+	}
+
+	if cfg.Security.RateLimitStore == "" {
+		cfg.Security.RateLimitStore = "memory"
+	}
+
+	if cfg.Security.AuthRateLimit == 0 {
+		cfg.Security.AuthRateLimit = 300
+	}
+
+	if cfg.Security.AuthRateLimitBurst == 0 {
+		cfg.Security.AuthRateLimitBurst = cfg.Security.AuthRateLimit
+	}
+
+	// Left out entirely only a proxy on the same host is trusted, an empty list trusts none
+	if cfg.Security.IPPolicy.TrustedProxies == nil {
+		cfg.Security.IPPolicy.TrustedProxies = []string{"127.0.0.0/8", "::1"}
+	}
+
+	if cfg.Security.JWT.Algorithm == "" {
+		cfg.Security.JWT.Algorithm = "HS256"
+	}
+
+	if cfg.Security.JWT.ScopesClaim == "" {
+		cfg.Security.JWT.ScopesClaim = "scope"
+	}
+
+	if cfg.Security.JWT.LeewaySeconds == 0 {
+		cfg.Security.JWT.LeewaySeconds = 30
+	}
+
+	if cfg.Security.HMAC.MaxSkewSeconds == 0 {
+		cfg.Security.HMAC.MaxSkewSeconds = 300
+	}
+
+	if cfg.Security.HMAC.NonceCacheSize == 0 {
+		cfg.Security.HMAC.NonceCacheSize = 100000
+	}
+
+	if cfg.Security.HMAC.NonceStore == "" {
+		cfg.Security.HMAC.NonceStore = "memory"
+	}
+
+	if cfg.Security.SignedURLs.DefaultTTLSeconds == 0 {
+		cfg.Security.SignedURLs.DefaultTTLSeconds = 900
+	}
+
+	if cfg.Security.SignedURLs.MaxTTLSeconds == 0 {
+		cfg.Security.SignedURLs.MaxTTLSeconds = 86400
+	}
+
+	if cfg.Storage.Backend == "" {
+		cfg.Storage.Backend = "local"
+	}
+
+	if len(cfg.Images.VariantSizes) == 0 {
+		cfg.Images.VariantSizes = []string{"64x64", "320x240", "640x480", "1280x720"}
+	}
+
+	if cfg.Images.JPEGQuality == 0 {
+		cfg.Images.JPEGQuality = 85
+	}
+
+	if cfg.Trash.RetentionHours == 0 {
+		cfg.Trash.RetentionHours = 720
+	}
+
+	if cfg.Trash.ReapIntervalMinutes == 0 {
+		cfg.Trash.ReapIntervalMinutes = 60
+	}
+
+	if cfg.Versioning.MaxVersions == 0 {
+		cfg.Versioning.MaxVersions = 10
+	}
+
+	if cfg.Expiry.GCIntervalMinutes == 0 {
+		cfg.Expiry.GCIntervalMinutes = 5
+	}
+
+	if cfg.Janitor.MaxAgeHours == 0 {
+		cfg.Janitor.MaxAgeHours = 24
+	}
+
+	if cfg.Janitor.IntervalMinutes == 0 {
+		cfg.Janitor.IntervalMinutes = 60
+	}
+
+	if cfg.Scrub.IntervalHours == 0 {
+		cfg.Scrub.IntervalHours = 168
+	}
+
+	if cfg.Scrub.RateMBPerSecond == 0 {
+		cfg.Scrub.RateMBPerSecond = 10
+	}
 }
 
 // setLogLevel sets the logger level based on the config
@@ -192,12 +488,60 @@ func getDefaultConfig() *Config {
 			TempDir:  "./tmp",
 		},
 		Uploads: Uploads{
-			MAX_FILE_SIZE: 10,
-			AllowedTypes:  []string{"image/jpeg", "image/png", "text/plain"},
+			MAX_FILE_SIZE:        10,
+			AllowedTypes:         []string{"image/jpeg", "image/png", "text/plain"},
+			ResumableExpiryHours: 24,
 		},
 		Security: Security{
-			TokenRequired:      false,
-			RateLimitPerMinute: 60,
+			TokenRequired:       false,
+			RateLimitPerMinute:  60,
+			RateLimitBurst:      60,
+			RateLimitMaxClients: 10000,
+			RateLimitStore:      "memory",
+			AuthRateLimit:       300,
+			AuthRateLimitBurst:  300,
+			JWT: JWT{
+				Algorithm:     "HS256",
+				ScopesClaim:   "scope",
+				LeewaySeconds: 30,
+			},
+			HMAC: HMAC{
+				MaxSkewSeconds: 300,
+				NonceCacheSize: 100000,
+				NonceStore:     "memory",
+			},
+			SignedURLs: SignedURLs{
+				DefaultTTLSeconds: 900,
+				MaxTTLSeconds:     86400,
+			},
+			IPPolicy: IPPolicy{
+				TrustedProxies: []string{"127.0.0.0/8", "::1"},
+			},
+		},
+		Storage: Storage{
+			Backend: "local",
+		},
+		Images: Images{
+			VariantSizes: []string{"64x64", "320x240", "640x480", "1280x720"},
+			JPEGQuality:  85,
+		},
+		Trash: Trash{
+			RetentionHours:      720,
+			ReapIntervalMinutes: 60,
+		},
+		Versioning: Versioning{
+			MaxVersions: 10,
+		},
+		Expiry: Expiry{
+			GCIntervalMinutes: 5,
+		},
+		Janitor: Janitor{
+			MaxAgeHours:     24,
+			IntervalMinutes: 60,
+		},
+		Scrub: Scrub{
+			IntervalHours:   168,
+			RateMBPerSecond: 10,
 		},
 		Debug: Debug{
 			Enabled: false,
@@ -0,0 +1,258 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"noverna.de/m/v2/internal/kv"
+	"noverna.de/m/v2/internal/storage"
+)
+
+var (
+	ErrNotFound = errors.New("file not found")
+	ErrExpired  = errors.New("file has expired")
+)
+
+// errContentChanged means the file record points to another blob than the caller expected
+var errContentChanged = errors.New("file content changed")
+
+// Blob is the reference counted content shared by all files with the same hash
+type Blob struct {
+	Hash      string    `json:"hash"`
+	Size      int64     `json:"size"`
+	Refs      int       `json:"refs"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// BlobKey returns the storage key of a blob: blobs/ab/cd/abcd...
+// Two levels of sharding keep single directories small on the local backend.
+func BlobKey(hash string) string {
+	return fmt.Sprintf("blobs/%s/%s/%s", hash[0:2], hash[2:4], hash)
+}
+
+func fileKey(id string) string {
+	return "file/" + id
+}
+
+func blobRecordKey(hash string) string {
+	return "blob/" + hash
+}
+
+// commit stores the blob behind file unless we have it already and saves the
+// file record. It reports whether the content was a duplicate.
+func (s *Service) commit(ctx context.Context, file *File, tmpPath string) (bool, error) {
+	hash := file.Hash()
+	unlock := s.blobLocks.lock(hash)
+	defer unlock()
+
+	_, known := s.db.Get(blobRecordKey(hash))
+	if !known {
+		if err := storage.PutFile(ctx, s.backend, BlobKey(hash), tmpPath); err != nil {
+			return false, fmt.Errorf("store blob: %w", err)
+		}
+	}
+
+	err := s.db.Update(func(tx *kv.Tx) error {
+		blob := &Blob{Hash: hash, Size: file.Size, CreatedAt: file.CreatedAt}
+		if _, err := tx.GetJSON(blobRecordKey(hash), blob); err != nil {
+			return err
+		}
+		blob.Refs++
+
+		if err := tx.PutJSON(blobRecordKey(hash), blob); err != nil {
+			return err
+		}
+		return s.withinQuota(tx, file.Owner, func() error {
+			return putFileRecord(tx, file)
+		})
+	})
+	if err != nil && !known {
+		// Nobody references the blob we just wrote
+		s.backend.Delete(ctx, BlobKey(hash))
+	}
+	return known, err
+}
+
+// Get loads a file record. Files in the trash are not found, expired files
+// fail with ErrExpired until the GC removed them.
+func (s *Service) Get(id string) (*File, error) {
+	file, err := s.repo.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if file.Trashed() {
+		return nil, ErrNotFound
+	}
+	if file.Expired(time.Now()) {
+		return nil, ErrExpired
+	}
+	return file, nil
+}
+
+// Namespace returns the namespace of a file, wherever it is in its lifecycle
+func (s *Service) Namespace(id string) (string, error) {
+	file, err := s.repo.Get(id)
+	if err != nil {
+		return "", err
+	}
+	return file.Namespace, nil
+}
+
+// List returns one page of file records matching q
+func (s *Service) List(q Query) (*Page, error) {
+	return s.repo.List(q)
+}
+
+// updateFile applies fn to the stored record of a file and saves it
+func (s *Service) updateFile(id string, fn func(file *File) error) error {
+	return s.db.Update(func(tx *kv.Tx) error {
+		file := &File{}
+		found, err := tx.GetJSON(fileKey(id), file)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return ErrNotFound
+		}
+		if err := fn(file); err != nil {
+			return err
+		}
+		file.UpdatedAt = time.Now().UTC()
+		return putFileRecord(tx, file)
+	})
+}
+
+// Open returns a file record together with a seekable stream of its content
+func (s *Service) Open(ctx context.Context, id string) (*File, *storage.ReadSeeker, error) {
+	file, err := s.Get(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, storage.NewReadSeeker(ctx, s.backend, BlobKey(file.Hash()), file.Size), nil
+}
+
+// purge removes a file record and its versions for good. Blobs are only
+// removed once no other file references them anymore.
+func (s *Service) purge(ctx context.Context, id string) error {
+	unlockFile := s.fileLocks.lock(id)
+	defer unlockFile()
+
+	file, err := s.repo.Get(id)
+	if err != nil {
+		return err
+	}
+	versions, err := s.loadVersions(id)
+	if err != nil {
+		return err
+	}
+
+	hashes := []string{file.Hash()}
+	for _, v := range versions {
+		hashes = append(hashes, v.Hash())
+	}
+	unlockBlobs := s.lockBlobs(hashes...)
+	defer unlockBlobs()
+
+	var orphaned []string
+	err = s.db.Update(func(tx *kv.Tx) error {
+		if err := deleteFileRecord(tx, id); err != nil {
+			return err
+		}
+		if err := putVersions(tx, file, versions, nil); err != nil {
+			return err
+		}
+
+		// The same content can show up in several versions, each holds a reference
+		for _, hash := range hashes {
+			released, err := releaseBlob(tx, hash)
+			if err != nil {
+				return err
+			}
+			if released {
+				orphaned = append(orphaned, hash)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range orphaned {
+		s.removeBlob(ctx, hash)
+	}
+
+	s.logger.Info("File purged", map[string]any{
+		"id":            id,
+		"versions":      len(versions),
+		"blobs_removed": len(orphaned),
+	})
+	return nil
+}
+
+// releaseBlob drops one reference to a blob and reports whether it was the last one
+func releaseBlob(tx *kv.Tx, hash string) (bool, error) {
+	blob := &Blob{}
+	found, err := tx.GetJSON(blobRecordKey(hash), blob)
+	if err != nil || !found {
+		return false, err
+	}
+
+	blob.Refs--
+	if blob.Refs > 0 {
+		return false, tx.PutJSON(blobRecordKey(hash), blob)
+	}
+	tx.Delete(blobRecordKey(hash))
+	return true, nil
+}
+
+// removeBlob deletes an unreferenced blob and its variants from storage
+func (s *Service) removeBlob(ctx context.Context, hash string) {
+	if err := s.backend.Delete(ctx, BlobKey(hash)); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		// The record is gone already, a leftover blob only costs disk space
+		s.logger.Error("Failed to delete blob", map[string]any{
+			"hash":  hash,
+			"error": err.Error(),
+		})
+	}
+	s.deleteVariants(ctx, hash)
+}
+
+// keyedMutex hands out one lock per key and forgets keys nobody waits on
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	waiters int
+}
+
+func (k *keyedMutex) lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyedLock)
+	}
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.waiters++
+	k.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		k.mu.Lock()
+		l.waiters--
+		if l.waiters == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
@@ -0,0 +1,124 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"noverna.de/m/v2/internal/storage"
+)
+
+func TestIngestDedup(t *testing.T) {
+	s := newService(t, nil)
+
+	first := ingest(t, s, Upload{Name: "a.txt"}, "same content")
+	second := ingest(t, s, Upload{Name: "b.txt"}, "same content")
+	other := ingest(t, s, Upload{Name: "c.txt"}, "other content")
+
+	if first.Duplicate || !second.Duplicate || other.Duplicate {
+		t.Errorf("duplicate flags %v, %v, %v, want only the second", first.Duplicate, second.Duplicate, other.Duplicate)
+	}
+	if first.ID == second.ID || first.Checksum != second.Checksum {
+		t.Fatalf("files %s and %s should be distinct records of one blob", first.ID, second.ID)
+	}
+	if n := refs(t, s, first.Hash()); n != 2 {
+		t.Errorf("shared blob has %d refs, want 2", n)
+	}
+	if n := refs(t, s, other.Hash()); n != 1 {
+		t.Errorf("other blob has %d refs, want 1", n)
+	}
+
+	blobs := 0
+	s.backend.List(context.Background(), "blobs/", func(storage.ObjectInfo) error {
+		blobs++
+		return nil
+	})
+	if blobs != 2 {
+		t.Errorf("%d blobs stored, want 2", blobs)
+	}
+}
+
+func TestPurgeReleasesBlob(t *testing.T) {
+	s := newService(t, nil)
+	first := ingest(t, s, Upload{}, "same content")
+	second := ingest(t, s, Upload{}, "same content")
+	hash := first.Hash()
+
+	// Trashed files still hold their reference
+	if _, err := s.Trash(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if n := refs(t, s, hash); n != 2 {
+		t.Fatalf("%d refs after trashing, want 2", n)
+	}
+
+	if err := s.Purge(context.Background(), first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if n := refs(t, s, hash); n != 1 {
+		t.Fatalf("%d refs after the first purge, want 1", n)
+	}
+	if _, content, err := s.Open(context.Background(), second.ID); err != nil {
+		t.Fatalf("other file unreadable: %v", err)
+	} else {
+		content.Close()
+	}
+
+	remove(t, s, second.ID)
+	if n := refs(t, s, hash); n != 0 {
+		t.Fatalf("%d refs after the last purge, want the blob gone", n)
+	}
+	if _, err := s.repo.Get(second.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("purged record: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestBlobKeptByVersion(t *testing.T) {
+	s := newService(t, nil)
+	file := ingest(t, s, Upload{}, "first")
+	old := file.Hash()
+	dup := ingest(t, s, Upload{}, "first")
+
+	// The replaced content lives on as version 1
+	current := replace(t, s, file.ID, "second").Hash()
+	if n := refs(t, s, old); n != 2 {
+		t.Fatalf("%d refs on the old content, want the version and the duplicate", n)
+	}
+
+	remove(t, s, dup.ID)
+	if n := refs(t, s, old); n != 1 {
+		t.Fatalf("%d refs on the old content, want the version's", n)
+	}
+	_, _, content, err := s.OpenVersion(context.Background(), file.ID, 1)
+	if err != nil {
+		t.Fatalf("version 1 unreadable: %v", err)
+	}
+	content.Close()
+
+	// Purging the file drops its versions and with them the last references
+	remove(t, s, file.ID)
+	if n := refs(t, s, old); n != 0 {
+		t.Errorf("%d refs on the old content after purge", n)
+	}
+	if n := refs(t, s, current); n != 0 {
+		t.Errorf("%d refs on the current content after purge", n)
+	}
+}
+
+func TestVersionsOfSameContent(t *testing.T) {
+	s := newService(t, nil)
+	file := ingest(t, s, Upload{}, "a")
+	hash := file.Hash()
+
+	// a, b, a: two versions hold a reference to the same blob
+	replace(t, s, file.ID, "b")
+	replace(t, s, file.ID, "a")
+	if n := refs(t, s, hash); n != 2 {
+		t.Fatalf("%d refs, want one per version", n)
+	}
+
+	remove(t, s, file.ID)
+	if n := refs(t, s, hash); n != 0 {
+		t.Errorf("%d refs after purge", n)
+	}
+}
@@ -0,0 +1,117 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// latestExpiry is the last time the expiry index can order, UnixNano
+// overflows after it
+var latestExpiry = time.Unix(0, math.MaxInt64).UTC()
+
+// ParseExpiry turns the expires_at or ttl option of an upload into an
+// expiry time. expires_at is RFC 3339, ttl a duration like "90m" or a
+// number of seconds. Empty values mean the file doesn't expire.
+func ParseExpiry(expiresAt, ttl string, now time.Time) (*time.Time, error) {
+	var t time.Time
+	switch {
+	case expiresAt != "" && ttl != "":
+		return nil, fmt.Errorf("%w: expires_at and ttl can't be combined", ErrInvalidExpiry)
+	case expiresAt != "":
+		parsed, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("%w: expires_at must be an RFC 3339 time", ErrInvalidExpiry)
+		}
+		t = parsed.UTC()
+	case ttl != "":
+		d, err := parseTTL(ttl)
+		if err != nil {
+			return nil, err
+		}
+		t = now.Add(d).UTC()
+	default:
+		return nil, nil
+	}
+
+	if t.Before(time.Unix(0, 0)) || t.After(latestExpiry) {
+		return nil, fmt.Errorf("%w: expiry must be between 1970 and %s", ErrInvalidExpiry, latestExpiry.Format(time.RFC3339))
+	}
+	return &t, nil
+}
+
+func parseTTL(ttl string) (time.Duration, error) {
+	var d time.Duration
+	if seconds, err := strconv.ParseInt(ttl, 10, 64); err == nil {
+		if seconds > int64(time.Duration(1<<63-1)/time.Second) {
+			return 0, fmt.Errorf("%w: ttl is too long", ErrInvalidExpiry)
+		}
+		d = time.Duration(seconds) * time.Second
+	} else if d, err = time.ParseDuration(ttl); err != nil {
+		return 0, fmt.Errorf("%w: ttl must be a duration or a number of seconds", ErrInvalidExpiry)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%w: ttl must be positive", ErrInvalidExpiry)
+	}
+	return d, nil
+}
+
+func (s *Service) startExpiryGC() {
+	interval := time.Duration(s.cfg.Expiry.GCIntervalMinutes) * time.Minute
+	s.tasks.every(interval, func(ctx context.Context) {
+		s.collectExpired(ctx, time.Now())
+	})
+}
+
+// collectExpired deletes every file whose expiry time has passed, whether
+// it is in the trash or not
+func (s *Service) collectExpired(ctx context.Context, now time.Time) {
+	// The expiry index is ordered oldest first, so everything up to now is due
+	end := expiryPrefix + fmt.Sprintf("%019d", now.UnixNano()) + "/\xff"
+
+	var ids []string
+	s.db.Scan(expiryPrefix, "", func(key string, _ []byte) bool {
+		if key > end {
+			return false
+		}
+		ids = append(ids, key[strings.LastIndexByte(key, '/')+1:])
+		return true
+	})
+
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return
+		}
+		file, err := s.repo.Get(id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err == nil && !file.Expired(now) {
+			// The expiry changed since we scanned the index
+			continue
+		}
+		if err == nil {
+			err = s.purge(ctx, id)
+		}
+		if err != nil {
+			if !errors.Is(err, ErrNotFound) {
+				s.logger.Error("Failed to delete expired file", map[string]any{
+					"id":    id,
+					"error": err.Error(),
+				})
+			}
+			continue
+		}
+
+		s.logger.Info("Expired file deleted", map[string]any{
+			"id":         id,
+			"name":       file.Name,
+			"owner":      file.Owner,
+			"expires_at": file.ExpiresAt.Format(time.RFC3339),
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseExpiry(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		expiresAt string
+		ttl       string
+		want      time.Time
+		wantErr   bool
+	}{
+		{name: "none"},
+		{name: "expires_at", expiresAt: "2026-10-17T12:00:00+02:00", want: time.Date(2026, 10, 17, 10, 0, 0, 0, time.UTC)},
+		{name: "ttl duration", ttl: "90m", want: now.Add(90 * time.Minute)},
+		{name: "ttl seconds", ttl: "3600", want: now.Add(time.Hour)},
+		{name: "both", expiresAt: "2026-10-17T12:00:00Z", ttl: "1h", wantErr: true},
+		{name: "expires_at not rfc 3339", expiresAt: "2026-10-17", wantErr: true},
+		{name: "ttl not a duration", ttl: "soon", wantErr: true},
+		{name: "ttl zero", ttl: "0", wantErr: true},
+		{name: "ttl negative", ttl: "-5m", wantErr: true},
+		{name: "ttl overflowing a duration", ttl: "9223372036854775807", wantErr: true},
+		{name: "last orderable expiry", expiresAt: "2262-04-11T23:47:16Z", want: time.Date(2262, 4, 11, 23, 47, 16, 0, time.UTC)},
+		{name: "expires_at past 2262", expiresAt: "2262-04-12T00:00:00Z", wantErr: true},
+		{name: "expires_at far future", expiresAt: "9999-12-31T23:59:59Z", wantErr: true},
+		{name: "expires_at before 1970", expiresAt: "1600-01-01T00:00:00Z", wantErr: true},
+		{name: "ttl past 2262", ttl: "2100000h", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseExpiry(tt.expiresAt, tt.ttl, now)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidExpiry) {
+					t.Fatalf("err = %v, want ErrInvalidExpiry", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want.IsZero() {
+				if got != nil {
+					t.Fatalf("expires at %v, want never", got)
+				}
+				return
+			}
+			if got == nil || !got.Equal(tt.want) || got.Location() != time.UTC {
+				t.Errorf("expires at %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollectExpired(t *testing.T) {
+	s := newService(t, nil)
+	now := time.Now().UTC()
+	soon, later := now.Add(time.Minute), now.Add(time.Hour)
+	last := latestExpiry
+
+	expiring := ingest(t, s, Upload{ExpiresAt: &soon}, "expiring")
+	trashed := ingest(t, s, Upload{ExpiresAt: &soon}, "trashed")
+	if _, err := s.Trash(trashed.ID); err != nil {
+		t.Fatal(err)
+	}
+	kept := ingest(t, s, Upload{ExpiresAt: &later}, "kept")
+	distant := ingest(t, s, Upload{ExpiresAt: &last}, "distant")
+
+	s.collectExpired(context.Background(), now.Add(10*time.Minute))
+
+	for _, id := range []string{expiring.ID, trashed.ID} {
+		if _, err := s.repo.Get(id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expired file %s: err = %v, want it purged", id, err)
+		}
+	}
+	for _, id := range []string{kept.ID, distant.ID} {
+		if _, err := s.Get(id); err != nil {
+			t.Errorf("file %s: %v, want it kept", id, err)
+		}
+	}
+	if n := refs(t, s, expiring.Hash()); n != 0 {
+		t.Errorf("%d refs on expired content", n)
+	}
+}
@@ -0,0 +1,425 @@
+package files
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"noverna.de/m/v2/internal/config"
+	"noverna.de/m/v2/internal/imaging"
+	"noverna.de/m/v2/internal/kv"
+	"noverna.de/m/v2/internal/logger"
+	"noverna.de/m/v2/internal/sniff"
+	"noverna.de/m/v2/internal/storage"
+)
+
+var (
+	ErrTooLarge         = errors.New("file exceeds the maximum upload size")
+	ErrTypeNotAllowed   = errors.New("file type is not allowed")
+	ErrEmpty            = errors.New("file is empty")
+	ErrInvalidContent   = errors.New("file content is malformed")
+	ErrInvalidTags      = errors.New("invalid tags")
+	ErrInvalidNamespace = errors.New("invalid namespace")
+	ErrInvalidExpiry    = errors.New("invalid expiry")
+)
+
+// File is the metadata we hand back to clients after an upload
+type File struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Size      int64      `json:"size"`
+	Mime      string     `json:"mime"`
+	Checksum  string     `json:"checksum"`
+	Namespace string     `json:"namespace"`
+	Owner     string     `json:"owner,omitempty"`
+	Tags      []string   `json:"tags"`
+	Version   int        `json:"version"`
+	Duplicate bool       `json:"duplicate,omitempty"`
+	Image     *ImageInfo `json:"image,omitempty"`
+	Video     *VideoInfo `json:"video,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	// ModifiedAt is when the current content was uploaded
+	ModifiedAt time.Time  `json:"modified_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	DeletedAt  *time.Time `json:"deleted_at,omitempty"`
+}
+
+// Hash returns the hex SHA-256 of the content, which is also its blob id
+func (f *File) Hash() string {
+	return strings.TrimPrefix(f.Checksum, "sha256:")
+}
+
+// LastModified returns when the current content was written
+func (f *File) LastModified() time.Time {
+	if f.ModifiedAt.IsZero() {
+		return f.CreatedAt
+	}
+	return f.ModifiedAt
+}
+
+// Expired reports whether the file is past its expiry time at now
+func (f *File) Expired(now time.Time) bool {
+	return f.ExpiresAt != nil && !now.Before(*f.ExpiresAt)
+}
+
+// Trashed reports whether the file was deleted but can still be restored
+func (f *File) Trashed() bool {
+	return f.DeletedAt != nil
+}
+
+// Upload describes an incoming file as the client announced it
+type Upload struct {
+	Name         string
+	DeclaredType string
+	Namespace    string
+	Owner        string
+	Tags         []string
+	// ExpiresAt makes the file disappear automatically, nil keeps it forever
+	ExpiresAt *time.Time
+	// KeepMetadata skips EXIF/XMP stripping and orientation normalization
+	KeepMetadata bool
+}
+
+// Service handles everything between an incoming byte stream and the storage backend
+type Service struct {
+	cfg     *config.Config
+	logger  *logger.Logger
+	backend storage.Backend
+	db      *kv.DB
+	repo    Repository
+
+	variantSizes []imaging.Size
+	blobLocks    keyedMutex
+	fileLocks    keyedMutex
+	tasks        *background
+
+	// replica is where damaged blobs are restored from, nil if not configured
+	replica   storage.Backend
+	scrubbing atomic.Bool
+}
+
+func NewService(cfg *config.Config, log *logger.Logger, backend storage.Backend, db *kv.DB) (*Service, error) {
+	if log == nil {
+		log = logger.NewLogger()
+		log.WithField("service", "API")
+		log.WithField("component", "files")
+	}
+
+	if err := os.MkdirAll(cfg.Server.TempDir, 0o755); err != nil {
+		return nil, fmt.Errorf("create %s: %w", cfg.Server.TempDir, err)
+	}
+
+	sizes, err := parseVariantSizes(cfg.Images.VariantSizes)
+	if err != nil {
+		return nil, err
+	}
+
+	repo, err := newKVRepository(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var replica storage.Backend
+	if cfg.Scrub.Replica.Backend != "" {
+		if cfg.Scrub.Replica.Backend == "local" && cfg.Scrub.Replica.Local.Root == "" {
+			return nil, errors.New("scrub.replica.local.root is required")
+		}
+		replica, err = storage.NewBackend(cfg.Scrub.Replica, "", cfg.Server.TempDir)
+		if err != nil {
+			return nil, fmt.Errorf("scrub replica: %w", err)
+		}
+	}
+
+	s := &Service{
+		cfg:          cfg,
+		logger:       log,
+		backend:      backend,
+		db:           db,
+		repo:         repo,
+		variantSizes: sizes,
+		tasks:        newBackground(),
+		replica:      replica,
+	}
+	s.resumeRemuxes()
+	s.startReaper()
+	s.startExpiryGC()
+	s.startScrubber()
+	return s, nil
+}
+
+// Close stops background tasks, waiting for them until ctx expires
+func (s *Service) Close(ctx context.Context) error {
+	return s.tasks.stop(ctx)
+}
+
+// MaxFileSize returns the upload limit in bytes
+func (s *Service) MaxFileSize() int64 {
+	return int64(s.cfg.Uploads.MAX_FILE_SIZE) * 1024 * 1024
+}
+
+// IsAllowed reports whether the mime type is listed in Uploads.AllowedTypes
+func (s *Service) IsAllowed(mime string) bool {
+	mime = sniff.Normalize(mime)
+	for _, allowed := range s.cfg.Uploads.AllowedTypes {
+		if sniff.Normalize(allowed) == mime {
+			return true
+		}
+	}
+	return false
+}
+
+// Ingest streams r into the temp dir, enforcing size and type limits on the way,
+// and hands the finished file to the storage backend. Content we already have
+// is not stored twice, the new file just references the existing blob.
+func (s *Service) Ingest(ctx context.Context, upload Upload, r io.Reader) (*File, error) {
+	tags, err := NormalizeTags(upload.Tags)
+	if err != nil {
+		return nil, err
+	}
+	namespace, err := NormalizeNamespace(upload.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	if upload.ExpiresAt != nil && !upload.ExpiresAt.After(now) {
+		return nil, fmt.Errorf("%w: expiry is in the past", ErrInvalidExpiry)
+	}
+
+	id, err := NewID()
+	if err != nil {
+		return nil, err
+	}
+
+	file := &File{
+		ID:         id,
+		Name:       filepath.Base(upload.Name),
+		Namespace:  namespace,
+		Owner:      upload.Owner,
+		Tags:       tags,
+		Version:    1,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		ModifiedAt: now,
+		ExpiresAt:  upload.ExpiresAt,
+	}
+
+	path, cleanup, err := s.receive(ctx, upload, r, file)
+	defer cleanup()
+	if err != nil {
+		return nil, err
+	}
+
+	remux := s.wantsRemux(file)
+	if remux {
+		file.Video.Remux = newTaskStatus(TaskPending, nil)
+	}
+
+	duplicate, err := s.commit(ctx, file, path)
+	if err != nil {
+		return nil, err
+	}
+	file.Duplicate = duplicate
+	if remux {
+		s.queueRemux(file.ID)
+	}
+
+	s.logger.Info("File stored", map[string]any{
+		"id":        file.ID,
+		"size":      file.Size,
+		"mime":      file.Mime,
+		"duplicate": file.Duplicate,
+	})
+	return file, nil
+}
+
+// receive streams r into the temp dir and runs the content checks. It fills
+// in the content fields of file (size, type, checksum, image and video info)
+// and returns where the final bytes are. cleanup must always be called.
+func (s *Service) receive(ctx context.Context, upload Upload, r io.Reader, file *File) (string, func(), error) {
+	var paths []string
+	cleanup := func() {
+		for _, path := range paths {
+			os.Remove(path)
+		}
+	}
+
+	tmp, err := os.CreateTemp(s.cfg.Server.TempDir, "upload-*")
+	if err != nil {
+		return "", cleanup, fmt.Errorf("create temp file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	paths = append(paths, tmpPath)
+	defer tmp.Close()
+
+	limit, err := s.uploadLimit(r, upload.Owner)
+	if err != nil {
+		return "", cleanup, err
+	}
+	br := bufio.NewReaderSize(limit, sniff.HeaderSize)
+	head, err := br.Peek(sniff.HeaderSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return "", cleanup, err
+	}
+	if len(head) == 0 {
+		return "", cleanup, ErrEmpty
+	}
+
+	// Type check happens before a single byte touches the disk
+	mime, err := sniff.Check(upload.DeclaredType, head)
+	if err != nil {
+		return "", cleanup, err
+	}
+	if !s.IsAllowed(mime) {
+		return "", cleanup, fmt.Errorf("%w: %s", ErrTypeNotAllowed, mime)
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), &ctxReader{ctx: ctx, r: br})
+	if err != nil {
+		return "", cleanup, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return "", cleanup, fmt.Errorf("sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", cleanup, fmt.Errorf("close temp file: %w", err)
+	}
+
+	file.Size = size
+	file.Mime = mime
+	file.Checksum = "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	file.Image = nil
+	file.Video = nil
+
+	storedPath, err := s.processImage(file, tmpPath, upload.KeepMetadata)
+	if err != nil {
+		return "", cleanup, err
+	}
+	if storedPath != tmpPath {
+		paths = append(paths, storedPath)
+
+		// Stripping changed the bytes, so the content address changes with them
+		sum, n, err := hashFile(storedPath)
+		if err != nil {
+			return "", cleanup, err
+		}
+		file.Checksum = "sha256:" + sum
+		file.Size = n
+	}
+
+	if err := s.inspectVideo(file, storedPath); err != nil {
+		return "", cleanup, err
+	}
+	return storedPath, cleanup, nil
+}
+
+// IsRejected reports whether err means the upload itself is unacceptable,
+// as opposed to something going wrong on our side
+func IsRejected(err error) bool {
+	var mismatch *sniff.MismatchError
+	return errors.Is(err, ErrTooLarge) ||
+		errors.Is(err, ErrTypeNotAllowed) ||
+		errors.Is(err, ErrEmpty) ||
+		errors.Is(err, ErrInvalidContent) ||
+		errors.Is(err, ErrInvalidTags) ||
+		errors.Is(err, ErrInvalidNamespace) ||
+		errors.Is(err, ErrInvalidExpiry) ||
+		errors.As(err, &mismatch)
+}
+
+const (
+	maxTags      = 20
+	maxTagLength = 64
+)
+
+// DefaultNamespace is used for uploads that don't name one
+const DefaultNamespace = "default"
+
+// NormalizeNamespace lowercases a namespace, "" becomes DefaultNamespace
+func NormalizeNamespace(namespace string) (string, error) {
+	namespace = strings.ToLower(strings.TrimSpace(namespace))
+	if namespace == "" {
+		return DefaultNamespace, nil
+	}
+	if len(namespace) > maxTagLength || strings.Trim(namespace, "abcdefghijklmnopqrstuvwxyz0123456789-_.") != "" {
+		return "", fmt.Errorf("%w: %q", ErrInvalidNamespace, namespace)
+	}
+	return namespace, nil
+}
+
+// NormalizeTags lowercases and dedups tags. Tags may contain letters, digits
+// and "-_.:", anything else is rejected.
+func NormalizeTags(tags []string) ([]string, error) {
+	normalized := []string{}
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len(tag) > maxTagLength || strings.Trim(tag, "abcdefghijklmnopqrstuvwxyz0123456789-_.:") != "" {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidTags, tag)
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	if len(normalized) > maxTags {
+		return nil, fmt.Errorf("%w: at most %d tags are allowed", ErrInvalidTags, maxTags)
+	}
+	return normalized, nil
+}
+
+// NewID returns a random, URL safe file id
+func NewID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// limitReader fails with ErrTooLarge once more than n bytes were read
+type limitReader struct {
+	r   io.Reader
+	n   int64
+	err error // returned once more than n bytes were read
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, l.err
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, l.err
+	}
+	return n, err
+}
+
+// ctxReader stops the copy as soon as the request is gone
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
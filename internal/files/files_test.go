@@ -0,0 +1,94 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"noverna.de/m/v2/internal/config"
+	"noverna.de/m/v2/internal/kv"
+	"noverna.de/m/v2/internal/logger"
+	"noverna.de/m/v2/internal/storage"
+)
+
+// newService returns a service on the memory backend with a fresh database.
+// modify, if not nil, adjusts the config before the service is created.
+func newService(t *testing.T, modify func(cfg *config.Config)) *Service {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &config.Config{
+		Server:     config.Server{DataDir: dir, TempDir: filepath.Join(dir, "tmp")},
+		Uploads:    config.Uploads{MAX_FILE_SIZE: 1, AllowedTypes: []string{"text/plain"}},
+		Trash:      config.Trash{RetentionHours: 1, ReapIntervalMinutes: 60},
+		Versioning: config.Versioning{MaxVersions: 10},
+		Expiry:     config.Expiry{GCIntervalMinutes: 60},
+	}
+	if modify != nil {
+		modify(cfg)
+	}
+
+	db, err := kv.Open(filepath.Join(dir, "files.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewService(cfg, logger.NewLogger().SetOutput(io.Discard), storage.NewMemory(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Close(context.Background())
+		db.Close()
+	})
+	return s
+}
+
+func ingest(t *testing.T, s *Service, upload Upload, content string) *File {
+	t.Helper()
+	file, err := s.Ingest(context.Background(), upload, strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("ingest %q: %v", content, err)
+	}
+	return file
+}
+
+func replace(t *testing.T, s *Service, id, content string) *File {
+	t.Helper()
+	file, err := s.Replace(context.Background(), id, Upload{}, strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("replace %s with %q: %v", id, content, err)
+	}
+	return file
+}
+
+// remove trashes and purges a file
+func remove(t *testing.T, s *Service, id string) {
+	t.Helper()
+	if _, err := s.Trash(id); err != nil {
+		t.Fatalf("trash %s: %v", id, err)
+	}
+	if err := s.Purge(context.Background(), id); err != nil {
+		t.Fatalf("purge %s: %v", id, err)
+	}
+}
+
+// refs returns how many references the blob record of hash holds, 0 if
+// there is none, and fails if record and storage disagree about the blob
+func refs(t *testing.T, s *Service, hash string) int {
+	t.Helper()
+	blob, recorded := s.blobRecord(hash)
+	_, err := s.backend.Stat(context.Background(), BlobKey(hash))
+	stored := err == nil
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		t.Fatal(err)
+	}
+	if recorded != stored {
+		t.Fatalf("blob %s: recorded %v, stored %v", hash[:8], recorded, stored)
+	}
+	if !recorded {
+		return 0
+	}
+	return blob.Refs
+}
@@ -0,0 +1,142 @@
+package files
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"noverna.de/m/v2/internal/imagemeta"
+	"noverna.de/m/v2/internal/imaging"
+)
+
+// ImageInfo is the metadata we extract from uploaded images before stripping it
+type ImageInfo struct {
+	Width            int        `json:"width"`
+	Height           int        `json:"height"`
+	CameraMake       string     `json:"camera_make,omitempty"`
+	CameraModel      string     `json:"camera_model,omitempty"`
+	CapturedAt       *time.Time `json:"captured_at,omitempty"`
+	Orientation      int        `json:"orientation,omitempty"`
+	MetadataStripped bool       `json:"metadata_stripped"`
+}
+
+type metaProcessor func(r io.Reader, w io.Writer) (*imagemeta.Metadata, error)
+
+var metaProcessors = map[string]metaProcessor{
+	"image/jpeg": imagemeta.ProcessJPEG,
+	"image/png":  imagemeta.ProcessPNG,
+}
+
+// processImage extracts the metadata of a JPEG or PNG upload and, unless the
+// client asked to keep it, strips it and bakes the EXIF orientation into the
+// pixels. It returns the path of the file to store, which is tmpPath itself
+// if nothing had to change.
+func (s *Service) processImage(file *File, tmpPath string, keep bool) (string, error) {
+	process, ok := metaProcessors[file.Mime]
+	if !ok {
+		return tmpPath, nil
+	}
+
+	in, err := os.Open(tmpPath)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	if keep {
+		meta, err := process(in, nil)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrInvalidContent, err)
+		}
+		file.Image = imageInfo(meta, false)
+		return tmpPath, nil
+	}
+
+	out, err := os.CreateTemp(s.cfg.Server.TempDir, "processed-*")
+	if err != nil {
+		return "", err
+	}
+	outPath := out.Name()
+	defer out.Close()
+
+	meta, err := process(in, out)
+	if err != nil {
+		os.Remove(outPath)
+		return "", fmt.Errorf("%w: %v", ErrInvalidContent, err)
+	}
+
+	if meta.NeedsRotation() {
+		// Re-encoding drops every bit of metadata on its own
+		if err := s.reorient(in, out, file.Mime, meta.Orientation); err != nil {
+			os.Remove(outPath)
+			return "", err
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		os.Remove(outPath)
+		return "", err
+	}
+
+	file.Image = imageInfo(meta, true)
+	return outPath, nil
+}
+
+func (s *Service) reorient(in *os.File, out *os.File, mime string, orientation int) error {
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	img, _, err := imaging.Decode(in)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidContent, err)
+	}
+
+	if err := out.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	format := imaging.FormatPNG
+	if mime == "image/jpeg" {
+		format = imaging.FormatJPEG
+	}
+	return imaging.Encode(out, imaging.Orient(img, orientation), format, s.cfg.Images.JPEGQuality)
+}
+
+func imageInfo(meta *imagemeta.Metadata, stripped bool) *ImageInfo {
+	info := &ImageInfo{
+		Width:            meta.Width,
+		Height:           meta.Height,
+		CameraMake:       meta.CameraMake,
+		CameraModel:      meta.CameraModel,
+		CapturedAt:       meta.CapturedAt,
+		Orientation:      meta.Orientation,
+		MetadataStripped: stripped,
+	}
+	// Report the dimensions the image is displayed with
+	if meta.SwapsAxes() {
+		info.Width, info.Height = info.Height, info.Width
+	}
+	return info
+}
+
+// hashFile returns the SHA-256 and size of a local file
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
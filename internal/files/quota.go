@@ -0,0 +1,152 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"noverna.de/m/v2/internal/kv"
+)
+
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// Which part of a quota was hit
+const (
+	QuotaBytes = "bytes"
+	QuotaFiles = "files"
+)
+
+// Quota limits what one owner may store, zero values are unlimited
+type Quota struct {
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+	MaxFiles int64 `json:"max_files,omitempty"`
+}
+
+// Remaining returns how many bytes still fit, -1 if there is no limit
+func (q Quota) Remaining(usage *Usage) int64 {
+	if q.MaxBytes == 0 {
+		return -1
+	}
+	return max(q.MaxBytes-usage.Total(), 0)
+}
+
+// QuotaError tells the owner which limit an upload ran into
+type QuotaError struct {
+	Limit string `json:"limit"`
+	Usage *Usage `json:"usage"`
+	Quota Quota  `json:"quota"`
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s: %s limit reached", ErrQuotaExceeded, e.Limit)
+}
+
+func (e *QuotaError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+// Full reports whether nothing fits anymore, as opposed to an upload being
+// too large for what is left
+func (e *QuotaError) Full() bool {
+	return e.Limit == QuotaFiles || e.Quota.Remaining(e.Usage) == 0
+}
+
+// Quota returns the limits of an owner
+func (s *Service) Quota(owner string) Quota {
+	q := s.cfg.Quotas
+	maxMB, maxFiles := q.MaxMB, q.MaxFiles
+	if override, ok := q.Owners[owner]; ok {
+		if override.MaxMB != 0 {
+			maxMB = override.MaxMB
+		}
+		if override.MaxFiles != 0 {
+			maxFiles = override.MaxFiles
+		}
+	}
+
+	quota := Quota{}
+	if maxMB > 0 {
+		quota.MaxBytes = int64(maxMB) * 1024 * 1024
+	}
+	if maxFiles > 0 {
+		quota.MaxFiles = int64(maxFiles)
+	}
+	return quota
+}
+
+// CheckQuota tells early whether a new file of size bytes would fit. A
+// negative size means unknown, then only a full quota is reported: empty
+// files are rejected anyway, so any file needs at least a byte. The final
+// check happens when the file is stored.
+func (s *Service) CheckQuota(owner string, size int64) error {
+	quota := s.Quota(owner)
+	if quota == (Quota{}) {
+		return nil
+	}
+	usage, err := s.Usage(owner)
+	if err != nil {
+		return err
+	}
+	return quota.check(usage, usage.Files+usage.TrashedFiles+1, usage.Total()+max(size, 1))
+}
+
+func (q Quota) check(usage *Usage, files, bytes int64) error {
+	if q.MaxFiles > 0 && files > q.MaxFiles {
+		return &QuotaError{Limit: QuotaFiles, Usage: usage, Quota: q}
+	}
+	if q.MaxBytes > 0 && bytes > q.MaxBytes {
+		return &QuotaError{Limit: QuotaBytes, Usage: usage, Quota: q}
+	}
+	return nil
+}
+
+// uploadLimit caps how much of an upload is read: the upload limit or what
+// is left of the owner's quota, whichever is smaller
+func (s *Service) uploadLimit(r io.Reader, owner string) (*limitReader, error) {
+	limit := &limitReader{r: r, n: s.MaxFileSize(), err: ErrTooLarge}
+
+	quota := s.Quota(owner)
+	if quota.MaxBytes == 0 {
+		return limit, nil
+	}
+	usage, err := s.Usage(owner)
+	if err != nil {
+		return nil, err
+	}
+	if room := quota.Remaining(usage); room < limit.n {
+		limit.n = room
+		limit.err = &QuotaError{Limit: QuotaBytes, Usage: usage, Quota: quota}
+	}
+	return limit, nil
+}
+
+// withinQuota runs fn, which changes the usage of owner inside tx, and fails
+// if that made the usage grow past the quota. Owners that are over their
+// quota already, e.g. after it was lowered, can still shrink.
+func (s *Service) withinQuota(tx *kv.Tx, owner string, fn func() error) error {
+	quota := s.Quota(owner)
+	if quota == (Quota{}) {
+		return fn()
+	}
+
+	before := &Usage{}
+	if _, err := tx.GetJSON(usageKey(owner), before); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	after := &Usage{}
+	if _, err := tx.GetJSON(usageKey(owner), after); err != nil {
+		return err
+	}
+
+	files, bytes := int64(0), int64(0)
+	if grown := after.Files + after.TrashedFiles; grown > before.Files+before.TrashedFiles {
+		files = grown
+	}
+	if grown := after.Total(); grown > before.Total() {
+		bytes = grown
+	}
+	return quota.check(before, files, bytes)
+}
@@ -0,0 +1,268 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"noverna.de/m/v2/internal/config"
+)
+
+const kb = 1024
+
+func content(letter string, size int) string {
+	return strings.Repeat(letter, size)
+}
+
+func usage(t *testing.T, s *Service, owner string) Usage {
+	t.Helper()
+	u, err := s.Usage(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *u
+}
+
+func total(t *testing.T, s *Service, owner string) int64 {
+	t.Helper()
+	u := usage(t, s, owner)
+	return u.Total()
+}
+
+func quotaError(t *testing.T, err error) *QuotaError {
+	t.Helper()
+	var quota *QuotaError
+	if !errors.As(err, &quota) || !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("err = %v, want a QuotaError", err)
+	}
+	return quota
+}
+
+func TestQuota(t *testing.T) {
+	s := newService(t, func(cfg *config.Config) {
+		cfg.Quotas = config.Quotas{
+			MaxMB:    2,
+			MaxFiles: 10,
+			Owners: map[string]config.OwnerQuota{
+				"big":       {MaxMB: 8},
+				"unlimited": {MaxMB: -1, MaxFiles: -1},
+				"few":       {MaxFiles: 1},
+			},
+		}
+	})
+
+	tests := map[string]Quota{
+		"someone":   {MaxBytes: 2 << 20, MaxFiles: 10},
+		"big":       {MaxBytes: 8 << 20, MaxFiles: 10},
+		"unlimited": {},
+		"few":       {MaxBytes: 2 << 20, MaxFiles: 1},
+	}
+	for owner, want := range tests {
+		if got := s.Quota(owner); got != want {
+			t.Errorf("quota of %s = %+v, want %+v", owner, got, want)
+		}
+	}
+}
+
+func TestQuotaErrorFull(t *testing.T) {
+	quota := Quota{MaxBytes: 100, MaxFiles: 5}
+
+	tests := []struct {
+		name  string
+		limit string
+		usage Usage
+		want  bool
+	}{
+		{name: "bytes left", limit: QuotaBytes, usage: Usage{Bytes: 40}, want: false},
+		{name: "bytes used up", limit: QuotaBytes, usage: Usage{Bytes: 60, TrashedBytes: 30, VersionBytes: 10}, want: true},
+		{name: "bytes over", limit: QuotaBytes, usage: Usage{Bytes: 150}, want: true},
+		{name: "files", limit: QuotaFiles, usage: Usage{Files: 5}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := &QuotaError{Limit: tt.limit, Usage: &tt.usage, Quota: quota}
+			if got := err.Full(); got != tt.want {
+				t.Errorf("Full() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUploadWithinQuota(t *testing.T) {
+	s := newService(t, func(cfg *config.Config) {
+		cfg.Quotas = config.Quotas{MaxMB: 1, MaxFiles: 3}
+	})
+	upload := Upload{Owner: "alice"}
+
+	ingest(t, s, upload, content("a", 600*kb))
+
+	// Too large for what is left: a smaller upload would still fit, so not full
+	_, err := s.Ingest(context.Background(), upload, strings.NewReader(content("b", 600*kb)))
+	if quota := quotaError(t, err); quota.Limit != QuotaBytes || quota.Full() {
+		t.Fatalf("%s limit, full %v, want bytes and not full", quota.Limit, quota.Full())
+	}
+	if err := s.CheckQuota("alice", 600*kb); err == nil {
+		t.Error("CheckQuota let an upload through that doesn't fit")
+	}
+	if err := s.CheckQuota("alice", 400*kb); err != nil {
+		t.Errorf("CheckQuota: %v for an upload that fits", err)
+	}
+
+	// Exactly what is left fits, after that nothing does
+	ingest(t, s, upload, content("c", 1<<20-600*kb))
+	_, err = s.Ingest(context.Background(), upload, strings.NewReader("d"))
+	if quota := quotaError(t, err); quota.Limit != QuotaBytes || !quota.Full() {
+		t.Fatalf("%s limit, full %v, want bytes and full", quota.Limit, quota.Full())
+	}
+	if err := s.CheckQuota("alice", -1); err == nil {
+		t.Error("CheckQuota of unknown size passed with a full quota")
+	}
+	if got := usage(t, s, "alice"); got.Files != 2 || got.Bytes != 1<<20 {
+		t.Errorf("usage %+v after rejected uploads", got)
+	}
+
+	// Other owners aren't affected, and the file count is a limit of its own
+	other := Upload{Owner: "bob"}
+	for i := range 3 {
+		ingest(t, s, other, content("e", i+1))
+	}
+	_, err = s.Ingest(context.Background(), other, strings.NewReader("f"))
+	if quota := quotaError(t, err); quota.Limit != QuotaFiles || !quota.Full() {
+		t.Fatalf("%s limit, full %v, want files and full", quota.Limit, quota.Full())
+	}
+}
+
+func TestUsageAccounting(t *testing.T) {
+	s := newService(t, nil)
+	a := ingest(t, s, Upload{Owner: "alice"}, content("a", 5))
+	b := ingest(t, s, Upload{Owner: "alice"}, content("b", 3))
+	ingest(t, s, Upload{Owner: "bob"}, content("a", 5))
+
+	steps := []struct {
+		name string
+		do   func() error
+		want Usage
+	}{
+		{
+			name: "uploads",
+			do:   func() error { return nil },
+			want: Usage{Files: 2, Bytes: 8},
+		},
+		{
+			name: "replace",
+			do: func() error {
+				_, err := s.Replace(context.Background(), a.ID, Upload{}, strings.NewReader(content("c", 7)))
+				return err
+			},
+			want: Usage{Files: 2, Bytes: 10, Versions: 1, VersionBytes: 5},
+		},
+		{
+			name: "trash",
+			do: func() error {
+				_, err := s.Trash(b.ID)
+				return err
+			},
+			want: Usage{Files: 1, Bytes: 7, TrashedFiles: 1, TrashedBytes: 3, Versions: 1, VersionBytes: 5},
+		},
+		{
+			name: "restore",
+			do: func() error {
+				_, err := s.Restore(b.ID)
+				return err
+			},
+			want: Usage{Files: 2, Bytes: 10, Versions: 1, VersionBytes: 5},
+		},
+		{
+			name: "promote",
+			do: func() error {
+				_, err := s.Promote(context.Background(), a.ID, 1)
+				return err
+			},
+			want: Usage{Files: 2, Bytes: 8, Versions: 2, VersionBytes: 12},
+		},
+		{
+			name: "purge with versions",
+			do: func() error {
+				if _, err := s.Trash(a.ID); err != nil {
+					return err
+				}
+				return s.Purge(context.Background(), a.ID)
+			},
+			want: Usage{Files: 1, Bytes: 3},
+		},
+		{
+			name: "purge the last file",
+			do: func() error {
+				if _, err := s.Trash(b.ID); err != nil {
+					return err
+				}
+				return s.Purge(context.Background(), b.ID)
+			},
+			want: Usage{},
+		},
+	}
+
+	for _, step := range steps {
+		if err := step.do(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if got := usage(t, s, "alice"); got != step.want {
+			t.Errorf("after %s: usage %+v, want %+v", step.name, got, step.want)
+		}
+	}
+	if _, ok := s.db.Get(usageKey("alice")); ok {
+		t.Error("empty usage record kept")
+	}
+	if got := usage(t, s, "bob"); got != (Usage{Files: 1, Bytes: 5}) {
+		t.Errorf("usage of bob changed to %+v", got)
+	}
+}
+
+func TestShrinkOverQuota(t *testing.T) {
+	s := newService(t, func(cfg *config.Config) {
+		cfg.Versioning.MaxVersions = 2
+	})
+	file := ingest(t, s, Upload{Owner: "alice"}, content("a", 700*kb))
+	replace(t, s, file.ID, content("b", 100*kb))
+	replace(t, s, file.ID, content("c", 600*kb))
+	if got := total(t, s, "alice"); got != 1400*kb {
+		t.Fatalf("usage %d, want 1400 KiB", got)
+	}
+
+	// The quota is lowered below what alice stores already
+	s.cfg.Quotas.MaxMB = 1
+
+	if _, err := s.Ingest(context.Background(), Upload{Owner: "alice"}, strings.NewReader("x")); err == nil {
+		t.Fatal("upload accepted while over quota")
+	}
+
+	// Promoting the small version prunes the large one, which shrinks the usage
+	if _, err := s.Promote(context.Background(), file.ID, 2); err != nil {
+		t.Fatalf("shrinking promote: %v", err)
+	}
+	if got := total(t, s, "alice"); got != 800*kb {
+		t.Fatalf("usage %d after promote, want 800 KiB", got)
+	}
+
+	// Growing again is not allowed, even though it only brings back old content
+	_, err := s.Promote(context.Background(), file.ID, 3)
+	quotaError(t, err)
+	if got := versionNumbers(t, s, file.ID); !equalInts(got, []int{4, 3, 2}) {
+		t.Errorf("versions %v after a rejected promote", got)
+	}
+	if got := total(t, s, "alice"); got != 800*kb {
+		t.Errorf("usage %d after a rejected promote", got)
+	}
+
+	// Removing files always works
+	if _, err := s.Trash(file.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Purge(context.Background(), file.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := usage(t, s, "alice"); got != (Usage{}) {
+		t.Errorf("usage %+v after purge", got)
+	}
+}
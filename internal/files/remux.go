@@ -0,0 +1,225 @@
+package files
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"noverna.de/m/v2/internal/kv"
+	"noverna.de/m/v2/internal/mp4"
+	"noverna.de/m/v2/internal/storage"
+)
+
+// wantsRemux reports whether a freshly inspected upload should get the faststart treatment
+func (s *Service) wantsRemux(file *File) bool {
+	return s.cfg.Videos.Faststart && file.Video != nil && !file.Video.Faststart
+}
+
+// queueRemux schedules the faststart rewrite of a file
+func (s *Service) queueRemux(id string) {
+	s.tasks.run(func(ctx context.Context) {
+		s.remux(ctx, id)
+	})
+}
+
+// resumeRemuxes picks up rewrites that were interrupted by a restart
+func (s *Service) resumeRemuxes() {
+	var ids []string
+	s.db.Scan("file/", "", func(key string, value []byte) bool {
+		file := &File{}
+		if err := json.Unmarshal(value, file); err != nil {
+			return true
+		}
+		if file.Video != nil && file.Video.Remux != nil {
+			switch file.Video.Remux.State {
+			case TaskPending, TaskRunning:
+				ids = append(ids, file.ID)
+			}
+		}
+		return true
+	})
+
+	for _, id := range ids {
+		s.queueRemux(id)
+	}
+	if len(ids) > 0 {
+		s.logger.Info("Resuming faststart remuxes", map[string]any{"count": len(ids)})
+	}
+}
+
+func (s *Service) remux(ctx context.Context, id string) {
+	err := s.setRemuxState(id, TaskRunning, nil)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			s.logger.Error("Faststart remux failed", map[string]any{"id": id, "error": err.Error()})
+		}
+		return
+	}
+
+	err = s.rewriteFaststart(ctx, id)
+	if ctx.Err() != nil {
+		// Shutting down, the task stays running and is resumed on the next start
+		return
+	}
+	if errors.Is(err, ErrNotFound) || errors.Is(err, errContentChanged) {
+		// Deleted or replaced by a new version, which gets its own remux if needed
+		return
+	}
+	if err != nil {
+		s.logger.Error("Faststart remux failed", map[string]any{"id": id, "error": err.Error()})
+		if err := s.setRemuxState(id, TaskFailed, err); err != nil && !errors.Is(err, ErrNotFound) {
+			s.logger.Error("Failed to record remux state", map[string]any{"id": id, "error": err.Error()})
+		}
+	}
+}
+
+func (s *Service) setRemuxState(id, state string, cause error) error {
+	return s.updateFile(id, func(file *File) error {
+		if file.Video == nil {
+			return ErrNotFound
+		}
+		file.Video.Remux = newTaskStatus(state, cause)
+		return nil
+	})
+}
+
+// rewriteFaststart copies the blob of a file to the temp dir, moves moov to
+// the front and swaps the file over to the rewritten blob
+func (s *Service) rewriteFaststart(ctx context.Context, id string) error {
+	file, err := s.repo.Get(id)
+	if err != nil {
+		return err
+	}
+	oldHash := file.Hash()
+
+	in, err := os.CreateTemp(s.cfg.Server.TempDir, "remux-in-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		in.Close()
+		os.Remove(in.Name())
+	}()
+
+	source := storage.NewReadSeeker(ctx, s.backend, BlobKey(oldHash), file.Size)
+	_, err = io.Copy(in, source)
+	source.Close()
+	if err != nil {
+		return fmt.Errorf("fetch blob: %w", err)
+	}
+
+	out, err := os.CreateTemp(s.cfg.Server.TempDir, "remux-out-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		out.Close()
+		os.Remove(out.Name())
+	}()
+
+	hash := sha256.New()
+	err = mp4.Faststart(in, file.Size, io.MultiWriter(out, hash))
+	if errors.Is(err, mp4.ErrAlreadyFaststart) {
+		return s.updateFile(id, func(file *File) error {
+			if file.Video == nil {
+				return ErrNotFound
+			}
+			file.Video.Faststart = true
+			file.Video.Remux = newTaskStatus(TaskDone, nil)
+			return nil
+		})
+	}
+	if err != nil {
+		return err
+	}
+	size, err := out.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	newHash := hex.EncodeToString(hash.Sum(nil))
+	orphaned, err := s.replaceContent(ctx, id, oldHash, out.Name(), newHash, size)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info("Faststart remux finished", map[string]any{
+		"id":           id,
+		"size":         size,
+		"blob_removed": orphaned,
+	})
+	return nil
+}
+
+// replaceContent points a file at new content and releases the old blob. It
+// fails with errContentChanged if the file no longer points at oldHash.
+func (s *Service) replaceContent(ctx context.Context, id, oldHash, path, newHash string, size int64) (bool, error) {
+	unlockFile := s.fileLocks.lock(id)
+	defer unlockFile()
+	// Both blobs change their refcount
+	unlockBlobs := s.lockBlobs(oldHash, newHash)
+	defer unlockBlobs()
+
+	_, known := s.db.Get(blobRecordKey(newHash))
+	if !known {
+		if err := storage.PutFile(ctx, s.backend, BlobKey(newHash), path); err != nil {
+			return false, fmt.Errorf("store blob: %w", err)
+		}
+	}
+
+	orphaned := false
+	err := s.db.Update(func(tx *kv.Tx) error {
+		file := &File{}
+		found, err := tx.GetJSON(fileKey(id), file)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return ErrNotFound
+		}
+		if file.Hash() != oldHash || file.Video == nil {
+			return errContentChanged
+		}
+
+		blob := &Blob{Hash: newHash, Size: size, CreatedAt: file.CreatedAt}
+		if _, err := tx.GetJSON(blobRecordKey(newHash), blob); err != nil {
+			return err
+		}
+		blob.Refs++
+		if err := tx.PutJSON(blobRecordKey(newHash), blob); err != nil {
+			return err
+		}
+
+		file.Checksum = "sha256:" + newHash
+		file.Size = size
+		file.Video.Faststart = true
+		file.Video.Remux = newTaskStatus(TaskDone, nil)
+		file.UpdatedAt = time.Now().UTC()
+		if err := putFileRecord(tx, file); err != nil {
+			return err
+		}
+
+		orphaned, err = releaseBlob(tx, oldHash)
+		return err
+	})
+	if err != nil {
+		if !known {
+			s.backend.Delete(ctx, BlobKey(newHash))
+		}
+		return false, err
+	}
+
+	if orphaned {
+		s.removeBlob(ctx, oldHash)
+	}
+	return orphaned, nil
+}
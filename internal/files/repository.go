@@ -0,0 +1,358 @@
+package files
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strings"
+	"time"
+
+	"noverna.de/m/v2/internal/kv"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 200
+)
+
+// Bump when the index layout changes, records are reindexed on startup
+const indexVersion = "4"
+
+// Query selects files for listing. Zero values don't filter.
+type Query struct {
+	Owner     string
+	Namespace string
+	Type      string // an exact mime type or a prefix like "image/*"
+	Tag       string
+	From      time.Time // created at or after
+	To        time.Time // created before
+	Cursor    string
+	Limit     int
+	// Trashed lists the trash instead, ordered by deletion time
+	Trashed bool
+}
+
+// Page is one slice of a listing, newest files first
+type Page struct {
+	Files      []*File `json:"files"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+}
+
+// Repository is the read side of the metadata store
+type Repository interface {
+	Get(id string) (*File, error)
+	List(query Query) (*Page, error)
+}
+
+// kvRepository keeps file records in the kv store together with secondary
+// indexes for owner, type and tag. Index keys end in the inverted creation
+// time and the file id, so a prefix scan yields the newest files first.
+type kvRepository struct {
+	db *kv.DB
+}
+
+func newKVRepository(db *kv.DB) (*kvRepository, error) {
+	repo := &kvRepository{db: db}
+	if err := repo.reindex(); err != nil {
+		return nil, fmt.Errorf("reindex files: %w", err)
+	}
+	return repo, nil
+}
+
+func (r *kvRepository) Get(id string) (*File, error) {
+	data, ok := r.db.Get(fileKey(id))
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	file := &File{}
+	if err := json.Unmarshal(data, file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// How many index entries are read per pass while filtering
+const scanBatch = 256
+
+func (r *kvRepository) List(q Query) (*Page, error) {
+	if q.Limit <= 0 {
+		q.Limit = DefaultPageSize
+	}
+	if q.Limit > MaxPageSize {
+		q.Limit = MaxPageSize
+	}
+
+	prefix := indexPrefix(q)
+	start := prefix
+	// The trash is ordered by deletion time, so date filters can't narrow the scan
+	byCreation := !q.Trashed
+	if byCreation && !q.To.IsZero() {
+		// created < To, which is everything after To in inverted order
+		start = prefix + invertedTime(q.To.Add(-time.Nanosecond))
+	}
+	if q.Cursor != "" {
+		pos, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		if after := prefix + pos + "\x00"; after > start {
+			start = after
+		}
+	}
+	var end string
+	if byCreation && !q.From.IsZero() {
+		end = prefix + invertedTime(q.From) + "/\xff"
+	}
+
+	page := &Page{Files: []*File{}}
+	lastPos := ""
+	for {
+		var keys []string
+		r.db.Scan(prefix, start, func(key string, _ []byte) bool {
+			if end != "" && key > end {
+				return false
+			}
+			keys = append(keys, key)
+			return len(keys) < scanBatch
+		})
+
+		for _, key := range keys {
+			pos := strings.TrimPrefix(key, prefix)
+			file, err := r.Get(pos[strings.LastIndexByte(pos, '/')+1:])
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if !q.matches(file) {
+				continue
+			}
+
+			if len(page.Files) == q.Limit {
+				// There is at least one more, so the caller gets a cursor
+				page.NextCursor = encodeCursor(lastPos)
+				return page, nil
+			}
+			page.Files = append(page.Files, file)
+			lastPos = pos
+		}
+
+		if len(keys) < scanBatch {
+			return page, nil
+		}
+		start = keys[len(keys)-1] + "\x00"
+	}
+}
+
+// matches applies every filter, the index only narrows down the candidates
+func (q Query) matches(file *File) bool {
+	if q.Trashed != file.Trashed() {
+		return false
+	}
+	if !q.Trashed && file.Expired(time.Now()) {
+		return false
+	}
+	if q.Owner != "" && file.Owner != q.Owner {
+		return false
+	}
+	if q.Namespace != "" && file.Namespace != q.Namespace {
+		return false
+	}
+	if q.Type != "" && !matchesType(q.Type, file.Mime) {
+		return false
+	}
+	if q.Tag != "" && !hasTag(file.Tags, q.Tag) {
+		return false
+	}
+	if !q.From.IsZero() && file.CreatedAt.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !file.CreatedAt.Before(q.To) {
+		return false
+	}
+	return true
+}
+
+func matchesType(pattern, mime string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(mime, prefix)
+	}
+	return pattern == mime
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// indexPrefix picks the most selective index for a query
+func indexPrefix(q Query) string {
+	switch {
+	case q.Trashed:
+		return trashPrefix
+	case q.Tag != "":
+		return indexKey("tag", q.Tag)
+	case q.Owner != "":
+		return indexKey("owner", q.Owner)
+	case q.Type != "" && !strings.HasSuffix(q.Type, "*"):
+		return indexKey("type", q.Type)
+	default:
+		return "idx/all/"
+	}
+}
+
+func indexKey(name, value string) string {
+	return "idx/" + name + "/" + url.PathEscape(value) + "/"
+}
+
+const (
+	trashPrefix  = "idx/trash/"
+	expiryPrefix = "idx/expiry/"
+)
+
+// indexKeys returns every index entry of a file record. Trashed files only
+// show up in the trash index, and in the expiry index if they expire.
+func indexKeys(file *File) []string {
+	var keys []string
+	if file.ExpiresAt != nil {
+		// Oldest first, unlike the listing indexes
+		keys = append(keys, expiryPrefix+fmt.Sprintf("%019d", file.ExpiresAt.UnixNano())+"/"+file.ID)
+	}
+	if file.Trashed() {
+		return append(keys, trashPrefix+invertedTime(*file.DeletedAt)+"/"+file.ID)
+	}
+
+	pos := invertedTime(file.CreatedAt) + "/" + file.ID
+	keys = append(keys, "idx/all/"+pos, indexKey("type", file.Mime)+pos)
+	if file.Owner != "" {
+		keys = append(keys, indexKey("owner", file.Owner)+pos)
+	}
+	for _, tag := range file.Tags {
+		keys = append(keys, indexKey("tag", tag)+pos)
+	}
+	return keys
+}
+
+// invertedTime sorts newer times first
+func invertedTime(t time.Time) string {
+	return fmt.Sprintf("%019d", math.MaxInt64-t.UnixNano())
+}
+
+func encodeCursor(pos string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(pos))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", ErrInvalidCursor
+	}
+	pos := string(raw)
+	inverted, id, ok := strings.Cut(pos, "/")
+	if !ok || len(inverted) != 19 || id == "" || strings.Contains(id, "/") {
+		return "", ErrInvalidCursor
+	}
+	return pos, nil
+}
+
+// putFileRecord stores a file record and keeps its index entries in sync
+func putFileRecord(tx *kv.Tx, file *File) error {
+	old := &File{}
+	found, err := tx.GetJSON(fileKey(file.ID), old)
+	if err != nil {
+		return err
+	}
+	if found {
+		for _, key := range indexKeys(old) {
+			tx.Delete(key)
+		}
+		if err := addUsage(tx, old, -1); err != nil {
+			return err
+		}
+	}
+
+	for _, key := range indexKeys(file) {
+		tx.Put(key, nil)
+	}
+	if err := addUsage(tx, file, 1); err != nil {
+		return err
+	}
+	return tx.PutJSON(fileKey(file.ID), file)
+}
+
+// deleteFileRecord removes a file record and its index entries
+func deleteFileRecord(tx *kv.Tx, id string) error {
+	old := &File{}
+	found, err := tx.GetJSON(fileKey(id), old)
+	if err != nil || !found {
+		return err
+	}
+	for _, key := range indexKeys(old) {
+		tx.Delete(key)
+	}
+	tx.Delete(fileKey(id))
+	return addUsage(tx, old, -1)
+}
+
+// reindex rebuilds all index entries and usage counters if they were written by an older version
+func (r *kvRepository) reindex() error {
+	if version, ok := r.db.Get("meta/index_version"); ok && string(version) == indexVersion {
+		return nil
+	}
+
+	var files []*File
+	r.db.Scan("file/", "", func(_ string, value []byte) bool {
+		file := &File{}
+		if err := json.Unmarshal(value, file); err == nil {
+			files = append(files, file)
+		}
+		return true
+	})
+
+	versions := make(map[string][]Version)
+	r.db.Scan("versions/", "", func(key string, value []byte) bool {
+		var v []Version
+		if err := json.Unmarshal(value, &v); err == nil {
+			versions[strings.TrimPrefix(key, "versions/")] = v
+		}
+		return true
+	})
+
+	var stale []string
+	for _, prefix := range []string{"idx/", usagePrefix} {
+		r.db.Scan(prefix, "", func(key string, _ []byte) bool {
+			stale = append(stale, key)
+			return true
+		})
+	}
+
+	return r.db.Update(func(tx *kv.Tx) error {
+		for _, key := range stale {
+			tx.Delete(key)
+		}
+		for _, file := range files {
+			for _, key := range indexKeys(file) {
+				tx.Put(key, nil)
+			}
+			if err := addUsage(tx, file, 1); err != nil {
+				return err
+			}
+			if err := addVersionUsage(tx, file.Owner, versions[file.ID], 1); err != nil {
+				return err
+			}
+		}
+		tx.Put("meta/index_version", []byte(indexVersion))
+		return nil
+	})
+}
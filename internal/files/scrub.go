@@ -0,0 +1,467 @@
+package files
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"noverna.de/m/v2/internal/kv"
+	"noverna.de/m/v2/internal/storage"
+)
+
+var (
+	ErrScrubRunning = errors.New("a scrub is already running")
+	ErrNoScrub      = errors.New("no scrub has run yet")
+)
+
+// Problems a scrub can find with a blob
+const (
+	ScrubMissing  = "missing"
+	ScrubMismatch = "mismatch"
+)
+
+const (
+	scrubReportKey   = "scrub/report"
+	scrubIssuePrefix = "scrub/issue/"
+)
+
+// BlobIssue is a blob that failed verification. It stays flagged until a
+// later scrub finds the blob intact, or it is repaired or deleted.
+type BlobIssue struct {
+	Hash       string    `json:"hash"`
+	Problem    string    `json:"problem"`
+	Size       int64     `json:"size"`
+	ActualSize int64     `json:"actual_size,omitempty"`
+	ActualHash string    `json:"actual_hash,omitempty"`
+	Files      []string  `json:"files,omitempty"` // files with the blob as current content or as a version
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+// ScrubReport is the outcome of the last scrub
+type ScrubReport struct {
+	State      string      `json:"state"`
+	Error      string      `json:"error,omitempty"`
+	StartedAt  time.Time   `json:"started_at"`
+	FinishedAt *time.Time  `json:"finished_at,omitempty"`
+	Checked    int         `json:"checked"`
+	Bytes      int64       `json:"bytes"`
+	Orphaned   int         `json:"orphaned"` // stored blobs without a record, left alone
+	Repaired   int         `json:"repaired"`
+	Issues     []BlobIssue `json:"issues"`
+}
+
+func scrubIssueKey(hash string) string {
+	return scrubIssuePrefix + hash
+}
+
+func (s *Service) startScrubber() {
+	if s.cfg.Scrub.IntervalHours <= 0 {
+		return
+	}
+	interval := time.Duration(s.cfg.Scrub.IntervalHours) * time.Hour
+	s.tasks.every(interval, func(ctx context.Context) {
+		if _, err := s.Scrub(ctx); err != nil && !errors.Is(err, ErrScrubRunning) {
+			s.logger.Error("Scrub failed", map[string]any{"error": err.Error()})
+		}
+	})
+}
+
+// StartScrub begins a scrub in the background and returns its initial report
+func (s *Service) StartScrub() (*ScrubReport, error) {
+	if !s.scrubbing.CompareAndSwap(false, true) {
+		return nil, ErrScrubRunning
+	}
+	report := &ScrubReport{State: TaskRunning, StartedAt: time.Now().UTC(), Issues: []BlobIssue{}}
+	// Saved before returning, so the report endpoint shows it right away
+	if err := s.db.Update(func(tx *kv.Tx) error { return tx.PutJSON(scrubReportKey, report) }); err != nil {
+		s.scrubbing.Store(false)
+		return nil, err
+	}
+	initial := *report
+
+	s.tasks.start(func(ctx context.Context) {
+		defer s.scrubbing.Store(false)
+		s.scrub(ctx, report)
+	})
+	return &initial, nil
+}
+
+// Scrub re-hashes every blob in storage and waits for the result
+func (s *Service) Scrub(ctx context.Context) (*ScrubReport, error) {
+	if !s.scrubbing.CompareAndSwap(false, true) {
+		return nil, ErrScrubRunning
+	}
+	defer s.scrubbing.Store(false)
+
+	report := &ScrubReport{State: TaskRunning, StartedAt: time.Now().UTC(), Issues: []BlobIssue{}}
+	return s.scrub(ctx, report)
+}
+
+// LastScrub returns the report of the running or most recent scrub
+func (s *Service) LastScrub() (*ScrubReport, error) {
+	data, ok := s.db.Get(scrubReportKey)
+	if !ok {
+		return nil, ErrNoScrub
+	}
+	report := &ScrubReport{}
+	if err := json.Unmarshal(data, report); err != nil {
+		return nil, err
+	}
+	if report.State == TaskRunning && !s.scrubbing.Load() {
+		// The process stopped while it was running
+		report.State = TaskFailed
+		report.Error = "interrupted"
+	}
+	return report, nil
+}
+
+func (s *Service) scrub(ctx context.Context, report *ScrubReport) (*ScrubReport, error) {
+	s.logger.Info("Scrub started", map[string]any{"rate_mb_per_second": s.cfg.Scrub.RateMBPerSecond})
+	s.saveScrubReport(report)
+
+	pace := newPacer(int64(s.cfg.Scrub.RateMBPerSecond) * 1024 * 1024)
+	seen := make(map[string]bool)
+
+	err := s.backend.List(ctx, "blobs/", func(obj storage.ObjectInfo) error {
+		if IsVariantKey(obj.Key) {
+			return nil
+		}
+		hash := path.Base(obj.Key)
+		blob, ok := s.blobRecord(hash)
+		if !ok {
+			report.Orphaned++
+			s.logger.Warn("Stored blob has no record", map[string]any{"key": obj.Key})
+			return nil
+		}
+		seen[hash] = true
+
+		actual, size, err := s.hashObject(ctx, s.backend, obj.Key, pace)
+		if errors.Is(err, storage.ErrNotFound) {
+			// Deleted since it was listed, the record check below decides
+			delete(seen, hash)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read %s: %w", obj.Key, err)
+		}
+		report.Checked++
+		report.Bytes += size
+
+		if actual == hash && size == blob.Size {
+			return s.clearBlobIssue(hash)
+		}
+		return s.flagBlob(ctx, BlobIssue{
+			Hash:       hash,
+			Problem:    ScrubMismatch,
+			Size:       blob.Size,
+			ActualSize: size,
+			ActualHash: actual,
+		}, report, pace)
+	})
+
+	if err == nil {
+		// Records whose blob never showed up in the listing
+		var missing []*Blob
+		s.db.Scan("blob/", "", func(_ string, value []byte) bool {
+			blob := &Blob{}
+			if json.Unmarshal(value, blob) == nil && !seen[blob.Hash] {
+				missing = append(missing, blob)
+			}
+			return ctx.Err() == nil
+		})
+		for _, blob := range missing {
+			if err = ctx.Err(); err != nil {
+				break
+			}
+			_, statErr := s.backend.Stat(ctx, BlobKey(blob.Hash))
+			if statErr == nil {
+				// Stored while we were listing
+				continue
+			}
+			if !errors.Is(statErr, storage.ErrNotFound) {
+				err = statErr
+				break
+			}
+			report.Checked++
+			if err = s.flagBlob(ctx, BlobIssue{Hash: blob.Hash, Problem: ScrubMissing, Size: blob.Size}, report, pace); err != nil {
+				break
+			}
+		}
+	}
+
+	issues, issuesErr := s.blobIssues()
+	if issuesErr == nil {
+		report.Issues = issues
+	}
+	now := time.Now().UTC()
+	report.FinishedAt = &now
+	report.State = TaskDone
+	if err != nil {
+		report.State = TaskFailed
+		report.Error = err.Error()
+	}
+	s.saveScrubReport(report)
+
+	fields := map[string]any{
+		"checked":  report.Checked,
+		"bytes":    report.Bytes,
+		"issues":   len(report.Issues),
+		"repaired": report.Repaired,
+		"orphaned": report.Orphaned,
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+		s.logger.Error("Scrub aborted", fields)
+		return report, err
+	}
+	s.logger.Info("Scrub finished", fields)
+	return report, nil
+}
+
+func (s *Service) blobRecord(hash string) (*Blob, bool) {
+	data, ok := s.db.Get(blobRecordKey(hash))
+	if !ok {
+		return nil, false
+	}
+	blob := &Blob{}
+	if err := json.Unmarshal(data, blob); err != nil {
+		return nil, false
+	}
+	return blob, true
+}
+
+// flagBlob records a damaged or missing blob, or repairs it from the replica
+func (s *Service) flagBlob(ctx context.Context, issue BlobIssue, report *ScrubReport, pace *pacer) error {
+	unlock := s.blobLocks.lock(issue.Hash)
+	defer unlock()
+
+	if _, ok := s.blobRecord(issue.Hash); !ok {
+		// Released while we were checking it
+		return s.clearBlobIssue(issue.Hash)
+	}
+
+	fields := map[string]any{
+		"hash":        issue.Hash,
+		"problem":     issue.Problem,
+		"actual_hash": issue.ActualHash,
+	}
+	if s.replica != nil {
+		err := s.repairBlob(ctx, issue.Hash, pace)
+		if err == nil {
+			report.Repaired++
+			s.logger.Info("Blob repaired from replica", fields)
+			return s.clearBlobIssue(issue.Hash)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		fields["repair_error"] = err.Error()
+	}
+
+	s.logger.Error("Blob failed verification", fields)
+	if data, ok := s.db.Get(scrubIssueKey(issue.Hash)); ok {
+		// Keep when it was first noticed
+		var old BlobIssue
+		if json.Unmarshal(data, &old) == nil {
+			issue.DetectedAt = old.DetectedAt
+		}
+	}
+	if issue.DetectedAt.IsZero() {
+		issue.DetectedAt = time.Now().UTC()
+	}
+	return s.db.Update(func(tx *kv.Tx) error {
+		return tx.PutJSON(scrubIssueKey(issue.Hash), issue)
+	})
+}
+
+// repairBlob copies a blob back from the replica if the replica's copy is intact
+func (s *Service) repairBlob(ctx context.Context, hash string, pace *pacer) error {
+	rc, _, err := s.replica.Get(ctx, BlobKey(hash), nil)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	tmp, err := os.CreateTemp(s.cfg.Server.TempDir, "repair-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hasher), &pacedReader{ctx: ctx, r: rc, pace: pace})
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(hasher.Sum(nil)); actual != hash {
+		return fmt.Errorf("replica copy is damaged as well (sha256 %s)", actual)
+	}
+	return storage.PutFile(ctx, s.backend, BlobKey(hash), tmp.Name())
+}
+
+func (s *Service) hashObject(ctx context.Context, b storage.Backend, key string, pace *pacer) (string, int64, error) {
+	rc, _, err := b.Get(ctx, key, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	defer rc.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, &pacedReader{ctx: ctx, r: rc, pace: pace})
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
+
+func (s *Service) clearBlobIssue(hash string) error {
+	if _, ok := s.db.Get(scrubIssueKey(hash)); !ok {
+		return nil
+	}
+	return s.db.Update(func(tx *kv.Tx) error {
+		tx.Delete(scrubIssueKey(hash))
+		return nil
+	})
+}
+
+// blobIssues returns every open issue together with the files it affects.
+// Issues of blobs that are gone by now are dropped.
+func (s *Service) blobIssues() ([]BlobIssue, error) {
+	byHash := make(map[string]*BlobIssue)
+	var order []string
+	s.db.Scan(scrubIssuePrefix, "", func(_ string, value []byte) bool {
+		issue := &BlobIssue{}
+		if json.Unmarshal(value, issue) == nil {
+			byHash[issue.Hash] = issue
+			order = append(order, issue.Hash)
+		}
+		return true
+	})
+	if len(order) == 0 {
+		return []BlobIssue{}, nil
+	}
+
+	var stale []string
+	for _, hash := range order {
+		if _, ok := s.blobRecord(hash); !ok {
+			stale = append(stale, hash)
+			delete(byHash, hash)
+		}
+	}
+	if len(stale) > 0 {
+		err := s.db.Update(func(tx *kv.Tx) error {
+			for _, hash := range stale {
+				tx.Delete(scrubIssueKey(hash))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	affect := func(hash, id string) {
+		if issue, ok := byHash[hash]; ok && !slices.Contains(issue.Files, id) {
+			issue.Files = append(issue.Files, id)
+		}
+	}
+	s.db.Scan("file/", "", func(_ string, value []byte) bool {
+		file := &File{}
+		if json.Unmarshal(value, file) == nil {
+			affect(file.Hash(), file.ID)
+		}
+		return true
+	})
+	s.db.Scan("versions/", "", func(key string, value []byte) bool {
+		var versions []Version
+		if json.Unmarshal(value, &versions) == nil {
+			id := strings.TrimPrefix(key, "versions/")
+			for _, v := range versions {
+				affect(v.Hash(), id)
+			}
+		}
+		return true
+	})
+
+	issues := make([]BlobIssue, 0, len(byHash))
+	for _, hash := range order {
+		if issue, ok := byHash[hash]; ok {
+			issues = append(issues, *issue)
+		}
+	}
+	return issues, nil
+}
+
+func (s *Service) saveScrubReport(report *ScrubReport) {
+	err := s.db.Update(func(tx *kv.Tx) error {
+		return tx.PutJSON(scrubReportKey, report)
+	})
+	if err != nil {
+		s.logger.Error("Failed to save scrub report", map[string]any{"error": err.Error()})
+	}
+}
+
+// pacer limits how many bytes per second a scrub reads across all blobs
+type pacer struct {
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+func newPacer(bytesPerSecond int64) *pacer {
+	return &pacer{rate: bytesPerSecond, start: time.Now()}
+}
+
+// wait accounts for n bytes and sleeps until reading them was within the rate
+func (p *pacer) wait(ctx context.Context, n int) error {
+	if p.rate <= 0 {
+		return ctx.Err()
+	}
+	p.read += int64(n)
+	due := p.start.Add(time.Duration(float64(p.read) / float64(p.rate) * float64(time.Second)))
+	delay := time.Until(due)
+	if delay <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Reads are cut into chunks so the pace stays smooth at low rates
+const pacedChunk = 64 << 10
+
+type pacedReader struct {
+	ctx  context.Context
+	r    io.Reader
+	pace *pacer
+}
+
+func (p *pacedReader) Read(b []byte) (int, error) {
+	if len(b) > pacedChunk {
+		b = b[:pacedChunk]
+	}
+	n, err := p.r.Read(b)
+	if waitErr := p.pace.wait(p.ctx, n); waitErr != nil {
+		return n, waitErr
+	}
+	return n, err
+}
@@ -0,0 +1,115 @@
+package files
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Task states as they show up on file records
+const (
+	TaskPending = "pending"
+	TaskRunning = "running"
+	TaskDone    = "done"
+	TaskFailed  = "failed"
+)
+
+// TaskStatus tracks background work on a file
+type TaskStatus struct {
+	State     string    `json:"state"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func newTaskStatus(state string, err error) *TaskStatus {
+	status := &TaskStatus{State: state, UpdatedAt: time.Now().UTC()}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	return status
+}
+
+// How many background tasks may run at the same time
+const maxConcurrentTasks = 2
+
+// background runs work off the request path and stops it on Close
+type background struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	slots  chan struct{}
+}
+
+func newBackground() *background {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &background{
+		ctx:    ctx,
+		cancel: cancel,
+		slots:  make(chan struct{}, maxConcurrentTasks),
+	}
+}
+
+// run starts fn as soon as a slot is free
+func (b *background) run(fn func(ctx context.Context)) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+
+		select {
+		case b.slots <- struct{}{}:
+		case <-b.ctx.Done():
+			return
+		}
+		defer func() { <-b.slots }()
+
+		fn(b.ctx)
+	}()
+}
+
+// start runs fn right away without taking a slot, for long jobs that pace
+// their own IO and would otherwise hold up short tasks
+func (b *background) start(fn func(ctx context.Context)) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		fn(b.ctx)
+	}()
+}
+
+// every runs fn once per interval until the service is closed. It doesn't
+// take a slot, periodic jobs are expected to be light or to pace themselves.
+func (b *background) every(interval time.Duration, fn func(ctx context.Context)) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fn(b.ctx)
+			case <-b.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// stop cancels all tasks and waits for them until ctx expires
+func (b *background) stop(ctx context.Context) error {
+	b.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
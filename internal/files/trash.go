@@ -0,0 +1,111 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrNotTrashed = errors.New("file is not in the trash")
+
+// Trash moves a file to the trash. It keeps its blob and can be restored
+// until the retention period is over.
+func (s *Service) Trash(id string) (*File, error) {
+	var trashed *File
+	err := s.updateFile(id, func(file *File) error {
+		if file.Trashed() {
+			return ErrNotFound
+		}
+		now := time.Now().UTC()
+		if file.Expired(now) {
+			return ErrExpired
+		}
+		file.DeletedAt = &now
+		trashed = file
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.logger.Info("File trashed", map[string]any{"id": id})
+	return trashed, nil
+}
+
+// Restore takes a file out of the trash
+func (s *Service) Restore(id string) (*File, error) {
+	var restored *File
+	err := s.updateFile(id, func(file *File) error {
+		if !file.Trashed() {
+			return ErrNotTrashed
+		}
+		file.DeletedAt = nil
+		restored = file
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.logger.Info("File restored", map[string]any{"id": id})
+	return restored, nil
+}
+
+// Purge permanently deletes a file from the trash
+func (s *Service) Purge(ctx context.Context, id string) error {
+	file, err := s.repo.Get(id)
+	if err != nil {
+		return err
+	}
+	if !file.Trashed() {
+		return ErrNotTrashed
+	}
+	return s.purge(ctx, id)
+}
+
+// TrashRetention returns how long trashed files are kept
+func (s *Service) TrashRetention() time.Duration {
+	return time.Duration(s.cfg.Trash.RetentionHours) * time.Hour
+}
+
+func (s *Service) startReaper() {
+	interval := time.Duration(s.cfg.Trash.ReapIntervalMinutes) * time.Minute
+	s.tasks.every(interval, func(ctx context.Context) {
+		s.reapTrash(ctx, time.Now())
+	})
+}
+
+// reapTrash purges everything that has been in the trash for longer than the retention period
+func (s *Service) reapTrash(ctx context.Context, now time.Time) {
+	// The trash index is ordered newest deletion first, so everything from
+	// the cutoff onwards is past retention
+	cutoff := trashPrefix + invertedTime(now.Add(-s.TrashRetention()))
+
+	var ids []string
+	s.db.Scan(trashPrefix, cutoff, func(key string, _ []byte) bool {
+		ids = append(ids, key[strings.LastIndexByte(key, '/')+1:])
+		return true
+	})
+
+	purged := 0
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := s.Purge(ctx, id); err != nil {
+			if !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrNotTrashed) {
+				s.logger.Error("Failed to reap trashed file", map[string]any{
+					"id":    id,
+					"error": err.Error(),
+				})
+			}
+			continue
+		}
+		purged++
+	}
+
+	if purged > 0 {
+		s.logger.Info("Trash reaped", map[string]any{"purged": purged})
+	}
+}
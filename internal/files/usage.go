@@ -0,0 +1,84 @@
+package files
+
+import (
+	"encoding/json"
+	"net/url"
+
+	"noverna.de/m/v2/internal/kv"
+)
+
+const usagePrefix = "usage/"
+
+// Usage is what an owner currently stores. Trashed files still take up space
+// until they are purged, so they count towards the total but are reported
+// on their own.
+type Usage struct {
+	Files        int64 `json:"files"`
+	Bytes        int64 `json:"bytes"`
+	TrashedFiles int64 `json:"trashed_files"`
+	TrashedBytes int64 `json:"trashed_bytes"`
+	Versions     int64 `json:"versions"`
+	VersionBytes int64 `json:"version_bytes"`
+}
+
+// Total returns the bytes that count against a quota
+func (u *Usage) Total() int64 {
+	return u.Bytes + u.TrashedBytes + u.VersionBytes
+}
+
+func usageKey(owner string) string {
+	return usagePrefix + url.PathEscape(owner)
+}
+
+// addUsage adds (sign 1) or removes (sign -1) a file record from its owner's usage
+func addUsage(tx *kv.Tx, file *File, sign int64) error {
+	return updateUsage(tx, file.Owner, func(usage *Usage) {
+		if file.Trashed() {
+			usage.TrashedFiles += sign
+			usage.TrashedBytes += sign * file.Size
+		} else {
+			usage.Files += sign
+			usage.Bytes += sign * file.Size
+		}
+	})
+}
+
+// addVersionUsage adds or removes previous versions from an owner's usage
+func addVersionUsage(tx *kv.Tx, owner string, versions []Version, sign int64) error {
+	if len(versions) == 0 {
+		return nil
+	}
+	return updateUsage(tx, owner, func(usage *Usage) {
+		for _, v := range versions {
+			usage.Versions += sign
+			usage.VersionBytes += sign * v.Size
+		}
+	})
+}
+
+func updateUsage(tx *kv.Tx, owner string, fn func(usage *Usage)) error {
+	usage := &Usage{}
+	if _, err := tx.GetJSON(usageKey(owner), usage); err != nil {
+		return err
+	}
+	fn(usage)
+
+	if *usage == (Usage{}) {
+		tx.Delete(usageKey(owner))
+		return nil
+	}
+	return tx.PutJSON(usageKey(owner), usage)
+}
+
+// Usage returns the current usage of an owner, "" being files without one
+func (s *Service) Usage(owner string) (*Usage, error) {
+	usage := &Usage{}
+	data, ok := s.db.Get(usageKey(owner))
+	if !ok {
+		return usage, nil
+	}
+	if err := json.Unmarshal(data, usage); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
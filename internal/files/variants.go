@@ -0,0 +1,170 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"noverna.de/m/v2/internal/imaging"
+	"noverna.de/m/v2/internal/storage"
+)
+
+var (
+	ErrNotAnImage     = errors.New("variants are only available for images")
+	ErrSizeNotAllowed = errors.New("requested size is not allowed")
+)
+
+// Formats we can decode, anything else (video, ...) has no variants
+var decodableImages = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// Variant is a derived image cached next to its original blob
+type Variant struct {
+	Key     string
+	Name    string
+	Mime    string
+	Size    int64
+	ModTime time.Time
+}
+
+// VariantKey returns where a variant of a blob is cached: blobs/ab/cd/abcd...~320x240-cover.jpeg
+func VariantKey(hash, name string) string {
+	return BlobKey(hash) + "~" + name
+}
+
+// VariantOptions parses and validates the variant query for a file
+func (s *Service) VariantOptions(file *File, query url.Values) (imaging.Options, error) {
+	if !decodableImages[file.Mime] {
+		return imaging.Options{}, ErrNotAnImage
+	}
+
+	source := ""
+	if file.Mime == "image/jpeg" {
+		source = imaging.FormatJPEG
+	}
+	opts, err := imaging.ParseOptions(query, source)
+	if err != nil {
+		return imaging.Options{}, err
+	}
+
+	for _, size := range s.variantSizes {
+		if size == opts.Size {
+			return opts, nil
+		}
+	}
+	return imaging.Options{}, fmt.Errorf("%w: %s", ErrSizeNotAllowed, opts.Size)
+}
+
+// OpenVariant returns the requested variant of file, rendering and caching it first if needed
+func (s *Service) OpenVariant(ctx context.Context, file *File, opts imaging.Options) (*Variant, *storage.ReadSeeker, error) {
+	key := VariantKey(file.Hash(), opts.Name())
+
+	info, err := s.backend.Stat(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		info, err = s.renderVariant(ctx, file, opts, key)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	variant := &Variant{
+		Key:     key,
+		Name:    opts.Name(),
+		Mime:    imaging.MimeType(opts.Format),
+		Size:    info.Size,
+		ModTime: info.ModTime,
+	}
+	return variant, storage.NewReadSeeker(ctx, s.backend, key, info.Size), nil
+}
+
+func (s *Service) renderVariant(ctx context.Context, file *File, opts imaging.Options, key string) (*storage.ObjectInfo, error) {
+	// Concurrent requests for the same variant render it only once
+	unlock := s.blobLocks.lock(key)
+	defer unlock()
+
+	if info, err := s.backend.Stat(ctx, key); err == nil {
+		return info, nil
+	}
+
+	source := storage.NewReadSeeker(ctx, s.backend, BlobKey(file.Hash()), file.Size)
+	defer source.Close()
+
+	img, _, err := imaging.Decode(source)
+	if errors.Is(err, imaging.ErrTooManyPixels) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotAnImage, err)
+	}
+
+	tmp, err := os.CreateTemp(s.cfg.Server.TempDir, "variant-*")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	if err := imaging.Encode(tmp, imaging.Resize(img, opts), opts.Format, s.cfg.Images.JPEGQuality); err != nil {
+		return nil, fmt.Errorf("encode variant: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := storage.PutFile(ctx, s.backend, key, tmp.Name()); err != nil {
+		return nil, fmt.Errorf("store variant: %w", err)
+	}
+
+	s.logger.Debug("Variant rendered", map[string]any{
+		"id":      file.ID,
+		"variant": opts.Name(),
+	})
+	return s.backend.Stat(ctx, key)
+}
+
+// deleteVariants drops every cached variant of a blob
+func (s *Service) deleteVariants(ctx context.Context, hash string) {
+	prefix := BlobKey(hash) + "~"
+
+	var keys []string
+	s.backend.List(ctx, prefix, func(info storage.ObjectInfo) error {
+		keys = append(keys, info.Key)
+		return nil
+	})
+
+	for _, key := range keys {
+		if err := s.backend.Delete(ctx, key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			s.logger.Error("Failed to delete variant", map[string]any{
+				"key":   key,
+				"error": err.Error(),
+			})
+		}
+	}
+}
+
+// IsVariantKey reports whether a storage key belongs to a cached variant rather than a blob
+func IsVariantKey(key string) bool {
+	return strings.Contains(key, "~")
+}
+
+func parseVariantSizes(sizes []string) ([]imaging.Size, error) {
+	parsed := make([]imaging.Size, 0, len(sizes))
+	for _, s := range sizes {
+		size, err := imaging.ParseSize(s)
+		if err != nil {
+			return nil, fmt.Errorf("images.variant_sizes: %w", err)
+		}
+		parsed = append(parsed, size)
+	}
+	return parsed, nil
+}
@@ -0,0 +1,314 @@
+package files
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"noverna.de/m/v2/internal/kv"
+	"noverna.de/m/v2/internal/storage"
+)
+
+var ErrVersionNotFound = errors.New("version not found")
+
+// Version is one generation of a file's content
+type Version struct {
+	Number    int        `json:"number"`
+	Size      int64      `json:"size"`
+	Mime      string     `json:"mime"`
+	Checksum  string     `json:"checksum"`
+	Image     *ImageInfo `json:"image,omitempty"`
+	Video     *VideoInfo `json:"video,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	Current   bool       `json:"current,omitempty"`
+}
+
+// Hash returns the hex SHA-256 of the version's content
+func (v *Version) Hash() string {
+	return strings.TrimPrefix(v.Checksum, "sha256:")
+}
+
+func versionsKey(id string) string {
+	return "versions/" + id
+}
+
+// currentVersion describes the content a file points at right now
+func (f *File) currentVersion() Version {
+	number := f.Version
+	if number == 0 {
+		// Records from before versioning
+		number = 1
+	}
+	return Version{
+		Number:    number,
+		Size:      f.Size,
+		Mime:      f.Mime,
+		Checksum:  f.Checksum,
+		Image:     f.Image,
+		Video:     f.Video,
+		CreatedAt: f.LastModified(),
+	}
+}
+
+// MaxVersions returns how many previous versions are kept in a namespace
+func (s *Service) MaxVersions(namespace string) int {
+	if policy, ok := s.cfg.Versioning.Namespaces[namespace]; ok && policy.MaxVersions > 0 {
+		return policy.MaxVersions
+	}
+	return s.cfg.Versioning.MaxVersions
+}
+
+// Versions lists the current and all previous versions of a file, newest first
+func (s *Service) Versions(id string) ([]Version, error) {
+	file, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.versionsOf(file)
+}
+
+func (s *Service) versionsOf(file *File) ([]Version, error) {
+	previous, err := s.loadVersions(file.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	current := file.currentVersion()
+	current.Current = true
+	return append([]Version{current}, previous...), nil
+}
+
+// OpenVersion returns a file record, one of its versions and a stream of its content
+func (s *Service) OpenVersion(ctx context.Context, id string, number int) (*File, *Version, *storage.ReadSeeker, error) {
+	file, err := s.Get(id)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	versions, err := s.versionsOf(file)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	for i := range versions {
+		if versions[i].Number == number {
+			v := &versions[i]
+			return file, v, storage.NewReadSeeker(ctx, s.backend, BlobKey(v.Hash()), v.Size), nil
+		}
+	}
+	return nil, nil, nil, ErrVersionNotFound
+}
+
+// Replace uploads new content for an existing file. The content it had
+// before is kept as a version.
+func (s *Service) Replace(ctx context.Context, id string, upload Upload, r io.Reader) (*File, error) {
+	existing, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	// The new content counts against the file owner's quota
+	upload.Owner = existing.Owner
+
+	received := &File{ID: id}
+	path, cleanup, err := s.receive(ctx, upload, r, received)
+	defer cleanup()
+	if err != nil {
+		return nil, err
+	}
+
+	next := received.currentVersion()
+	next.CreatedAt = time.Now().UTC()
+	remux := s.wantsRemux(received)
+	if remux {
+		next.Video.Remux = newTaskStatus(TaskPending, nil)
+	}
+
+	name := ""
+	if upload.Name != "" {
+		name = filepath.Base(upload.Name)
+	}
+	file, err := s.pushVersion(ctx, id, next, path, name)
+	if err != nil {
+		return nil, err
+	}
+	if remux {
+		s.queueRemux(id)
+	}
+	return file, nil
+}
+
+// Promote makes an old version current again. It becomes a new version with
+// the old content, so the history in between is not lost.
+func (s *Service) Promote(ctx context.Context, id string, number int) (*File, error) {
+	_, version, content, err := s.OpenVersion(ctx, id, number)
+	if err != nil {
+		return nil, err
+	}
+	content.Close()
+	if version.Current {
+		return s.Get(id)
+	}
+
+	next := *version
+	next.CreatedAt = time.Now().UTC()
+	return s.pushVersion(ctx, id, next, "", "")
+}
+
+// pushVersion makes next the current content of a file and prunes versions
+// beyond the namespace's limit. path is where next's bytes are if we might
+// not have the blob yet, "" if it is referenced by the file's history.
+func (s *Service) pushVersion(ctx context.Context, id string, next Version, path, name string) (*File, error) {
+	unlockFile := s.fileLocks.lock(id)
+	defer unlockFile()
+
+	file, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	previous, err := s.loadVersions(id)
+	if err != nil {
+		return nil, err
+	}
+
+	history := append([]Version{file.currentVersion()}, previous...)
+	var pruned []Version
+	if max := s.MaxVersions(file.Namespace); len(history) > max {
+		history, pruned = history[:max], history[max:]
+	}
+
+	hashes := []string{next.Hash()}
+	for _, v := range pruned {
+		hashes = append(hashes, v.Hash())
+	}
+	unlockBlobs := s.lockBlobs(hashes...)
+	defer unlockBlobs()
+
+	nextHash := next.Hash()
+	_, known := s.db.Get(blobRecordKey(nextHash))
+	if !known {
+		if path == "" {
+			return nil, fmt.Errorf("blob %s of version %d is missing", nextHash, next.Number)
+		}
+		if err := storage.PutFile(ctx, s.backend, BlobKey(nextHash), path); err != nil {
+			return nil, fmt.Errorf("store blob: %w", err)
+		}
+	}
+
+	next.Number = file.currentVersion().Number + 1
+	next.Current = false
+	if name != "" {
+		file.Name = name
+	}
+	file.setContent(next)
+
+	var orphaned []string
+	err = s.db.Update(func(tx *kv.Tx) error {
+		blob := &Blob{Hash: nextHash, Size: next.Size, CreatedAt: next.CreatedAt}
+		if _, err := tx.GetJSON(blobRecordKey(nextHash), blob); err != nil {
+			return err
+		}
+		blob.Refs++
+		if err := tx.PutJSON(blobRecordKey(nextHash), blob); err != nil {
+			return err
+		}
+
+		for _, v := range pruned {
+			released, err := releaseBlob(tx, v.Hash())
+			if err != nil {
+				return err
+			}
+			if released {
+				orphaned = append(orphaned, v.Hash())
+			}
+		}
+
+		return s.withinQuota(tx, file.Owner, func() error {
+			if err := putVersions(tx, file, previous, history); err != nil {
+				return err
+			}
+			return putFileRecord(tx, file)
+		})
+	})
+	if err != nil {
+		if !known && path != "" {
+			s.backend.Delete(ctx, BlobKey(nextHash))
+		}
+		return nil, err
+	}
+
+	for _, hash := range orphaned {
+		s.removeBlob(ctx, hash)
+	}
+
+	s.logger.Info("File version stored", map[string]any{
+		"id":      id,
+		"version": next.Number,
+		"pruned":  len(pruned),
+	})
+	return file, nil
+}
+
+// setContent points a file at the content of a version
+func (f *File) setContent(v Version) {
+	now := time.Now().UTC()
+	f.Version = v.Number
+	f.Size = v.Size
+	f.Mime = v.Mime
+	f.Checksum = v.Checksum
+	f.Image = v.Image
+	f.Video = v.Video
+	f.ModifiedAt = v.CreatedAt
+	f.UpdatedAt = now
+}
+
+func (s *Service) loadVersions(id string) ([]Version, error) {
+	data, ok := s.db.Get(versionsKey(id))
+	if !ok {
+		return nil, nil
+	}
+	var versions []Version
+	if err := json.Unmarshal(data, &versions); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// putVersions replaces the stored history of a file and updates its owner's usage
+func putVersions(tx *kv.Tx, file *File, old, versions []Version) error {
+	if err := addVersionUsage(tx, file.Owner, old, -1); err != nil {
+		return err
+	}
+	if err := addVersionUsage(tx, file.Owner, versions, 1); err != nil {
+		return err
+	}
+
+	if len(versions) == 0 {
+		tx.Delete(versionsKey(file.ID))
+		return nil
+	}
+	return tx.PutJSON(versionsKey(file.ID), versions)
+}
+
+// lockBlobs locks several blobs in a fixed order, so two callers can't deadlock
+func (s *Service) lockBlobs(hashes ...string) func() {
+	sorted := append([]string(nil), hashes...)
+	sort.Strings(sorted)
+
+	var unlocks []func()
+	for i, hash := range sorted {
+		if i > 0 && hash == sorted[i-1] {
+			continue
+		}
+		unlocks = append(unlocks, s.blobLocks.lock(hash))
+	}
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"noverna.de/m/v2/internal/config"
+)
+
+func readVersion(t *testing.T, s *Service, id string, number int) string {
+	t.Helper()
+	_, _, content, err := s.OpenVersion(context.Background(), id, number)
+	if err != nil {
+		t.Fatalf("open version %d: %v", number, err)
+	}
+	defer content.Close()
+	data, err := io.ReadAll(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func versionNumbers(t *testing.T, s *Service, id string) []int {
+	t.Helper()
+	versions, err := s.Versions(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numbers := make([]int, len(versions))
+	for i, v := range versions {
+		numbers[i] = v.Number
+	}
+	return numbers
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReplace(t *testing.T) {
+	s := newService(t, nil)
+	file := ingest(t, s, Upload{Name: "notes.txt", Owner: "alice"}, "first")
+
+	replaced, err := s.Replace(context.Background(), file.ID, Upload{Owner: "mallory"}, strings.NewReader("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced.Version != 2 || replaced.Size != 6 || replaced.Name != "notes.txt" || replaced.Owner != "alice" {
+		t.Errorf("replaced file %+v", replaced)
+	}
+	if got := versionNumbers(t, s, file.ID); !equalInts(got, []int{2, 1}) {
+		t.Errorf("versions %v, want [2 1]", got)
+	}
+	if got := readVersion(t, s, file.ID, 2); got != "second" {
+		t.Errorf("version 2 is %q", got)
+	}
+	if got := readVersion(t, s, file.ID, 1); got != "first" {
+		t.Errorf("version 1 is %q", got)
+	}
+
+	// A new name comes along with the content
+	renamed, err := s.Replace(context.Background(), file.ID, Upload{Name: "dir/renamed.txt"}, strings.NewReader("third"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renamed.Name != "renamed.txt" {
+		t.Errorf("name %q after replacing with a new one", renamed.Name)
+	}
+
+	// Rejected content leaves the file alone
+	if _, err := s.Replace(context.Background(), file.ID, Upload{}, strings.NewReader("")); !errors.Is(err, ErrEmpty) {
+		t.Fatalf("empty replacement: err = %v, want ErrEmpty", err)
+	}
+	if got := versionNumbers(t, s, file.ID); !equalInts(got, []int{3, 2, 1}) {
+		t.Errorf("versions %v after a rejected replacement", got)
+	}
+
+	if _, err := s.Replace(context.Background(), "0123456789abcdef0123456789abcdef", Upload{}, strings.NewReader("x")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown file: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestPromote(t *testing.T) {
+	s := newService(t, nil)
+	file := ingest(t, s, Upload{}, "first")
+	replace(t, s, file.ID, "second")
+
+	promoted, err := s.Promote(context.Background(), file.ID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if promoted.Version != 3 || promoted.Checksum != file.Checksum {
+		t.Errorf("promoted file is version %d with %s, want 3 with the first content", promoted.Version, promoted.Checksum)
+	}
+	// The history in between is kept
+	if got := versionNumbers(t, s, file.ID); !equalInts(got, []int{3, 2, 1}) {
+		t.Errorf("versions %v, want [3 2 1]", got)
+	}
+	if got := readVersion(t, s, file.ID, 3); got != "first" {
+		t.Errorf("current content %q", got)
+	}
+	if n := refs(t, s, file.Hash()); n != 2 {
+		t.Errorf("%d refs on the promoted content, want versions 1 and 3", n)
+	}
+
+	// Promoting the current version changes nothing
+	current, err := s.Promote(context.Background(), file.ID, 3)
+	if err != nil || current.Version != 3 {
+		t.Fatalf("promote current: version %v, %v", current, err)
+	}
+	if _, err := s.Promote(context.Background(), file.ID, 7); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("unknown version: err = %v, want ErrVersionNotFound", err)
+	}
+}
+
+func TestPruning(t *testing.T) {
+	tests := []struct {
+		name      string
+		namespace string
+		want      []int
+	}{
+		{name: "global limit", namespace: "", want: []int{5, 4, 3}},
+		{name: "namespace limit", namespace: "avatars", want: []int{5, 4}},
+		{name: "namespace without a limit", namespace: "docs", want: []int{5, 4, 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newService(t, func(cfg *config.Config) {
+				cfg.Versioning.MaxVersions = 2
+				cfg.Versioning.Namespaces = map[string]config.NamespaceVersioning{
+					"avatars": {MaxVersions: 1},
+					"docs":    {MaxVersions: 0},
+				}
+			})
+
+			file := ingest(t, s, Upload{Namespace: tt.namespace}, "v1")
+			hashes := []string{file.Hash()}
+			for _, content := range []string{"v2", "v3", "v4", "v5"} {
+				hashes = append(hashes, replace(t, s, file.ID, content).Hash())
+			}
+
+			if got := versionNumbers(t, s, file.ID); !equalInts(got, tt.want) {
+				t.Fatalf("versions %v, want %v", got, tt.want)
+			}
+			// Pruned content is gone, the rest is still referenced once
+			for i, hash := range hashes {
+				want := 0
+				if i+1 >= tt.want[len(tt.want)-1] {
+					want = 1
+				}
+				if n := refs(t, s, hash); n != want {
+					t.Errorf("v%d has %d refs, want %d", i+1, n, want)
+				}
+			}
+			if _, err := s.Promote(context.Background(), file.ID, 1); !errors.Is(err, ErrVersionNotFound) {
+				t.Errorf("promote pruned version: err = %v, want ErrVersionNotFound", err)
+			}
+
+			usage, err := s.Usage("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if usage.Versions != int64(len(tt.want)-1) || usage.VersionBytes != 2*usage.Versions {
+				t.Errorf("usage counts %d versions with %d bytes, want %d", usage.Versions, usage.VersionBytes, len(tt.want)-1)
+			}
+		})
+	}
+}
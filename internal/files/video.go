@@ -0,0 +1,62 @@
+package files
+
+import (
+	"fmt"
+	"os"
+
+	"noverna.de/m/v2/internal/mp4"
+)
+
+// VideoInfo is what we extract from uploaded mp4 containers
+type VideoInfo struct {
+	Duration   float64  `json:"duration"`
+	Width      int      `json:"width,omitempty"`
+	Height     int      `json:"height,omitempty"`
+	FrameRate  float64  `json:"frame_rate,omitempty"`
+	VideoCodec string   `json:"video_codec,omitempty"`
+	AudioCodec string   `json:"audio_codec,omitempty"`
+	Codecs     []string `json:"codecs"`
+	Faststart  bool     `json:"faststart"`
+	// Remux is set when the container is being rewritten for faststart
+	Remux *TaskStatus `json:"remux,omitempty"`
+}
+
+// inspectVideo validates an mp4 upload and records its properties on file
+func (s *Service) inspectVideo(file *File, path string) error {
+	if file.Mime != "video/mp4" {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := mp4.Inspect(f, file.Size)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidContent, err)
+	}
+
+	file.Video = videoInfo(info)
+	return nil
+}
+
+func videoInfo(info *mp4.Info) *VideoInfo {
+	video := &VideoInfo{
+		Duration:   info.Duration,
+		Width:      info.Width,
+		Height:     info.Height,
+		FrameRate:  info.FrameRate,
+		VideoCodec: info.VideoCodec,
+		AudioCodec: info.AudioCodec,
+		Codecs:     []string{},
+		Faststart:  info.Faststart,
+	}
+	for _, track := range info.Tracks {
+		if track.Codec != "" {
+			video.Codecs = append(video.Codecs, track.Codec)
+		}
+	}
+	return video
+}
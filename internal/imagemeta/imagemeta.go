@@ -0,0 +1,240 @@
+// Package imagemeta reads and strips the metadata of JPEG and PNG files
+// (EXIF, XMP, IPTC, comments and PNG text chunks) without decoding pixels.
+package imagemeta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var ErrMalformed = errors.New("malformed image")
+
+// Metadata chunks larger than this are skipped instead of parsed
+const maxMetadataChunk = 1 << 20
+
+// Metadata is what we keep from the original file
+type Metadata struct {
+	Width       int
+	Height      int
+	Orientation int // EXIF orientation 1-8, 0 if not present
+	CameraMake  string
+	CameraModel string
+	CapturedAt  *time.Time
+	HasGPS      bool
+}
+
+// NeedsRotation reports whether the pixels have to be transformed to display upright
+func (m *Metadata) NeedsRotation() bool {
+	return m.Orientation > 1
+}
+
+// SwapsAxes reports whether applying the orientation swaps width and height
+func (m *Metadata) SwapsAxes() bool {
+	return m.Orientation >= 5 && m.Orientation <= 8
+}
+
+// ProcessJPEG reads the metadata of a JPEG. If w is not nil the image is
+// copied to w with all metadata segments removed. The ICC profile (APP2)
+// and the Adobe segment (APP14) are kept as they affect how colors render.
+func ProcessJPEG(r io.Reader, w io.Writer) (*Metadata, error) {
+	br := bufio.NewReader(r)
+	meta := &Metadata{}
+
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return nil, fmt.Errorf("%w: missing JPEG start of image", ErrMalformed)
+	}
+	if err := write(w, soi[:]); err != nil {
+		return nil, err
+	}
+
+	for {
+		marker, err := nextMarker(br)
+		if err != nil {
+			return nil, err
+		}
+
+		// Markers without a payload
+		if marker == 0xD9 || marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			if err := write(w, []byte{0xFF, marker}); err != nil {
+				return nil, err
+			}
+			if marker == 0xD9 {
+				return meta, nil
+			}
+			continue
+		}
+
+		var lengthBytes [2]byte
+		if _, err := io.ReadFull(br, lengthBytes[:]); err != nil {
+			return nil, fmt.Errorf("%w: truncated JPEG segment", ErrMalformed)
+		}
+		length := int(binary.BigEndian.Uint16(lengthBytes[:]))
+		if length < 2 {
+			return nil, fmt.Errorf("%w: invalid JPEG segment length", ErrMalformed)
+		}
+		payload := make([]byte, length-2)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return nil, fmt.Errorf("%w: truncated JPEG segment", ErrMalformed)
+		}
+
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")):
+			parseTIFF(payload[6:], meta)
+		case isSOF(marker) && len(payload) >= 5:
+			meta.Height = int(binary.BigEndian.Uint16(payload[1:3]))
+			meta.Width = int(binary.BigEndian.Uint16(payload[3:5]))
+		}
+
+		if !isMetadataSegment(marker) {
+			if err := write(w, []byte{0xFF, marker}, lengthBytes[:], payload); err != nil {
+				return nil, err
+			}
+		}
+
+		// Start of scan: the rest is entropy coded image data, copy it as is
+		if marker == 0xDA {
+			if w == nil {
+				return meta, nil
+			}
+			if _, err := io.Copy(w, br); err != nil {
+				return nil, err
+			}
+			return meta, nil
+		}
+	}
+}
+
+func nextMarker(br *bufio.Reader) (byte, error) {
+	b, err := br.ReadByte()
+	if err != nil || b != 0xFF {
+		return 0, fmt.Errorf("%w: expected JPEG marker", ErrMalformed)
+	}
+	// Any number of 0xFF fill bytes may precede the marker
+	for {
+		b, err = br.ReadByte()
+		if err != nil {
+			return 0, fmt.Errorf("%w: truncated JPEG", ErrMalformed)
+		}
+		if b != 0xFF {
+			return b, nil
+		}
+	}
+}
+
+func isSOF(marker byte) bool {
+	return marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC
+}
+
+// APP1 (EXIF, XMP), APP13 (IPTC), comments and vendor APPn segments
+func isMetadataSegment(marker byte) bool {
+	if marker == 0xFE {
+		return true
+	}
+	return marker >= 0xE1 && marker <= 0xEF && marker != 0xE2 && marker != 0xEE
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// Text and time chunks, the PNG equivalent of EXIF
+var pngMetadataChunks = map[string]bool{
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"eXIf": true,
+	"tIME": true,
+}
+
+// ProcessPNG reads the metadata of a PNG. If w is not nil the image is copied
+// to w without text, time and EXIF chunks. Pixel data is streamed, not buffered.
+func ProcessPNG(r io.Reader, w io.Writer) (*Metadata, error) {
+	br := bufio.NewReader(r)
+	meta := &Metadata{}
+
+	sig := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(br, sig); err != nil || !bytes.Equal(sig, pngSignature) {
+		return nil, fmt.Errorf("%w: missing PNG signature", ErrMalformed)
+	}
+	if err := write(w, sig); err != nil {
+		return nil, err
+	}
+
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			return nil, fmt.Errorf("%w: truncated PNG chunk", ErrMalformed)
+		}
+		length := int64(binary.BigEndian.Uint32(header[0:4]))
+		typ := string(header[4:8])
+
+		drop := pngMetadataChunks[typ]
+		inspect := typ == "IHDR" || typ == "eXIf" || typ == "tEXt"
+
+		// Chunk data plus the trailing CRC
+		var body io.Reader = io.LimitReader(br, length+4)
+		if inspect && length <= maxMetadataChunk {
+			data := make([]byte, length+4)
+			if _, err := io.ReadFull(br, data); err != nil {
+				return nil, fmt.Errorf("%w: truncated PNG chunk", ErrMalformed)
+			}
+			parsePNGChunk(typ, data[:length], meta)
+			body = bytes.NewReader(data)
+		}
+
+		if drop || w == nil {
+			if n, err := io.Copy(io.Discard, body); err != nil || n != length+4 {
+				return nil, fmt.Errorf("%w: truncated PNG chunk", ErrMalformed)
+			}
+		} else {
+			if err := write(w, header[:]); err != nil {
+				return nil, err
+			}
+			if n, err := io.Copy(w, body); err != nil || n != length+4 {
+				return nil, fmt.Errorf("%w: truncated PNG chunk", ErrMalformed)
+			}
+		}
+
+		if typ == "IEND" {
+			return meta, nil
+		}
+	}
+}
+
+func parsePNGChunk(typ string, data []byte, meta *Metadata) {
+	switch typ {
+	case "IHDR":
+		if len(data) >= 8 {
+			meta.Width = int(binary.BigEndian.Uint32(data[0:4]))
+			meta.Height = int(binary.BigEndian.Uint32(data[4:8]))
+		}
+	case "eXIf":
+		parseTIFF(data, meta)
+	case "tEXt":
+		key, value, ok := bytes.Cut(data, []byte{0})
+		if ok && string(key) == "Creation Time" && meta.CapturedAt == nil {
+			for _, layout := range []string{time.RFC1123Z, time.RFC1123, time.RFC3339, exifTimeLayout} {
+				if t, err := time.Parse(layout, string(value)); err == nil {
+					meta.CapturedAt = &t
+					break
+				}
+			}
+		}
+	}
+}
+
+func write(w io.Writer, parts ...[]byte) error {
+	if w == nil {
+		return nil
+	}
+	for _, p := range parts {
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,387 @@
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+	"time"
+)
+
+// tag is one IFD entry, value holds the data of ASCII tags or the
+// 4 byte value field of everything else
+type tag struct {
+	id    uint16
+	typ   uint16
+	value []byte
+}
+
+type byteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+func ascii(id uint16, s string) tag { return tag{id, 2, append([]byte(s), 0)} }
+
+// exif builds a TIFF structure with IFD0 and, if given, an EXIF sub IFD.
+// Values longer than 4 bytes are placed after the IFD they belong to.
+func exif(order byteOrder, ifd0, sub []tag) []byte {
+	var data []byte
+	if order.String() == binary.LittleEndian.String() {
+		data = []byte("II")
+	} else {
+		data = []byte("MM")
+	}
+	data = order.AppendUint16(data, 42)
+	data = order.AppendUint32(data, 8)
+
+	writeIFD := func(tags []tag) {
+		start := len(data)
+		extra := start + 2 + 12*len(tags) + 4
+		var values []byte
+		data = order.AppendUint16(data, uint16(len(tags)))
+		for _, t := range tags {
+			data = order.AppendUint16(data, t.id)
+			data = order.AppendUint16(data, t.typ)
+			count := uint32(1)
+			if t.typ == 2 {
+				count = uint32(len(t.value))
+			}
+			data = order.AppendUint32(data, count)
+			if len(t.value) > 4 {
+				data = order.AppendUint32(data, uint32(extra+len(values)))
+				values = append(values, t.value...)
+			} else {
+				data = append(data, t.value...)
+				data = append(data, make([]byte, 4-len(t.value))...)
+			}
+		}
+		data = order.AppendUint32(data, 0)
+		data = append(data, values...)
+	}
+
+	if sub != nil {
+		// The pointer is patched in once we know where the sub IFD lands
+		ifd0 = append(ifd0, tag{tagExifIFD, 4, make([]byte, 4)})
+	}
+	writeIFD(ifd0)
+	if sub != nil {
+		pointer := 8 + 2 + 12*(len(ifd0)-1) + 8
+		order.PutUint32(data[pointer:], uint32(len(data)))
+		writeIFD(sub)
+	}
+	return data
+}
+
+func short(order byteOrder, id, v uint16) tag {
+	return tag{id, 3, order.AppendUint16(nil, v)}
+}
+
+func segment(marker byte, payload []byte) []byte {
+	out := []byte{0xFF, marker}
+	out = binary.BigEndian.AppendUint16(out, uint16(len(payload)+2))
+	return append(out, payload...)
+}
+
+// withSegments returns a real JPEG with the segments inserted after SOI
+func withSegments(t *testing.T, segments ...[]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 3, 2)), nil); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+	return bytes.Join(append([][]byte{encoded[:2]}, append(segments, encoded[2:])...), nil)
+}
+
+func chunk(typ string, data []byte) []byte {
+	out := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	out = append(out, typ...)
+	out = append(out, data...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out[4:]))
+}
+
+// withChunks returns a real PNG with the chunks inserted after IHDR
+func withChunks(t *testing.T, chunks ...[]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 3, 2))); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+	ihdrEnd := len(pngSignature) + 8 + 13 + 4
+	return bytes.Join(append([][]byte{encoded[:ihdrEnd]}, append(chunks, encoded[ihdrEnd:])...), nil)
+}
+
+func TestParseTIFF(t *testing.T) {
+	le, be := binary.LittleEndian, binary.BigEndian
+	captured := time.Date(2024, 5, 17, 9, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		data []byte
+		want Metadata
+	}{
+		{
+			name: "little endian",
+			data: exif(le, []tag{ascii(tagMake, "Canon"), ascii(tagModel, "EOS R6 "), short(le, tagOrientation, 6)}, nil),
+			want: Metadata{CameraMake: "Canon", CameraModel: "EOS R6", Orientation: 6},
+		},
+		{
+			name: "big endian with short inline strings",
+			data: exif(be, []tag{ascii(tagMake, "LG"), short(be, tagOrientation, 3)}, nil),
+			want: Metadata{CameraMake: "LG", Orientation: 3},
+		},
+		{
+			name: "original date wins over modification date",
+			data: exif(le, []tag{ascii(tagDateTime, "2030:01:01 00:00:00")}, []tag{ascii(tagDateTimeOriginal, "2024:05:17 09:30:00")}),
+			want: Metadata{CapturedAt: &captured},
+		},
+		{
+			name: "modification date as fallback",
+			data: exif(le, []tag{ascii(tagDateTime, "2024:05:17 09:30:00")}, []tag{}),
+			want: Metadata{CapturedAt: &captured},
+		},
+		{
+			name: "gps",
+			data: exif(be, []tag{{tagGPSIFD, 4, []byte{0, 0, 0, 0}}}, nil),
+			want: Metadata{HasGPS: true},
+		},
+		{
+			name: "orientation out of range",
+			data: exif(le, []tag{short(le, tagOrientation, 9)}, nil),
+		},
+		{
+			name: "orientation with the wrong type",
+			data: exif(le, []tag{{tagOrientation, 4, []byte{6, 0, 0, 0}}}, nil),
+		},
+		{name: "short", data: []byte("II*")},
+		{name: "unknown byte order", data: []byte("XX\x2a\x00\x08\x00\x00\x00")},
+		{name: "wrong magic", data: []byte("II\x2b\x00\x08\x00\x00\x00")},
+		{name: "ifd past the end", data: []byte("II\x2a\x00\xff\x00\x00\x00")},
+		{
+			name: "string past the end",
+			data: func() []byte {
+				data := exif(le, []tag{ascii(tagMake, "Panasonic")}, nil)
+				return data[:len(data)-4]
+			}(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Metadata
+			parseTIFF(tt.data, &got)
+
+			if (got.CapturedAt == nil) != (tt.want.CapturedAt == nil) ||
+				got.CapturedAt != nil && !got.CapturedAt.Equal(*tt.want.CapturedAt) {
+				t.Errorf("captured at %v, want %v", got.CapturedAt, tt.want.CapturedAt)
+			}
+			got.CapturedAt, tt.want.CapturedAt = nil, nil
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessJPEG(t *testing.T) {
+	le := binary.LittleEndian
+	app1 := segment(0xE1, append([]byte("Exif\x00\x00"), exif(le, []tag{ascii(tagMake, "Canon"), short(le, tagOrientation, 8)}, nil)...))
+	xmp := segment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>"))
+	iptc := segment(0xED, []byte("Photoshop 3.0\x00secret"))
+	comment := segment(0xFE, []byte("shot at home"))
+	icc := segment(0xE2, []byte("ICC_PROFILE\x00profile"))
+	adobe := segment(0xEE, []byte("Adobe\x00\x64\x00\x00\x00\x00\x01"))
+
+	tests := []struct {
+		name     string
+		segments [][]byte
+		kept     [][]byte
+		dropped  [][]byte
+		want     Metadata
+	}{
+		{name: "no metadata", want: Metadata{Width: 3, Height: 2}},
+		{
+			name:     "exif",
+			segments: [][]byte{app1},
+			dropped:  [][]byte{app1},
+			want:     Metadata{Width: 3, Height: 2, CameraMake: "Canon", Orientation: 8},
+		},
+		{
+			name:     "xmp, iptc and comments",
+			segments: [][]byte{xmp, iptc, comment},
+			dropped:  [][]byte{xmp, iptc, comment},
+			want:     Metadata{Width: 3, Height: 2},
+		},
+		{
+			name:     "color segments are kept",
+			segments: [][]byte{icc, app1, adobe},
+			kept:     [][]byte{icc, adobe},
+			dropped:  [][]byte{app1},
+			want:     Metadata{Width: 3, Height: 2, CameraMake: "Canon", Orientation: 8},
+		},
+		{
+			name:     "fill bytes before a marker",
+			segments: [][]byte{{0xFF, 0xFF}, comment[1:]},
+			dropped:  [][]byte{comment},
+			want:     Metadata{Width: 3, Height: 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := withSegments(t, tt.segments...)
+			var out bytes.Buffer
+			meta, err := ProcessJPEG(bytes.NewReader(data), &out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *meta != tt.want {
+				t.Errorf("metadata %+v, want %+v", *meta, tt.want)
+			}
+
+			for _, s := range tt.kept {
+				if !bytes.Contains(out.Bytes(), s) {
+					t.Errorf("segment %q was stripped", s[4:])
+				}
+			}
+			for _, s := range tt.dropped {
+				if bytes.Contains(out.Bytes(), s[4:]) {
+					t.Errorf("segment %q is still there", s[4:])
+				}
+			}
+			if _, err := jpeg.Decode(bytes.NewReader(out.Bytes())); err != nil {
+				t.Errorf("stripped image does not decode: %v", err)
+			}
+
+			// Without a writer only the metadata is read
+			meta, err = ProcessJPEG(bytes.NewReader(data), nil)
+			if err != nil || *meta != tt.want {
+				t.Errorf("read only: %+v, %v", meta, err)
+			}
+		})
+	}
+}
+
+func TestProcessJPEGMalformed(t *testing.T) {
+	valid := withSegments(t)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"not a jpeg", []byte("GIF89a")},
+		{"no marker after soi", []byte{0xFF, 0xD8, 0x00}},
+		{"truncated length", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00}},
+		{"length below two", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x01}},
+		{"truncated segment", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x10, 'E', 'x'}},
+		{"ends in fill bytes", []byte{0xFF, 0xD8, 0xFF, 0xFF}},
+		{"cut before scan", valid[:20]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ProcessJPEG(bytes.NewReader(tt.data), nil); !errors.Is(err, ErrMalformed) {
+				t.Fatalf("err = %v, want ErrMalformed", err)
+			}
+		})
+	}
+}
+
+func TestProcessPNG(t *testing.T) {
+	le := binary.LittleEndian
+	created := time.Date(2024, 5, 17, 9, 30, 0, 0, time.UTC)
+	text := chunk("tEXt", []byte("Creation Time\x00Fri, 17 May 2024 09:30:00 +0000"))
+	comment := chunk("tEXt", []byte("Comment\x00shot at home"))
+	itxt := chunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta/>"))
+	stamp := chunk("tIME", []byte{0x07, 0xE8, 5, 17, 9, 30, 0})
+	exifChunk := chunk("eXIf", exif(le, []tag{ascii(tagModel, "Pixel 8"), short(le, tagOrientation, 6)}, nil))
+	gamma := chunk("gAMA", []byte{0, 0, 0xB1, 0x8F})
+
+	tests := []struct {
+		name    string
+		chunks  [][]byte
+		kept    [][]byte
+		dropped [][]byte
+		want    Metadata
+	}{
+		{name: "no metadata", want: Metadata{Width: 3, Height: 2}},
+		{
+			name:    "text and time",
+			chunks:  [][]byte{text, comment, itxt, stamp},
+			dropped: [][]byte{text, comment, itxt, stamp},
+			want:    Metadata{Width: 3, Height: 2, CapturedAt: &created},
+		},
+		{
+			name:    "exif",
+			chunks:  [][]byte{exifChunk, gamma},
+			kept:    [][]byte{gamma},
+			dropped: [][]byte{exifChunk},
+			want:    Metadata{Width: 3, Height: 2, CameraModel: "Pixel 8", Orientation: 6},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := withChunks(t, tt.chunks...)
+			var out bytes.Buffer
+			meta, err := ProcessPNG(bytes.NewReader(data), &out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (meta.CapturedAt == nil) != (tt.want.CapturedAt == nil) ||
+				meta.CapturedAt != nil && !meta.CapturedAt.Equal(*tt.want.CapturedAt) {
+				t.Errorf("captured at %v, want %v", meta.CapturedAt, tt.want.CapturedAt)
+			}
+			got, want := *meta, tt.want
+			got.CapturedAt, want.CapturedAt = nil, nil
+			if got != want {
+				t.Errorf("metadata %+v, want %+v", got, want)
+			}
+
+			for _, c := range tt.kept {
+				if !bytes.Contains(out.Bytes(), c) {
+					t.Errorf("chunk %q was stripped", c[4:8])
+				}
+			}
+			for _, c := range tt.dropped {
+				if bytes.Contains(out.Bytes(), c) {
+					t.Errorf("chunk %q is still there", c[4:8])
+				}
+			}
+			if _, err := png.Decode(bytes.NewReader(out.Bytes())); err != nil {
+				t.Errorf("stripped image does not decode: %v", err)
+			}
+		})
+	}
+}
+
+func TestProcessPNGMalformed(t *testing.T) {
+	valid := withChunks(t)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"not a png", []byte("\xFF\xD8\xFF\xE0")},
+		{"no chunks", pngSignature},
+		{"truncated chunk", valid[:len(pngSignature)+10]},
+		{"no IEND", valid[:len(valid)-12]},
+		{"chunk longer than the file", append(append([]byte(nil), pngSignature...), 0x7F, 0, 0, 0, 'I', 'D', 'A', 'T', 1, 2, 3)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ProcessPNG(bytes.NewReader(tt.data), nil); !errors.Is(err, ErrMalformed) {
+				t.Fatalf("err = %v, want ErrMalformed", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+// EXIF tags we care about
+const (
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagDateTimeOriginal = 0x9003
+)
+
+const exifTimeLayout = "2006:01:02 15:04:05"
+
+// parseTIFF reads the interesting tags out of an EXIF TIFF structure.
+// Broken or truncated data just yields fewer fields, never an error,
+// since metadata is optional and phones write all kinds of garbage.
+func parseTIFF(data []byte, meta *Metadata) {
+	if len(data) < 8 {
+		return
+	}
+
+	var order binary.ByteOrder
+	switch {
+	case bytes.HasPrefix(data, []byte("II")):
+		order = binary.LittleEndian
+	case bytes.HasPrefix(data, []byte("MM")):
+		order = binary.BigEndian
+	default:
+		return
+	}
+	if order.Uint16(data[2:4]) != 42 {
+		return
+	}
+
+	t := &tiff{data: data, order: order}
+	ifd0 := t.readIFD(order.Uint32(data[4:8]))
+
+	meta.CameraMake = t.ascii(ifd0[tagMake])
+	meta.CameraModel = t.ascii(ifd0[tagModel])
+	if o, ok := t.short(ifd0[tagOrientation]); ok && o >= 1 && o <= 8 {
+		meta.Orientation = int(o)
+	}
+	if _, ok := ifd0[tagGPSIFD]; ok {
+		meta.HasGPS = true
+	}
+
+	captured := t.ascii(ifd0[tagDateTime])
+	if entry, ok := ifd0[tagExifIFD]; ok {
+		if offset, ok := t.long(entry); ok {
+			exif := t.readIFD(offset)
+			if original := t.ascii(exif[tagDateTimeOriginal]); original != "" {
+				captured = original
+			}
+		}
+	}
+	if ts, err := time.Parse(exifTimeLayout, captured); err == nil {
+		meta.CapturedAt = &ts
+	}
+}
+
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+type ifdEntry struct {
+	typ   uint16
+	count uint32
+	value []byte // the raw 4 byte value/offset field
+}
+
+func (t *tiff) readIFD(offset uint32) map[uint16]ifdEntry {
+	entries := make(map[uint16]ifdEntry)
+	if int64(offset)+2 > int64(len(t.data)) {
+		return entries
+	}
+
+	n := int(t.order.Uint16(t.data[offset:]))
+	pos := int64(offset) + 2
+	for i := 0; i < n && pos+12 <= int64(len(t.data)); i++ {
+		e := t.data[pos : pos+12]
+		entries[t.order.Uint16(e[0:2])] = ifdEntry{
+			typ:   t.order.Uint16(e[2:4]),
+			count: t.order.Uint32(e[4:8]),
+			value: e[8:12],
+		}
+		pos += 12
+	}
+	return entries
+}
+
+func (t *tiff) ascii(e ifdEntry) string {
+	if e.typ != 2 || e.count == 0 {
+		return ""
+	}
+
+	var raw []byte
+	if e.count <= 4 {
+		raw = e.value[:e.count]
+	} else {
+		offset := int64(t.order.Uint32(e.value))
+		end := offset + int64(e.count)
+		if end > int64(len(t.data)) {
+			return ""
+		}
+		raw = t.data[offset:end]
+	}
+	return strings.TrimSpace(strings.TrimRight(string(raw), "\x00"))
+}
+
+func (t *tiff) short(e ifdEntry) (uint16, bool) {
+	if e.typ != 3 || e.count < 1 {
+		return 0, false
+	}
+	return t.order.Uint16(e.value), true
+}
+
+func (t *tiff) long(e ifdEntry) (uint32, bool) {
+	if e.typ != 4 && e.typ != 13 || e.count < 1 {
+		return 0, false
+	}
+	return t.order.Uint32(e.value), true
+}
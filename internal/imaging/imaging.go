@@ -0,0 +1,264 @@
+// Package imaging decodes, resizes and encodes images in pure Go.
+package imaging
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// MaxPixels protects us from decompression bombs: a tiny file that claims
+// to be 50000x50000 pixels would otherwise eat gigabytes of memory
+const MaxPixels = 64 * 1000 * 1000
+
+var (
+	ErrInvalidOptions = errors.New("invalid image options")
+	ErrTooManyPixels  = errors.New("image dimensions are too large")
+)
+
+// Fit modes
+const (
+	FitContain = "contain" // Scale down to fit inside the box, keep aspect ratio
+	FitCover   = "cover"   // Fill the box, keep aspect ratio and crop the overflow
+	FitFill    = "fill"    // Stretch to exactly the box
+)
+
+// Output formats
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+)
+
+// Size is a width x height pair, 0 means "derive from the aspect ratio"
+type Size struct {
+	Width  int
+	Height int
+}
+
+func (s Size) String() string {
+	return fmt.Sprintf("%dx%d", s.Width, s.Height)
+}
+
+// ParseSize parses "320x240" or "320x0"
+func ParseSize(s string) (Size, error) {
+	w, h, ok := strings.Cut(strings.ToLower(strings.TrimSpace(s)), "x")
+	if !ok {
+		return Size{}, fmt.Errorf("invalid size %q", s)
+	}
+	width, err1 := strconv.Atoi(w)
+	height, err2 := strconv.Atoi(h)
+	if err1 != nil || err2 != nil || width < 0 || height < 0 || width+height == 0 {
+		return Size{}, fmt.Errorf("invalid size %q", s)
+	}
+	return Size{Width: width, Height: height}, nil
+}
+
+// Options describe a derived image
+type Options struct {
+	Size
+	Fit    string
+	Format string
+}
+
+// Name is a stable identifier for the variant, used for caching
+func (o Options) Name() string {
+	return fmt.Sprintf("%s-%s.%s", o.Size, o.Fit, o.Format)
+}
+
+// Wants reports whether the query asks for a derived image at all
+func Wants(query url.Values) bool {
+	return query.Has("w") || query.Has("h") || query.Has("fit") || query.Has("format")
+}
+
+// ParseOptions reads w, h, fit and format from the query. sourceFormat is used
+// when no format is requested.
+func ParseOptions(query url.Values, sourceFormat string) (Options, error) {
+	opts := Options{
+		Fit:    strings.ToLower(query.Get("fit")),
+		Format: strings.ToLower(query.Get("format")),
+	}
+
+	var err error
+	if v := query.Get("w"); v != "" {
+		if opts.Width, err = strconv.Atoi(v); err != nil || opts.Width <= 0 {
+			return Options{}, fmt.Errorf("%w: w must be a positive integer", ErrInvalidOptions)
+		}
+	}
+	if v := query.Get("h"); v != "" {
+		if opts.Height, err = strconv.Atoi(v); err != nil || opts.Height <= 0 {
+			return Options{}, fmt.Errorf("%w: h must be a positive integer", ErrInvalidOptions)
+		}
+	}
+	if opts.Width == 0 && opts.Height == 0 {
+		return Options{}, fmt.Errorf("%w: w or h is required", ErrInvalidOptions)
+	}
+
+	switch opts.Fit {
+	case "":
+		opts.Fit = FitContain
+	case FitContain:
+	case FitCover, FitFill:
+		if opts.Width == 0 || opts.Height == 0 {
+			return Options{}, fmt.Errorf("%w: fit=%s needs both w and h", ErrInvalidOptions, opts.Fit)
+		}
+	default:
+		return Options{}, fmt.Errorf("%w: fit must be contain, cover or fill", ErrInvalidOptions)
+	}
+
+	switch opts.Format {
+	case "":
+		opts.Format = FormatPNG
+		if sourceFormat == FormatJPEG {
+			opts.Format = FormatJPEG
+		}
+	case "jpg":
+		opts.Format = FormatJPEG
+	case FormatJPEG, FormatPNG:
+	default:
+		return Options{}, fmt.Errorf("%w: format must be jpeg or png", ErrInvalidOptions)
+	}
+
+	return opts, nil
+}
+
+// Decode reads an image after making sure its dimensions are sane.
+// r is read twice, so it has to be seekable.
+func Decode(r io.ReadSeeker) (image.Image, string, error) {
+	cfg, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > MaxPixels {
+		return nil, "", ErrTooManyPixels
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+	img, _, err := image.Decode(r)
+	return img, format, err
+}
+
+// Resize scales src according to opts
+func Resize(src image.Image, opts Options) image.Image {
+	bounds := src.Bounds()
+	sw, sh := float64(bounds.Dx()), float64(bounds.Dy())
+	srcRect := bounds
+
+	var dw, dh int
+	switch opts.Fit {
+	case FitFill:
+		dw, dh = opts.Width, opts.Height
+
+	case FitCover:
+		scale := math.Max(float64(opts.Width)/sw, float64(opts.Height)/sh)
+		cw := int(math.Round(float64(opts.Width) / scale))
+		ch := int(math.Round(float64(opts.Height) / scale))
+		x := bounds.Min.X + (bounds.Dx()-cw)/2
+		y := bounds.Min.Y + (bounds.Dy()-ch)/2
+		srcRect = image.Rect(x, y, x+cw, y+ch)
+		dw, dh = opts.Width, opts.Height
+
+	default:
+		scale := math.Inf(1)
+		if opts.Width > 0 {
+			scale = float64(opts.Width) / sw
+		}
+		if opts.Height > 0 {
+			scale = math.Min(scale, float64(opts.Height)/sh)
+		}
+		// Thumbnails never get bigger than the original
+		scale = math.Min(scale, 1)
+		dw = max(1, int(math.Round(sw*scale)))
+		dh = max(1, int(math.Round(sh*scale)))
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, srcRect, draw.Src, nil)
+	return dst
+}
+
+// Encode writes img in the given format
+func Encode(w io.Writer, img image.Image, format string, quality int) error {
+	switch format {
+	case FormatJPEG:
+		// The encoder would silently clamp anything else
+		if quality < 1 || quality > 100 {
+			return fmt.Errorf("%w: jpeg quality must be between 1 and 100", ErrInvalidOptions)
+		}
+		// JPEG has no alpha, flatten onto white instead of letting it turn black
+		flat := image.NewRGBA(img.Bounds())
+		draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+		return jpeg.Encode(w, flat, &jpeg.Options{Quality: quality})
+	case FormatPNG:
+		return png.Encode(w, img)
+	default:
+		return fmt.Errorf("%w: unknown format %s", ErrInvalidOptions, format)
+	}
+}
+
+// MimeType returns the content type of an output format
+func MimeType(format string) string {
+	if format == FormatJPEG {
+		return "image/jpeg"
+	}
+	return "image/png"
+}
+
+// Orient transforms img so it displays upright for the given EXIF orientation (1-8)
+func Orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for dy := 0; dy < dh; dy++ {
+		for dx := 0; dx < dw; dx++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // flip horizontal
+				sx, sy = w-1-dx, dy
+			case 3: // rotate 180
+				sx, sy = w-1-dx, h-1-dy
+			case 4: // flip vertical
+				sx, sy = dx, h-1-dy
+			case 5: // transpose
+				sx, sy = dy, dx
+			case 6: // rotate 90 clockwise
+				sx, sy = dy, h-1-dx
+			case 7: // transverse
+				sx, sy = w-1-dy, h-1-dx
+			case 8: // rotate 90 counter clockwise
+				sx, sy = w-1-dy, dx
+			}
+			si := src.PixOffset(sx, sy)
+			di := dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
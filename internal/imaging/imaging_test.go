@@ -0,0 +1,69 @@
+package imaging
+
+import (
+	"errors"
+	"image"
+	"io"
+	"net/url"
+	"testing"
+)
+
+func TestParseOptions(t *testing.T) {
+	tests := []struct {
+		query   string
+		source  string
+		want    Options
+		wantErr bool
+	}{
+		{query: "w=320", want: Options{Size{320, 0}, FitContain, FormatPNG}},
+		{query: "w=320&h=240", source: FormatJPEG, want: Options{Size{320, 240}, FitContain, FormatJPEG}},
+		{query: "w=320&h=240&fit=COVER&format=jpg", want: Options{Size{320, 240}, FitCover, FormatJPEG}},
+		{query: "h=240&format=png", source: FormatJPEG, want: Options{Size{0, 240}, FitContain, FormatPNG}},
+		{query: "", wantErr: true},
+		{query: "format=png", wantErr: true},
+		{query: "w=0", wantErr: true},
+		{query: "w=-5", wantErr: true},
+		{query: "w=abc", wantErr: true},
+		{query: "w=320&fit=fill", wantErr: true},
+		{query: "w=320&fit=stretch", wantErr: true},
+		{query: "w=320&format=gif", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			query, _ := url.ParseQuery(tt.query)
+			got, err := ParseOptions(query, tt.source)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidOptions) {
+					t.Fatalf("err = %v, want ErrInvalidOptions", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeQuality(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+
+	for _, quality := range []int{-1, 0, 101} {
+		if err := Encode(io.Discard, img, FormatJPEG, quality); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("quality %d: err = %v, want ErrInvalidOptions", quality, err)
+		}
+	}
+	for _, quality := range []int{1, 85, 100} {
+		if err := Encode(io.Discard, img, FormatJPEG, quality); err != nil {
+			t.Errorf("quality %d: %v", quality, err)
+		}
+	}
+	// PNG has no quality setting
+	if err := Encode(io.Discard, img, FormatPNG, 0); err != nil {
+		t.Errorf("png: %v", err)
+	}
+}
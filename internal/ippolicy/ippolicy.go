@@ -0,0 +1,96 @@
+// Package ippolicy decides which client addresses may reach which routes
+package ippolicy
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Rule is an allow or deny entry of a policy
+type Rule struct {
+	Allow  bool
+	Prefix netip.Prefix
+}
+
+func (r Rule) String() string {
+	if r.Allow {
+		return "allow " + r.Prefix.String()
+	}
+	return "deny " + r.Prefix.String()
+}
+
+// Policy denies addresses in Deny. If Allow is not empty, addresses outside
+// of it are denied too.
+type Policy struct {
+	Allow []netip.Prefix
+	Deny  []netip.Prefix
+}
+
+// NewPolicy parses CIDR ranges, a bare address stands for itself
+func NewPolicy(allow, deny []string) (Policy, error) {
+	var p Policy
+	var err error
+	if p.Allow, err = ParsePrefixes(allow); err != nil {
+		return p, err
+	}
+	if p.Deny, err = ParsePrefixes(deny); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// ParsePrefixes parses CIDR ranges, a bare address stands for itself
+func ParsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q", value)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q", value)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Check reports whether addr may pass and the rule that decided it. A
+// policy without rules lets everything pass with a zero rule.
+func (p Policy) Check(addr netip.Addr) (bool, Rule) {
+	addr = addr.Unmap()
+	for _, prefix := range p.Deny {
+		if prefix.Contains(addr) {
+			return false, Rule{Prefix: prefix}
+		}
+	}
+	for _, prefix := range p.Allow {
+		if prefix.Contains(addr) {
+			return true, Rule{Allow: true, Prefix: prefix}
+		}
+	}
+	return len(p.Allow) == 0, Rule{}
+}
+
+// Empty reports whether the policy has no rules at all
+func (p Policy) Empty() bool {
+	return len(p.Allow) == 0 && len(p.Deny) == 0
+}
+
+// Contains reports whether addr is in any of prefixes
+func Contains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,164 @@
+// Package janitor removes files that were left behind in the temp dir by
+// broken uploads and crashes.
+package janitor
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"noverna.de/m/v2/internal/logger"
+	"noverna.de/m/v2/internal/metrics"
+)
+
+var (
+	reclaimedBytes = metrics.NewCounter("noverna_janitor_reclaimed_bytes_total", "Bytes freed in the temp dir by the janitor")
+	removedFiles   = metrics.NewCounter("noverna_janitor_removed_files_total", "Files removed from the temp dir by the janitor")
+)
+
+// Sweeper cleans up a directory that knows which of its files are still in use
+type Sweeper interface {
+	Sweep(now time.Time) (removed int, reclaimed int64, err error)
+}
+
+type Janitor struct {
+	dir      string
+	maxAge   time.Duration
+	logger   *logger.Logger
+	sweepers map[string]Sweeper
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	mu     sync.Mutex
+}
+
+// New creates a janitor for dir that removes files not modified for maxAge.
+// Files that are still written to keep getting a fresh modification time.
+func New(dir string, maxAge time.Duration, log *logger.Logger) *Janitor {
+	return &Janitor{
+		dir:      dir,
+		maxAge:   maxAge,
+		logger:   log,
+		sweepers: make(map[string]Sweeper),
+	}
+}
+
+// Delegate leaves the subdirectory sub of the temp dir to sw instead of
+// judging its files by age
+func (j *Janitor) Delegate(sub string, sw Sweeper) {
+	j.sweepers[filepath.Join(j.dir, sub)] = sw
+}
+
+// Start cleans up once right away and then once per interval until Stop
+func (j *Janitor) Start(interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	j.cancel = cancel
+	j.done = make(chan struct{})
+
+	go func() {
+		defer close(j.done)
+
+		j.Run(ctx, time.Now())
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				j.Run(ctx, time.Now())
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the periodic cleanup and waits for a running pass until ctx expires
+func (j *Janitor) Stop(ctx context.Context) error {
+	if j.cancel == nil {
+		return nil
+	}
+	j.cancel()
+
+	select {
+	case <-j.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run does a single cleanup pass
+func (j *Janitor) Run(ctx context.Context, now time.Time) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	removed, reclaimed := 0, int64(0)
+	cutoff := now.Add(-j.maxAge)
+
+	err := filepath.WalkDir(j.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// Files may vanish while we walk, whoever owned them cleaned up
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if entry.IsDir() {
+			if sw, ok := j.sweepers[path]; ok {
+				n, bytes, err := sw.Sweep(now)
+				if err != nil {
+					j.logger.Error("Temp dir sweep failed", map[string]any{
+						"dir":   path,
+						"error": err.Error(),
+					})
+				}
+				removed += n
+				reclaimed += bytes
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		stat, err := entry.Info()
+		if err != nil || stat.ModTime().After(cutoff) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			if !os.IsNotExist(err) {
+				j.logger.Warn("Failed to remove temp file", map[string]any{
+					"path":  path,
+					"error": err.Error(),
+				})
+			}
+			return nil
+		}
+		removed++
+		reclaimed += stat.Size()
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		j.logger.Error("Temp dir cleanup failed", map[string]any{
+			"dir":   j.dir,
+			"error": err.Error(),
+		})
+	}
+
+	removedFiles.Add(int64(removed))
+	reclaimedBytes.Add(reclaimed)
+	if removed > 0 {
+		j.logger.Info("Temp dir cleaned up", map[string]any{
+			"removed":         removed,
+			"reclaimed_bytes": reclaimed,
+		})
+	}
+}
@@ -0,0 +1,307 @@
+// Package kv is a small embedded key/value store. All data is kept in memory
+// and every committed transaction is appended to a log file, which is
+// replayed on startup and compacted once it holds mostly stale entries.
+package kv
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrClosed = errors.New("kv: database is closed")
+
+// Rewrite the log once it holds this many stale entries and more stale than live ones
+const compactThreshold = 1024
+
+type op struct {
+	Key    string `json:"k"`
+	Value  []byte `json:"v,omitempty"`
+	Delete bool   `json:"d,omitempty"`
+}
+
+type DB struct {
+	mu   sync.RWMutex
+	path string
+	log  *os.File
+	data map[string][]byte
+	keys []string // sorted, for ordered scans
+	size int64    // bytes of valid log
+	// entries in the log, live and stale. The stale ones are derived from it
+	// rather than counted, so overwrites and deletes can't skew them.
+	entries int
+}
+
+// Open loads the database at path, creating it if it doesn't exist yet
+func Open(path string) (*DB, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	db := &DB{path: path, data: make(map[string][]byte)}
+	if err := db.replay(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	db.log = f
+	return db, nil
+}
+
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.log == nil {
+		return nil
+	}
+	err := db.log.Close()
+	db.log = nil
+	return err
+}
+
+// Get returns a copy of the value stored under key
+func (db *DB) Get(key string) ([]byte, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	v, ok := db.data[key]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), v...), true
+}
+
+// Scan calls fn in key order for every key that starts with prefix and is
+// greater than or equal to start. Returning false from fn stops the scan.
+// fn runs under the read lock and must not call Update.
+func (db *DB) Scan(prefix, start string, fn func(key string, value []byte) bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if start < prefix {
+		start = prefix
+	}
+	for i := sort.SearchStrings(db.keys, start); i < len(db.keys); i++ {
+		key := db.keys[i]
+		if !strings.HasPrefix(key, prefix) {
+			return
+		}
+		if !fn(key, db.data[key]) {
+			return
+		}
+	}
+}
+
+// Update runs fn in a read-write transaction. Writers are serialized and the
+// changes only become visible once they have been written to the log.
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.log == nil {
+		return ErrClosed
+	}
+
+	tx := &Tx{db: db, pending: make(map[string]*op)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if len(tx.ops) == 0 {
+		return nil
+	}
+
+	line, err := json.Marshal(tx.ops)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := db.log.Write(line); err != nil {
+		// Don't leave a torn entry in front of the next commit
+		db.log.Truncate(db.size)
+		return fmt.Errorf("kv: write log: %w", err)
+	}
+	if err := db.log.Sync(); err != nil {
+		db.log.Truncate(db.size)
+		return fmt.Errorf("kv: sync log: %w", err)
+	}
+	db.size += int64(len(line))
+
+	for _, o := range tx.ops {
+		db.apply(o)
+	}
+
+	// Compaction is best effort, the log is valid either way and we retry on the next commit
+	db.maybeCompact()
+	return nil
+}
+
+// Tx sees its own writes before they are committed
+type Tx struct {
+	db      *DB
+	ops     []*op
+	pending map[string]*op
+}
+
+func (tx *Tx) Get(key string) ([]byte, bool) {
+	if o, ok := tx.pending[key]; ok {
+		if o.Delete {
+			return nil, false
+		}
+		return o.Value, true
+	}
+	v, ok := tx.db.data[key]
+	return v, ok
+}
+
+func (tx *Tx) Put(key string, value []byte) {
+	o := &op{Key: key, Value: append([]byte(nil), value...)}
+	tx.ops = append(tx.ops, o)
+	tx.pending[key] = o
+}
+
+func (tx *Tx) Delete(key string) {
+	o := &op{Key: key, Delete: true}
+	tx.ops = append(tx.ops, o)
+	tx.pending[key] = o
+}
+
+// GetJSON decodes the value under key into v
+func (tx *Tx) GetJSON(key string, v any) (bool, error) {
+	data, ok := tx.Get(key)
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+// PutJSON stores v encoded as JSON
+func (tx *Tx) PutJSON(key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tx.Put(key, data)
+	return nil
+}
+
+func (db *DB) apply(o *op) {
+	db.entries++
+	_, exists := db.data[o.Key]
+
+	if o.Delete {
+		if exists {
+			delete(db.data, o.Key)
+			i := sort.SearchStrings(db.keys, o.Key)
+			db.keys = append(db.keys[:i], db.keys[i+1:]...)
+		}
+		return
+	}
+
+	db.data[o.Key] = o.Value
+	if !exists {
+		i := sort.SearchStrings(db.keys, o.Key)
+		db.keys = append(db.keys, "")
+		copy(db.keys[i+1:], db.keys[i:])
+		db.keys[i] = o.Key
+	}
+}
+
+func (db *DB) replay() error {
+	f, err := os.Open(db.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var valid int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			var ops []*op
+			if jsonErr := json.Unmarshal(line, &ops); jsonErr != nil {
+				return fmt.Errorf("kv: corrupt log %s at offset %d: %w", db.path, valid, jsonErr)
+			}
+			for _, o := range ops {
+				db.apply(o)
+			}
+			valid += int64(len(line))
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	db.size = valid
+
+	// A half written last line means we crashed mid commit, drop it
+	if stat, err := f.Stat(); err == nil && stat.Size() > valid {
+		return os.Truncate(db.path, valid)
+	}
+	return nil
+}
+
+// stale counts log entries that are overwritten, deleted or deletes themselves
+func (db *DB) stale() int {
+	return db.entries - len(db.data)
+}
+
+func (db *DB) maybeCompact() error {
+	if stale := db.stale(); stale < compactThreshold || stale < len(db.data) {
+		return nil
+	}
+
+	tmpPath := db.path + ".compact"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	var size int64
+	for _, key := range db.keys {
+		line, err := json.Marshal([]*op{{Key: key, Value: db.data[key]}})
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		n, _ := w.Write(append(line, '\n'))
+		size += int64(n)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+
+	if err := os.Rename(tmpPath, db.path); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(db.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	db.log.Close()
+	db.log = f
+	db.size = size
+	db.entries = len(db.data)
+	return nil
+}
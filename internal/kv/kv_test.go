@@ -0,0 +1,183 @@
+package kv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func open(t *testing.T, path string) *DB {
+	t.Helper()
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func update(t *testing.T, db *DB, fn func(tx *Tx)) {
+	t.Helper()
+	if err := db.Update(func(tx *Tx) error { fn(tx); return nil }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func contents(db *DB) string {
+	var pairs []string
+	db.Scan("", "", func(key string, value []byte) bool {
+		pairs = append(pairs, key+"="+string(value))
+		return true
+	})
+	return strings.Join(pairs, ",")
+}
+
+func TestReplay(t *testing.T) {
+	tests := []struct {
+		name      string
+		txs       []func(tx *Tx)
+		want      string
+		wantStale int
+	}{
+		{
+			name: "puts",
+			txs: []func(tx *Tx){
+				func(tx *Tx) { tx.Put("b", []byte("2")); tx.Put("a", []byte("1")) },
+			},
+			want: "a=1,b=2",
+		},
+		{
+			name: "overwrite",
+			txs: []func(tx *Tx){
+				func(tx *Tx) { tx.Put("a", []byte("1")) },
+				func(tx *Tx) { tx.Put("a", []byte("2")) },
+			},
+			want:      "a=2",
+			wantStale: 1,
+		},
+		{
+			name: "delete",
+			txs: []func(tx *Tx){
+				func(tx *Tx) { tx.Put("a", []byte("1")); tx.Put("b", []byte("2")) },
+				func(tx *Tx) { tx.Delete("a") },
+			},
+			want:      "b=2",
+			wantStale: 2,
+		},
+		{
+			name: "delete missing",
+			txs: []func(tx *Tx){
+				func(tx *Tx) { tx.Delete("a") },
+			},
+			want:      "",
+			wantStale: 1,
+		},
+		{
+			name: "delete twice",
+			txs: []func(tx *Tx){
+				func(tx *Tx) { tx.Put("a", []byte("1")) },
+				func(tx *Tx) { tx.Delete("a") },
+				func(tx *Tx) { tx.Delete("a") },
+			},
+			want:      "",
+			wantStale: 3,
+		},
+		{
+			name: "put and delete in one transaction",
+			txs: []func(tx *Tx){
+				func(tx *Tx) { tx.Put("a", []byte("1")); tx.Delete("a"); tx.Put("a", []byte("3")) },
+			},
+			want:      "a=3",
+			wantStale: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+			db := open(t, path)
+			for _, fn := range tt.txs {
+				update(t, db, fn)
+			}
+			if got := contents(db); got != tt.want {
+				t.Errorf("before reopen = %q, want %q", got, tt.want)
+			}
+			if got := db.stale(); got != tt.wantStale {
+				t.Errorf("stale before reopen = %d, want %d", got, tt.wantStale)
+			}
+			db.Close()
+
+			db = open(t, path)
+			if got := contents(db); got != tt.want {
+				t.Errorf("after reopen = %q, want %q", got, tt.want)
+			}
+			if got := db.stale(); got != tt.wantStale {
+				t.Errorf("stale after reopen = %d, want %d", got, tt.wantStale)
+			}
+		})
+	}
+}
+
+func TestReplayTornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := open(t, path)
+	update(t, db, func(tx *Tx) { tx.Put("a", []byte("1")) })
+	db.Close()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`[{"k":"b","v":"M`)
+	f.Close()
+
+	db = open(t, path)
+	if got := contents(db); got != "a=1" {
+		t.Fatalf("contents = %q, want the torn commit dropped", got)
+	}
+	// The next commit must not land behind the torn bytes
+	update(t, db, func(tx *Tx) { tx.Put("c", []byte("3")) })
+	db.Close()
+
+	db = open(t, path)
+	if got := contents(db); got != "a=1,c=3" {
+		t.Fatalf("contents = %q, want a=1,c=3", got)
+	}
+}
+
+func TestReplayCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	if err := os.WriteFile(path, []byte("not json\n"+`[{"k":"a","v":"MQ=="}]`+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Fatal("opened a log with a corrupt entry in the middle")
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := open(t, path)
+
+	for i := range compactThreshold + 10 {
+		update(t, db, func(tx *Tx) { tx.Put("counter", []byte(fmt.Sprint(i))) })
+	}
+	if got := db.stale(); got >= compactThreshold {
+		t.Fatalf("stale = %d, want the log compacted", got)
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() > 4096 {
+		t.Fatalf("log is %d bytes after compaction", stat.Size())
+	}
+	db.Close()
+
+	db = open(t, path)
+	if got, want := contents(db), fmt.Sprintf("counter=%d", compactThreshold+9); got != want {
+		t.Fatalf("after reopen = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,81 @@
+// Package metrics holds process wide counters and serves them in the
+// Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter only ever goes up
+type Counter struct {
+	name  string
+	help  string
+	value atomic.Int64
+}
+
+// Add increases the counter, negative values are ignored
+func (c *Counter) Add(n int64) {
+	if n > 0 {
+		c.value.Add(n)
+	}
+}
+
+// Inc increases the counter by one
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+// Value returns the current count
+func (c *Counter) Value() int64 {
+	return c.value.Load()
+}
+
+var (
+	mu       sync.Mutex
+	counters = make(map[string]*Counter)
+)
+
+// NewCounter registers a counter. Asking for the same name twice returns
+// the counter registered first.
+func NewCounter(name, help string) *Counter {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if c, ok := counters[name]; ok {
+		return c
+	}
+	c := &Counter{name: name, help: help}
+	counters[name] = c
+	return c
+}
+
+// Handler serves every registered counter
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Write(w)
+	})
+}
+
+// Write prints every registered counter, sorted by name
+func Write(w io.Writer) error {
+	mu.Lock()
+	sorted := make([]*Counter, 0, len(counters))
+	for _, c := range counters {
+		sorted = append(sorted, c)
+	}
+	mu.Unlock()
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+
+	for _, c := range sorted {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.Value()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"noverna.de/m/v2/internal/auth"
+	"noverna.de/m/v2/pkg/hmacsign"
+)
+
+type APIKeyConfig struct {
+	// Authenticate resolves a presented key to its identity
+	Authenticate func(key string) (*auth.Identity, error)
+	// AuthenticateRequest resolves the signature of a signed request to its
+	// identity. It may replace the body, which is closed once the request
+	// is done.
+	AuthenticateRequest func(r *http.Request) (*auth.Identity, error)
+	// Required turns away requests without a key. Without it anonymous
+	// requests pass, but a wrong key is still rejected.
+	Required bool
+	// Exempt reports whether a request may pass without a key
+	Exempt func(r *http.Request) bool
+	// Unauthorized writes the response for a missing or invalid key
+	Unauthorized func(w http.ResponseWriter, r *http.Request, reason string)
+}
+
+// APIKeyMiddleware checks the key or JWT from "Authorization: Bearer <key>"
+// or "X-Api-Key", or the signature of a request signed with hmacsign, and
+// puts the identity it stands for into the request context
+func APIKeyMiddleware(config *APIKeyConfig) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Preflights never carry credentials
+			if r.Method == http.MethodOptions || (config.Exempt != nil && config.Exempt(r)) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if hmacsign.IsSigned(r) {
+				identity, err := config.AuthenticateRequest(r)
+				if err != nil {
+					config.Unauthorized(w, r, signatureReason(err))
+					return
+				}
+				defer r.Body.Close()
+				setLogSubject(r.Context(), identity.Name())
+				next.ServeHTTP(w, r.WithContext(auth.WithIdentity(r.Context(), identity)))
+				return
+			}
+
+			key, ok := requestKey(r)
+			if !ok {
+				if config.Required {
+					config.Unauthorized(w, r, "missing API key")
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			identity, err := config.Authenticate(key)
+			if err != nil {
+				config.Unauthorized(w, r, reason(err))
+				return
+			}
+
+			setLogSubject(r.Context(), identity.Name())
+			next.ServeHTTP(w, r.WithContext(auth.WithIdentity(r.Context(), identity)))
+		})
+	}
+}
+
+// reason tells the caller why their credentials were refused, without
+// passing on details of what went wrong internally
+func reason(err error) string {
+	switch {
+	case errors.Is(err, auth.ErrKeyExpired), errors.Is(err, auth.ErrKeyRevoked), errors.Is(err, auth.ErrTokenExpired):
+		return err.Error()
+	case errors.Is(err, auth.ErrInvalidToken):
+		return auth.ErrInvalidToken.Error()
+	default:
+		return auth.ErrInvalidKey.Error()
+	}
+}
+
+// signatureReason is reason for signed requests
+func signatureReason(err error) string {
+	switch {
+	case errors.Is(err, auth.ErrStaleRequest), errors.Is(err, auth.ErrReplayedRequest),
+		errors.Is(err, auth.ErrBodyMismatch), errors.Is(err, auth.ErrBodyTooLarge):
+		return err.Error()
+	case errors.Is(err, auth.ErrNonceUnavailable):
+		return auth.ErrNonceUnavailable.Error()
+	default:
+		return auth.ErrInvalidSignature.Error()
+	}
+}
+
+// requestKey reads the key from the Authorization or X-Api-Key header
+func requestKey(r *http.Request) (string, bool) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, key, found := strings.Cut(header, " ")
+		if found && strings.EqualFold(scheme, "Bearer") {
+			key = strings.TrimSpace(key)
+			return key, key != ""
+		}
+	}
+	key := strings.TrimSpace(r.Header.Get("X-Api-Key"))
+	return key, key != ""
+}
@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -50,11 +51,23 @@ type LogEntry struct {
 	Size         int64
 	Headers      map[string]string
 	Error        error
+	// Subject is who the request was authenticated as, filled in by the auth middleware
+	Subject string
+}
+
+type logEntryKey struct{}
+
+// setLogSubject records who made a request in its access log entry
+func setLogSubject(ctx context.Context, subject string) {
+	if entry, ok := ctx.Value(logEntryKey{}).(*LogEntry); ok {
+		entry.Subject = subject
+	}
 }
 
 type responseWriter struct {
 	http.ResponseWriter
 	body       *bytes.Buffer
+	maxBody    int64
 	statusCode int
 	size       int64
 }
@@ -65,7 +78,8 @@ func (rw *responseWriter) WriteHeader(code int) {
 }
 
 func (rw *responseWriter) Write(data []byte) (int, error) {
-	if rw.body != nil {
+	// Only keep what we are going to log, downloads can be huge
+	if rw.body != nil && int64(rw.body.Len()) <= rw.maxBody {
 		rw.body.Write(data)
 	}
 	n, err := rw.ResponseWriter.Write(data)
@@ -131,6 +145,7 @@ func LoggerMiddleware(config *LoggerConfig) func(next http.Handler) http.Handler
 				rw = &responseWriter{
 					ResponseWriter: w,
 					body:           &bytes.Buffer{},
+					maxBody:        config.MaxBodySize,
 					statusCode:     http.StatusOK,
 				}
 			} else {
@@ -140,7 +155,8 @@ func LoggerMiddleware(config *LoggerConfig) func(next http.Handler) http.Handler
 				}
 			}
 
-			next.ServeHTTP(rw, r)
+			// Handlers further down fill in the subject
+			next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), logEntryKey{}, entry)))
 
 			duration := time.Since(start)
 			entry.Duration = duration
@@ -175,6 +191,9 @@ func logRequest(l *logger.Logger, entry *LogEntry) {
 	if entry.Referer != "" {
 		fields["referer"] = entry.Referer
 	}
+	if entry.Subject != "" {
+		fields["subject"] = entry.Subject
+	}
 	if len(entry.Headers) > 0 {
 		fields["headers"] = entry.Headers
 	}
@@ -228,7 +247,12 @@ func readAndRestoreBody(r *http.Request, maxSize int64) (string, error) {
 		return "", err
 	}
 
-	r.Body = io.NopCloser(bytes.NewBuffer(body))
+	// Put the consumed prefix back in front of the rest, otherwise bodies
+	// larger than maxSize get cut off for the actual handler
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
 
 	return string(body), nil
 }
@@ -265,7 +289,7 @@ func DetailedLoggerMiddleware(l *logger.Logger) func(next http.Handler) http.Han
 		LogResponseBody:  true,
 		LogHeaders:       true,
 		MaxBodySize:      1024 * 10, // 10KB
-		RedactHeaders:    []string{"Authorization", "Cookie"},
+		RedactHeaders:    []string{"Authorization", "Cookie", "X-Api-Key"},
 		RedactBodyFields: []string{"password", "token"},
 	}
 	return LoggerMiddleware(config)
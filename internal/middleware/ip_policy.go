@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/go-chi/chi/v5/middleware"
+
+	"noverna.de/m/v2/internal/ippolicy"
+	"noverna.de/m/v2/internal/logger"
+)
+
+// IPPolicyGroup applies a policy to the routes matching one of Patterns,
+// see matchPattern
+type IPPolicyGroup struct {
+	Name     string
+	Patterns []string
+	Policy   ippolicy.Policy
+}
+
+type IPPolicyConfig struct {
+	// Default applies to every request, a group's policy on top of it
+	Default ippolicy.Policy
+	Groups  []IPPolicyGroup
+	Logger  *logger.Logger
+	// Denied writes the response for a request that may not pass
+	Denied func(w http.ResponseWriter, r *http.Request)
+}
+
+// IPPolicyMiddleware turns away clients the policies don't allow. It has to
+// run after RealIP.
+func IPPolicyMiddleware(config *IPPolicyConfig) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			group, policies := "", []ippolicy.Policy{config.Default}
+			if g, ok := matchGroup(config.Groups, r); ok {
+				group = g.Name
+				policies = append(policies, g.Policy)
+			}
+
+			addr, parsed := remoteAddr(r.RemoteAddr)
+			for _, policy := range policies {
+				if policy.Empty() {
+					continue
+				}
+
+				rule := "unknown client address"
+				allowed := false
+				if parsed {
+					var matched ippolicy.Rule
+					allowed, matched = policy.Check(addr)
+					rule = "not in allow list"
+					if matched.Prefix.IsValid() {
+						rule = matched.String()
+					}
+				}
+				if !allowed {
+					config.Logger.Warn("Request denied by IP policy", map[string]any{
+						"request_id":  middleware.GetReqID(r.Context()),
+						"remote_addr": r.RemoteAddr,
+						"method":      r.Method,
+						"path":        r.URL.Path,
+						"group":       group,
+						"rule":        rule,
+					})
+					config.Denied(w, r)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// matchGroup picks the group with the most specific pattern matching r
+func matchGroup(groups []IPPolicyGroup, r *http.Request) (IPPolicyGroup, bool) {
+	type candidate struct {
+		group IPPolicyGroup
+		rank  int
+	}
+	var matches []candidate
+	for _, g := range groups {
+		for _, pattern := range g.Patterns {
+			if matchPattern(pattern, r) {
+				matches = append(matches, candidate{g, patternRank(pattern)})
+			}
+		}
+	}
+	if len(matches) == 0 {
+		return IPPolicyGroup{}, false
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].rank > matches[j].rank })
+	return matches[0].group, true
+}
@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+)
+
+// matchPattern matches a request against a path, optionally after a method
+// like "POST /v1/files". A trailing "*" matches everything below a prefix.
+func matchPattern(pattern string, r *http.Request) bool {
+	path := pattern
+	if method, rest, ok := strings.Cut(pattern, " "); ok {
+		if !strings.EqualFold(method, r.Method) {
+			return false
+		}
+		path = strings.TrimSpace(rest)
+	}
+
+	if prefix, ok := strings.CutSuffix(path, "*"); ok {
+		return strings.HasPrefix(r.URL.Path, prefix)
+	}
+	return r.URL.Path == path
+}
+
+// patternRank orders patterns by how specific they are: those with a
+// method first, then exact paths, then longer prefixes
+func patternRank(pattern string) int {
+	rank := len(pattern)
+	if strings.Contains(pattern, " ") {
+		rank += 1 << 20
+	}
+	if !strings.HasSuffix(pattern, "*") {
+		rank += 1 << 16
+	}
+	return rank
+}
@@ -0,0 +1,113 @@
+package middleware
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"noverna.de/m/v2/internal/auth"
+	"noverna.de/m/v2/internal/ratelimit"
+)
+
+// RouteLimit overrides the limit for requests matching Pattern: a path,
+// optionally after a method like "POST /v1/files". A trailing "*" matches
+// everything below a prefix. Matching routes get a bucket of their own.
+type RouteLimit struct {
+	Pattern string
+	Limit   ratelimit.Limit
+}
+
+type RateLimitConfig struct {
+	Limiter ratelimit.Store
+	Default ratelimit.Limit
+	Routes  []RouteLimit
+	// Bucket names the default bucket, so limiters sharing a store don't
+	// count against each other. Empty means "default".
+	Bucket string
+	// Skip reports whether a request isn't counted at all
+	Skip func(r *http.Request) bool
+	// Limited writes the response for a request over the limit
+	Limited func(w http.ResponseWriter, r *http.Request, d ratelimit.Decision)
+}
+
+// RateLimitMiddleware limits requests per API key, or per client IP for
+// anonymous requests. It has to run after RealIP, and after the API key
+// check unless every request should be counted per client IP.
+func RateLimitMiddleware(config *RateLimitConfig) func(next http.Handler) http.Handler {
+	routes := sortRoutes(config.Routes)
+	name := config.Bucket
+	if name == "" {
+		name = "default"
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if config.Skip != nil && config.Skip(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			bucket, limit := name, config.Default
+			if route, ok := matchRoute(routes, r); ok {
+				bucket, limit = route.Pattern, route.Limit
+			}
+
+			d, err := config.Limiter.Allow(r.Context(), bucket+"|"+clientKey(r), limit)
+			if err != nil {
+				// An outage of the limiter shouldn't take the API down with it
+				next.ServeHTTP(w, r)
+				return
+			}
+			if d.Limit >= 0 {
+				w.Header().Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+				w.Header().Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+				w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.Reset)))
+				w.Header().Set("RateLimit-Policy", strconv.Itoa(limit.PerMinute)+";w=60;burst="+strconv.Itoa(limit.Burst))
+			}
+			if !d.Allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(max(ceilSeconds(d.RetryAfter), 1)))
+				config.Limited(w, r, d)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// clientKey names who a request is counted against
+func clientKey(r *http.Request) string {
+	if owner := auth.Owner(r.Context()); owner != "" {
+		return "owner:" + owner
+	}
+	// RealIP leaves a bare IP, without it RemoteAddr still has the port
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// sortRoutes orders routes so the most specific pattern is tried first
+func sortRoutes(routes []RouteLimit) []RouteLimit {
+	sorted := append([]RouteLimit(nil), routes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return patternRank(sorted[i].Pattern) > patternRank(sorted[j].Pattern)
+	})
+	return sorted
+}
+
+func matchRoute(routes []RouteLimit, r *http.Request) (RouteLimit, bool) {
+	for _, route := range routes {
+		if matchPattern(route.Pattern, r) {
+			return route, true
+		}
+	}
+	return RouteLimit{}, false
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
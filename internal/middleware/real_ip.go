@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"noverna.de/m/v2/internal/ippolicy"
+)
+
+// RealIP replaces RemoteAddr with the client address, like chi's RealIP.
+// Forwarding headers are only believed when the peer is one of trusted,
+// so clients can't make up their own address.
+func RealIP(trusted []netip.Prefix) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if peer, ok := remoteAddr(r.RemoteAddr); ok {
+				client := peer
+				if ippolicy.Contains(trusted, peer) {
+					client = forwardedFor(r, trusted, peer)
+				}
+				r.RemoteAddr = client.String()
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// forwardedFor walks X-Forwarded-For from the nearest hop back and returns
+// the first address that isn't a trusted proxy. Hops further back could
+// have been written by the client.
+func forwardedFor(r *http.Request, trusted []netip.Prefix, peer netip.Addr) netip.Addr {
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = hop.Unmap()
+		if !ippolicy.Contains(trusted, client) {
+			return client
+		}
+	}
+	if len(hops) > 0 {
+		return client
+	}
+
+	for _, header := range []string{"X-Real-IP", "True-Client-IP"} {
+		if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get(header))); err == nil {
+			return addr.Unmap()
+		}
+	}
+	return peer
+}
+
+// ClientAddr returns the client address of r once RealIP ran, the zero Addr
+// if RemoteAddr doesn't hold one
+func ClientAddr(r *http.Request) netip.Addr {
+	addr, _ := remoteAddr(r.RemoteAddr)
+	return addr
+}
+
+// remoteAddr parses a RemoteAddr with or without a port
+func remoteAddr(value string) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(value)
+	if err != nil {
+		host = value
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
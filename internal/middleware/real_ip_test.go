@@ -0,0 +1,149 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestRealIP(t *testing.T) {
+	trusted := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("::1/128"),
+	}
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string][]string
+		want    string
+	}{
+		{name: "direct client", remote: "203.0.113.7:5000", want: "203.0.113.7"},
+		{
+			name:    "untrusted peer can't forward",
+			remote:  "203.0.113.7:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.1"}, "X-Real-Ip": {"198.51.100.2"}},
+			want:    "203.0.113.7",
+		},
+		{
+			name:    "one trusted proxy",
+			remote:  "10.0.0.2:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.1"}},
+			want:    "198.51.100.1",
+		},
+		{
+			name:    "chain of trusted proxies",
+			remote:  "10.0.0.2:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.1, 10.1.1.1", "10.2.2.2"}},
+			want:    "198.51.100.1",
+		},
+		{
+			name:    "spoofed hops beyond the first untrusted one",
+			remote:  "10.0.0.2:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"1.2.3.4, 198.51.100.1, 10.1.1.1"}},
+			want:    "198.51.100.1",
+		},
+		{
+			name:    "every hop trusted",
+			remote:  "10.0.0.2:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"10.3.3.3, 10.1.1.1"}},
+			want:    "10.3.3.3",
+		},
+		{
+			name:    "garbage stops the walk",
+			remote:  "10.0.0.2:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.1, bogus, 10.1.1.1"}},
+			want:    "10.1.1.1",
+		},
+		{
+			name:    "garbage as the nearest hop",
+			remote:  "10.0.0.2:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.1, bogus"}},
+			want:    "10.0.0.2",
+		},
+		{
+			name:    "mapped addresses are unmapped",
+			remote:  "[::ffff:10.0.0.2]:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"::ffff:198.51.100.1"}},
+			want:    "198.51.100.1",
+		},
+		{
+			name:    "ipv6 proxy",
+			remote:  "[::1]:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"2001:db8::1"}},
+			want:    "2001:db8::1",
+		},
+		{
+			name:    "x-real-ip without x-forwarded-for",
+			remote:  "10.0.0.2:5000",
+			headers: map[string][]string{"X-Real-Ip": {"198.51.100.2"}},
+			want:    "198.51.100.2",
+		},
+		{
+			name:    "x-forwarded-for wins over x-real-ip",
+			remote:  "10.0.0.2:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.1"}, "X-Real-Ip": {"198.51.100.2"}},
+			want:    "198.51.100.1",
+		},
+		{
+			name:    "true-client-ip",
+			remote:  "10.0.0.2:5000",
+			headers: map[string][]string{"True-Client-Ip": {"198.51.100.3"}},
+			want:    "198.51.100.3",
+		},
+		{name: "trusted proxy without headers", remote: "10.0.0.2:5000", want: "10.0.0.2"},
+		{name: "unparsable remote is left alone", remote: "pipe", want: "pipe"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := RealIP(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.RemoteAddr
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			for name, values := range tt.headers {
+				r.Header[name] = values
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+
+			if got != tt.want {
+				t.Errorf("RemoteAddr = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRealIPTrustsNothingByDefault(t *testing.T) {
+	var got string
+	handler := RealIP(nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.RemoteAddr
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "127.0.0.1:5000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if got != "127.0.0.1" {
+		t.Fatalf("RemoteAddr = %q, want the peer", got)
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	for remote, want := range map[string]string{
+		"198.51.100.1":           "198.51.100.1",
+		"198.51.100.1:5000":      "198.51.100.1",
+		"[::ffff:10.0.0.2]:5000": "10.0.0.2",
+		"pipe":                   "invalid IP",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remote
+		if got := ClientAddr(r).String(); got != want {
+			t.Errorf("ClientAddr(%q) = %s, want %s", remote, got, want)
+		}
+	}
+}
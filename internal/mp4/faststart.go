@@ -0,0 +1,286 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+var ErrAlreadyFaststart = errors.New("moov already precedes mdat")
+
+// Boxes on the way from moov down to the chunk offset tables
+var containerBoxes = map[string]bool{
+	"moov": true,
+	"trak": true,
+	"mdia": true,
+	"minf": true,
+	"stbl": true,
+}
+
+// node is a box held in memory, either with raw data or with children
+type node struct {
+	typ      string
+	data     []byte
+	children []*node
+}
+
+func (n *node) size() int64 {
+	size := int64(8) + int64(len(n.data))
+	for _, c := range n.children {
+		size += c.size()
+	}
+	return size
+}
+
+func (n *node) writeTo(w io.Writer) error {
+	size := n.size()
+	if size > math.MaxUint32 {
+		return fmt.Errorf("%w: %q box is too large to rewrite", ErrMalformed, n.typ)
+	}
+
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(size))
+	copy(header[4:8], n.typ)
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(n.data); err != nil {
+		return err
+	}
+	for _, c := range n.children {
+		if err := c.writeTo(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Faststart copies the container in r to w with moov moved in front of the
+// media data and every chunk offset adjusted to match. Samples are copied
+// byte for byte, nothing is re-encoded. If a 32 bit stco table can no longer
+// hold the shifted offsets it is widened to co64.
+func Faststart(r io.ReaderAt, size int64, w io.Writer) error {
+	top, err := ReadBoxes(r, 0, size, true)
+	if err != nil {
+		return err
+	}
+
+	moovIndex, firstMdat := -1, -1
+	for i, box := range top {
+		switch box.Type {
+		case "moov":
+			if moovIndex >= 0 {
+				return fmt.Errorf("%w: more than one moov", ErrMalformed)
+			}
+			moovIndex = i
+		case "mdat":
+			if firstMdat < 0 {
+				firstMdat = i
+			}
+		}
+	}
+	if moovIndex < 0 {
+		return fmt.Errorf("%w: no moov box", ErrMalformed)
+	}
+	if firstMdat < 0 || moovIndex < firstMdat {
+		return ErrAlreadyFaststart
+	}
+
+	moovBox := top[moovIndex]
+	if moovBox.DataSize() > maxTableSize {
+		return fmt.Errorf("%w: moov box is too large", ErrMalformed)
+	}
+	moov, err := readTree(r, moovBox)
+	if err != nil {
+		return err
+	}
+
+	// New order: everything before the first mdat, then moov, then the rest
+	order := make([]Box, 0, len(top))
+	order = append(order, top[:firstMdat]...)
+	order = append(order, moovBox)
+	for i := firstMdat; i < len(top); i++ {
+		if i != moovIndex {
+			order = append(order, top[i])
+		}
+	}
+
+	tables, err := chunkOffsetTables(moov)
+	if err != nil {
+		return err
+	}
+	for {
+		// Where each original box ends up with moov at its current size
+		moved := make(map[int64]int64, len(order))
+		var pos int64
+		for _, box := range order {
+			if box.Type != "moov" {
+				moved[box.Offset] = pos
+				pos += box.Size
+			} else {
+				pos += moov.size()
+			}
+		}
+
+		overflow, err := shiftOffsets(tables, top, moovIndex, moved)
+		if err != nil {
+			return err
+		}
+		if !overflow {
+			break
+		}
+		// Wider tables grow moov, so the layout has to be computed again.
+		// After this no table can overflow anymore.
+		for _, table := range tables {
+			table.node.typ = "co64"
+			table.node.data = encodeOffsets(table.node.data[:4], table.offsets, true)
+		}
+	}
+
+	for _, box := range order {
+		if box.Type == "moov" {
+			if err := moov.writeTo(w); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := io.Copy(w, io.NewSectionReader(r, box.Offset, box.Size)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkOffsetTable is a stco or co64 box and its original entries
+type chunkOffsetTable struct {
+	node    *node
+	offsets []uint64
+}
+
+func readTree(r io.ReaderAt, box Box) (*node, error) {
+	n := &node{typ: box.Type}
+	if !containerBoxes[box.Type] {
+		data, err := readPayload(r, box)
+		if err != nil {
+			return nil, err
+		}
+		n.data = data
+		return n, nil
+	}
+
+	children, err := ReadBoxes(r, box.DataOffset(), box.Offset+box.Size, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		c, err := readTree(r, child)
+		if err != nil {
+			return nil, err
+		}
+		n.children = append(n.children, c)
+	}
+	return n, nil
+}
+
+func chunkOffsetTables(n *node) ([]*chunkOffsetTable, error) {
+	var tables []*chunkOffsetTable
+	for _, c := range n.children {
+		switch c.typ {
+		case "stco", "co64":
+			offsets, err := decodeOffsets(c)
+			if err != nil {
+				return nil, err
+			}
+			tables = append(tables, &chunkOffsetTable{node: c, offsets: offsets})
+		default:
+			nested, err := chunkOffsetTables(c)
+			if err != nil {
+				return nil, err
+			}
+			tables = append(tables, nested...)
+		}
+	}
+	return tables, nil
+}
+
+// shiftOffsets rewrites every chunk offset table for the new box positions.
+// It reports an overflow if a 32 bit table can't hold the result.
+func shiftOffsets(tables []*chunkOffsetTable, top []Box, moovIndex int, moved map[int64]int64) (bool, error) {
+	for _, table := range tables {
+		shifted := make([]uint64, len(table.offsets))
+		fits := true
+		for i, offset := range table.offsets {
+			box, ok := containingBox(top, offset)
+			if !ok || box.Offset == top[moovIndex].Offset {
+				return false, fmt.Errorf("%w: chunk offset %d points outside the media data", ErrMalformed, offset)
+			}
+			shifted[i] = offset - uint64(box.Offset) + uint64(moved[box.Offset])
+			if shifted[i] > math.MaxUint32 {
+				fits = false
+			}
+		}
+
+		wide := table.node.typ == "co64"
+		if !wide && !fits {
+			return true, nil
+		}
+		table.node.data = encodeOffsets(table.node.data[:4], shifted, wide)
+	}
+	return false, nil
+}
+
+func decodeOffsets(n *node) ([]uint64, error) {
+	width := int64(4)
+	if n.typ == "co64" {
+		width = 8
+	}
+	if len(n.data) < 8 {
+		return nil, fmt.Errorf("%w: short %s", ErrMalformed, n.typ)
+	}
+	count := int64(binary.BigEndian.Uint32(n.data[4:8]))
+	if count*width > int64(len(n.data)-8) {
+		return nil, fmt.Errorf("%w: truncated %s", ErrMalformed, n.typ)
+	}
+
+	offsets := make([]uint64, count)
+	for i := range offsets {
+		pos := 8 + int64(i)*width
+		if width == 8 {
+			offsets[i] = binary.BigEndian.Uint64(n.data[pos:])
+		} else {
+			offsets[i] = uint64(binary.BigEndian.Uint32(n.data[pos:]))
+		}
+	}
+	return offsets, nil
+}
+
+func encodeOffsets(versionFlags []byte, offsets []uint64, wide bool) []byte {
+	width := 4
+	if wide {
+		width = 8
+	}
+
+	data := make([]byte, 8+len(offsets)*width)
+	copy(data[0:4], versionFlags)
+	binary.BigEndian.PutUint32(data[4:8], uint32(len(offsets)))
+	for i, offset := range offsets {
+		pos := 8 + i*width
+		if wide {
+			binary.BigEndian.PutUint64(data[pos:], offset)
+		} else {
+			binary.BigEndian.PutUint32(data[pos:], uint32(offset))
+		}
+	}
+	return data
+}
+
+func containingBox(top []Box, offset uint64) (Box, bool) {
+	for _, box := range top {
+		if offset >= uint64(box.Offset) && offset < uint64(box.Offset+box.Size) {
+			return box, true
+		}
+	}
+	return Box{}, false
+}
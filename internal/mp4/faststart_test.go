@@ -0,0 +1,109 @@
+package mp4
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// samplesAt reads the bytes every chunk offset of every track points to
+func samplesAt(t *testing.T, data []byte) []string {
+	t.Helper()
+	r := bytes.NewReader(data)
+	top, err := ReadBoxes(r, 0, int64(len(data)), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var samples []string
+	for _, b := range top {
+		if b.Type != "moov" {
+			continue
+		}
+		moov, err := readTree(r, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tables, err := chunkOffsetTables(moov)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, table := range tables {
+			for _, offset := range table.offsets {
+				samples = append(samples, string(data[offset:offset+5]))
+			}
+		}
+	}
+	return samples
+}
+
+func TestFaststart(t *testing.T) {
+	data := movie(false)
+	var out bytes.Buffer
+	if err := Faststart(bytes.NewReader(data), int64(len(data)), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.Len() != len(data) {
+		t.Errorf("output is %d bytes, want %d", out.Len(), len(data))
+	}
+	info, err := Inspect(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatalf("rewritten file: %v", err)
+	}
+	if !info.Faststart {
+		t.Error("moov still follows mdat")
+	}
+
+	before, after := samplesAt(t, data), samplesAt(t, out.Bytes())
+	if len(before) != 3 || len(after) != len(before) {
+		t.Fatalf("chunk offsets before %v, after %v", before, after)
+	}
+	for i := range before {
+		if before[i] != after[i] {
+			t.Errorf("chunk %d points at %q, was %q", i, after[i], before[i])
+		}
+	}
+}
+
+func TestFaststartRejects(t *testing.T) {
+	outside := bytes.Join([][]byte{ftyp, box("mdat", []byte("data")),
+		box("moov", box("trak", box("mdia", box("minf", box("stbl", box("stco", u32(0, 1, 10000)))))))}, nil)
+	truncatedTable := bytes.Join([][]byte{ftyp, box("mdat", []byte("data")),
+		box("moov", box("trak", box("mdia", box("minf", box("stbl", box("stco", u32(0, 5, 20)))))))}, nil)
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"already faststart", movie(true), ErrAlreadyFaststart},
+		{"no mdat", bytes.Join([][]byte{ftyp, box("moov")}, nil), ErrAlreadyFaststart},
+		{"no moov", bytes.Join([][]byte{ftyp, box("mdat")}, nil), ErrMalformed},
+		{"two moov", bytes.Join([][]byte{ftyp, box("mdat"), box("moov"), box("moov")}, nil), ErrMalformed},
+		{"offset outside mdat", outside, ErrMalformed},
+		{"truncated stco", truncatedTable, ErrMalformed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Faststart(bytes.NewReader(tt.data), int64(len(tt.data)), io.Discard)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeOffsetsWidens(t *testing.T) {
+	offsets := []uint64{8, 1 << 33}
+	n := &node{typ: "co64", data: encodeOffsets([]byte{0, 0, 0, 0}, offsets, true)}
+	got, err := decodeOffsets(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != 8 || got[1] != 1<<33 {
+		t.Fatalf("decoded %v, want %v", got, offsets)
+	}
+}
@@ -0,0 +1,405 @@
+// Package mp4 inspects ISO-BMFF (mp4) containers. It only walks the box
+// structure and reads the few tables it needs, media data is never loaded.
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+var ErrMalformed = errors.New("malformed mp4")
+
+// Boxes we read completely are capped so a hostile header can't make us allocate gigabytes
+const maxTableSize = 64 << 20
+
+// Info is what we learn from a container
+type Info struct {
+	MajorBrand string
+	Duration   float64 // seconds
+	Width      int
+	Height     int
+	FrameRate  float64
+	VideoCodec string
+	AudioCodec string
+	// Faststart is true when moov precedes mdat, so playback can start before the download finishes
+	Faststart bool
+	Tracks    []Track
+}
+
+// Track is a single trak box
+type Track struct {
+	ID          uint32
+	Handler     string // "vide", "soun", ...
+	Codec       string // sample entry fourcc, e.g. avc1, hvc1, mp4a
+	Width       int
+	Height      int
+	Timescale   uint32
+	Duration    uint64 // in Timescale units
+	SampleCount uint64
+}
+
+// Box is a box header and where its payload lives in the file
+type Box struct {
+	Type   string
+	Offset int64 // start of the header
+	Size   int64 // including the header
+	Header int64 // header length, 8 or 16
+}
+
+// DataOffset returns where the payload starts
+func (b Box) DataOffset() int64 {
+	return b.Offset + b.Header
+}
+
+// DataSize returns the payload length
+func (b Box) DataSize() int64 {
+	return b.Size - b.Header
+}
+
+// Inspect validates the container in r and extracts its properties
+func Inspect(r io.ReaderAt, size int64) (*Info, error) {
+	top, err := ReadBoxes(r, 0, size, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(top) == 0 || top[0].Type != "ftyp" {
+		return nil, fmt.Errorf("%w: file does not start with ftyp", ErrMalformed)
+	}
+
+	info := &Info{}
+	ftyp, err := readPayload(r, top[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(ftyp) < 4 {
+		return nil, fmt.Errorf("%w: short ftyp", ErrMalformed)
+	}
+	info.MajorBrand = string(ftyp[:4])
+
+	var moov *Box
+	sawMdat := false
+	for i := range top {
+		switch top[i].Type {
+		case "moov":
+			if moov != nil {
+				return nil, fmt.Errorf("%w: more than one moov", ErrMalformed)
+			}
+			moov = &top[i]
+			info.Faststart = !sawMdat
+		case "mdat":
+			sawMdat = true
+		}
+	}
+	if moov == nil {
+		return nil, fmt.Errorf("%w: no moov box", ErrMalformed)
+	}
+
+	if err := parseMoov(r, *moov, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// ReadBoxes lists the boxes between start and end. A size of zero is only
+// valid for the last top level box and means it extends to the end of the file.
+func ReadBoxes(r io.ReaderAt, start, end int64, topLevel bool) ([]Box, error) {
+	var boxes []Box
+	var header [16]byte
+
+	for pos := start; pos < end; {
+		if end-pos < 8 {
+			return nil, fmt.Errorf("%w: truncated box header at %d", ErrMalformed, pos)
+		}
+		if _, err := r.ReadAt(header[:8], pos); err != nil {
+			return nil, fmt.Errorf("%w: truncated box header at %d", ErrMalformed, pos)
+		}
+
+		box := Box{
+			Type:   string(header[4:8]),
+			Offset: pos,
+			Size:   int64(binary.BigEndian.Uint32(header[0:4])),
+			Header: 8,
+		}
+		switch box.Size {
+		case 0:
+			if !topLevel {
+				return nil, fmt.Errorf("%w: open ended %q box", ErrMalformed, box.Type)
+			}
+			box.Size = end - pos
+		case 1:
+			if end-pos < 16 {
+				return nil, fmt.Errorf("%w: truncated box header at %d", ErrMalformed, pos)
+			}
+			if _, err := r.ReadAt(header[8:16], pos+8); err != nil {
+				return nil, fmt.Errorf("%w: truncated box header at %d", ErrMalformed, pos)
+			}
+			large := binary.BigEndian.Uint64(header[8:16])
+			if large > math.MaxInt64 {
+				return nil, fmt.Errorf("%w: %q box is too large", ErrMalformed, box.Type)
+			}
+			box.Size = int64(large)
+			box.Header = 16
+		}
+
+		if box.Size < box.Header {
+			return nil, fmt.Errorf("%w: %q box is smaller than its header", ErrMalformed, box.Type)
+		}
+		if box.Size > end-pos {
+			return nil, fmt.Errorf("%w: %q box is truncated", ErrMalformed, box.Type)
+		}
+
+		boxes = append(boxes, box)
+		pos += box.Size
+	}
+	return boxes, nil
+}
+
+func parseMoov(r io.ReaderAt, moov Box, info *Info) error {
+	children, err := ReadBoxes(r, moov.DataOffset(), moov.Offset+moov.Size, false)
+	if err != nil {
+		return err
+	}
+
+	var movieTimescale uint32
+	var movieDuration uint64
+	for _, box := range children {
+		switch box.Type {
+		case "mvhd":
+			data, err := readPayload(r, box)
+			if err != nil {
+				return err
+			}
+			movieTimescale, movieDuration, err = parseTimes(data, "mvhd")
+			if err != nil {
+				return err
+			}
+		case "trak":
+			track, err := parseTrak(r, box)
+			if err != nil {
+				return err
+			}
+			info.Tracks = append(info.Tracks, *track)
+		}
+	}
+
+	if movieTimescale == 0 {
+		return fmt.Errorf("%w: missing or invalid mvhd", ErrMalformed)
+	}
+	if len(info.Tracks) == 0 {
+		return fmt.Errorf("%w: no tracks", ErrMalformed)
+	}
+	info.Duration = float64(movieDuration) / float64(movieTimescale)
+
+	for _, track := range info.Tracks {
+		switch {
+		case track.Handler == "vide" && info.VideoCodec == "":
+			info.VideoCodec = track.Codec
+			info.Width = track.Width
+			info.Height = track.Height
+			if track.Duration > 0 && track.Timescale > 0 {
+				seconds := float64(track.Duration) / float64(track.Timescale)
+				info.FrameRate = math.Round(float64(track.SampleCount)/seconds*1000) / 1000
+			}
+		case track.Handler == "soun" && info.AudioCodec == "":
+			info.AudioCodec = track.Codec
+		}
+	}
+	return nil
+}
+
+func parseTrak(r io.ReaderAt, trak Box) (*Track, error) {
+	track := &Track{}
+
+	children, err := ReadBoxes(r, trak.DataOffset(), trak.Offset+trak.Size, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, box := range children {
+		switch box.Type {
+		case "tkhd":
+			data, err := readPayload(r, box)
+			if err != nil {
+				return nil, err
+			}
+			if err := parseTkhd(data, track); err != nil {
+				return nil, err
+			}
+		case "mdia":
+			if err := parseMdia(r, box, track); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if track.Handler == "" {
+		return nil, fmt.Errorf("%w: track %d has no handler", ErrMalformed, track.ID)
+	}
+	return track, nil
+}
+
+func parseMdia(r io.ReaderAt, mdia Box, track *Track) error {
+	children, err := ReadBoxes(r, mdia.DataOffset(), mdia.Offset+mdia.Size, false)
+	if err != nil {
+		return err
+	}
+	for _, box := range children {
+		switch box.Type {
+		case "mdhd":
+			data, err := readPayload(r, box)
+			if err != nil {
+				return err
+			}
+			track.Timescale, track.Duration, err = parseTimes(data, "mdhd")
+			if err != nil {
+				return err
+			}
+		case "hdlr":
+			data, err := readPayload(r, box)
+			if err != nil {
+				return err
+			}
+			// version/flags, pre_defined, handler_type
+			if len(data) < 12 {
+				return fmt.Errorf("%w: short hdlr", ErrMalformed)
+			}
+			track.Handler = string(data[8:12])
+		case "minf":
+			if err := parseMinf(r, box, track); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func parseMinf(r io.ReaderAt, minf Box, track *Track) error {
+	stbl, err := FindBox(r, minf, "stbl")
+	if err != nil || stbl == nil {
+		return err
+	}
+
+	children, err := ReadBoxes(r, stbl.DataOffset(), stbl.Offset+stbl.Size, false)
+	if err != nil {
+		return err
+	}
+	for _, box := range children {
+		switch box.Type {
+		case "stsd":
+			var head [16]byte
+			if box.DataSize() < 16 {
+				return fmt.Errorf("%w: short stsd", ErrMalformed)
+			}
+			if _, err := r.ReadAt(head[:], box.DataOffset()); err != nil {
+				return fmt.Errorf("%w: short stsd", ErrMalformed)
+			}
+			// version/flags, entry_count, then the first sample entry's size and format
+			if binary.BigEndian.Uint32(head[4:8]) > 0 {
+				track.Codec = string(head[12:16])
+			}
+		case "stts":
+			data, err := readPayload(r, box)
+			if err != nil {
+				return err
+			}
+			track.SampleCount, err = parseStts(data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// FindBox returns the first direct child of parent with the given type, or nil
+func FindBox(r io.ReaderAt, parent Box, typ string) (*Box, error) {
+	children, err := ReadBoxes(r, parent.DataOffset(), parent.Offset+parent.Size, false)
+	if err != nil {
+		return nil, err
+	}
+	for i := range children {
+		if children[i].Type == typ {
+			return &children[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// parseTimes reads timescale and duration from a mvhd or mdhd box
+func parseTimes(data []byte, name string) (uint32, uint64, error) {
+	if len(data) < 4 {
+		return 0, 0, fmt.Errorf("%w: short %s", ErrMalformed, name)
+	}
+	switch data[0] {
+	case 0:
+		// version/flags, creation, modification, timescale, duration (32 bit)
+		if len(data) < 20 {
+			return 0, 0, fmt.Errorf("%w: short %s", ErrMalformed, name)
+		}
+		return binary.BigEndian.Uint32(data[12:16]), uint64(binary.BigEndian.Uint32(data[16:20])), nil
+	case 1:
+		// Same with 64 bit times and duration
+		if len(data) < 32 {
+			return 0, 0, fmt.Errorf("%w: short %s", ErrMalformed, name)
+		}
+		return binary.BigEndian.Uint32(data[20:24]), binary.BigEndian.Uint64(data[24:32]), nil
+	default:
+		return 0, 0, fmt.Errorf("%w: unknown %s version %d", ErrMalformed, name, data[0])
+	}
+}
+
+func parseTkhd(data []byte, track *Track) error {
+	if len(data) < 4 {
+		return fmt.Errorf("%w: short tkhd", ErrMalformed)
+	}
+
+	// Track id follows creation and modification time, width and height
+	// are 16.16 fixed point numbers at the very end
+	var idOffset, sizeOffset int
+	switch data[0] {
+	case 0:
+		idOffset, sizeOffset = 12, 76
+	case 1:
+		idOffset, sizeOffset = 20, 88
+	default:
+		return fmt.Errorf("%w: unknown tkhd version %d", ErrMalformed, data[0])
+	}
+	if len(data) < sizeOffset+8 {
+		return fmt.Errorf("%w: short tkhd", ErrMalformed)
+	}
+
+	track.ID = binary.BigEndian.Uint32(data[idOffset:])
+	track.Width = int(binary.BigEndian.Uint32(data[sizeOffset:]) >> 16)
+	track.Height = int(binary.BigEndian.Uint32(data[sizeOffset+4:]) >> 16)
+	return nil
+}
+
+// parseStts sums up the sample counts of the time-to-sample table
+func parseStts(data []byte) (uint64, error) {
+	if len(data) < 8 {
+		return 0, fmt.Errorf("%w: short stts", ErrMalformed)
+	}
+	entries := int64(binary.BigEndian.Uint32(data[4:8]))
+	if entries*8 > int64(len(data)-8) {
+		return 0, fmt.Errorf("%w: truncated stts", ErrMalformed)
+	}
+
+	var samples uint64
+	for i := int64(0); i < entries; i++ {
+		samples += uint64(binary.BigEndian.Uint32(data[8+i*8:]))
+	}
+	return samples, nil
+}
+
+func readPayload(r io.ReaderAt, box Box) ([]byte, error) {
+	if box.DataSize() > maxTableSize {
+		return nil, fmt.Errorf("%w: %q box is too large", ErrMalformed, box.Type)
+	}
+	data := make([]byte, box.DataSize())
+	if _, err := r.ReadAt(data, box.DataOffset()); err != nil {
+		return nil, fmt.Errorf("%w: truncated %q box", ErrMalformed, box.Type)
+	}
+	return data, nil
+}
@@ -0,0 +1,184 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// box builds a box from its type and payload parts
+func box(typ string, parts ...[]byte) []byte {
+	payload := bytes.Join(parts, nil)
+	out := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(out[0:4], uint32(8+len(payload)))
+	copy(out[4:8], typ)
+	return append(out, payload...)
+}
+
+func u32(values ...uint32) []byte {
+	out := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(out[i*4:], v)
+	}
+	return out
+}
+
+func u64(values ...uint64) []byte {
+	out := make([]byte, 8*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint64(out[i*8:], v)
+	}
+	return out
+}
+
+// version 0 mvhd or mdhd: version/flags, creation, modification, timescale, duration
+func times(timescale, duration uint32) []byte {
+	return append(u32(0, 0, 0, timescale, duration), make([]byte, 80)...)
+}
+
+// version 0 tkhd with the size at the very end
+func tkhd(id uint32, width, height uint32) []byte {
+	data := make([]byte, 84)
+	binary.BigEndian.PutUint32(data[12:], id)
+	binary.BigEndian.PutUint32(data[76:], width<<16)
+	binary.BigEndian.PutUint32(data[80:], height<<16)
+	return data
+}
+
+func hdlr(handler string) []byte {
+	return append(u32(0, 0), []byte(handler+"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")...)
+}
+
+func stsd(codec string) []byte {
+	return append(u32(0, 1, 16), []byte(codec+"\x00\x00\x00\x00")...)
+}
+
+// stts with one entry of count samples
+func stts(count uint32) []byte {
+	return u32(0, 1, count, 1000)
+}
+
+// trak with one chunk offset table, stco or co64
+func trak(id uint32, handler, codec string, width, height, samples uint32, table []byte) []byte {
+	return box("trak",
+		box("tkhd", tkhd(id, width, height)),
+		box("mdia",
+			box("mdhd", times(1000, samples*1000/25)),
+			box("hdlr", hdlr(handler)),
+			box("minf", box("stbl",
+				box("stsd", stsd(codec)),
+				box("stts", stts(samples)),
+				table,
+			)),
+		),
+	)
+}
+
+var ftyp = box("ftyp", []byte("isom"), u32(512), []byte("isomavc1"))
+
+// movie returns a file with ftyp, then mdat and moov in the given order. The
+// chunk offset tables point at the start of each sample run in mdat.
+func movie(moovFirst bool) []byte {
+	media := []byte("VIDEOSAMPLES-AUDIOSAMPLES")
+	build := func(mdatAt uint32) []byte {
+		return box("moov",
+			box("mvhd", times(1000, 2000)),
+			trak(1, "vide", "avc1", 640, 360, 50, box("stco", u32(0, 2, mdatAt+8, mdatAt+8+6))),
+			trak(2, "soun", "mp4a", 0, 0, 50, box("co64", u32(0, 1), u64(uint64(mdatAt+8+13)))),
+		)
+	}
+
+	mdat := box("mdat", media)
+	if !moovFirst {
+		mdatAt := uint32(len(ftyp))
+		return bytes.Join([][]byte{ftyp, mdat, build(mdatAt)}, nil)
+	}
+	moovSize := uint32(len(build(0)))
+	return bytes.Join([][]byte{ftyp, build(uint32(len(ftyp)) + moovSize), mdat}, nil)
+}
+
+func TestInspect(t *testing.T) {
+	for _, moovFirst := range []bool{false, true} {
+		data := movie(moovFirst)
+		info, err := Inspect(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatalf("moovFirst=%v: %v", moovFirst, err)
+		}
+
+		if info.Faststart != moovFirst {
+			t.Errorf("moovFirst=%v: Faststart = %v", moovFirst, info.Faststart)
+		}
+		if info.MajorBrand != "isom" || info.Duration != 2 {
+			t.Errorf("brand %q, duration %v, want isom and 2", info.MajorBrand, info.Duration)
+		}
+		if info.VideoCodec != "avc1" || info.AudioCodec != "mp4a" {
+			t.Errorf("codecs %q and %q, want avc1 and mp4a", info.VideoCodec, info.AudioCodec)
+		}
+		if info.Width != 640 || info.Height != 360 {
+			t.Errorf("size %dx%d, want 640x360", info.Width, info.Height)
+		}
+		if info.FrameRate != 25 {
+			t.Errorf("frame rate %v, want 25", info.FrameRate)
+		}
+		if len(info.Tracks) != 2 || info.Tracks[1].ID != 2 || info.Tracks[1].Handler != "soun" {
+			t.Errorf("tracks %+v", info.Tracks)
+		}
+	}
+}
+
+func TestInspectMalformed(t *testing.T) {
+	valid := movie(false)
+	moov := box("moov", box("mvhd", times(1000, 1000)), trak(1, "vide", "avc1", 1, 1, 1, box("stco", u32(0, 0))))
+
+	bad := func(mutate func([]byte) []byte) []byte {
+		return mutate(append([]byte(nil), valid...))
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"no ftyp", bytes.Join([][]byte{box("mdat"), moov}, nil)},
+		{"no moov", bytes.Join([][]byte{ftyp, box("mdat")}, nil)},
+		{"two moov", bytes.Join([][]byte{ftyp, moov, moov}, nil)},
+		{"truncated header", append(append([]byte(nil), ftyp...), 0, 0, 0)},
+		{"truncated box", bad(func(b []byte) []byte { return b[:len(b)-1] })},
+		{"smaller than header", bytes.Join([][]byte{ftyp, u32(4), []byte("free")}, nil)},
+		{"large size past the end", bytes.Join([][]byte{ftyp, u32(1), []byte("mdat"), u64(1 << 40)}, nil)},
+		{"open ended child", bytes.Join([][]byte{ftyp, box("moov", u32(0), []byte("trak"))}, nil)},
+		{"no tracks", bytes.Join([][]byte{ftyp, box("moov", box("mvhd", times(1000, 1000)))}, nil)},
+		{"no mvhd", bytes.Join([][]byte{ftyp, box("moov", trak(1, "vide", "avc1", 1, 1, 1, box("stco", u32(0, 0))))}, nil)},
+		{"unknown mvhd version", bytes.Join([][]byte{ftyp, box("moov", box("mvhd", []byte{7, 0, 0, 0}))}, nil)},
+		{"truncated stts", bytes.Join([][]byte{ftyp, box("moov", box("mvhd", times(1000, 1000)),
+			box("trak", box("mdia", box("hdlr", hdlr("vide")), box("minf", box("stbl", box("stts", u32(0, 1000)))))))}, nil)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Inspect(bytes.NewReader(tt.data), int64(len(tt.data)))
+			if !errors.Is(err, ErrMalformed) {
+				t.Fatalf("err = %v, want ErrMalformed", err)
+			}
+		})
+	}
+}
+
+func TestReadBoxesLargeSize(t *testing.T) {
+	// A 64 bit size, and a zero size running to the end of the file
+	data := bytes.Join([][]byte{u32(1), []byte("wide"), u64(20), []byte("abcd"), u32(0), []byte("mdat"), []byte("rest")}, nil)
+	boxes, err := ReadBoxes(bytes.NewReader(data), 0, int64(len(data)), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(boxes) != 2 {
+		t.Fatalf("got %d boxes, want 2", len(boxes))
+	}
+	if b := boxes[0]; b.Type != "wide" || b.Size != 20 || b.Header != 16 || b.DataSize() != 4 {
+		t.Errorf("wide box %+v", b)
+	}
+	if b := boxes[1]; b.Type != "mdat" || b.Offset != 20 || b.Size != 12 {
+		t.Errorf("open ended box %+v", b)
+	}
+}
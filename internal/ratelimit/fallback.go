@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"noverna.de/m/v2/internal/logger"
+)
+
+// Fallback uses a shared store while it answers and local buckets while it
+// doesn't. After a failure the shared store is left alone for a while, so
+// requests don't each wait for it to time out.
+type Fallback struct {
+	shared  Store
+	local   *Limiter
+	retry   time.Duration
+	timeout time.Duration
+	logger  *logger.Logger
+
+	mu        sync.Mutex
+	downUntil time.Time
+	down      bool
+}
+
+// NewFallback asks shared first, giving it timeout per request, and falls
+// back to local for retry once it fails
+func NewFallback(shared Store, local *Limiter, timeout, retry time.Duration, log *logger.Logger) *Fallback {
+	return &Fallback{shared: shared, local: local, retry: retry, timeout: timeout, logger: log}
+}
+
+// Allow never fails, without the shared store the local buckets decide
+func (f *Fallback) Allow(ctx context.Context, key string, limit Limit) (Decision, error) {
+	if f.usable(time.Now()) {
+		sharedCtx, cancel := context.WithTimeout(ctx, f.timeout)
+		d, err := f.shared.Allow(sharedCtx, key, limit)
+		cancel()
+		if err == nil {
+			f.recovered()
+			return d, nil
+		}
+		// A request that went away says nothing about the store
+		if ctx.Err() == nil {
+			f.failed(err)
+		}
+	}
+	return f.local.Allow(ctx, key, limit)
+}
+
+func (f *Fallback) usable(now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !now.Before(f.downUntil)
+}
+
+func (f *Fallback) failed(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.downUntil = time.Now().Add(f.retry)
+	if !f.down {
+		f.down = true
+		f.logger.Warn("Rate limit store unreachable, limiting per instance", map[string]any{
+			"error":    err.Error(),
+			"retry_in": f.retry.String(),
+		})
+	}
+}
+
+func (f *Fallback) recovered() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		f.down = false
+		f.logger.Info("Rate limit store reachable again")
+	}
+}
@@ -0,0 +1,159 @@
+// Package ratelimit hands out requests from token buckets, one per client
+// and limit. Buckets live in memory or in a Redis compatible server shared
+// by every instance.
+package ratelimit
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"noverna.de/m/v2/internal/metrics"
+)
+
+var (
+	rejected = metrics.NewCounter("noverna_ratelimit_rejected_total", "Requests turned away by the rate limiter")
+	evicted  = metrics.NewCounter("noverna_ratelimit_evicted_total", "Client buckets dropped to stay within the client limit")
+)
+
+// Limit is a bucket of Burst requests refilled at PerMinute
+type Limit struct {
+	PerMinute int
+	Burst     int
+}
+
+// Unlimited reports whether the limit lets everything through
+func (l Limit) Unlimited() bool {
+	return l.PerMinute < 0
+}
+
+func (l Limit) perSecond() float64 {
+	return float64(l.PerMinute) / 60
+}
+
+// Decision is the outcome of taking a request from a bucket
+type Decision struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is how long until the next request is allowed, 0 if it is now
+	RetryAfter time.Duration
+}
+
+// Store keeps the buckets. Allow takes a request from the bucket of key.
+type Store interface {
+	Allow(ctx context.Context, key string, limit Limit) (Decision, error)
+}
+
+// take refills a bucket that held tokens at last and takes a request from it
+func take(limit Limit, tokens float64, last, now time.Time) (Decision, float64) {
+	if elapsed := now.Sub(last).Seconds(); elapsed > 0 {
+		tokens = math.Min(float64(limit.Burst), tokens+elapsed*limit.perSecond())
+	}
+
+	allowed := tokens >= 1
+	if allowed {
+		tokens--
+	}
+	return decision(limit, tokens, allowed), tokens
+}
+
+// decision describes a bucket left with tokens. Every store reports through
+// it, so they agree on the headers.
+func decision(limit Limit, tokens float64, allowed bool) Decision {
+	rate := limit.perSecond()
+	d := Decision{
+		Allowed:   allowed,
+		Limit:     limit.Burst,
+		Remaining: int(tokens),
+		Reset:     secondsToDuration((float64(limit.Burst) - tokens) / rate),
+	}
+	if !allowed {
+		d.RetryAfter = secondsToDuration((1 - tokens) / rate)
+		rejected.Inc()
+	}
+	return d
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	if seconds <= 0 || math.IsInf(seconds, 0) || math.IsNaN(seconds) {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// Limiter keeps buckets in memory. Only the most recently seen clients are
+// tracked, so a flood of new clients can't grow it without bound. A client
+// that is forgotten starts over with a full bucket.
+type Limiter struct {
+	maxKeys int
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	// Most recently used at the front
+	order *list.List
+}
+
+// New creates a limiter tracking at most maxKeys clients
+func New(maxKeys int) *Limiter {
+	return &Limiter{
+		maxKeys: max(maxKeys, 1),
+		buckets: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// unlimited is the decision for routes without a limit
+var unlimited = Decision{Allowed: true, Limit: -1, Remaining: -1}
+
+// Allow takes a request from the bucket of key, it never fails
+func (l *Limiter) Allow(_ context.Context, key string, limit Limit) (Decision, error) {
+	if limit.Unlimited() {
+		return unlimited, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b := l.bucket(key, limit, now)
+	d, tokens := take(limit, b.tokens, b.last, now)
+	b.tokens, b.last = tokens, now
+	return d, nil
+}
+
+// bucket returns the bucket of key, a full one if it isn't tracked
+func (l *Limiter) bucket(key string, limit Limit, now time.Time) *bucket {
+	if el, ok := l.buckets[key]; ok {
+		l.order.MoveToFront(el)
+		return el.Value.(*bucket)
+	}
+
+	for l.order.Len() >= l.maxKeys {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.buckets, oldest.Value.(*bucket).key)
+		evicted.Inc()
+	}
+
+	b := &bucket{key: key, tokens: float64(limit.Burst), last: now}
+	l.buckets[key] = l.order.PushFront(b)
+	return b
+}
+
+// Len returns how many clients are tracked
+func (l *Limiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.order.Len()
+}
@@ -0,0 +1,90 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"noverna.de/m/v2/internal/resp"
+)
+
+// bucketScript is take() run inside the server, so instances sharing a
+// bucket can't race. It reads the clock of the server, the instances' own
+// clocks don't have to agree. Buckets expire once they would be full again.
+const bucketScript = `
+local burst = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2]) / 1000
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(state[1]) or burst
+local last = tonumber(state[2]) or now
+if now > last then
+	tokens = math.min(burst, tokens + (now - last) * rate)
+end
+
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens))
+redis.call('HSET', KEYS[1], 'last', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate) + 1000)
+return {allowed, tostring(tokens)}
+`
+
+// RedisStore keeps buckets in a Redis compatible server
+type RedisStore struct {
+	client *resp.Client
+	prefix string
+	sha    string
+}
+
+// NewRedisStore keeps buckets under prefix in the server behind client
+func NewRedisStore(client *resp.Client, prefix string) *RedisStore {
+	return &RedisStore{client: client, prefix: prefix, sha: scriptSHA(bucketScript)}
+}
+
+func (s *RedisStore) Allow(ctx context.Context, key string, limit Limit) (Decision, error) {
+	if limit.Unlimited() {
+		return unlimited, nil
+	}
+
+	args := []string{s.sha, "1", s.prefix + key, strconv.Itoa(limit.Burst), strconv.FormatFloat(limit.perSecond(), 'g', -1, 64)}
+	reply, err := s.client.Do(ctx, append([]string{"EVALSHA"}, args...)...)
+	var replyErr resp.Error
+	if errors.As(err, &replyErr) && strings.HasPrefix(string(replyErr), "NOSCRIPT") {
+		// First use, or the server was restarted. EVAL caches it again.
+		args[0] = bucketScript
+		reply, err = s.client.Do(ctx, append([]string{"EVAL"}, args...)...)
+	}
+	if err != nil {
+		return Decision{}, err
+	}
+
+	items, ok := reply.([]any)
+	if !ok || len(items) != 2 {
+		return Decision{}, fmt.Errorf("ratelimit: unexpected reply %v", reply)
+	}
+	allowed, _ := items[0].(int64)
+	text, _ := items[1].(string)
+	tokens, err := strconv.ParseFloat(text, 64)
+	if err != nil || math.IsNaN(tokens) {
+		return Decision{}, fmt.Errorf("ratelimit: unexpected reply %v", reply)
+	}
+	return decision(limit, tokens, allowed == 1), nil
+}
+
+// scriptSHA is the name the server caches a script under
+func scriptSHA(script string) string {
+	sum := sha1.Sum([]byte(script))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,209 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"noverna.de/m/v2/internal/logger"
+	"noverna.de/m/v2/internal/resp"
+	"noverna.de/m/v2/internal/resp/resptest"
+)
+
+// fakeClock is moved by hand, safe to read from the server's goroutines
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newServer(t *testing.T) (*resptest.Server, *fakeClock) {
+	t.Helper()
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	server := resptest.NewServer()
+	server.Now = clock.Now
+	t.Cleanup(server.Close)
+	return server, clock
+}
+
+func newRedisStore(t *testing.T, server *resptest.Server) *RedisStore {
+	t.Helper()
+	client := resp.NewClient(resp.Options{Addr: server.Addr, DialTimeout: time.Second, MaxIdle: 2})
+	t.Cleanup(func() { client.Close(context.Background()) })
+	return NewRedisStore(client, "test:")
+}
+
+func TestRedisStore(t *testing.T) {
+	ctx := context.Background()
+	limit := Limit{PerMinute: 60, Burst: 3}
+
+	steps := []struct {
+		advance       time.Duration
+		wantAllowed   bool
+		wantRemaining int
+	}{
+		{0, true, 2},
+		{0, true, 1},
+		{0, true, 0},
+		{0, false, 0},
+		{500 * time.Millisecond, false, 0},
+		{500 * time.Millisecond, true, 0},
+		{10 * time.Second, true, 2},
+	}
+
+	server, clock := newServer(t)
+	store := newRedisStore(t, server)
+	for i, step := range steps {
+		clock.Add(step.advance)
+		d, err := store.Allow(ctx, "client", limit)
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if d.Allowed != step.wantAllowed || d.Remaining != step.wantRemaining {
+			t.Errorf("step %d: allowed %v with %d left, want %v with %d", i, d.Allowed, d.Remaining, step.wantAllowed, step.wantRemaining)
+		}
+		if !d.Allowed && (d.RetryAfter <= 0 || d.RetryAfter > time.Second) {
+			t.Errorf("step %d: retry after %v", i, d.RetryAfter)
+		}
+	}
+
+	if ttl := server.TTL("test:client"); ttl <= 0 || ttl > 2*time.Second {
+		t.Errorf("bucket expires in %v, want once it would be full again", ttl)
+	}
+	clock.Add(3 * time.Second)
+	if server.Exists("test:client") {
+		t.Error("full bucket was kept")
+	}
+
+	// The script is sent once, after that it runs by its hash
+	calls := server.Calls()
+	if calls[0] != "EVALSHA" || calls[1] != "EVAL" {
+		t.Fatalf("first calls %v, want EVALSHA answered with NOSCRIPT, then EVAL", calls[:2])
+	}
+	for _, call := range calls[2:] {
+		if call == "EVAL" {
+			t.Fatalf("script sent again: %v", calls)
+		}
+	}
+}
+
+func TestRedisStoreScriptFlushed(t *testing.T) {
+	ctx := context.Background()
+	server, _ := newServer(t)
+	store := newRedisStore(t, server)
+
+	if _, err := store.Allow(ctx, "client", Limit{PerMinute: 60, Burst: 3}); err != nil {
+		t.Fatal(err)
+	}
+	server.FlushScripts()
+	d, err := store.Allow(ctx, "client", Limit{PerMinute: 60, Burst: 3})
+	if err != nil {
+		t.Fatalf("after a flush: %v", err)
+	}
+	if d.Remaining != 1 {
+		t.Errorf("remaining %d, want the bucket to survive the flush", d.Remaining)
+	}
+}
+
+func TestRedisStoreUnlimited(t *testing.T) {
+	server, _ := newServer(t)
+	store := newRedisStore(t, server)
+
+	d, err := store.Allow(context.Background(), "client", Limit{PerMinute: -1})
+	if err != nil || !d.Allowed || d.Limit != -1 {
+		t.Fatalf("got %+v, %v", d, err)
+	}
+	if calls := server.Calls(); len(calls) != 0 {
+		t.Fatalf("unlimited request reached the server: %v", calls)
+	}
+}
+
+func TestFallback(t *testing.T) {
+	ctx := context.Background()
+	limit := Limit{PerMinute: 60, Burst: 2}
+	server, _ := newServer(t)
+
+	var logs bytes.Buffer
+	local := New(100)
+	retry := 50 * time.Millisecond
+	fallback := NewFallback(newRedisStore(t, server), local, time.Second, retry, logger.NewLogger().SetOutput(&logs))
+
+	allow := func() Decision {
+		t.Helper()
+		d, err := fallback.Allow(ctx, "client", limit)
+		if err != nil {
+			t.Fatalf("fallback failed: %v", err)
+		}
+		return d
+	}
+
+	allow()
+	if !server.Exists("test:client") || local.Len() != 0 {
+		t.Fatal("the shared store didn't decide")
+	}
+
+	// Down: local buckets decide, and the store isn't asked again until retry passed
+	server.SetUnavailable(true)
+	if d := allow(); !d.Allowed || d.Remaining != 1 {
+		t.Errorf("local decision %+v, want a fresh bucket", d)
+	}
+	calls := len(server.Calls())
+	allow()
+	if d := allow(); d.Allowed {
+		t.Error("local bucket didn't run out")
+	}
+	if n := len(server.Calls()); n != calls {
+		t.Errorf("store was asked %d times while marked down", n-calls)
+	}
+	if got := strings.Count(logs.String(), "unreachable"); got != 1 {
+		t.Errorf("outage logged %d times, want once", got)
+	}
+
+	// Back: after retry the shared bucket, which still has a token, decides again
+	server.SetUnavailable(false)
+	time.Sleep(retry)
+	if d := allow(); !d.Allowed || d.Remaining != 0 {
+		t.Errorf("decision after recovery %+v, want the shared bucket", d)
+	}
+	if len(server.Calls()) == calls {
+		t.Error("store wasn't asked after retry passed")
+	}
+	if !strings.Contains(logs.String(), "reachable again") {
+		t.Error("recovery wasn't logged")
+	}
+}
+
+func TestFallbackCanceledRequest(t *testing.T) {
+	server, _ := newServer(t)
+	local := New(100)
+	fallback := NewFallback(newRedisStore(t, server), local, time.Second, time.Hour, logger.NewLogger().SetOutput(&bytes.Buffer{}))
+	limit := Limit{PerMinute: 60, Burst: 2}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := fallback.Allow(canceled, "client", limit); err != nil {
+		t.Fatal(err)
+	}
+
+	// The store answered nothing wrong, it must still be asked
+	if _, err := fallback.Allow(context.Background(), "client", limit); err != nil {
+		t.Fatal(err)
+	}
+	if !server.Exists("test:client") {
+		t.Fatal("a canceled request marked the store down")
+	}
+}
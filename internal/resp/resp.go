@@ -0,0 +1,272 @@
+// Package resp is a small client for servers speaking the Redis protocol
+// (RESP2), enough to run commands and scripts against Redis and its clones.
+package resp
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrClosed = errors.New("resp: client is closed")
+
+// Replies claiming to be larger than this are refused before anything is
+// allocated for them. Nothing we keep comes close, a larger length means a
+// broken or hostile server.
+const (
+	maxBulkLen  = 16 << 20
+	maxArrayLen = 1 << 20
+)
+
+// Error is an error reply sent by the server
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Options describe how to reach the server
+type Options struct {
+	Addr     string
+	Username string
+	Password string
+	DB       int
+	TLS      bool
+	// DialTimeout also bounds commands sent without a deadline in their context
+	DialTimeout time.Duration
+	// MaxIdle connections are kept open for reuse
+	MaxIdle int
+}
+
+// ParseURL reads redis://[user:password@]host[:port][/db], rediss:// for
+// TLS, or a plain host:port
+func ParseURL(endpoint string) (Options, error) {
+	opts := Options{DialTimeout: 2 * time.Second, MaxIdle: 8}
+	if !strings.Contains(endpoint, "://") {
+		opts.Addr = endpoint
+		if _, _, err := net.SplitHostPort(endpoint); err != nil {
+			opts.Addr = net.JoinHostPort(endpoint, "6379")
+		}
+		return opts, nil
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return opts, fmt.Errorf("resp: %w", err)
+	}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		opts.TLS = true
+	default:
+		return opts, fmt.Errorf("resp: unsupported scheme %q", u.Scheme)
+	}
+
+	opts.Addr = u.Host
+	if u.Port() == "" {
+		opts.Addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		opts.Username = u.User.Username()
+		opts.Password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if opts.DB, err = strconv.Atoi(db); err != nil {
+			return opts, fmt.Errorf("resp: invalid database %q", db)
+		}
+	}
+	return opts, nil
+}
+
+// Client keeps a few connections open and runs one command at a time on each
+type Client struct {
+	opts Options
+
+	mu     sync.Mutex
+	idle   []*conn
+	closed bool
+}
+
+func NewClient(opts Options) *Client {
+	return &Client{opts: opts}
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// Do sends a command and returns its reply: a string, an int64, nil or a
+// []any of those. Error replies are returned as Error.
+func (c *Client) Do(ctx context.Context, args ...string) (any, error) {
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := cn.do(ctx, c.opts.DialTimeout, args)
+	var replyErr Error
+	if err != nil && !errors.As(err, &replyErr) {
+		// The connection may hold half a reply, it can't be reused
+		cn.Close()
+		return nil, err
+	}
+	c.put(cn)
+	return reply, err
+}
+
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if n := len(c.idle); n > 0 {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return cn, nil
+	}
+	c.mu.Unlock()
+	return c.dial(ctx)
+}
+
+func (c *Client) put(cn *conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || len(c.idle) >= c.opts.MaxIdle {
+		cn.Close()
+		return
+	}
+	c.idle = append(c.idle, cn)
+}
+
+func (c *Client) dial(ctx context.Context) (*conn, error) {
+	dialer := &net.Dialer{Timeout: c.opts.DialTimeout}
+	var nc net.Conn
+	var err error
+	if c.opts.TLS {
+		host, _, _ := net.SplitHostPort(c.opts.Addr)
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host}}
+		nc, err = tlsDialer.DialContext(ctx, "tcp", c.opts.Addr)
+	} else {
+		nc, err = dialer.DialContext(ctx, "tcp", c.opts.Addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("resp: dial %s: %w", c.opts.Addr, err)
+	}
+
+	cn := &conn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+	if c.opts.Password != "" {
+		args := []string{"AUTH", c.opts.Password}
+		if c.opts.Username != "" {
+			args = []string{"AUTH", c.opts.Username, c.opts.Password}
+		}
+		if _, err := cn.do(ctx, c.opts.DialTimeout, args); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("resp: auth: %w", err)
+		}
+	}
+	if c.opts.DB != 0 {
+		if _, err := cn.do(ctx, c.opts.DialTimeout, []string{"SELECT", strconv.Itoa(c.opts.DB)}); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("resp: select: %w", err)
+		}
+	}
+	return cn, nil
+}
+
+// Close closes the idle connections, those in use are closed when they return
+func (c *Client) Close(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, cn := range c.idle {
+		cn.Close()
+	}
+	c.idle = nil
+	return nil
+}
+
+func (cn *conn) do(ctx context.Context, timeout time.Duration, args []string) (any, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(timeout)
+	}
+	cn.SetDeadline(deadline)
+
+	fmt.Fprintf(cn.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(cn.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := cn.w.Flush(); err != nil {
+		return nil, err
+	}
+	return readReply(cn.r)
+}
+
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("resp: malformed reply")
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, Error(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n > maxBulkLen {
+			return nil, errors.New("resp: malformed bulk length")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n > maxArrayLen {
+			return nil, errors.New("resp: malformed array length")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			// An error inside an array belongs to that item, not to the reply
+			item, err := readReply(r)
+			var replyErr Error
+			if errors.As(err, &replyErr) {
+				item = replyErr
+			} else if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("resp: unknown reply type %q", kind)
+	}
+}
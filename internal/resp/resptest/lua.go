@@ -0,0 +1,130 @@
+package resptest
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// runLua runs a script the way EVAL does: KEYS and ARGV are set, redis.call
+// runs commands on the server and replies are converted like Redis converts
+// them. gopher-lua speaks Lua 5.1, the version Redis embeds.
+func runLua(source string, call func(args ...string) (any, error), keys, args []string) (any, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	defer L.Close()
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+
+	L.SetGlobal("KEYS", stringTable(L, keys))
+	L.SetGlobal("ARGV", stringTable(L, args))
+	redis := L.NewTable()
+	redis.RawSetString("call", L.NewFunction(func(L *lua.LState) int {
+		command := make([]string, L.GetTop())
+		for i := range command {
+			switch v := L.Get(i + 1).(type) {
+			case lua.LString:
+				command[i] = string(v)
+			case lua.LNumber:
+				command[i] = strconv.FormatFloat(float64(v), 'g', -1, 64)
+			default:
+				L.RaiseError("Lua redis lib command arguments must be strings or integers")
+			}
+		}
+		reply, err := call(command...)
+		if err != nil {
+			L.RaiseError("%s", err)
+		}
+		L.Push(toLua(L, reply))
+		return 1
+	}))
+	L.SetGlobal("redis", redis)
+
+	if err := L.DoString(source); err != nil {
+		return nil, fmt.Errorf("ERR %w", err)
+	}
+	return fromLua(L.Get(-1))
+}
+
+func stringTable(L *lua.LState, values []string) *lua.LTable {
+	t := L.CreateTable(len(values), 0)
+	for _, v := range values {
+		t.Append(lua.LString(v))
+	}
+	return t
+}
+
+// toLua converts a reply for a script: integers become numbers, nil becomes
+// false and arrays become tables
+func toLua(L *lua.LState, reply any) lua.LValue {
+	switch v := reply.(type) {
+	case nil:
+		return lua.LFalse
+	case int64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case Status:
+		t := L.NewTable()
+		t.RawSetString("ok", lua.LString(v))
+		return t
+	case []any:
+		t := L.CreateTable(len(v), 0)
+		for _, item := range v {
+			t.Append(toLua(L, item))
+		}
+		return t
+	default:
+		panic(fmt.Sprintf("resptest: no Lua value for %T", reply))
+	}
+}
+
+// fromLua converts what a script returns: numbers are truncated to integers,
+// false becomes nil and tables become arrays up to their first nil
+func fromLua(value lua.LValue) (any, error) {
+	switch v := value.(type) {
+	case lua.LNumber:
+		return int64(v), nil
+	case lua.LString:
+		return string(v), nil
+	case lua.LBool:
+		if v {
+			return int64(1), nil
+		}
+		return nil, nil
+	case *lua.LTable:
+		if msg, ok := v.RawGetString("err").(lua.LString); ok {
+			return nil, errors.New(string(msg))
+		}
+		if status, ok := v.RawGetString("ok").(lua.LString); ok {
+			return Status(status), nil
+		}
+		items := []any{}
+		for i := 1; ; i++ {
+			item := v.RawGetInt(i)
+			if item == lua.LNil {
+				break
+			}
+			converted, err := fromLua(item)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, converted)
+		}
+		return items, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,368 @@
+// Package resptest runs an in-process server speaking enough of the Redis
+// protocol to test clients of package resp without a real server. Scripts
+// sent with EVAL run in an embedded Lua interpreter.
+package resptest
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Status is a simple string reply, like OK
+type Status string
+
+// Server keeps strings and hashes in memory. Expiry follows Now, so tests can
+// move the clock instead of sleeping.
+type Server struct {
+	Addr string
+	// Now is the clock behind TIME and expiry
+	Now func() time.Time
+
+	ln net.Listener
+
+	mu          sync.Mutex
+	strings     map[string]string
+	hashes      map[string]map[string]string
+	expires     map[string]time.Time
+	loaded      map[string]string // source by SHA1, what EVAL cached
+	calls       []string
+	conns       map[net.Conn]struct{}
+	unavailable bool
+}
+
+// NewServer starts a server on a local port. It panics if it can't listen,
+// like httptest.NewServer.
+func NewServer() *Server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("resptest: failed to listen: %v", err))
+	}
+
+	s := &Server{
+		Addr:    ln.Addr().String(),
+		Now:     time.Now,
+		ln:      ln,
+		strings: make(map[string]string),
+		hashes:  make(map[string]map[string]string),
+		expires: make(map[string]time.Time),
+		loaded:  make(map[string]string),
+		conns:   make(map[net.Conn]struct{}),
+	}
+	go s.serve()
+	return s
+}
+
+// Close stops the server and drops every connection
+func (s *Server) Close() {
+	s.ln.Close()
+	s.dropConns()
+}
+
+// SetUnavailable makes the server drop every connection, open or new, until
+// it is called with false again
+func (s *Server) SetUnavailable(unavailable bool) {
+	s.mu.Lock()
+	s.unavailable = unavailable
+	s.mu.Unlock()
+	if unavailable {
+		s.dropConns()
+	}
+}
+
+// FlushScripts forgets the scripts cached by EVAL, like a restarted server
+func (s *Server) FlushScripts() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.loaded)
+}
+
+// Calls returns the names of the commands received so far, in upper case
+func (s *Server) Calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.calls...)
+}
+
+// Exists reports whether key holds a value that hasn't expired
+func (s *Server) Exists(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.exists(key)
+}
+
+// TTL returns how long key has left, 0 if it doesn't expire
+func (s *Server) TTL(key string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.exists(key) {
+		return 0
+	}
+	if at, ok := s.expires[key]; ok {
+		return at.Sub(s.Now())
+	}
+	return 0
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.unavailable {
+			s.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) dropConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.calls = append(s.calls, strings.ToUpper(args[0]))
+		reply, err := s.exec(args)
+		s.mu.Unlock()
+
+		if err != nil {
+			reply = err
+		}
+		writeReply(w, reply)
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// exec runs a command, s.mu has to be held
+func (s *Server) exec(args []string) (any, error) {
+	name, args := strings.ToUpper(args[0]), args[1:]
+	switch {
+	case name == "PING" && len(args) == 0:
+		return Status("PONG"), nil
+	case name == "AUTH" || name == "SELECT":
+		return Status("OK"), nil
+	case name == "TIME" && len(args) == 0:
+		now := s.Now()
+		return []any{strconv.FormatInt(now.Unix(), 10), strconv.Itoa(now.Nanosecond() / 1000)}, nil
+	case name == "GET" && len(args) == 1:
+		if !s.exists(args[0]) {
+			return nil, nil
+		}
+		return s.strings[args[0]], nil
+	case name == "SET" && len(args) >= 2:
+		return s.set(args)
+	case name == "DEL" && len(args) >= 1:
+		var n int64
+		for _, key := range args {
+			if s.exists(key) {
+				s.delete(key)
+				n++
+			}
+		}
+		return n, nil
+	case name == "HMGET" && len(args) >= 2:
+		s.exists(args[0])
+		values := make([]any, len(args)-1)
+		for i, field := range args[1:] {
+			if v, ok := s.hashes[args[0]][field]; ok {
+				values[i] = v
+			}
+		}
+		return values, nil
+	case name == "HSET" && len(args) >= 3 && len(args)%2 == 1:
+		if !s.exists(args[0]) {
+			s.hashes[args[0]] = make(map[string]string)
+		}
+		var added int64
+		for i := 1; i < len(args); i += 2 {
+			if _, ok := s.hashes[args[0]][args[i]]; !ok {
+				added++
+			}
+			s.hashes[args[0]][args[i]] = args[i+1]
+		}
+		return added, nil
+	case name == "PEXPIRE" && len(args) == 2:
+		ms, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return nil, errors.New("ERR value is not an integer or out of range")
+		}
+		if !s.exists(args[0]) {
+			return int64(0), nil
+		}
+		s.expires[args[0]] = s.Now().Add(time.Duration(ms) * time.Millisecond)
+		return int64(1), nil
+	case name == "EVAL" && len(args) >= 2:
+		sum := sha1.Sum([]byte(args[0]))
+		s.loaded[hex.EncodeToString(sum[:])] = args[0]
+		return s.eval(args[0], args[1:])
+	case name == "EVALSHA" && len(args) >= 2:
+		source, ok := s.loaded[strings.ToLower(args[0])]
+		if !ok {
+			return nil, errors.New("NOSCRIPT No matching script. Please use EVAL.")
+		}
+		return s.eval(source, args[1:])
+	default:
+		return nil, fmt.Errorf("ERR unknown command or wrong number of arguments for '%s'", name)
+	}
+}
+
+// set handles SET key value [NX] [PX ms | EX s]
+func (s *Server) set(args []string) (any, error) {
+	key, value := args[0], args[1]
+	var nx bool
+	var ttl time.Duration
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+		case "PX", "EX":
+			if i+1 == len(args) {
+				return nil, errors.New("ERR syntax error")
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				return nil, errors.New("ERR invalid expire time in 'set' command")
+			}
+			ttl = time.Duration(n) * time.Millisecond
+			if strings.ToUpper(args[i]) == "EX" {
+				ttl = time.Duration(n) * time.Second
+			}
+			i++
+		default:
+			return nil, errors.New("ERR syntax error")
+		}
+	}
+
+	if nx && s.exists(key) {
+		return nil, nil
+	}
+	s.delete(key)
+	s.strings[key] = value
+	if ttl > 0 {
+		s.expires[key] = s.Now().Add(ttl)
+	}
+	return Status("OK"), nil
+}
+
+func (s *Server) eval(source string, args []string) (any, error) {
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 0 || n > len(args)-1 {
+		return nil, errors.New("ERR Number of keys can't be greater than number of args")
+	}
+	call := func(args ...string) (any, error) {
+		return s.exec(args)
+	}
+	return runLua(source, call, args[1:1+n], args[1+n:])
+}
+
+// exists drops key if it expired and reports whether it is still there
+func (s *Server) exists(key string) bool {
+	if at, ok := s.expires[key]; ok && !s.Now().Before(at) {
+		s.delete(key)
+	}
+	_, isString := s.strings[key]
+	_, isHash := s.hashes[key]
+	return isString || isHash
+}
+
+func (s *Server) delete(key string) {
+	delete(s.strings, key)
+	delete(s.hashes, key)
+	delete(s.expires, key)
+}
+
+// readCommand reads an array of bulk strings, the only form clients send
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, errors.New("resptest: expected an array")
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || n < 1 {
+		return nil, errors.New("resptest: invalid array length")
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, errors.New("resptest: expected a bulk string")
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil || size < 0 {
+			return nil, errors.New("resptest: invalid bulk length")
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func writeReply(w *bufio.Writer, reply any) {
+	switch v := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case Status:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case error:
+		fmt.Fprintf(w, "-%s\r\n", v.Error())
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case []any:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeReply(w, item)
+		}
+	default:
+		fmt.Fprintf(w, "-ERR resptest: can't encode %T\r\n", reply)
+	}
+}
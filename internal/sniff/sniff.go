@@ -0,0 +1,128 @@
+// Package sniff detects file types from their leading bytes, so we never
+// have to trust whatever Content-Type a client claims.
+package sniff
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// HeaderSize is the number of leading bytes Detect wants to look at
+const HeaderSize = 512
+
+const fallbackType = "application/octet-stream"
+
+// Signature matches the magic number of one file type
+type Signature struct {
+	Mime  string
+	Match func(head []byte) bool
+}
+
+var signatures = []Signature{
+	{Mime: "image/png", Match: prefix([]byte("\x89PNG\r\n\x1a\n"))},
+	{Mime: "image/jpeg", Match: prefix([]byte{0xFF, 0xD8, 0xFF})},
+	{Mime: "image/gif", Match: func(head []byte) bool {
+		return bytes.HasPrefix(head, []byte("GIF87a")) || bytes.HasPrefix(head, []byte("GIF89a"))
+	}},
+	{Mime: "image/webp", Match: func(head []byte) bool {
+		return len(head) >= 12 && bytes.Equal(head[0:4], []byte("RIFF")) && bytes.Equal(head[8:12], []byte("WEBP"))
+	}},
+}
+
+// ISO-BMFF major brands that are not plain mp4 video
+var ftypBrands = map[string]string{
+	"qt  ": "video/quicktime",
+	"M4A ": "audio/mp4",
+	"M4B ": "audio/mp4",
+	"avif": "image/avif",
+	"avis": "image/avif",
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"mif1": "image/heif",
+	"3gp4": "video/3gpp",
+	"3gp5": "video/3gpp",
+	"3g2a": "video/3gpp2",
+}
+
+// Register adds a signature in front of the built-in ones
+func Register(sig Signature) {
+	signatures = append([]Signature{sig}, signatures...)
+}
+
+// Detect returns the mime type of the content starting with head.
+// Types we don't have a signature for fall back to net/http's sniffer.
+func Detect(head []byte) string {
+	for _, sig := range signatures {
+		if sig.Match(head) {
+			return sig.Mime
+		}
+	}
+
+	if mime := detectFtyp(head); mime != "" {
+		return mime
+	}
+
+	if len(head) == 0 {
+		return fallbackType
+	}
+	return Normalize(http.DetectContentType(head))
+}
+
+// Check detects the type of head and compares it with what the client declared.
+// An empty or generic declaration is not treated as a mismatch.
+func Check(declared string, head []byte) (string, error) {
+	detected := Detect(head)
+
+	declared = Normalize(declared)
+	if declared == "" || declared == fallbackType {
+		return detected, nil
+	}
+	if declared != detected {
+		return detected, &MismatchError{Declared: declared, Detected: detected}
+	}
+	return detected, nil
+}
+
+// Normalize strips parameters and maps aliases to their canonical type
+func Normalize(mime string) string {
+	if i := strings.IndexByte(mime, ';'); i >= 0 {
+		mime = mime[:i]
+	}
+	mime = strings.ToLower(strings.TrimSpace(mime))
+
+	switch mime {
+	case "image/jpg", "image/pjpeg":
+		return "image/jpeg"
+	case "image/x-png":
+		return "image/png"
+	}
+	return mime
+}
+
+// MismatchError is returned when the declared type doesn't match the content
+type MismatchError struct {
+	Declared string `json:"declared"`
+	Detected string `json:"detected"`
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("declared type %s does not match detected type %s", e.Declared, e.Detected)
+}
+
+func detectFtyp(head []byte) string {
+	if len(head) < 12 || !bytes.Equal(head[4:8], []byte("ftyp")) {
+		return ""
+	}
+	if mime, ok := ftypBrands[string(head[8:12])]; ok {
+		return mime
+	}
+	return "video/mp4"
+}
+
+func prefix(magic []byte) func([]byte) bool {
+	return func(head []byte) bool {
+		return bytes.HasPrefix(head, magic)
+	}
+}
@@ -0,0 +1,127 @@
+package sniff
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func ftyp(brand string) []byte {
+	return append([]byte("\x00\x00\x00\x18ftyp"), brand+"\x00\x00\x02\x00isomiso2"...)
+}
+
+var (
+	png  = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	jpeg = []byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x10, 'J', 'F', 'I', 'F', 0x00}
+	webp = []byte("RIFF\x24\x00\x00\x00WEBPVP8 ")
+)
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name string
+		head []byte
+		want string
+	}{
+		{name: "png", head: png, want: "image/png"},
+		{name: "jpeg jfif", head: jpeg, want: "image/jpeg"},
+		{name: "jpeg exif", head: []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x10, 'E', 'x', 'i', 'f'}, want: "image/jpeg"},
+		{name: "gif87a", head: []byte("GIF87a\x01\x00\x01\x00"), want: "image/gif"},
+		{name: "gif89a", head: []byte("GIF89a\x01\x00\x01\x00"), want: "image/gif"},
+		{name: "webp", head: webp, want: "image/webp"},
+		{name: "riff but not webp", head: []byte("RIFF\x24\x00\x00\x00WAVEfmt "), want: "audio/wave"},
+		{name: "truncated webp", head: []byte("RIFF\x24\x00\x00\x00WEB"), want: "application/octet-stream"},
+		{name: "mp4 isom", head: ftyp("isom"), want: "video/mp4"},
+		{name: "mp4 mp42", head: ftyp("mp42"), want: "video/mp4"},
+		{name: "mp4 unknown brand", head: ftyp("xyz1"), want: "video/mp4"},
+		{name: "quicktime", head: ftyp("qt  "), want: "video/quicktime"},
+		{name: "m4a", head: ftyp("M4A "), want: "audio/mp4"},
+		{name: "avif", head: ftyp("avif"), want: "image/avif"},
+		{name: "heic", head: ftyp("heic"), want: "image/heic"},
+		{name: "heif", head: ftyp("mif1"), want: "image/heif"},
+		{name: "3gp", head: ftyp("3gp4"), want: "video/3gpp"},
+		{name: "truncated ftyp", head: []byte("\x00\x00\x00\x18ftypis"), want: "application/octet-stream"},
+		{name: "text drops the charset", head: []byte("hello world"), want: "text/plain"},
+		{name: "empty", head: nil, want: "application/octet-stream"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Detect(tt.head); got != tt.want {
+				t.Errorf("Detect = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := map[string]string{
+		"image/png":                 "image/png",
+		"IMAGE/PNG":                 "image/png",
+		" image/png ":               "image/png",
+		"image/jpg":                 "image/jpeg",
+		"image/pjpeg":               "image/jpeg",
+		"image/x-png":               "image/png",
+		"text/plain; charset=utf-8": "text/plain",
+		"image/jpg;q=0.9":           "image/jpeg",
+		"":                          "",
+	}
+	for mime, want := range tests {
+		if got := Normalize(mime); got != want {
+			t.Errorf("Normalize(%q) = %q, want %q", mime, got, want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name         string
+		declared     string
+		head         []byte
+		want         string
+		wantMismatch bool
+	}{
+		{name: "matching", declared: "image/png", head: png, want: "image/png"},
+		{name: "jpg alias", declared: "image/jpg", head: jpeg, want: "image/jpeg"},
+		{name: "pjpeg alias", declared: "image/pjpeg", head: jpeg, want: "image/jpeg"},
+		{name: "parameters", declared: "image/webp; foo=bar", head: webp, want: "image/webp"},
+		{name: "case", declared: "Video/MP4", head: ftyp("isom"), want: "video/mp4"},
+		{name: "nothing declared", declared: "", head: png, want: "image/png"},
+		{name: "generic declaration", declared: "application/octet-stream", head: jpeg, want: "image/jpeg"},
+		{name: "png as jpeg", declared: "image/jpeg", head: png, want: "image/png", wantMismatch: true},
+		{name: "quicktime as mp4", declared: "video/mp4", head: ftyp("qt  "), want: "video/quicktime", wantMismatch: true},
+		{name: "text as png", declared: "image/png", head: []byte("<?php echo 1; ?>"), want: "text/plain", wantMismatch: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Check(tt.declared, tt.head)
+			if got != tt.want {
+				t.Errorf("detected %q, want %q", got, tt.want)
+			}
+			var mismatch *MismatchError
+			if !tt.wantMismatch {
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				return
+			}
+			if !errors.As(err, &mismatch) {
+				t.Fatalf("err = %v, want a MismatchError", err)
+			}
+			if mismatch.Declared != Normalize(tt.declared) || mismatch.Detected != tt.want {
+				t.Errorf("mismatch %+v", mismatch)
+			}
+		})
+	}
+}
+
+func TestRegister(t *testing.T) {
+	builtin := signatures
+	t.Cleanup(func() { signatures = builtin })
+
+	// Registered signatures are tried before the built-in ones
+	Register(Signature{Mime: "image/x-test", Match: func(head []byte) bool { return bytes.HasPrefix(head, []byte("\x89PNG")) }})
+	if got := Detect(png); got != "image/x-test" {
+		t.Errorf("Detect = %q, want the registered type", got)
+	}
+}
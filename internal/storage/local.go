@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// tmpDirName lives inside the root so renames into place never cross filesystems
+const tmpDirName = ".tmp"
+
+// Local stores objects as plain files below a root directory
+type Local struct {
+	root string
+}
+
+func NewLocal(root string) (*Local, error) {
+	if err := os.MkdirAll(filepath.Join(root, tmpDirName), 0o755); err != nil {
+		return nil, fmt.Errorf("create storage root: %w", err)
+	}
+	return &Local{root: root}, nil
+}
+
+// Root returns the directory the backend writes to
+func (l *Local) Root() string {
+	return l.root
+}
+
+func (l *Local) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	target, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Join(l.root, tmpDirName), "put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, &ctxReader{ctx: ctx, r: r}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return l.rename(tmp.Name(), target)
+}
+
+// Import moves a local file into place. Files on another filesystem are copied.
+func (l *Local) Import(ctx context.Context, key string, localPath string) error {
+	target, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := l.rename(localPath, target); err == nil {
+		return nil
+	}
+	return putFileCopy(ctx, l, key, localPath)
+}
+
+func (l *Local) Get(ctx context.Context, key string, rng *Range) (io.ReadCloser, *ObjectInfo, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	info := &ObjectInfo{Key: key, Size: stat.Size(), ModTime: stat.ModTime()}
+
+	if rng == nil {
+		return f, info, nil
+	}
+
+	resolved, err := rng.check(info.Size)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	reader := io.NewSectionReader(f, resolved.Offset, resolved.Length)
+	return readCloser{Reader: reader, Closer: f}, info, nil
+}
+
+func (l *Local) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Key: key, Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	l.pruneDirs(filepath.Dir(p))
+	return nil
+}
+
+func (l *Local) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	// Only walk the part of the tree the prefix can match
+	dir := path.Dir(prefix)
+	if _, err := CleanKey(dir); err != nil && dir != "." {
+		return err
+	}
+	start := filepath.Join(l.root, filepath.FromSlash(dir))
+
+	return filepath.WalkDir(start, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && p == start {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+
+		if d.IsDir() {
+			if d.Name() == tmpDirName {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		stat, err := d.Info()
+		if err != nil {
+			// Deleted while we were walking
+			return nil
+		}
+		return fn(ObjectInfo{Key: key, Size: stat.Size(), ModTime: stat.ModTime()})
+	})
+}
+
+func (l *Local) path(key string) (string, error) {
+	clean, err := CleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	if clean == tmpDirName || strings.HasPrefix(clean, tmpDirName+"/") {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(l.root, filepath.FromSlash(clean)), nil
+}
+
+func (l *Local) rename(from, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(from, to)
+}
+
+// pruneDirs removes empty parent directories up to the root
+func (l *Local) pruneDirs(dir string) {
+	root := filepath.Clean(l.root)
+	for dir != root && strings.HasPrefix(dir, root) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+func putFileCopy(ctx context.Context, b Backend, key string, localPath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return b.Put(ctx, key, f, stat.Size())
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ReadSeeker adapts a backend object to io.ReadSeeker, e.g. for
+// http.ServeContent. Seeking is free; the next Read opens a ranged stream
+// from the new position, so nothing is buffered beyond what's being copied.
+type ReadSeeker struct {
+	ctx     context.Context
+	backend Backend
+	key     string
+	size    int64
+	pos     int64
+	body    io.ReadCloser
+}
+
+func NewReadSeeker(ctx context.Context, backend Backend, key string, size int64) *ReadSeeker {
+	return &ReadSeeker{ctx: ctx, backend: backend, key: key, size: size}
+}
+
+func (r *ReadSeeker) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.body == nil {
+		body, _, err := r.backend.Get(r.ctx, r.key, &Range{Offset: r.pos, Length: -1})
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+
+	n, err := r.body.Read(p)
+	r.pos += int64(n)
+	if err == io.EOF && r.pos < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *ReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = r.size + offset
+	default:
+		return 0, errors.New("storage: invalid whence")
+	}
+	if pos < 0 {
+		return 0, errors.New("storage: negative position")
+	}
+
+	if pos != r.pos {
+		r.closeBody()
+		r.pos = pos
+	}
+	return pos, nil
+}
+
+func (r *ReadSeeker) Close() error {
+	return r.closeBody()
+}
+
+func (r *ReadSeeker) closeBody() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
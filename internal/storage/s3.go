@@ -0,0 +1,444 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"noverna.de/m/v2/internal/config"
+)
+
+const (
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	emptyPayload    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3 talks to any S3 compatible object store (AWS, MinIO, Garage, ...)
+// using plain net/http and AWS Signature Version 4.
+type S3 struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	client    *http.Client
+	// tempDir holds uploads of unknown length while they are measured
+	tempDir string
+}
+
+// NewS3 creates a backend for the bucket in cfg. Streams of unknown length
+// are spooled to tempDir, an empty one means the OS default.
+func NewS3(cfg config.S3Storage, tempDir string) (*S3, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 storage needs an endpoint and a bucket")
+	}
+
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint: %s", cfg.Endpoint)
+	}
+
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	if tempDir != "" {
+		if err := os.MkdirAll(tempDir, 0o755); err != nil {
+			return nil, fmt.Errorf("create %s: %w", tempDir, err)
+		}
+	}
+
+	return &S3{
+		endpoint:  endpoint,
+		region:    region,
+		bucket:    cfg.Bucket,
+		prefix:    prefix,
+		accessKey: cfg.AccessKey,
+		secretKey: cfg.SecretKey,
+		pathStyle: cfg.PathStyle,
+		client:    &http.Client{},
+		tempDir:   tempDir,
+	}, nil
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	key, err := CleanKey(key)
+	if err != nil {
+		return err
+	}
+
+	// S3 wants a Content-Length up front
+	if size < 0 {
+		spooled, n, err := spool(r, s.tempDir)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			spooled.Close()
+			os.Remove(spooled.Name())
+		}()
+		r, size = spooled, n
+	}
+
+	req, err := s.newRequest(ctx, http.MethodPut, key, nil, io.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+
+	resp, err := s.do(req, unsignedPayload)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) Get(ctx context.Context, key string, rng *Range) (io.ReadCloser, *ObjectInfo, error) {
+	// newRequest takes an empty key for the bucket itself
+	key, err := CleanKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := s.newRequest(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rng != nil {
+		if rng.Offset < 0 {
+			return nil, nil, ErrInvalidRange
+		}
+		if rng.Length < 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", rng.Offset))
+		} else if rng.Length == 0 {
+			// S3 has no way to express an empty range
+			info, err := s.Stat(ctx, key)
+			if err != nil {
+				return nil, nil, err
+			}
+			if rng.Offset > info.Size {
+				return nil, nil, ErrInvalidRange
+			}
+			return io.NopCloser(strings.NewReader("")), info, nil
+		} else {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", rng.Offset, rng.Offset+rng.Length-1))
+		}
+	}
+
+	resp, err := s.do(req, emptyPayload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info := s.objectInfo(key, resp)
+	if resp.StatusCode == http.StatusPartialContent {
+		// Content-Length is the range, the full size is behind the slash
+		if _, total, ok := strings.Cut(resp.Header.Get("Content-Range"), "/"); ok {
+			if n, err := strconv.ParseInt(total, 10, 64); err == nil {
+				info.Size = n
+			}
+		}
+	}
+	return resp.Body, info, nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := s.newRequest(ctx, http.MethodHead, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(req, emptyPayload)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return s.objectInfo(key, resp), nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	// S3 happily deletes missing keys, the other backends don't
+	if _, err := s.Stat(ctx, key); err != nil {
+		return err
+	}
+
+	req, err := s.newRequest(ctx, http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(req, emptyPayload)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type listBucketResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+}
+
+func (s *S3) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", s.prefix+prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		req, err := s.newRequest(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := s.do(req, emptyPayload)
+		if err != nil {
+			return err
+		}
+
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("s3: decode list response: %w", err)
+		}
+
+		for _, obj := range result.Contents {
+			info := ObjectInfo{
+				Key:     strings.TrimPrefix(obj.Key, s.prefix),
+				Size:    obj.Size,
+				ModTime: obj.LastModified,
+			}
+			if err := fn(info); err != nil {
+				return err
+			}
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *S3) newRequest(ctx context.Context, method, key string, query url.Values, body io.ReadCloser) (*http.Request, error) {
+	if key != "" {
+		clean, err := CleanKey(key)
+		if err != nil {
+			return nil, err
+		}
+		key = s.prefix + clean
+	}
+
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+	u.RawPath = encodePath(u.Path)
+	if query != nil {
+		u.RawQuery = encodeQuery(query)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// do signs and sends the request and turns S3 error responses into errors
+func (s *S3) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	s.sign(req, payloadHash, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3: %s %s: %w", req.Method, req.URL.Path, err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+		return nil, ErrInvalidRange
+	case resp.StatusCode >= 300:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3: %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header
+func (s *S3) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	if rng := req.Header.Get("Range"); rng != "" {
+		headers["range"] = rng
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature,
+	))
+}
+
+func (s *S3) objectInfo(key string, resp *http.Response) *ObjectInfo {
+	info := &ObjectInfo{Key: key, Size: resp.ContentLength}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = t
+	}
+	return info
+}
+
+// spool buffers a stream of unknown length in a temp file in dir
+func spool(r io.Reader, dir string) (*os.File, int64, error) {
+	f, err := os.CreateTemp(dir, "s3-put-*")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	n, err := io.Copy(f, r)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, 0, err
+	}
+	return f, n, nil
+}
+
+// encodePath escapes every path segment the way SigV4 expects
+func encodePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = uriEncode(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func encodeQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k)+"="+uriEncode(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes everything except the RFC 3986 unreserved characters
+func uriEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,112 @@
+// Package storage abstracts where file contents live. Keys are slash
+// separated paths like "ab/cd/abcd..." and mean the same on every backend.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"noverna.de/m/v2/internal/config"
+)
+
+var (
+	ErrNotFound     = errors.New("object not found")
+	ErrInvalidKey   = errors.New("invalid object key")
+	ErrInvalidRange = errors.New("invalid range")
+)
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Range selects Length bytes starting at Offset. A negative Length reads to the end.
+type Range struct {
+	Offset int64
+	Length int64
+}
+
+type Backend interface {
+	// Put stores r under key. size may be -1 if unknown.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get streams the object, or only the requested range if rng is not nil
+	Get(ctx context.Context, key string, rng *Range) (io.ReadCloser, *ObjectInfo, error)
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	// List calls fn for every object below prefix until fn returns an error
+	List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error
+}
+
+// Importer is implemented by backends that can take over a local file
+// without copying it, e.g. by renaming it into place.
+type Importer interface {
+	Import(ctx context.Context, key string, localPath string) error
+}
+
+// New creates the backend selected in the [storage] config section
+func New(cfg *config.Config) (Backend, error) {
+	return NewBackend(cfg.Storage, cfg.Server.DataDir, cfg.Server.TempDir)
+}
+
+// NewBackend creates a backend from a storage section. A local backend
+// without a root falls back to dataDir, backends that need scratch space
+// take it from tempDir.
+func NewBackend(st config.Storage, dataDir, tempDir string) (Backend, error) {
+	switch st.Backend {
+	case "", "local":
+		root := st.Local.Root
+		if root == "" {
+			root = dataDir
+		}
+		return NewLocal(root)
+	case "memory":
+		return NewMemory(), nil
+	case "s3":
+		return NewS3(st.S3, tempDir)
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", st.Backend)
+	}
+}
+
+// PutFile stores a local file, letting the backend import it directly if it can
+func PutFile(ctx context.Context, b Backend, key string, localPath string) error {
+	if imp, ok := b.(Importer); ok {
+		return imp.Import(ctx, key, localPath)
+	}
+	return putFileCopy(ctx, b, key, localPath)
+}
+
+// CleanKey validates a key and returns it in canonical form
+func CleanKey(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return "", ErrInvalidKey
+	}
+	clean := path.Clean(key)
+	if clean != key || clean == "." || strings.HasPrefix(clean, "../") || clean == ".." {
+		return "", ErrInvalidKey
+	}
+	return clean, nil
+}
+
+// check makes sure rng fits into an object of the given size and resolves
+// a negative length to "until the end"
+func (r *Range) check(size int64) (Range, error) {
+	if r == nil {
+		return Range{Offset: 0, Length: size}, nil
+	}
+	if r.Offset < 0 || r.Offset > size {
+		return Range{}, ErrInvalidRange
+	}
+	length := r.Length
+	if length < 0 || r.Offset+length > size {
+		length = size - r.Offset
+	}
+	return Range{Offset: r.Offset, Length: length}, nil
+}
@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"noverna.de/m/v2/internal/config"
+)
+
+// fakeS3 is a stand-in for an S3 compatible store with path style buckets.
+// It keeps objects in memory and answers the few calls the backend makes.
+type fakeS3 struct {
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		http.Error(w, "unsigned request", http.StatusForbidden)
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+f.bucket+"/")
+	if !ok {
+		http.Error(w, "no such bucket", http.StatusNotFound)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && key == "" && r.URL.Query().Get("list-type") == "2":
+		f.list(w, r.URL.Query().Get("prefix"))
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = data
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "no such key", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var result listBucketResult
+	for _, key := range keys {
+		result.Contents = append(result.Contents, struct {
+			Key          string    `xml:"Key"`
+			Size         int64     `xml:"Size"`
+			LastModified time.Time `xml:"LastModified"`
+		}{Key: key, Size: int64(len(f.objects[key])), LastModified: time.Now().UTC()})
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+// backends returns every backend, each empty
+func backends(t *testing.T) map[string]Backend {
+	t.Helper()
+
+	local, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]Backend{"local": local, "memory": NewMemory(), "s3": newS3(t, t.TempDir())}
+}
+
+// newS3 returns an S3 backend talking to a fresh fakeS3
+func newS3(t *testing.T, tempDir string) *S3 {
+	t.Helper()
+	fake := &fakeS3{bucket: "noverna", objects: map[string][]byte{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	s3, err := NewS3(config.S3Storage{
+		Endpoint:  server.URL,
+		Bucket:    "noverna",
+		Prefix:    "test",
+		AccessKey: "access",
+		SecretKey: "secret",
+		PathStyle: true,
+	}, tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s3
+}
+
+func TestBackendRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	content := []byte("0123456789")
+
+	for name, b := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := b.Put(ctx, "ab/cd/object", bytes.NewReader(content), -1); err != nil {
+				t.Fatalf("put: %v", err)
+			}
+
+			info, err := b.Stat(ctx, "ab/cd/object")
+			if err != nil {
+				t.Fatalf("stat: %v", err)
+			}
+			if info.Size != int64(len(content)) {
+				t.Errorf("stat size = %d, want %d", info.Size, len(content))
+			}
+
+			ranges := []struct {
+				rng  *Range
+				want string
+			}{
+				{nil, "0123456789"},
+				{&Range{Offset: 2, Length: 3}, "234"},
+				{&Range{Offset: 7, Length: -1}, "789"},
+				{&Range{Offset: 4, Length: 0}, ""},
+			}
+			for _, tt := range ranges {
+				r, info, err := b.Get(ctx, "ab/cd/object", tt.rng)
+				if err != nil {
+					t.Fatalf("get %+v: %v", tt.rng, err)
+				}
+				got, _ := io.ReadAll(r)
+				r.Close()
+				if string(got) != tt.want {
+					t.Errorf("get %+v = %q, want %q", tt.rng, got, tt.want)
+				}
+				if info.Size != int64(len(content)) {
+					t.Errorf("get %+v size = %d, want the full %d", tt.rng, info.Size, len(content))
+				}
+			}
+
+			if err := b.Delete(ctx, "ab/cd/object"); err != nil {
+				t.Fatalf("delete: %v", err)
+			}
+			if _, err := b.Stat(ctx, "ab/cd/object"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("stat after delete: err = %v, want ErrNotFound", err)
+			}
+			if err := b.Delete(ctx, "ab/cd/object"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("second delete: err = %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestBackendInvalidKeys(t *testing.T) {
+	ctx := context.Background()
+	keys := []string{"", "/abs", "a//b", "a/../b", "../up", "a\\b", "."}
+
+	for name, b := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, key := range keys {
+				if err := b.Put(ctx, key, strings.NewReader("x"), 1); !errors.Is(err, ErrInvalidKey) {
+					t.Errorf("put %q: err = %v, want ErrInvalidKey", key, err)
+				}
+				if _, _, err := b.Get(ctx, key, nil); !errors.Is(err, ErrInvalidKey) {
+					t.Errorf("get %q: err = %v, want ErrInvalidKey", key, err)
+				}
+				if _, err := b.Stat(ctx, key); !errors.Is(err, ErrInvalidKey) {
+					t.Errorf("stat %q: err = %v, want ErrInvalidKey", key, err)
+				}
+				if err := b.Delete(ctx, key); !errors.Is(err, ErrInvalidKey) {
+					t.Errorf("delete %q: err = %v, want ErrInvalidKey", key, err)
+				}
+			}
+		})
+	}
+}
+
+func TestBackendList(t *testing.T) {
+	ctx := context.Background()
+
+	for name, b := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			for i, key := range []string{"blobs/b", "blobs/a", "variants/c"} {
+				data := strings.Repeat("x", i+1)
+				if err := b.Put(ctx, key, strings.NewReader(data), int64(len(data))); err != nil {
+					t.Fatalf("put %s: %v", key, err)
+				}
+			}
+
+			var got []string
+			err := b.List(ctx, "blobs/", func(info ObjectInfo) error {
+				got = append(got, info.Key+":"+strconv.FormatInt(info.Size, 10))
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("list: %v", err)
+			}
+			sort.Strings(got)
+			if want := []string{"blobs/a:2", "blobs/b:1"}; fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("list = %v, want %v", got, want)
+			}
+
+			stop := errors.New("stop")
+			calls := 0
+			err = b.List(ctx, "", func(ObjectInfo) error {
+				calls++
+				return stop
+			})
+			if !errors.Is(err, stop) || calls != 1 {
+				t.Errorf("list stopped after %d calls with %v, want 1 call and the callback's error", calls, err)
+			}
+		})
+	}
+}
+
+// spyReader reports what is in dir once r is drained
+type spyReader struct {
+	r   io.Reader
+	dir string
+	saw []string
+}
+
+func (s *spyReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err == io.EOF {
+		entries, _ := os.ReadDir(s.dir)
+		for _, entry := range entries {
+			s.saw = append(s.saw, entry.Name())
+		}
+	}
+	return n, err
+}
+
+func TestS3SpoolsToTempDir(t *testing.T) {
+	ctx := context.Background()
+	tempDir := filepath.Join(t.TempDir(), "tmp")
+	s3 := newS3(t, tempDir)
+
+	spy := &spyReader{r: strings.NewReader("unknown length"), dir: tempDir}
+	if err := s3.Put(ctx, "object", spy, -1); err != nil {
+		t.Fatal(err)
+	}
+	if len(spy.saw) != 1 || !strings.HasPrefix(spy.saw[0], "s3-put-") {
+		t.Fatalf("temp dir held %v while spooling, want one s3-put file", spy.saw)
+	}
+	if entries, _ := os.ReadDir(tempDir); len(entries) != 0 {
+		t.Errorf("%d files left in the temp dir", len(entries))
+	}
+
+	rc, info, err := s3.Get(ctx, "object", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if data, _ := io.ReadAll(rc); string(data) != "unknown length" || info.Size != int64(len(data)) {
+		t.Errorf("read back %q, size %d", data, info.Size)
+	}
+}
@@ -0,0 +1,409 @@
+// Package tus keeps the state of resumable uploads (tus 1.0) on disk.
+// Every upload is a pair of files in the store dir: <id>.info with the
+// session as JSON and <id>.part with the bytes received so far.
+package tus
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"noverna.de/m/v2/internal/files"
+)
+
+const Version = "1.0.0"
+
+var (
+	ErrNotFound       = errors.New("upload not found")
+	ErrExpired        = errors.New("upload expired")
+	ErrLocked         = errors.New("upload is locked by another request")
+	ErrOffsetMismatch = errors.New("upload offset does not match")
+	ErrExceedsLength  = errors.New("upload exceeds the announced length")
+	ErrCompleted      = errors.New("upload is already completed")
+	ErrBadMetadata    = errors.New("malformed Upload-Metadata header")
+)
+
+// Info is the persisted state of one upload session
+type Info struct {
+	ID        string            `json:"id"`
+	Length    int64             `json:"length"`
+	Offset    int64             `json:"offset"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Owner     string            `json:"owner,omitempty"`
+	FileID    string            `json:"file_id,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+// Done reports whether all bytes have been received
+func (i *Info) Done() bool {
+	return i.Offset == i.Length
+}
+
+type Store struct {
+	dir    string
+	expiry time.Duration
+
+	mu sync.Mutex
+	// Uploads a request is working on. The channel is closed when the lock
+	// is released, for the few callers that wait instead of giving up.
+	locked map[string]chan struct{}
+}
+
+func NewStore(dir string, expiry time.Duration) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create %s: %w", dir, err)
+	}
+	return &Store{
+		dir:    dir,
+		expiry: expiry,
+		locked: make(map[string]chan struct{}),
+	}, nil
+}
+
+// Create starts a new upload session of the given length on behalf of owner
+func (s *Store) Create(length int64, owner string, metadata map[string]string) (*Info, error) {
+	id, err := files.NewID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	info := &Info{
+		ID:        id,
+		Length:    length,
+		Metadata:  metadata,
+		Owner:     owner,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.expiry),
+	}
+
+	part, err := os.OpenFile(s.partPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("create part file: %w", err)
+	}
+	part.Close()
+
+	if err := s.writeInfo(info); err != nil {
+		os.Remove(s.partPath(id))
+		return nil, err
+	}
+	return info, nil
+}
+
+// Get loads a session. Expired sessions are left for Sweep to remove, it
+// knows whether a request is still writing to them.
+func (s *Store) Get(id string) (*Info, error) {
+	info, err := s.readInfo(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(info.ExpiresAt) {
+		return nil, ErrExpired
+	}
+
+	// The part file is the source of truth, the info may be stale after a crash
+	if info.FileID == "" {
+		stat, err := os.Stat(s.partPath(id))
+		if err != nil {
+			return nil, ErrNotFound
+		}
+		info.Offset = stat.Size()
+	}
+	return info, nil
+}
+
+// Append writes r to the upload starting at offset. Whatever arrived before
+// a broken connection is kept, so the client can resume from there, and the
+// session lives for another expiry period from now on.
+func (s *Store) Append(ctx context.Context, id string, offset int64, r io.Reader) (*Info, error) {
+	unlock, err := s.lock(id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	info, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if info.FileID != "" {
+		return nil, ErrCompleted
+	}
+	if info.Offset != offset {
+		return info, ErrOffsetMismatch
+	}
+
+	part, err := os.OpenFile(s.partPath(id), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open part file: %w", err)
+	}
+	defer part.Close()
+
+	remaining := info.Length - info.Offset
+	n, copyErr := io.Copy(part, io.LimitReader(&ctxReader{ctx: ctx, r: r}, remaining+1))
+	if n > remaining {
+		// Drop the byte that proved the client is sending too much
+		part.Truncate(info.Length)
+		n = remaining
+		copyErr = ErrExceedsLength
+	}
+
+	info.Offset += n
+	info.ExpiresAt = time.Now().UTC().Add(s.expiry)
+	if err := s.writeInfo(info); err != nil {
+		return info, err
+	}
+	return info, copyErr
+}
+
+// Open returns the received bytes of a complete upload for reading
+func (s *Store) Open(id string) (*os.File, error) {
+	return os.Open(s.partPath(id))
+}
+
+// Complete marks a session as turned into a stored file and drops its data.
+// The info is kept until it expires so HEAD still answers for it.
+func (s *Store) Complete(id, fileID string) error {
+	info, err := s.readInfo(id)
+	if err != nil {
+		return err
+	}
+	info.FileID = fileID
+	if err := s.writeInfo(info); err != nil {
+		return err
+	}
+	return os.Remove(s.partPath(id))
+}
+
+// Lock acquires the per-upload lock, failing if someone else holds it
+func (s *Store) Lock(id string) (func(), error) {
+	return s.lock(id)
+}
+
+// LockWait acquires the per-upload lock, waiting for whoever holds it until
+// ctx is done
+func (s *Store) LockWait(ctx context.Context, id string) (func(), error) {
+	for {
+		unlock, released := s.tryLock(id)
+		if unlock != nil {
+			return unlock, nil
+		}
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Delete terminates an upload and removes all of its data
+func (s *Store) Delete(id string) error {
+	unlock, err := s.lock(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := s.readInfo(id); err != nil {
+		return err
+	}
+	return s.remove(id)
+}
+
+// Abort removes an upload whose lock the caller already holds
+func (s *Store) Abort(id string) error {
+	return s.remove(id)
+}
+
+// Sweep removes every session that expired before now, skipping those a
+// request is still writing to. Files left behind by a crash, a part without
+// an info or a half written info, go once they are older than a session
+// could live. It returns how many files it removed and their size.
+func (s *Store) Sweep(now time.Time) (int, int64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	removed, reclaimed := 0, int64(0)
+	drop := func(path string) {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return
+		}
+		if os.Remove(path) == nil {
+			removed++
+			reclaimed += stat.Size()
+		}
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if id, ok := strings.CutSuffix(name, ".info"); ok {
+			info, err := s.readInfo(id)
+			if err == nil && !now.After(info.ExpiresAt) {
+				continue
+			}
+			unlock, err := s.lock(id)
+			if err != nil {
+				// Still being written, it goes on the next sweep
+				continue
+			}
+			// A request may have extended it before we got the lock
+			if info, err := s.readInfo(id); err == nil && !now.After(info.ExpiresAt) {
+				unlock()
+				continue
+			}
+			drop(s.partPath(id))
+			drop(s.infoPath(id))
+			unlock()
+			continue
+		}
+
+		id, _, _ := strings.Cut(name, ".")
+		if _, err := os.Stat(s.infoPath(id)); err == nil {
+			continue
+		}
+		stat, err := entry.Info()
+		if err != nil || now.Sub(stat.ModTime()) < s.expiry {
+			continue
+		}
+		drop(filepath.Join(s.dir, name))
+	}
+	return removed, reclaimed, nil
+}
+
+func (s *Store) lock(id string) (func(), error) {
+	unlock, _ := s.tryLock(id)
+	if unlock == nil {
+		return nil, ErrLocked
+	}
+	return unlock, nil
+}
+
+// tryLock takes the lock of id if it is free, otherwise it returns a
+// channel that is closed once the holder lets go
+func (s *Store) tryLock(id string) (func(), <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if held, ok := s.locked[id]; ok {
+		return nil, held
+	}
+	released := make(chan struct{})
+	s.locked[id] = released
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			delete(s.locked, id)
+			s.mu.Unlock()
+			close(released)
+		})
+	}, nil
+}
+
+func (s *Store) remove(id string) error {
+	partErr := os.Remove(s.partPath(id))
+	if partErr != nil && !os.IsNotExist(partErr) {
+		return partErr
+	}
+	return os.Remove(s.infoPath(id))
+}
+
+func (s *Store) readInfo(id string) (*Info, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+
+	data, err := os.ReadFile(s.infoPath(id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info := &Info{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, fmt.Errorf("decode upload info: %w", err)
+	}
+	return info, nil
+}
+
+func (s *Store) writeInfo(info *Info) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.infoPath(info.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("write upload info: %w", err)
+	}
+	return os.Rename(tmp, s.infoPath(info.ID))
+}
+
+func (s *Store) partPath(id string) string {
+	return filepath.Join(s.dir, id+".part")
+}
+
+func (s *Store) infoPath(id string) string {
+	return filepath.Join(s.dir, id+".info")
+}
+
+// ParseMetadata decodes an Upload-Metadata header ("key base64value,key2 ...")
+func ParseMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, ErrBadMetadata
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, ErrBadMetadata
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata, nil
+}
+
+// ids come from files.NewID, anything else must not reach the filesystem
+func validID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,231 @@
+package tus
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := NewStore(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestAppendOffsets(t *testing.T) {
+	tests := []struct {
+		name       string
+		length     int64
+		chunks     []string
+		offsets    []int64
+		wantOffset int64
+		wantErr    error
+	}{
+		{name: "single chunk", length: 5, chunks: []string{"hello"}, offsets: []int64{0}, wantOffset: 5},
+		{name: "resumed", length: 10, chunks: []string{"hello", "world"}, offsets: []int64{0, 5}, wantOffset: 10},
+		{name: "offset behind", length: 10, chunks: []string{"hello", "world"}, offsets: []int64{0, 3}, wantOffset: 5, wantErr: ErrOffsetMismatch},
+		{name: "offset ahead", length: 10, chunks: []string{"hello"}, offsets: []int64{2}, wantOffset: 0, wantErr: ErrOffsetMismatch},
+		{name: "too long", length: 4, chunks: []string{"hello"}, offsets: []int64{0}, wantOffset: 4, wantErr: ErrExceedsLength},
+		{name: "completed then more", length: 5, chunks: []string{"hello", "!"}, offsets: []int64{0, 5}, wantOffset: 5, wantErr: ErrExceedsLength},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStore(t)
+			info, err := s.Create(tt.length, "owner", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, chunk := range tt.chunks {
+				_, err = s.Append(context.Background(), info.ID, tt.offsets[i], strings.NewReader(chunk))
+				if err != nil {
+					break
+				}
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+
+			got, err := s.Get(info.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Offset != tt.wantOffset {
+				t.Errorf("offset = %d, want %d", got.Offset, tt.wantOffset)
+			}
+		})
+	}
+}
+
+func TestAppendLocked(t *testing.T) {
+	s := newStore(t)
+	info, err := s.Create(5, "owner", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unlock, err := s.Lock(info.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Append(context.Background(), info.ID, 0, strings.NewReader("hello")); !errors.Is(err, ErrLocked) {
+		t.Fatalf("append while locked: err = %v, want ErrLocked", err)
+	}
+	if err := s.Delete(info.ID); !errors.Is(err, ErrLocked) {
+		t.Fatalf("delete while locked: err = %v, want ErrLocked", err)
+	}
+
+	unlock()
+	// A second call must not release a lock someone else took in between
+	relock, err := s.Lock(info.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	if _, err := s.Lock(info.ID); !errors.Is(err, ErrLocked) {
+		t.Fatalf("lock after stale unlock: err = %v, want ErrLocked", err)
+	}
+	relock()
+
+	if _, err := s.Append(context.Background(), info.ID, 0, strings.NewReader("hello")); err != nil {
+		t.Fatalf("append after unlock: %v", err)
+	}
+}
+
+func TestLockExclusive(t *testing.T) {
+	s := newStore(t)
+
+	var holders, overlaps atomic.Int32
+	var wg sync.WaitGroup
+	for range 64 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 200 {
+				unlock, err := s.lock("upload")
+				if err != nil {
+					continue
+				}
+				if holders.Add(1) > 1 {
+					overlaps.Add(1)
+				}
+				holders.Add(-1)
+				unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := overlaps.Load(); n > 0 {
+		t.Fatalf("lock was held by two requests at once %d times", n)
+	}
+	if len(s.locked) != 0 {
+		t.Fatalf("%d locks left behind", len(s.locked))
+	}
+}
+
+func TestGetExpired(t *testing.T) {
+	s := newStore(t)
+	info, err := s.Create(5, "owner", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info.ExpiresAt = time.Now().Add(-time.Minute)
+	if err := s.writeInfo(info); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get only reports it, the files are left to Sweep
+	unlock, err := s.Lock(info.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(info.ID); !errors.Is(err, ErrExpired) {
+		t.Fatalf("err = %v, want ErrExpired", err)
+	}
+	if _, err := os.Stat(s.partPath(info.ID)); err != nil {
+		t.Fatalf("part file of a locked upload removed: %v", err)
+	}
+	if removed, _, _ := s.Sweep(time.Now()); removed != 0 {
+		t.Fatalf("sweep removed %d files of a locked upload", removed)
+	}
+
+	unlock()
+	if removed, _, _ := s.Sweep(time.Now()); removed != 2 {
+		t.Fatalf("sweep removed %d files, want the part and the info", removed)
+	}
+	if _, err := s.Get(info.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("after sweep: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestAppendExtendsExpiry(t *testing.T) {
+	s := newStore(t)
+	info, err := s.Create(10, "owner", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info.ExpiresAt = time.Now().Add(time.Minute)
+	if err := s.writeInfo(info); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.Append(context.Background(), info.ID, 0, strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if until := time.Until(got.ExpiresAt); until < 59*time.Minute {
+		t.Errorf("session expires in %v after a chunk, want another hour", until)
+	}
+	if removed, _, _ := s.Sweep(time.Now().Add(30 * time.Minute)); removed != 0 {
+		t.Errorf("sweep removed %d files of an active upload", removed)
+	}
+}
+
+func TestLockWait(t *testing.T) {
+	s := newStore(t)
+	unlock, err := s.Lock("upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := s.LockWait(ctx, "upload"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want the deadline", err)
+	}
+
+	acquired := make(chan func())
+	go func() {
+		unlock, err := s.LockWait(context.Background(), "upload")
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- unlock
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("lock taken while held")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	unlock()
+	select {
+	case relock := <-acquired:
+		if _, err := s.Lock("upload"); !errors.Is(err, ErrLocked) {
+			t.Fatalf("err = %v, want the waiter to hold the lock", err)
+		}
+		relock()
+	case <-time.After(time.Second):
+		t.Fatal("waiter never got the lock")
+	}
+}
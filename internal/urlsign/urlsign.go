@@ -0,0 +1,162 @@
+// Package urlsign signs links that grant access to one path until they
+// expire, so files can be handed to browsers without an API key. Links carry
+// the id of the key they were signed with, which lets several keys be
+// accepted at once while the signing key is rotated.
+package urlsign
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"noverna.de/m/v2/internal/config"
+)
+
+// Query parameters a signed link carries next to its own
+const (
+	ParamExpires   = "expires"
+	ParamClientIP  = "ip"
+	ParamKeyID     = "kid"
+	ParamSignature = "sig"
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid link signature")
+	ErrExpired          = errors.New("link has expired")
+	ErrWrongClient      = errors.New("link was issued to another address")
+	ErrInvalidTTL       = errors.New("invalid link lifetime")
+)
+
+var keyIDFormat = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// Signer signs links with the configured signing key and verifies links
+// signed with any of the configured keys
+type Signer struct {
+	keys       map[string][]byte
+	signingKey string
+	defaultTTL time.Duration
+	maxTTL     time.Duration
+}
+
+// New loads the secret of every key in cfg
+func New(cfg config.SignedURLs) (*Signer, error) {
+	s := &Signer{
+		keys:       make(map[string][]byte, len(cfg.Keys)),
+		signingKey: cfg.SigningKey,
+		defaultTTL: time.Duration(cfg.DefaultTTLSeconds) * time.Second,
+		maxTTL:     time.Duration(cfg.MaxTTLSeconds) * time.Second,
+	}
+	if s.defaultTTL <= 0 || s.maxTTL < s.defaultTTL {
+		return nil, errors.New("urlsign: default_ttl_seconds must be positive and at most max_ttl_seconds")
+	}
+
+	for id, key := range cfg.Keys {
+		if !keyIDFormat.MatchString(id) {
+			return nil, fmt.Errorf("urlsign: invalid key id %q", id)
+		}
+		if key.SecretFile == "" {
+			return nil, fmt.Errorf("urlsign: key %q needs a secret_file", id)
+		}
+		secret, err := os.ReadFile(key.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("urlsign: read secret of %q: %w", id, err)
+		}
+		secret = bytes.TrimSpace(secret)
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("urlsign: secret of %q must be at least 32 bytes", id)
+		}
+		s.keys[id] = secret
+	}
+	if _, ok := s.keys[s.signingKey]; !ok {
+		return nil, fmt.Errorf("urlsign: signing_key %q is not one of the keys", s.signingKey)
+	}
+	return s, nil
+}
+
+// Expiry turns a requested lifetime into an expiry time, 0 picks the default
+func (s *Signer) Expiry(ttl time.Duration, now time.Time) (time.Time, error) {
+	if ttl == 0 {
+		ttl = s.defaultTTL
+	}
+	if ttl < 0 || ttl > s.maxTTL {
+		return time.Time{}, fmt.Errorf("%w: at most %s", ErrInvalidTTL, s.maxTTL)
+	}
+	return now.Add(ttl).Truncate(time.Second), nil
+}
+
+// Sign returns query with the parameters that grant access to path until
+// expires, from client only unless it is the zero address
+func (s *Signer) Sign(path string, query url.Values, expires time.Time, client netip.Addr) url.Values {
+	signed := url.Values{}
+	for name, values := range query {
+		signed[name] = append([]string(nil), values...)
+	}
+	signed.Set(ParamExpires, strconv.FormatInt(expires.Unix(), 10))
+	if client.IsValid() {
+		signed.Set(ParamClientIP, client.Unmap().String())
+	}
+	signed.Set(ParamKeyID, s.signingKey)
+	signed.Set(ParamSignature, base64.RawURLEncoding.EncodeToString(sign(s.keys[s.signingKey], path, signed)))
+	return signed
+}
+
+// KeyID is the key new links are signed with
+func (s *Signer) KeyID() string {
+	return s.signingKey
+}
+
+// Verify checks that query holds a valid signature for path that hasn't
+// expired at now and, if bound to an address, is used from client
+func (s *Signer) Verify(path string, query url.Values, client netip.Addr, now time.Time) error {
+	secret, ok := s.keys[query.Get(ParamKeyID)]
+	if !ok {
+		return ErrInvalidSignature
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(query.Get(ParamSignature))
+	if err != nil || !hmac.Equal(signature, sign(secret, path, query)) {
+		return ErrInvalidSignature
+	}
+
+	// Everything below is covered by the signature
+	expires, err := strconv.ParseInt(query.Get(ParamExpires), 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if !now.Before(time.Unix(expires, 0)) {
+		return ErrExpired
+	}
+	if bound := query.Get(ParamClientIP); bound != "" {
+		addr, err := netip.ParseAddr(bound)
+		if err != nil {
+			return ErrInvalidSignature
+		}
+		if addr != client.Unmap() {
+			return ErrWrongClient
+		}
+	}
+	return nil
+}
+
+// sign covers path and every query parameter but the signature itself, so
+// none can be added, dropped or changed
+func sign(secret []byte, path string, query url.Values) []byte {
+	covered := url.Values{}
+	for name, values := range query {
+		if name != ParamSignature {
+			covered[name] = values
+		}
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(path + "\n" + covered.Encode()))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,260 @@
+package urlsign
+
+import (
+	"errors"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"noverna.de/m/v2/internal/config"
+)
+
+var testNow = time.Unix(1760601600, 0)
+
+func secretFile(t *testing.T, name, secret string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(secret+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testConfig(t *testing.T) config.SignedURLs {
+	return config.SignedURLs{
+		Enabled:    true,
+		SigningKey: "k1",
+		Keys: map[string]config.SigningKey{
+			"k1": {SecretFile: secretFile(t, "k1.key", strings.Repeat("1", 32))},
+			"k2": {SecretFile: secretFile(t, "k2.key", strings.Repeat("2", 32))},
+		},
+		DefaultTTLSeconds: 300,
+		MaxTTLSeconds:     3600,
+	}
+}
+
+func newSigner(t *testing.T, cfg config.SignedURLs) *Signer {
+	t.Helper()
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *config.SignedURLs)
+	}{
+		{name: "no default ttl", modify: func(cfg *config.SignedURLs) { cfg.DefaultTTLSeconds = 0 }},
+		{name: "max below default", modify: func(cfg *config.SignedURLs) { cfg.MaxTTLSeconds = 60 }},
+		{name: "unknown signing key", modify: func(cfg *config.SignedURLs) { cfg.SigningKey = "k3" }},
+		{
+			name:   "invalid key id",
+			modify: func(cfg *config.SignedURLs) { cfg.Keys["k 3"] = cfg.Keys["k1"] },
+		},
+		{
+			name:   "no secret file",
+			modify: func(cfg *config.SignedURLs) { cfg.Keys["k3"] = config.SigningKey{} },
+		},
+		{
+			name:   "missing secret file",
+			modify: func(cfg *config.SignedURLs) { cfg.Keys["k3"] = config.SigningKey{SecretFile: "/nonexistent/k3.key"} },
+		},
+		{
+			name: "short secret",
+			modify: func(cfg *config.SignedURLs) {
+				cfg.Keys["k3"] = config.SigningKey{SecretFile: secretFile(t, "k3.key", strings.Repeat("3", 31))}
+			},
+		},
+	}
+
+	newSigner(t, testConfig(t))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			tt.modify(&cfg)
+			if _, err := New(cfg); err == nil {
+				t.Fatal("config accepted")
+			}
+		})
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	s := newSigner(t, testConfig(t))
+
+	tests := []struct {
+		ttl     time.Duration
+		want    time.Time
+		wantErr bool
+	}{
+		{ttl: 0, want: testNow.Add(5 * time.Minute)},
+		{ttl: time.Minute, want: testNow.Add(time.Minute)},
+		{ttl: time.Hour, want: testNow.Add(time.Hour)},
+		{ttl: time.Hour + time.Second, wantErr: true},
+		{ttl: -time.Second, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ttl.String(), func(t *testing.T) {
+			got, err := s.Expiry(tt.ttl, testNow.Add(300*time.Millisecond))
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidTTL) {
+					t.Fatalf("err = %v, want ErrInvalidTTL", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("expires %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	const path = "/v1/files/42/download"
+	client := netip.MustParseAddr("198.51.100.1")
+	expires := testNow.Add(time.Minute)
+	s := newSigner(t, testConfig(t))
+
+	sign := func(client netip.Addr) url.Values {
+		return s.Sign(path, url.Values{"w": {"100"}}, expires, client)
+	}
+	with := func(query url.Values, name, value string) url.Values {
+		query.Set(name, value)
+		return query
+	}
+	without := func(query url.Values, name string) url.Values {
+		query.Del(name)
+		return query
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		query   url.Values
+		client  netip.Addr
+		now     time.Time
+		wantErr error
+	}{
+		{name: "valid", query: sign(netip.Addr{}), now: testNow},
+		{name: "unbound from anywhere", query: sign(netip.Addr{}), client: client, now: testNow},
+		{name: "last second", query: sign(netip.Addr{}), now: expires.Add(-time.Second)},
+		{name: "at expiry", query: sign(netip.Addr{}), now: expires, wantErr: ErrExpired},
+		{name: "after expiry", query: sign(netip.Addr{}), now: expires.Add(time.Hour), wantErr: ErrExpired},
+		{name: "bound client", query: sign(client), client: client, now: testNow},
+		{
+			name:   "bound client, mapped",
+			query:  sign(client),
+			client: netip.MustParseAddr("::ffff:198.51.100.1"),
+			now:    testNow,
+		},
+		{name: "bound to a mapped address", query: sign(netip.MustParseAddr("::ffff:198.51.100.1")), client: client, now: testNow},
+		{
+			name:    "other client",
+			query:   sign(client),
+			client:  netip.MustParseAddr("198.51.100.2"),
+			now:     testNow,
+			wantErr: ErrWrongClient,
+		},
+		{name: "bound, no client", query: sign(client), now: testNow, wantErr: ErrWrongClient},
+		{name: "other path", path: "/v1/files/43/download", query: sign(netip.Addr{}), now: testNow, wantErr: ErrInvalidSignature},
+		{name: "changed parameter", query: with(sign(netip.Addr{}), "w", "2000"), now: testNow, wantErr: ErrInvalidSignature},
+		{name: "added parameter", query: with(sign(netip.Addr{}), "h", "100"), now: testNow, wantErr: ErrInvalidSignature},
+		{name: "dropped parameter", query: without(sign(netip.Addr{}), "w"), now: testNow, wantErr: ErrInvalidSignature},
+		{
+			name:    "extended expiry",
+			query:   with(sign(netip.Addr{}), ParamExpires, "9999999999"),
+			now:     testNow,
+			wantErr: ErrInvalidSignature,
+		},
+		{name: "binding dropped", query: without(sign(client), ParamClientIP), now: testNow, wantErr: ErrInvalidSignature},
+		{
+			name:    "binding moved",
+			query:   with(sign(client), ParamClientIP, "198.51.100.2"),
+			client:  netip.MustParseAddr("198.51.100.2"),
+			now:     testNow,
+			wantErr: ErrInvalidSignature,
+		},
+		{name: "unknown key", query: with(sign(netip.Addr{}), ParamKeyID, "k3"), now: testNow, wantErr: ErrInvalidSignature},
+		{name: "other known key", query: with(sign(netip.Addr{}), ParamKeyID, "k2"), now: testNow, wantErr: ErrInvalidSignature},
+		{name: "no signature", query: without(sign(netip.Addr{}), ParamSignature), now: testNow, wantErr: ErrInvalidSignature},
+		{name: "garbled signature", query: with(sign(netip.Addr{}), ParamSignature, "%%%"), now: testNow, wantErr: ErrInvalidSignature},
+		{name: "unsigned", query: url.Values{"w": {"100"}}, now: testNow, wantErr: ErrInvalidSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := path
+			if tt.path != "" {
+				p = tt.path
+			}
+			if err := s.Verify(p, tt.query, tt.client, tt.now); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyAfterEncoding(t *testing.T) {
+	const path = "/v1/files/a b/download"
+	s := newSigner(t, testConfig(t))
+	query := s.Sign(path, url.Values{"name": {"x&y=z"}}, testNow.Add(time.Minute), netip.Addr{})
+
+	// A link survives being put in a URL and parsed back
+	parsed, err := url.ParseQuery(query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Verify(path, parsed, netip.Addr{}, testNow); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	const path = "/v1/files/42/download"
+	expires := testNow.Add(time.Minute)
+	cfg := testConfig(t)
+	old := newSigner(t, cfg).Sign(path, nil, expires, netip.Addr{})
+
+	// Rotated: new links are signed with k2, links signed with k1 still work
+	cfg.SigningKey = "k2"
+	rotated := newSigner(t, cfg)
+	if rotated.KeyID() != "k2" {
+		t.Fatalf("signing with %s, want k2", rotated.KeyID())
+	}
+	fresh := rotated.Sign(path, nil, expires, netip.Addr{})
+	if got := fresh.Get(ParamKeyID); got != "k2" {
+		t.Fatalf("new link signed with %s", got)
+	}
+	for name, query := range map[string]url.Values{"old": old, "new": fresh} {
+		if err := rotated.Verify(path, query, netip.Addr{}, testNow); err != nil {
+			t.Errorf("%s link: %v", name, err)
+		}
+	}
+
+	// Retired: once k1 is dropped its links stop working
+	delete(cfg.Keys, "k1")
+	retired := newSigner(t, cfg)
+	if err := retired.Verify(path, old, netip.Addr{}, testNow); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("link of a retired key: err = %v, want ErrInvalidSignature", err)
+	}
+	if err := retired.Verify(path, fresh, netip.Addr{}, testNow); err != nil {
+		t.Errorf("new link after k1 retired: %v", err)
+	}
+
+	// A key id reused with another secret doesn't accept old links
+	cfg.Keys["k1"] = config.SigningKey{SecretFile: secretFile(t, "k1-new.key", strings.Repeat("9", 32))}
+	if err := newSigner(t, cfg).Verify(path, old, netip.Addr{}, testNow); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("link checked against a replaced secret: err = %v, want ErrInvalidSignature", err)
+	}
+}
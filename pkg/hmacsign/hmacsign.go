@@ -0,0 +1,229 @@
+// Package hmacsign signs requests to the Noverna API with a shared secret,
+// so services don't have to send a bearer secret with every call.
+//
+// A signed request carries these headers:
+//
+//	X-Nv-Date: 1760601600
+//	X-Nv-Nonce: 9f86d081884c7d65
+//	X-Nv-Content-Sha256: <hex sha256 of the body>
+//	Authorization: NV-HMAC-SHA256 KeyId=backend, SignedHeaders=content-type;host, Signature=<hex>
+//
+// The signature is the HMAC-SHA256 of StringToSign. The server rejects
+// requests whose date is too far off its clock and nonces it has seen before.
+package hmacsign
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	Scheme = "NV-HMAC-SHA256"
+
+	HeaderDate          = "X-Nv-Date"
+	HeaderNonce         = "X-Nv-Nonce"
+	HeaderContentSHA256 = "X-Nv-Content-Sha256"
+)
+
+// EmptySHA256 is the body hash of requests without a body
+var EmptySHA256 = hashHex(nil)
+
+var ErrMalformed = errors.New("malformed signature header")
+
+// Signer signs outgoing requests with one key
+type Signer struct {
+	KeyID  string
+	Secret []byte
+	// Headers are signed in addition to host, if the request has them
+	Headers []string
+	// Now is used for the date, time.Now if nil
+	Now func() time.Time
+}
+
+// Sign adds the signature headers to r. The body is read to hash it and
+// put back, use SignHashed for bodies that shouldn't be held in memory.
+func (s *Signer) Sign(r *http.Request) error {
+	hash := EmptySHA256
+	if r.Body != nil && r.Body != http.NoBody {
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return fmt.Errorf("hmacsign: read body: %w", err)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+		hash = hashHex(body)
+	}
+	return s.SignHashed(r, hash)
+}
+
+// SignHashed adds the signature headers to r whose body has the hex encoded
+// SHA-256 bodyHash
+func (s *Signer) SignHashed(r *http.Request, bodyHash string) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("hmacsign: nonce: %w", err)
+	}
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+
+	r.Header.Set(HeaderDate, strconv.FormatInt(now().Unix(), 10))
+	r.Header.Set(HeaderNonce, hex.EncodeToString(nonce))
+	r.Header.Set(HeaderContentSHA256, bodyHash)
+
+	signed := []string{"host"}
+	for _, name := range s.Headers {
+		name = strings.ToLower(name)
+		if name != "host" && r.Header.Get(name) != "" {
+			signed = append(signed, name)
+		}
+	}
+	sort.Strings(signed)
+
+	signature := Sign(s.Secret, StringToSign(r, signed))
+	r.Header.Set("Authorization", fmt.Sprintf("%s KeyId=%s, SignedHeaders=%s, Signature=%s",
+		Scheme, s.KeyID, strings.Join(signed, ";"), hex.EncodeToString(signature)))
+	return nil
+}
+
+// Transport signs every request before handing it to base,
+// http.DefaultTransport if nil
+func (s *Signer) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return roundTripper(func(r *http.Request) (*http.Response, error) {
+		// A RoundTripper must not modify the request it was given
+		r = r.Clone(r.Context())
+		if err := s.Sign(r); err != nil {
+			return nil, err
+		}
+		return base.RoundTrip(r)
+	})
+}
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// Authorization is a parsed signature header
+type Authorization struct {
+	KeyID         string
+	SignedHeaders []string
+	Signature     []byte
+}
+
+// IsSigned reports whether r claims to be signed with this scheme
+func IsSigned(r *http.Request) bool {
+	scheme, _, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	return scheme == Scheme
+}
+
+// ParseAuthorization reads the Authorization header of a signed request
+func ParseAuthorization(header string) (Authorization, error) {
+	var a Authorization
+	rest, ok := strings.CutPrefix(header, Scheme+" ")
+	if !ok {
+		return a, ErrMalformed
+	}
+
+	for _, part := range strings.Split(rest, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return a, ErrMalformed
+		}
+		switch name {
+		case "KeyId":
+			a.KeyID = value
+		case "SignedHeaders":
+			a.SignedHeaders = strings.Split(value, ";")
+		case "Signature":
+			signature, err := hex.DecodeString(value)
+			if err != nil {
+				return a, ErrMalformed
+			}
+			a.Signature = signature
+		}
+	}
+	if a.KeyID == "" || len(a.Signature) == 0 || !sort.StringsAreSorted(a.SignedHeaders) {
+		return a, ErrMalformed
+	}
+	return a, nil
+}
+
+// StringToSign is what the signature covers: method, path, query, the
+// signed headers, date, nonce and body hash, one per line
+func StringToSign(r *http.Request, signedHeaders []string) string {
+	var b strings.Builder
+	b.WriteString(Scheme + "\n")
+	b.WriteString(r.Method + "\n")
+	b.WriteString(r.URL.EscapedPath() + "\n")
+	b.WriteString(canonicalQuery(r.URL.Query()) + "\n")
+	for _, name := range signedHeaders {
+		b.WriteString(name + ":" + headerValue(r, name) + "\n")
+	}
+	b.WriteString(strings.Join(signedHeaders, ";") + "\n")
+	b.WriteString(r.Header.Get(HeaderDate) + "\n")
+	b.WriteString(r.Header.Get(HeaderNonce) + "\n")
+	b.WriteString(r.Header.Get(HeaderContentSHA256))
+	return b.String()
+}
+
+// Sign returns the HMAC-SHA256 of stringToSign
+func Sign(secret []byte, stringToSign string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(stringToSign))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery sorts parameters by name and value
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var parts []string
+	for _, name := range names {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, url.QueryEscape(name)+"="+url.QueryEscape(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func headerValue(r *http.Request, name string) string {
+	if name == "host" {
+		if r.Host != "" {
+			return r.Host
+		}
+		return r.URL.Host
+	}
+	return strings.TrimSpace(strings.Join(r.Header.Values(name), ","))
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,155 @@
+package hmacsign
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAuthorization(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    Authorization
+		wantErr bool
+	}{
+		{
+			name:   "valid",
+			header: Scheme + " KeyId=backend, SignedHeaders=content-type;host, Signature=00ff",
+			want:   Authorization{KeyID: "backend", SignedHeaders: []string{"content-type", "host"}, Signature: []byte{0, 0xff}},
+		},
+		{
+			name:   "no spaces after commas",
+			header: Scheme + " KeyId=backend,SignedHeaders=host,Signature=01",
+			want:   Authorization{KeyID: "backend", SignedHeaders: []string{"host"}, Signature: []byte{1}},
+		},
+		{name: "other scheme", header: "Bearer abc", wantErr: true},
+		{name: "no key", header: Scheme + " SignedHeaders=host, Signature=01", wantErr: true},
+		{name: "no signature", header: Scheme + " KeyId=backend, SignedHeaders=host", wantErr: true},
+		{name: "signature not hex", header: Scheme + " KeyId=backend, SignedHeaders=host, Signature=xyz", wantErr: true},
+		{name: "part without value", header: Scheme + " KeyId=backend, host, Signature=01", wantErr: true},
+		{name: "unsorted headers", header: Scheme + " KeyId=backend, SignedHeaders=host;content-type, Signature=01", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseAuthorization(tt.header)
+			if tt.wantErr {
+				if !errors.Is(err, ErrMalformed) {
+					t.Fatalf("err = %v, want ErrMalformed", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.KeyID != tt.want.KeyID || strings.Join(got.SignedHeaders, ";") != strings.Join(tt.want.SignedHeaders, ";") ||
+				string(got.Signature) != string(tt.want.Signature) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStringToSign(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "http://api.test/v1/files/a%20b?z=1&a=2&a=1&q=x+y", nil)
+	r.Header.Set("Content-Type", "text/plain")
+	r.Header.Add("X-Tag", " one")
+	r.Header.Add("X-Tag", "two ")
+	r.Header.Set(HeaderDate, "1760601600")
+	r.Header.Set(HeaderNonce, "nonce")
+	r.Header.Set(HeaderContentSHA256, EmptySHA256)
+
+	want := strings.Join([]string{
+		Scheme,
+		"POST",
+		"/v1/files/a%20b",
+		"a=1&a=2&q=x+y&z=1",
+		"content-type:text/plain",
+		"host:api.test",
+		"x-tag:one,two",
+		"content-type;host;x-tag",
+		"1760601600",
+		"nonce",
+		EmptySHA256,
+	}, "\n")
+	if got := StringToSign(r, []string{"content-type", "host", "x-tag"}); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	// Parameter order doesn't change what is signed
+	reordered := r.Clone(r.Context())
+	reordered.URL.RawQuery = "q=x+y&a=1&z=1&a=2"
+	if StringToSign(reordered, []string{"host"}) != StringToSign(r, []string{"host"}) {
+		t.Error("reordering the query changed the string to sign")
+	}
+}
+
+func TestSign(t *testing.T) {
+	signer := &Signer{
+		KeyID:   "backend",
+		Secret:  []byte("0123456789abcdef0123456789abcdef"),
+		Headers: []string{"X-Tag", "Content-Type", "Host"},
+		Now:     func() time.Time { return time.Unix(1760601600, 0) },
+	}
+
+	r := httptest.NewRequest(http.MethodPut, "http://api.test/v1/files/1", strings.NewReader("hello"))
+	r.Header.Set("Content-Type", "text/plain")
+	if err := signer.Sign(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := r.Header.Get(HeaderContentSHA256); got != hashHex([]byte("hello")) {
+		t.Errorf("body hash %s", got)
+	}
+	if got := r.Header.Get(HeaderDate); got != "1760601600" {
+		t.Errorf("date %s", got)
+	}
+	authz, err := ParseAuthorization(r.Header.Get("Authorization"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// X-Tag isn't set, so it isn't signed
+	if got := strings.Join(authz.SignedHeaders, ";"); got != "content-type;host" {
+		t.Errorf("signed headers %s", got)
+	}
+	if string(authz.Signature) != string(Sign(signer.Secret, StringToSign(r, authz.SignedHeaders))) {
+		t.Error("signature doesn't match the string to sign")
+	}
+
+	// The body is still there, and can be sent again on a redirect
+	for range 2 {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "hello" {
+			t.Fatalf("body %q after signing", body)
+		}
+		r.Body, _ = r.GetBody()
+	}
+
+	// Every request gets a nonce of its own
+	nonce := r.Header.Get(HeaderNonce)
+	if err := signer.Sign(r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Header.Get(HeaderNonce) == nonce {
+		t.Error("nonce was reused")
+	}
+}
+
+func TestSignWithoutBody(t *testing.T) {
+	signer := &Signer{KeyID: "backend", Secret: []byte("secret")}
+	r := httptest.NewRequest(http.MethodGet, "http://api.test/v1/files", nil)
+	if err := signer.Sign(r); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Header.Get(HeaderContentSHA256); got != EmptySHA256 {
+		t.Errorf("body hash %s, want the hash of nothing", got)
+	}
+	if !IsSigned(r) {
+		t.Error("signed request isn't recognized")
+	}
+}